@@ -1,2 +1,2 @@
 #!/bin/bash
-docker build --tag finalproject/poll-api:v1  -f ./dockerfile .
+docker build --tag finalproject/poll-api:v1  -f ./dockerfile ..
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"common"
+)
+
+// Configuration of the PollAPI, the settings every service has are in
+// common/config.go.  TracerName names the service in its logs, traces and
+// usage message.
+const (
+	TracerName  = "poll-api"
+	DefaultPort = 3080
+)
+
+type Config struct {
+	*common.Config
+
+	VoteUrl  string
+	VoterUrl string
+}
+
+func (cfg *Config) Register(fs *flag.FlagSet) []common.ConfigOption {
+	fs.StringVar(&cfg.VoteUrl, "vote-url", VoteDefaultLocation, "Base URL of the vote API")
+	fs.StringVar(&cfg.VoterUrl, "voter-url", VoterDefaultLocation, "Base URL of the voter API")
+
+	return []common.ConfigOption{
+		{Flag: "vote-url", Key: "vote-url", Env: "VOTE_URL"},
+		{Flag: "voter-url", Key: "voter-url", Env: "VOTER_URL"},
+	}
+}
+
+func (cfg *Config) Validate() []error {
+	return []error{
+		common.ValidateServiceUrl("vote-url", cfg.VoteUrl),
+		common.ValidateServiceUrl("voter-url", cfg.VoterUrl),
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the config file,
+// the environment and the command line arguments, in that order
+func LoadConfig(args []string) (*Config, error) {
+	cfg := &Config{}
+
+	var err error
+	if cfg.Config, err = common.LoadConfig(TracerName, DefaultPort, args, cfg); err != nil {
+		return nil, err
+	}
+
+	//Every edit and deletion of a poll seals it on the VoteAPI first,
+	//which takes a key with votes:admin
+	if cfg.ServiceApiKey == "" {
+		return nil, errors.New("service-api-key: required, polls are sealed on the VoteAPI with it")
+	}
+	return cfg, nil
+}
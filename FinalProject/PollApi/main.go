@@ -1,94 +1,151 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"log"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
-)
+	"time"
 
-var (
-	hostFlag string
-	portFlag uint
+	"common"
 )
 
-func processCmdLineFlags() {
+func main() {
+	cfg, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
 
-	//Note some networking lingo, some frameworks start the server on localhost
-	//this is a local-only interface and is fine for testing but its not accessible
-	//from other machines.  To make the server accessible from other machines, we
-	//need to listen on an interface, that could be an IP address, but modern
-	//cloud servers may have multiple network interfaces for scale.  With TCP/IP
-	//the address 0.0.0.0 instructs the network stack to listen on all interfaces
-	//We set this up as a flag so that we can overwrite it on the command line if
-	//needed
-	flag.StringVar(&hostFlag, "h", "0.0.0.0", "Listen on all interfaces")
-	flag.UintVar(&portFlag, "p", 3080, "Default Port")
+	if cfg.PrintConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
 
-	flag.Parse()
-}
+	common.InitLogging(TracerName, cfg.LogLevel)
 
-func main() {
-	processCmdLineFlags()
+	shutdownTracing, err := common.InitTracing(TracerName, cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		return
+	}
 
-	api, err := NewPollApi()
+	api, err := NewPollApi(cfg)
 
 	if err != nil {
-		log.Println("Failed to initialize the API... ", err)
+		slog.Error("Failed to initialize the API", "error", err)
 		return
 	}
 
-	r := gin.Default()
+	keys := common.NewApiKeyStore(api.store, cfg.AdminApiKey, cfg.ApiKeysRequired)
+	hooks := common.NewWebhooks(api.store, cfg.Config)
+	api.outbox.Relay(hooks)
+
+	health := common.NewHealth()
+	health.AddCheck(cfg.Store, func(ctx context.Context) error {
+		return api.store.Ping(ctx)
+	})
 
-	r.GET("/poll", func(c *gin.Context) {
-		votes, err := api.GetAllPolls()
+	r := gin.New()
+	r.Use(otelgin.Middleware(TracerName))
+	r.Use(common.RequestLogMiddleware())
+	r.Use(common.RecoveryMiddleware())
+	r.Use(cfg.Timeouts.Middleware())
+	r.Use(common.MetricsMiddleware())
+	r.Use(health.Middleware())
+	r.Use(keys.Middleware())
+
+	health.Register(r, "/poll/health")
+	common.RegisterMetricsRoute(r)
+
+	common.RegisterApiKeyRoutes(r, keys)
+	common.RegisterWebhookRoutes(r, keys, hooks)
+	common.RegisterEventRoutes(r, keys, api.outbox)
+	common.RegisterLogLevelRoute(r, keys)
+
+	r.GET("/poll", keys.RequireScope("polls:read"), func(c *gin.Context) {
+		page, err := common.PageFromQuery(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		polls, next, err := api.ListPolls(c.Request.Context(), page)
 		if err != nil {
-			log.Println("Failed to get votes from redis...", err)
+			common.LogFrom(c.Request.Context()).Error("Failed to get polls from the store", "error", err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		c.JSON(http.StatusOK, votes)
+		//Keys narrowed to single polls only get to see those polls
+		visible := []Poll{}
+		for _, poll := range polls {
+			if common.ApiKeyAllows(c, "polls:read", fmt.Sprint("poll/", poll.PollID)) {
+				visible = append(visible, poll)
+			}
+		}
+
+		common.SetNextLink(c, next)
+		c.JSON(http.StatusOK, visible)
 	})
 
-	r.POST("/poll", func(c *gin.Context) {
+	r.POST("/poll", keys.RequireScope("polls:write"), func(c *gin.Context) {
+		if !common.ApiKeyHolds(c, "polls:write") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
 
 		type Poll struct {
-			PollTitle    string   `json:"pollTitle"`
-			PollQuestion string   `json:"pollQuestion"`
-			PollOptions  []string `json:"pollOptions"`
+			PollTitle    string              `json:"pollTitle"`
+			PollQuestion string              `json:"pollQuestion"`
+			PollOptions  []string            `json:"pollOptions"`
+			Eligibility  *common.Eligibility `json:"eligibility"`
 		}
 		var poll Poll
 
 		err := c.ShouldBindJSON(&poll)
 		if err != nil {
-			log.Println("Cannot fetch JSON body from vote POST", err)
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from poll POST", "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		newPoll, err := api.AddPoll(poll.PollTitle, poll.PollQuestion, poll.PollOptions)
+		newPoll, err := api.AddPoll(c.Request.Context(), poll.PollTitle, poll.PollQuestion, poll.PollOptions, poll.Eligibility)
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			abortPollEdit(c, err)
 			return
 		}
 
 		c.JSON(http.StatusOK, newPoll)
 	})
 
-	r.GET("/poll/:id", func(c *gin.Context) {
+	r.GET("/poll/:id", keys.RequireScope("polls:read"), func(c *gin.Context) {
 		id := c.Param("id")
 		id64, err := strconv.ParseUint(id, 10, 32)
 		if err != nil {
-			log.Println("Error converting id to int64: ", err)
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
-		poll, err := api.GetPoll(int(id64))
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:read", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		poll, err := api.GetPoll(c.Request.Context(), int(id64))
 		if err != nil {
-			log.Println("Failed to get poll from redis...", err)
+			common.LogFrom(c.Request.Context()).Warn("Failed to get poll from the store", "error", err)
 			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
@@ -96,17 +153,364 @@ func main() {
 		c.JSON(http.StatusOK, poll)
 	})
 
-	// Hardcoded health status
-	r.GET("/poll/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":             "ok",
-			"version":            "1.0.0",
-			"uptime":             100,
-			"users_processed":    1000,
-			"errors_encountered": 10,
+	r.PUT("/poll/:id", keys.RequireScope("polls:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:write", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		type PollPut struct {
+			PollTitle    string              `json:"pollTitle"`
+			PollQuestion string              `json:"pollQuestion"`
+			PollOptions  []string            `json:"pollOptions"`
+			Eligibility  *common.Eligibility `json:"eligibility"`
+		}
+		var poll PollPut
+
+		err = c.ShouldBindJSON(&poll)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from poll PUT", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		//A PUT replaces everything but the id and whether it's closed
+		updated, err := api.UpdatePoll(c.Request.Context(), uint(id64), func(p *Poll) {
+			p.PollTitle = poll.PollTitle
+			p.PollQuestion = poll.PollQuestion
+			p.PollOptions = poll.PollOptions
+			p.Eligibility = poll.Eligibility
+		})
+		if err != nil {
+			abortPollEdit(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, updated)
+	})
+
+	r.PATCH("/poll/:id", keys.RequireScope("polls:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:write", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		//Pointers tell us which fields were present in the body, the
+		//eligibility is kept raw so that null can clear it
+		type PollPatch struct {
+			PollTitle    *string         `json:"pollTitle"`
+			PollQuestion *string         `json:"pollQuestion"`
+			PollOptions  *[]string       `json:"pollOptions"`
+			Eligibility  json.RawMessage `json:"eligibility"`
+		}
+		var patch PollPatch
+
+		err = c.ShouldBindJSON(&patch)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from poll PATCH", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		var eligibility *common.Eligibility
+		if patch.Eligibility != nil {
+			if eligibility, err = patchEligibility(patch.Eligibility); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		//The patch is applied to the poll as stored when it's written
+		poll, err := api.UpdatePoll(c.Request.Context(), uint(id64), func(p *Poll) {
+			if patch.PollTitle != nil {
+				p.PollTitle = *patch.PollTitle
+			}
+			if patch.PollQuestion != nil {
+				p.PollQuestion = *patch.PollQuestion
+			}
+			if patch.PollOptions != nil {
+				p.PollOptions = *patch.PollOptions
+			}
+			if patch.Eligibility != nil {
+				p.Eligibility = eligibility
+			}
+		})
+		if err != nil {
+			abortPollEdit(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, poll)
+	})
+
+	r.DELETE("/poll/:id", keys.RequireScope("polls:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:write", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		force, _ := strconv.ParseBool(c.Query("force"))
+
+		if err := api.DeletePoll(c.Request.Context(), int(id64), force); err != nil {
+			abortPollEdit(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	for action, closed := range map[string]bool{"open": false, "close": true} {
+		closed := closed
+		r.POST("/poll/:id/"+action, keys.RequireScope("polls:write"), func(c *gin.Context) {
+			id := c.Param("id")
+			id64, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+
+			common.LogWith(c, "poll_id", id64)
+
+			if !common.ApiKeyAllows(c, "polls:write", fmt.Sprint("poll/", id64)) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+
+			poll, err := api.SetClosed(c.Request.Context(), int(id64), closed)
+			if err != nil {
+				abortPollEdit(c, err)
+				return
+			}
+
+			c.JSON(http.StatusOK, poll)
 		})
+	}
+
+	r.GET("/poll/:id/results", keys.RequireScope("polls:read"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:read", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		//?asOf=<RFC3339> is the tally at that time, e.g. the poll's closedAt
+		var asOf *time.Time
+		if value := c.Query("asOf"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "asOf must be an RFC3339 time"})
+				return
+			}
+			asOf = &parsed
+		}
+
+		results, err := api.GetResults(c.Request.Context(), int(id64), asOf)
+		if errors.Is(err, ErrPollNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrResultsUnknown) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to get the results", "error", err)
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+
+		c.JSON(http.StatusOK, results)
+	})
+
+	//Votes cast per bucket, ?bucket=1m|15m|1h|1d...&from=&to= (RFC3339),
+	//for charting turnout
+	r.GET("/poll/:id/timeseries", keys.RequireScope("polls:read"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:read", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		query := map[string]string{}
+		for _, name := range []string{"bucket", "from", "to"} {
+			if value := c.Query(name); value != "" {
+				query[name] = value
+			}
+		}
+
+		series, err := api.GetTimeseries(c.Request.Context(), int(id64), query)
+		if errors.Is(err, ErrPollNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrInvalidTimeseries) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to get the time series", "error", err)
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+
+		c.JSON(http.StatusOK, series)
+	})
+
+	hub := NewResultsHub(api)
+	cfg.Timeouts.NoDeadline("GET /poll/:id/results/stream")
+
+	r.GET("/poll/:id/results/stream", keys.RequireScope("polls:read"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:read", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		//Joined first, results published while the current ones are
+		//read reach the client too
+		client, err := hub.join(c.Request.Context(), uint(id64))
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to subscribe to the results", "error", err)
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+
+		results, err := api.GetResults(c.Request.Context(), int(id64), nil)
+		if errors.Is(err, ErrPollNotFound) {
+			hub.leave(uint(id64), client)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			hub.leave(uint(id64), client)
+			common.LogFrom(c.Request.Context()).Error("Failed to get the results", "error", err)
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+
+		hub.Stream(c, client, results)
 	})
 
-	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
-	r.Run(serverPath)
+	r.GET("/poll/:id/eligible-voters", keys.RequireScope("polls:read"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "polls:read", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		voters, err := api.GetEligibleVoters(c.Request.Context(), int(id64))
+		if errors.Is(err, ErrPollNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to list eligible voters", "error", err)
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+
+		//Only identify the voters, the rest of their profile stays with the VoterAPI
+		type EligibleVoter struct {
+			VoterID   uint   `json:"id"`
+			FirstName string `json:"FirstName"`
+			LastName  string `json:"LastName"`
+		}
+
+		eligible := make([]EligibleVoter, 0, len(voters))
+		for _, v := range voters {
+			eligible = append(eligible, EligibleVoter{v.VoterID, v.FirstName, v.LastName})
+		}
+
+		c.JSON(http.StatusOK, eligible)
+	})
+
+	serverPath := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	server := common.NewServer(serverPath, r, health, cfg.DrainDelay, cfg.DrainTimeout)
+	server.OnDrain(hub.Close)
+	server.OnShutdown("tracing", shutdownTracing)
+	server.OnShutdown(cfg.Store, func(context.Context) error {
+		return api.store.Close()
+	})
+	server.OnShutdown("webhooks", hooks.Close)
+	server.OnShutdown("outbox", api.outbox.Close)
+
+	if err := server.Run(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// abortPollEdit maps the errors of UpdatePoll and DeletePoll to responses
+func abortPollEdit(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrPollNotFound):
+		c.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, ErrInvalidPoll):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPollHasVotes), errors.Is(err, ErrOptionsLocked), errors.Is(err, common.ErrConflict):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		common.LogFrom(c.Request.Context()).Error("Failed to change poll", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,21 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Business metrics of the service, served on /metrics next to the http,
+// redis and outbound metrics of common/metrics.go
+var (
+	pollsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "polls_created_total",
+		Help: "Polls created since the service started.",
+	})
+
+	resultsStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "results_streams",
+		Help: "Clients connected to a results stream.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(pollsCreated, resultsStreams)
+}
@@ -5,56 +5,85 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
-	"github.com/nitishm/go-rejson/v4"
-	"log"
-	"os"
+	"github.com/go-resty/resty/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"common"
 )
 
 const (
 	RedisNilError        = "redis: nil"
-	RedisDefaultLocation = "0.0.0.0:6379"
 	RedisKeyPrefix       = "poll:"
 	RedisIDKey           = "pollCnt:"
+	PollIndex            = "pollIdx:"
+	VoteDefaultLocation  = "http://0.0.0.0:1080"
+	VoterDefaultLocation = "http://0.0.0.0:2080"
+)
+
+var (
+	ErrPollHasVotes  = errors.New("poll has votes, deleting it requires force=true")
+	ErrOptionsLocked = errors.New("poll has votes, options can only be appended")
+	ErrPollNotFound  = errors.New("poll does not exist")
+	ErrInvalidPoll   = errors.New("invalid poll")
+
+	ErrInvalidTimeseries = errors.New("invalid time series")
+	ErrResultsUnknown    = errors.New("results unknown")
 )
 
 type Poll struct {
-	PollID       uint     `json:"pollID"`
-	PollTitle    string   `json:"pollTitle"`
-	PollQuestion string   `json:"pollQuestion"`
-	PollOptions  []string `json:"pollOptions"`
+	PollID       uint                `json:"pollID"`
+	PollTitle    string              `json:"pollTitle"`
+	PollQuestion string              `json:"pollQuestion"`
+	PollOptions  []string            `json:"pollOptions"`
+	Eligibility  *common.Eligibility `json:"eligibility,omitempty"`
+	Closed       bool                `json:"closed,omitempty"`
+	ClosedAt     *time.Time          `json:"closedAt,omitempty"`
 }
 
 type PollApi struct {
-	cacheClient *redis.Client
-	jsonHelper  *rejson.Handler
-	context     context.Context
-	idCnter     uint
+	store     common.Store
+	apiClient *resty.Client
+	VoteUrl   string
+	VoterUrl  string
+	outbox    *common.Outbox
+
+	//Serializes the creations of this replica on the id counter
+	mu sync.Mutex
 }
 
-func NewPollApi() (*PollApi, error) {
-	redisUrl := os.Getenv("REDIS_URL")
-	if redisUrl == "" {
-		redisUrl = RedisDefaultLocation
-	}
-
-	api, err := NewDbWithInstance(redisUrl)
+func NewPollApi(cfg *Config) (*PollApi, error) {
+	store, err := common.NewStore(cfg.Config)
 	if err != nil {
 		return &PollApi{}, err
 	}
 
-	itemObject, err := api.jsonHelper.JSONGet(RedisIDKey, ".")
-	if err != nil {
-		// There's no entry for the current number of polls,
-		// assume 0
-		return api, nil
+	//There is no context kept here, every call passes the context of the
+	//request it serves
+	api := &PollApi{store: store}
+	api.outbox = common.NewOutbox(store, TracerName, cfg.OutboxRetention)
+
+	//Editing and deleting polls depends on whether they have votes,
+	//which only the VoteAPI knows
+	api.apiClient = resty.New()
+	common.InstrumentClient(api.apiClient)
+	common.TraceClient(api.apiClient)
+	common.ForwardRequestID(api.apiClient)
+	api.VoteUrl = cfg.VoteUrl
+	api.VoterUrl = cfg.VoterUrl
+
+	if cfg.ServiceApiKey != "" {
+		api.apiClient.SetAuthScheme(common.ApiKeyAuthScheme)
+		api.apiClient.SetAuthToken(cfg.ServiceApiKey)
 	}
 
-	//JSONGet returns an "any" object, or empty interface,
-	//we need to convert it to a byte array, which is the
-	//underlying type of the object, then we can unmarshal
-	//it into our ToDoItem struct
-	err = json.Unmarshal(itemObject.([]byte), &api.idCnter)
+	//Polls created before the index existed are indexed once at startup
+	err = common.RebuildIndex(context.Background(), api.store, PollIndex, RedisKeyPrefix, func(ctx context.Context, poll *Poll) error {
+		return api.store.IndexAdd(ctx, PollIndex, uint64(poll.PollID))
+	})
 	if err != nil {
 		return &PollApi{}, err
 	}
@@ -62,124 +91,449 @@ func NewPollApi() (*PollApi, error) {
 	return api, nil
 }
 
-func NewDbWithInstance(location string) (*PollApi, error) {
+// In redis, our keys will be strings, they will look like
+// todo:<number>.  This function will take an integer and
+// return a string that can be used as a key in redis
+func redisKeyFromId(id int) string {
+	return fmt.Sprintf("%s%d", RedisKeyPrefix, id)
+}
+
+func pollKey(id uint64) string {
+	return redisKeyFromId(int(id))
+}
+
+func (t *PollApi) AddPoll(ctx context.Context, pollTitle string, pollQuestion string, pollOptions []string, eligibility *common.Eligibility) (*Poll, error) {
+
+	if err := common.ValidateEligibility(eligibility); err != nil {
+		return &Poll{}, fmt.Errorf("%w: %v", ErrInvalidPoll, err)
+	}
+
+	//The id is the next value of the counter, taken by a compare-and-set
+	//on it along with the poll, so concurrent creations, here or on other
+	//replicas, can't get the same one.  The lock keeps the creations of
+	//this replica from fighting over it.
+	var newPoll Poll
+	t.mu.Lock()
+	err := common.Update(ctx, t.store, RedisIDKey, func(last *uint, b *common.Batch) error {
+		var id uint = 1
+		if last != nil {
+			id = *last + 1
+		}
+
+		newPoll = Poll{
+			PollID:       id,
+			PollTitle:    pollTitle,
+			PollQuestion: pollQuestion,
+			PollOptions:  pollOptions,
+			Eligibility:  eligibility,
+		}
 
-	client := redis.NewClient(&redis.Options{
-		Addr: location,
+		//The poll, its index entry, the id counter and the event are
+		//written together
+		b.Set(redisKeyFromId(int(id)), newPoll)
+		b.IndexAdd(PollIndex, uint64(id))
+		b.Set(RedisIDKey, id)
+		return t.outbox.Record(ctx, b, "poll.created", newPoll)
 	})
+	t.mu.Unlock()
+	if err != nil {
+		return &Poll{}, err
+	}
 
-	ctx := context.Background()
+	pollsCreated.Inc()
 
-	err := client.Ping(ctx).Err()
+	//If everything is ok, return nil for the error
+	return &newPoll, nil
+}
+
+func (t *PollApi) GetPoll(ctx context.Context, pollID int) (*Poll, error) {
+
+	// Check if item exists before trying to get it
+	// this is a good practice, return an error if the
+	// item does not exist
+	var poll Poll
+	pattern := redisKeyFromId(pollID)
+	err := t.store.Get(ctx, pattern, &poll)
 	if err != nil {
-		log.Println("Error connecting to redis" + err.Error())
-		return nil, err
+		return &Poll{}, err
 	}
 
-	jsonHelper := rejson.NewReJSONHandler()
-	jsonHelper.SetGoRedisClientWithContext(ctx, client)
+	return &poll, nil
+}
 
-	//Return a pointer to a new ToDo struct
-	return &PollApi{
-			cacheClient: client,
-			jsonHelper:  jsonHelper,
-			context:     ctx,
-		},
-		nil
+// ListPolls returns a page of polls in id order and the cursor of the
+// next page, 0 on the last one
+func (t *PollApi) ListPolls(ctx context.Context, page common.Page) ([]Poll, uint64, error) {
+	return common.ListPage[Poll](ctx, t.store, PollIndex, page, pollKey, nil)
 }
 
-// In redis, our keys will be strings, they will look like
-// todo:<number>.  This function will take an integer and
-// return a string that can be used as a key in redis
-func redisKeyFromId(id int) string {
-	return fmt.Sprintf("%s%d", RedisKeyPrefix, id)
+// patchEligibility reads the eligibility of a PATCH body, one that is
+// present at all: null clears the rules, anything else replaces them
+func patchEligibility(raw json.RawMessage) (*common.Eligibility, error) {
+	if string(raw) == "null" {
+		return nil, nil
+	}
+
+	var eligibility common.Eligibility
+	if err := json.Unmarshal(raw, &eligibility); err != nil {
+		return nil, err
+	}
+	return &eligibility, nil
+}
+
+// Votes refer to options by position, so once a poll has votes its
+// options can't be removed or reordered, only new ones appended
+func checkPollEdit(existing *Poll, updated *Poll, hasVotes bool) error {
+	if !hasVotes {
+		return nil
+	}
+
+	if len(updated.PollOptions) < len(existing.PollOptions) {
+		return ErrOptionsLocked
+	}
+
+	for i, option := range existing.PollOptions {
+		if updated.PollOptions[i] != option {
+			return ErrOptionsLocked
+		}
+	}
+
+	return nil
 }
 
-func (t *PollApi) getPollFromRedis(key string, poll *Poll) error {
+// sealPoll has the VoteAPI stop taking votes for the poll, then tells
+// whether it has any.  No vote can land between the answer and the edit
+// that depends on it, until unsealPoll or the seal runs out.
+func (t *PollApi) sealPoll(ctx context.Context, pollID uint) (bool, error) {
+	type SealResult struct {
+		HasVotes bool `json:"hasVotes"`
+	}
+	var result SealResult
 
-	//Lets query redis for the item, note we can return parts of the
-	//json structure, the second parameter "." means return the entire
-	//json structure
-	itemObject, err := t.jsonHelper.JSONGet(key, ".")
+	url := fmt.Sprint(t.VoteUrl, "/vote/poll/", pollID, "/seal")
+	resp, err := t.apiClient.R().SetContext(ctx).SetResult(&result).Post(url)
 	if err != nil {
-		return err
+		common.LogFrom(ctx).Error("Error when trying to reach vote api", "url", url, "error", err)
+		return false, err
+	}
+
+	if resp.IsError() {
+		return false, fmt.Errorf("vote api refused to seal the poll: %s", resp.Status())
+	}
+
+	return result.HasVotes, nil
+}
+
+// unsealPoll lets votes in again once the edit is done, a failure only
+// means the seal runs out on its own
+func (t *PollApi) unsealPoll(ctx context.Context, pollID uint) {
+	url := fmt.Sprint(t.VoteUrl, "/vote/poll/", pollID, "/seal")
+	resp, err := t.apiClient.R().SetContext(context.WithoutCancel(ctx)).Delete(url)
+	if err == nil && resp.IsError() {
+		err = fmt.Errorf("vote api returned %s", resp.Status())
 	}
+	if err != nil {
+		common.LogFrom(ctx).Warn("Failed to unseal the poll", "url", url, "error", err)
+	}
+}
 
-	//JSONGet returns an "any" object, or empty interface,
-	//we need to convert it to a byte array, which is the
-	//underlying type of the object, then we can unmarshal
-	//it into our ToDoItem struct
-	err = json.Unmarshal(itemObject.([]byte), poll)
+func (t *PollApi) archivePollVotes(ctx context.Context, pollID uint) error {
+	url := fmt.Sprint(t.VoteUrl, "/vote/poll/", pollID, "/archive")
+	resp, err := t.apiClient.R().SetContext(ctx).Post(url)
 	if err != nil {
+		common.LogFrom(ctx).Error("Could not connect to vote-api to archive votes", "url", url, "error", err)
 		return err
 	}
 
+	if resp.IsError() {
+		return fmt.Errorf("vote api refused to archive votes: %s", resp.Status())
+	}
+
 	return nil
 }
 
-func (t *PollApi) AddPoll(pollTitle string, pollQuestion string, pollOptions []string) (*Poll, error) {
+// UpdatePoll applies change to the poll, e.g. a new title, and returns the
+// poll as written, making sure the edit doesn't invalidate the votes that
+// were already cast.  The poll may be closed or opened while this runs,
+// the write is retried rather than put back the older state.
+func (t *PollApi) UpdatePoll(ctx context.Context, pollID uint, change func(poll *Poll)) (*Poll, error) {
 
-	//Before we add an item to the DB, lets make sure
-	//it does not exist, if it does, return an error
-	redisKey := redisKeyFromId(int(t.idCnter + 1))
-	var existingPoll Poll
-	if err := t.getPollFromRedis(redisKey, &existingPoll); err == nil {
-		return &Poll{}, errors.New("Poll already exists!")
+	if _, err := t.GetPoll(ctx, int(pollID)); err != nil {
+		return nil, ErrPollNotFound
 	}
 
-	newPoll := Poll{
-		PollID:       t.idCnter + 1,
-		PollTitle:    pollTitle,
-		PollQuestion: pollQuestion,
-		PollOptions:  pollOptions,
+	hasVotes, err := t.sealPoll(ctx, pollID)
+	if err != nil {
+		return nil, err
 	}
+	defer t.unsealPoll(ctx, pollID)
 
-	//Add item to database with JSON Set
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", newPoll); err != nil {
-		return &Poll{}, err
+	var updated Poll
+	err = common.Update(ctx, t.store, redisKeyFromId(int(pollID)), func(poll *Poll, b *common.Batch) error {
+		if poll == nil {
+			return ErrPollNotFound
+		}
+
+		existing := *poll
+		change(poll)
+
+		if err := common.ValidateEligibility(poll.Eligibility); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPoll, err)
+		}
+		if err := checkPollEdit(&existing, poll, hasVotes); err != nil {
+			return err
+		}
+
+		b.Set(redisKeyFromId(int(pollID)), poll)
+		updated = *poll
+		return t.outbox.Record(ctx, b, "poll.updated", poll)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	t.idCnter += 1
+	return &updated, nil
+}
 
-	if _, err := t.jsonHelper.JSONSet(RedisIDKey, ".", t.idCnter); err != nil {
-		return &Poll{}, err
+// DeletePoll refuses to delete a poll with votes unless force is set.
+// Either way the VoteAPI archives the poll's votes first, which keeps it
+// sealed for good, so no vote lands once the poll is gone.
+func (t *PollApi) DeletePoll(ctx context.Context, pollID int, force bool) error {
+
+	if _, err := t.GetPoll(ctx, pollID); err != nil {
+		return ErrPollNotFound
 	}
 
-	//If everything is ok, return nil for the error
-	return &newPoll, nil
+	hasVotes, err := t.sealPoll(ctx, uint(pollID))
+	if err != nil {
+		return err
+	}
+
+	if hasVotes && !force {
+		t.unsealPoll(ctx, uint(pollID))
+		return ErrPollHasVotes
+	}
+
+	if err := t.archivePollVotes(ctx, uint(pollID)); err != nil {
+		return err
+	}
+
+	var b common.Batch
+	b.Delete(redisKeyFromId(pollID))
+	b.IndexRemove(PollIndex, uint64(pollID))
+
+	if err := t.outbox.Record(ctx, &b, "poll.deleted", map[string]int{"pollID": pollID}); err != nil {
+		return err
+	}
+
+	return t.store.Commit(ctx, &b)
 }
 
-func (t *PollApi) GetPoll(pollID int) (*Poll, error) {
+// SetClosed opens or closes a poll for voting, closed polls keep their
+// votes and results but the VoteAPI refuses new ones
+func (t *PollApi) SetClosed(ctx context.Context, pollID int, closed bool) (*Poll, error) {
 
-	// Check if item exists before trying to get it
-	// this is a good practice, return an error if the
-	// item does not exist
-	var poll Poll
-	pattern := redisKeyFromId(pollID)
-	err := t.getPollFromRedis(pattern, &poll)
+	//Only the flag changes, an edit committed meanwhile is kept
+	var updated Poll
+	err := common.Update(ctx, t.store, redisKeyFromId(pollID), func(poll *Poll, b *common.Batch) error {
+		if poll == nil {
+			return ErrPollNotFound
+		}
+
+		updated = *poll
+		if poll.Closed == closed {
+			return nil
+		}
+
+		//When it closed is kept for audits, e.g. the results as of then
+		poll.Closed = closed
+		poll.ClosedAt = nil
+		event := "poll.opened"
+		if closed {
+			now := time.Now()
+			poll.ClosedAt = &now
+			event = "poll.closed"
+		}
+
+		//The VoteAPI passes the event on to its websocket clients
+		b.Set(redisKeyFromId(pollID), poll)
+		updated = *poll
+		return t.outbox.Record(ctx, b, event, poll)
+	})
 	if err != nil {
-		return &Poll{}, err
+		return nil, err
 	}
 
-	return &poll, nil
+	return &updated, nil
 }
 
-func (t *PollApi) GetAllPolls() ([]Poll, error) {
+// GetEligibleVoters asks the VoterAPI for every voter and keeps the ones
+// the poll's eligibility rules admit
+func (t *PollApi) GetEligibleVoters(ctx context.Context, pollID int) ([]common.EligibilityVoter, error) {
 
-	//Now that we have the DB loaded, lets crate a slice
-	var pollList []Poll
-	var poll Poll
+	poll, err := t.GetPoll(ctx, pollID)
+	if err != nil {
+		return nil, ErrPollNotFound
+	}
+
+	var voters []common.EligibilityVoter
+
+	//The voter list is paged, follow the next links to the end
+	url := fmt.Sprint(t.VoterUrl, "/voter?limit=", common.MaxPageLimit)
+	for url != "" {
+		var page []common.EligibilityVoter
 
-	//Lets query redis for all of the items
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := t.cacheClient.Keys(t.context, pattern).Result()
-	for _, key := range ks {
-		err := t.getPollFromRedis(key, &poll)
+		resp, err := t.apiClient.R().SetContext(ctx).SetResult(&page).Get(url)
 		if err != nil {
+			common.LogFrom(ctx).Error("Error when trying to reach voter api", "url", url, "error", err)
 			return nil, err
 		}
-		pollList = append(pollList, poll)
+
+		if resp.IsError() {
+			return nil, fmt.Errorf("voter api returned %s", resp.Status())
+		}
+
+		voters = append(voters, page...)
+		url = common.NextPageUrl(t.VoterUrl, resp.Header())
+	}
+
+	eligible := []common.EligibilityVoter{}
+	for i := range voters {
+		if poll.Eligibility.Admits(&voters[i]) {
+			eligible = append(eligible, voters[i])
+		}
+	}
+
+	sort.Slice(eligible, func(i, j int) bool { return eligible[i].VoterID < eligible[j].VoterID })
+	return eligible, nil
+}
+
+type OptionResult struct {
+	Option string `json:"option"`
+	Votes  int64  `json:"votes"`
+}
+
+type PollResults struct {
+	PollID       uint           `json:"pollID"`
+	PollQuestion string         `json:"pollQuestion"`
+	Results      []OptionResult `json:"results"`
+	Total        int64          `json:"total"`
+	Version      int64          `json:"version"`
+	AsOf         *time.Time     `json:"asOf,omitempty"`
+}
+
+// voteCounts are the counters the VoteAPI keeps for a poll, by option
+// position.  Version goes up with every change.
+type voteCounts struct {
+	Counts  map[string]int64 `json:"counts"`
+	Version int64            `json:"version"`
+}
+
+// GetResults pairs the options of a poll with the vote counts the VoteAPI
+// keeps for it, one request whatever the number of votes.  A non nil asOf
+// asks for the counts as they stood at that time.
+func (t *PollApi) GetResults(ctx context.Context, pollID int, asOf *time.Time) (*PollResults, error) {
+
+	poll, err := t.GetPoll(ctx, pollID)
+	if err != nil {
+		return nil, ErrPollNotFound
+	}
+
+	var counts voteCounts
+	var failure struct {
+		Error string `json:"error"`
+	}
+
+	req := t.apiClient.R().SetContext(ctx).SetResult(&counts).SetError(&failure)
+	if asOf != nil {
+		req.SetQueryParam("asOf", asOf.Format(time.RFC3339Nano))
+	}
+
+	url := fmt.Sprint(t.VoteUrl, "/vote/poll/", pollID, "/results")
+	resp, err := req.Get(url)
+	if err != nil {
+		common.LogFrom(ctx).Error("Error when trying to reach vote api", "url", url, "error", err)
+		return nil, err
+	}
+
+	//The VoteAPI can't tell the results before its event stream began
+	if resp.StatusCode() == http.StatusBadRequest && failure.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrResultsUnknown, failure.Error)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("vote api returned %s", resp.Status())
+	}
+
+	results := pollResults(poll, &counts)
+	results.AsOf = asOf
+	return results, nil
+}
+
+func pollResults(poll *Poll, counts *voteCounts) *PollResults {
+
+	//Counts are keyed by option position
+	results := &PollResults{
+		PollID:       poll.PollID,
+		PollQuestion: poll.PollQuestion,
+		Results:      make([]OptionResult, len(poll.PollOptions)),
+		Version:      counts.Version,
+	}
+	for i, option := range poll.PollOptions {
+		votes := counts.Counts[strconv.Itoa(i)]
+		results.Results[i] = OptionResult{Option: option, Votes: votes}
+		results.Total += votes
+	}
+
+	return results
+}
+
+type VoteRatePoint struct {
+	Time  time.Time `json:"time"`
+	Votes int64     `json:"votes"`
+}
+
+// VoteRateSeries is the turnout of a poll over time, the votes cast in
+// each bucket between From and To
+type VoteRateSeries struct {
+	PollID       uint            `json:"pollID"`
+	PollQuestion string          `json:"pollQuestion"`
+	Bucket       string          `json:"bucket"`
+	Resolution   string          `json:"resolution"`
+	From         time.Time       `json:"from"`
+	To           time.Time       `json:"to"`
+	Total        int64           `json:"total"`
+	Points       []VoteRatePoint `json:"points"`
+}
+
+// GetTimeseries reads the vote rates the VoteAPI rolls up as votes are
+// cast.  query holds the bucket, from and to of the request, the VoteAPI
+// checks them.
+func (t *PollApi) GetTimeseries(ctx context.Context, pollID int, query map[string]string) (*VoteRateSeries, error) {
+
+	poll, err := t.GetPoll(ctx, pollID)
+	if err != nil {
+		return nil, ErrPollNotFound
+	}
+
+	var series VoteRateSeries
+	var failure struct {
+		Error string `json:"error"`
+	}
+
+	url := fmt.Sprint(t.VoteUrl, "/vote/poll/", pollID, "/timeseries")
+	resp, err := t.apiClient.R().SetContext(ctx).SetQueryParams(query).SetResult(&series).SetError(&failure).Get(url)
+	if err != nil {
+		common.LogFrom(ctx).Error("Error when trying to reach vote api", "url", url, "error", err)
+		return nil, err
+	}
+
+	if resp.StatusCode() == http.StatusBadRequest && failure.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTimeseries, failure.Error)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("vote api returned %s", resp.Status())
 	}
 
-	return pollList, nil
+	series.PollQuestion = poll.PollQuestion
+	return &series, nil
 }
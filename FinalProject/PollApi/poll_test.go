@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// voteStub stands in for the VoteAPI: the results of every poll are one
+// vote for the first option at version, unknown as of any earlier time,
+// a seal answers hasVotes, and the
+// seal and archive calls are recorded.  Those need votes:admin like on the
+// VoteAPI, the key checks are the real ones.  onSeal, if set, runs while a
+// seal is answered.
+type voteStub struct {
+	*httptest.Server
+	keys     *common.ApiKeyStore
+	version  atomic.Int64
+	hasVotes atomic.Bool
+	onSeal   func()
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func newVoteStub(t *testing.T) *voteStub {
+	t.Helper()
+
+	store, err := common.NewStore(&common.Config{Store: common.StoreMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &voteStub{keys: common.NewApiKeyStore(store, "", false)}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(stub.keys.Middleware())
+
+	admin := func(c *gin.Context) {
+		stub.mu.Lock()
+		stub.calls = append(stub.calls, c.Request.Method+" "+c.Request.URL.Path)
+		stub.mu.Unlock()
+		if stub.onSeal != nil && c.Request.Method == http.MethodPost && strings.HasSuffix(c.Request.URL.Path, "/seal") {
+			stub.onSeal()
+		}
+		c.JSON(http.StatusOK, gin.H{"hasVotes": stub.hasVotes.Load()})
+	}
+	r.POST("/vote/poll/:id/seal", stub.keys.RequireScope("votes:admin"), admin)
+	r.DELETE("/vote/poll/:id/seal", stub.keys.RequireScope("votes:admin"), admin)
+	r.POST("/vote/poll/:id/archive", stub.keys.RequireScope("votes:admin"), admin)
+	r.NoRoute(func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		c.Status(http.StatusOK)
+		if strings.HasSuffix(c.Request.URL.Path, "/results") && c.Query("asOf") != "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "the results of this poll are not known that far back"})
+			return
+		}
+		if strings.HasSuffix(c.Request.URL.Path, "/results") {
+			fmt.Fprintf(c.Writer, `{"counts": {"0": 1}, "version": %d}`, stub.version.Load())
+			return
+		}
+		c.Writer.Write([]byte(`[]`))
+	})
+
+	stub.Server = httptest.NewServer(r)
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// newTestApi calls the VoteAPI with a key of votes:admin, as set up in the
+// README
+func newTestApi(t *testing.T) (*PollApi, *voteStub) {
+	t.Helper()
+
+	stub := newVoteStub(t)
+	_, token, err := stub.keys.CreateKey(context.Background(), nil, "poll-api", []string{"votes:admin"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newPollApi(t, stub, token), stub
+}
+
+func newPollApi(t *testing.T, stub *voteStub, serviceKey string) *PollApi {
+	t.Helper()
+
+	cfg := &Config{
+		Config:   &common.Config{Store: common.StoreMemory, OutboxRetention: time.Hour, ServiceApiKey: serviceKey},
+		VoteUrl:  stub.URL,
+		VoterUrl: stub.URL,
+	}
+	api, err := NewPollApi(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+// made returns the seal and archive calls made since the last time
+func (s *voteStub) made() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	calls := s.calls
+	s.calls = nil
+	return calls
+}
+
+func TestUpdatePollSealsAroundTheEdit(t *testing.T) {
+	ctx := context.Background()
+	api, stub := newTestApi(t)
+
+	poll, err := api.AddPoll(ctx, "Colour", "Which one?", []string{"red", "blue"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := []string{"POST /vote/poll/1/seal", "DELETE /vote/poll/1/seal"}
+
+	//With votes the options can't be reordered
+	stub.hasVotes.Store(true)
+	reorder := func(p *Poll) { p.PollOptions = []string{"blue", "red"} }
+	if _, err := api.UpdatePoll(ctx, poll.PollID, reorder); !errors.Is(err, ErrOptionsLocked) {
+		t.Errorf("reorder of a poll with votes: %v, want ErrOptionsLocked", err)
+	}
+	if calls := stub.made(); !reflect.DeepEqual(calls, seal) {
+		t.Errorf("calls = %v, want %v", calls, seal)
+	}
+
+	stub.hasVotes.Store(false)
+	if _, err := api.UpdatePoll(ctx, poll.PollID, reorder); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.made(); !reflect.DeepEqual(calls, seal) {
+		t.Errorf("calls = %v, want %v", calls, seal)
+	}
+}
+
+func TestDeletePollArchivesUnderSeal(t *testing.T) {
+	ctx := context.Background()
+	api, stub := newTestApi(t)
+
+	if _, err := api.AddPoll(ctx, "Colour", "Which one?", []string{"red", "blue"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stub.hasVotes.Store(true)
+	if err := api.DeletePoll(ctx, 1, false); !errors.Is(err, ErrPollHasVotes) {
+		t.Errorf("delete of a poll with votes: %v, want ErrPollHasVotes", err)
+	}
+	if calls, want := stub.made(), []string{"POST /vote/poll/1/seal", "DELETE /vote/poll/1/seal"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+
+	if err := api.DeletePoll(ctx, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if calls, want := stub.made(), []string{"POST /vote/poll/1/seal", "POST /vote/poll/1/archive"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if _, err := api.GetPoll(ctx, 1); err == nil {
+		t.Error("the poll is still there")
+	}
+}
+
+func TestPatchEligibility(t *testing.T) {
+	cleared, err := patchEligibility(json.RawMessage(`null`))
+	if err != nil || cleared != nil {
+		t.Errorf("null: %v, %v, want the rules cleared", cleared, err)
+	}
+
+	if _, err := patchEligibility(json.RawMessage(`"everyone"`)); err == nil {
+		t.Error("a string was taken for rules")
+	}
+
+	rules, err := patchEligibility(json.RawMessage(`{}`))
+	if err != nil || rules == nil {
+		t.Errorf("{}: %v, %v, want rules", rules, err)
+	}
+}
+
+// The VoteAPI turning down a time it has no results for is passed on with
+// its reason, not taken for a failure of the VoteAPI
+func TestResultsUnknownAsOf(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	poll, err := api.AddPoll(ctx, "Colour", "Which one?", []string{"red", "blue"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := api.GetResults(ctx, int(poll.PollID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 1 {
+		t.Errorf("total = %d, want the vote of the VoteAPI", results.Total)
+	}
+
+	asOf := time.Now().Add(-time.Hour)
+	_, err = api.GetResults(ctx, int(poll.PollID), &asOf)
+	if !errors.Is(err, ErrResultsUnknown) || !strings.Contains(err.Error(), "not known that far back") {
+		t.Errorf("err = %v, want ErrResultsUnknown with the reason of the VoteAPI", err)
+	}
+}
+
+// A poll closed while an edit waits on the seal stays closed, and the edit
+// is kept when the poll is opened again
+func TestUpdatePollKeepsConcurrentClose(t *testing.T) {
+	ctx := context.Background()
+	api, stub := newTestApi(t)
+
+	poll, err := api.AddPoll(ctx, "Colour", "Which one?", []string{"red", "blue"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub.onSeal = func() {
+		if _, err := api.SetClosed(ctx, int(poll.PollID), true); err != nil {
+			t.Error(err)
+		}
+	}
+	updated, err := api.UpdatePoll(ctx, poll.PollID, func(p *Poll) { p.PollTitle = "Color" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Closed || updated.PollTitle != "Color" {
+		t.Errorf("edit returned closed=%v title=%q, want closed with the edit", updated.Closed, updated.PollTitle)
+	}
+
+	stub.onSeal = nil
+	opened, err := api.SetClosed(ctx, int(poll.PollID), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Closed || opened.PollTitle != "Color" {
+		t.Errorf("opened poll: closed=%v title=%q, want open with the edit", opened.Closed, opened.PollTitle)
+	}
+}
+
+// Without a service key the VoteAPI turns the seal down, the poll is left
+// as it was
+func TestEditNeedsTheServiceKey(t *testing.T) {
+	ctx := context.Background()
+	stub := newVoteStub(t)
+	api := newPollApi(t, stub, "")
+
+	poll, err := api.AddPoll(ctx, "Colour", "Which one?", []string{"red", "blue"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := api.UpdatePoll(ctx, poll.PollID, func(p *Poll) { p.PollTitle = "Color" }); err == nil {
+		t.Error("edit without a service key went through")
+	}
+	if err := api.DeletePoll(ctx, int(poll.PollID), false); err == nil {
+		t.Error("delete without a service key went through")
+	}
+	if calls := stub.made(); len(calls) != 0 {
+		t.Errorf("calls %v reached the VoteAPI", calls)
+	}
+
+	got, err := api.GetPoll(ctx, int(poll.PollID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PollTitle != "Colour" {
+		t.Errorf("title = %q, want the poll unchanged", got.PollTitle)
+	}
+}
+
+func TestConfigNeedsServiceKey(t *testing.T) {
+	if _, err := LoadConfig(nil); err == nil || !strings.Contains(err.Error(), "service-api-key") {
+		t.Errorf("config without a service key: %v, want it refused", err)
+	}
+	if _, err := LoadConfig([]string{"-service-api-key", "ak_1.secret"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplicasCreateDistinctIds(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+	//A second replica on the same store
+	other := &PollApi{store: api.store, apiClient: api.apiClient, VoteUrl: api.VoteUrl, VoterUrl: api.VoterUrl, outbox: api.outbox}
+
+	const polls = 40
+	ids := make(chan uint, polls)
+	var wg sync.WaitGroup
+	for i := 0; i < polls; i++ {
+		replica := api
+		if i%2 == 1 {
+			replica = other
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			poll, err := replica.AddPoll(ctx, fmt.Sprint("Poll ", i), "Which?", []string{"this", "that"}, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- poll.PollID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[uint]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("id %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+	for id := 1; id <= polls; id++ {
+		if _, err := api.GetPoll(ctx, id); err != nil {
+			t.Errorf("poll %d: %v", id, err)
+		}
+	}
+}
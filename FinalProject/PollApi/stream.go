@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"common"
+)
+
+// Results streams.  GET /poll/:id/results/stream is a Server-Sent Events
+// stream of the poll's results, sent again whenever a vote changes them.
+// The VoteAPI publishes the new counts on voteResults:<poll id> through the
+// store, so any VoteAPI replica can publish and any PollApi replica serve
+// the streams.  Each replica holds one subscription per poll that has
+// clients and hands the results to all of them.  A client joins before
+// the current results are read, so nothing published in between is lost,
+// and a subscription that drops is made again, its clients getting the
+// results they may have missed meanwhile.
+//
+// Event ids are the results version, a client reconnecting with
+// Last-Event-ID only gets the results again if they changed meanwhile.
+// Slow clients never hold up the others: a client only ever has the
+// latest results pending, older ones are dropped, and a client that
+// can't take a write within StreamWriteTimeout is disconnected.
+const (
+	ResultsChannelPrefix = "voteResults:"
+	StreamHeartbeat      = 15 * time.Second
+	StreamWriteTimeout   = 10 * time.Second
+	StreamResubscribe    = time.Second
+)
+
+type ResultsHub struct {
+	api     *PollApi
+	mu      sync.Mutex
+	polls   map[uint]*resultsSubscription
+	done    chan struct{}
+	closing sync.Once
+}
+
+// resultsSubscription is made by its forward goroutine, ready is closed
+// once it is, err set if it couldn't be
+type resultsSubscription struct {
+	clients map[*streamClient]struct{}
+	cancel  context.CancelFunc
+	ready   chan struct{}
+	err     error
+}
+
+// streamClient holds at most one pending event, the latest results
+type streamClient struct {
+	events chan streamEvent
+}
+
+type streamEvent struct {
+	version int64
+	frame   []byte
+}
+
+func NewResultsHub(api *PollApi) *ResultsHub {
+	return &ResultsHub{
+		api:   api,
+		polls: map[uint]*resultsSubscription{},
+		done:  make(chan struct{}),
+	}
+}
+
+// Close ends every stream, called when the service starts draining
+func (h *ResultsHub) Close() {
+	h.closing.Do(func() { close(h.done) })
+}
+
+func resultsChannel(pollID uint) string {
+	return fmt.Sprintf("%s%d", ResultsChannelPrefix, pollID)
+}
+
+func resultsEvent(results *PollResults) (streamEvent, error) {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return streamEvent{}, err
+	}
+
+	frame := fmt.Sprintf("id: %d\nevent: results\ndata: %s\n\n", results.Version, data)
+	return streamEvent{version: results.Version, frame: []byte(frame)}, nil
+}
+
+var heartbeatFrame = []byte("event: heartbeat\ndata: {}\n\n")
+
+// offer replaces whatever the client hasn't sent yet
+func (c *streamClient) offer(ev streamEvent) {
+	for {
+		select {
+		case c.events <- ev:
+			return
+		default:
+		}
+
+		select {
+		case <-c.events:
+		default:
+		}
+	}
+}
+
+// join adds a client to the poll's subscription, making it if the client
+// is the first.  The store is only called outside the lock, a slow
+// subscribe holds up the clients of that poll and no other.
+func (h *ResultsHub) join(ctx context.Context, pollID uint) (*streamClient, error) {
+	client := &streamClient{events: make(chan streamEvent, 1)}
+
+	h.mu.Lock()
+	sub, ok := h.polls[pollID]
+	if !ok {
+		subCtx, cancel := context.WithCancel(context.Background())
+		sub = &resultsSubscription{clients: map[*streamClient]struct{}{}, cancel: cancel, ready: make(chan struct{})}
+		h.polls[pollID] = sub
+		go h.forward(subCtx, pollID, sub)
+	}
+	sub.clients[client] = struct{}{}
+	resultsStreams.Inc()
+	h.mu.Unlock()
+
+	select {
+	case <-sub.ready:
+	case <-ctx.Done():
+		h.leave(pollID, client)
+		return nil, ctx.Err()
+	}
+
+	if sub.err != nil {
+		h.leave(pollID, client)
+		return nil, sub.err
+	}
+	return client, nil
+}
+
+func (h *ResultsHub) leave(pollID uint, client *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	resultsStreams.Dec()
+
+	sub, ok := h.polls[pollID]
+	if !ok {
+		return
+	}
+
+	delete(sub.clients, client)
+	if len(sub.clients) == 0 {
+		sub.cancel()
+		delete(h.polls, pollID)
+	}
+}
+
+// offer hands the results to every client of the poll
+func (h *ResultsHub) offer(pollID uint, ev streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sub, ok := h.polls[pollID]; ok {
+		for client := range sub.clients {
+			client.offer(ev)
+		}
+	}
+}
+
+// forward subscribes to the poll's results and turns the counts published
+// by the VoteAPI into results, once for all the clients of the poll.  A
+// subscription that drops is made again until the last client leaves.
+func (h *ResultsHub) forward(ctx context.Context, pollID uint, sub *resultsSubscription) {
+	messages, err := h.api.store.Subscribe(ctx, resultsChannel(pollID))
+	if err != nil {
+		//The clients waiting give up, the next one to come tries again
+		h.mu.Lock()
+		if h.polls[pollID] == sub {
+			delete(h.polls, pollID)
+		}
+		h.mu.Unlock()
+	}
+	sub.err = err
+	close(sub.ready)
+	if err != nil {
+		return
+	}
+
+	for {
+		for message := range messages {
+			var counts voteCounts
+			if err := json.Unmarshal(message, &counts); err != nil {
+				common.LogFrom(ctx).Warn("Ignoring malformed results message", "poll_id", pollID, "error", err)
+				continue
+			}
+
+			poll, err := h.api.GetPoll(ctx, int(pollID))
+			if err != nil {
+				continue
+			}
+
+			ev, err := resultsEvent(pollResults(poll, &counts))
+			if err != nil {
+				common.LogFrom(ctx).Warn("Failed to encode the results", "poll_id", pollID, "error", err)
+				continue
+			}
+			h.offer(pollID, ev)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		common.LogFrom(ctx).Warn("Results subscription dropped, subscribing again", "poll_id", pollID)
+		if messages = h.resubscribe(ctx, pollID); messages == nil {
+			return
+		}
+	}
+}
+
+// resubscribe tries again every StreamResubscribe until it subscribes, nil
+// when the clients are all gone first.  The results published while there
+// was no subscription are caught up with by reading them again.
+func (h *ResultsHub) resubscribe(ctx context.Context, pollID uint) <-chan []byte {
+	for {
+		select {
+		case <-time.After(StreamResubscribe):
+		case <-ctx.Done():
+			return nil
+		}
+
+		messages, err := h.api.store.Subscribe(ctx, resultsChannel(pollID))
+		if err != nil {
+			common.LogFrom(ctx).Warn("Failed to subscribe to the results again", "poll_id", pollID, "error", err)
+			continue
+		}
+
+		results, err := h.api.GetResults(ctx, int(pollID), nil)
+		if err != nil {
+			common.LogFrom(ctx).Warn("Failed to catch up with the results", "poll_id", pollID, "error", err)
+			return messages
+		}
+		if ev, err := resultsEvent(results); err == nil {
+			h.offer(pollID, ev)
+		}
+		return messages
+	}
+}
+
+// Stream serves one client, starting from the current results, until it
+// goes away, falls behind or the service drains.  The client must have
+// joined before current was read, Stream has it leave.
+func (h *ResultsHub) Stream(c *gin.Context, client *streamClient, current *PollResults) {
+	defer h.leave(current.PollID, client)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	rc := http.NewResponseController(c.Writer)
+	write := func(frame []byte) bool {
+		rc.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		if _, err := c.Writer.Write(frame); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	//Versions only go up, anything not newer than what the client has
+	//is skipped, including results published out of order.  A resumed
+	//client still gets the current results if its id is any different.
+	last := int64(-1)
+	if id, err := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64); err == nil {
+		last = id
+	}
+
+	if current.Version != last {
+		ev, err := resultsEvent(current)
+		if err != nil || !write(ev.frame) {
+			return
+		}
+		last = current.Version
+	} else if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev := <-client.events:
+			if ev.version <= last {
+				continue
+			}
+			if !write(ev.frame) {
+				common.LogFrom(c.Request.Context()).Info("Closing a results stream that can't keep up")
+				return
+			}
+			last = ev.version
+		case <-heartbeat.C:
+			if !write(heartbeatFrame) {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
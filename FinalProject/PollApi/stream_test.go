@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"common"
+)
+
+// subscriptions hands out subscriptions the test controls: Subscribe waits
+// for hold to be released, and drop closes the latest one as a lost
+// connection would
+type subscriptions struct {
+	common.Store
+	hold chan struct{}
+
+	mu   sync.Mutex
+	made int
+	stop func()
+}
+
+func (s *subscriptions) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	if s.hold != nil {
+		<-s.hold
+	}
+
+	messages := make(chan []byte)
+	var once sync.Once
+	stop := func() { once.Do(func() { close(messages) }) }
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.made++
+	s.stop = stop
+	return messages, nil
+}
+
+func (s *subscriptions) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+}
+
+func (s *subscriptions) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.made
+}
+
+func receive(t *testing.T, client *streamClient) streamEvent {
+	t.Helper()
+
+	select {
+	case ev := <-client.events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no results reached the client")
+		return streamEvent{}
+	}
+}
+
+// Results published after the client joined and before its snapshot was
+// read reach it
+func TestJoinedClientGetsResultsPublishedMeanwhile(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+	hub := NewResultsHub(api)
+
+	poll, err := api.AddPoll(ctx, "Colour", "Which one?", []string{"red", "blue"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := hub.join(ctx, poll.PollID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.leave(poll.PollID, client)
+
+	if err := api.store.Publish(ctx, resultsChannel(poll.PollID), []byte(`{"counts": {"1": 1}, "version": 5}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := receive(t, client); ev.version != 5 {
+		t.Errorf("client got version %d, want 5", ev.version)
+	}
+}
+
+// A poll whose subscription is slow to be made doesn't hold up the others
+func TestJoinDoesNotHoldTheHub(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+	store := &subscriptions{Store: api.store, hold: make(chan struct{})}
+	api.store = store
+	hub := NewResultsHub(api)
+
+	joined := make(chan error, 1)
+	go func() {
+		client, err := hub.join(ctx, 1)
+		if err == nil {
+			hub.leave(1, client)
+		}
+		joined <- err
+	}()
+
+	//Poll 1 is stuck subscribing, poll 2 only waits for its own
+	waiting, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := hub.join(waiting, 2); err != context.DeadlineExceeded {
+		t.Errorf("join of another poll: %v, want it waiting on its own subscription", err)
+	}
+
+	close(store.hold)
+	if err := <-joined; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamResubscribes(t *testing.T) {
+	ctx := context.Background()
+	api, stub := newTestApi(t)
+	store := &subscriptions{Store: api.store}
+	api.store = store
+	hub := NewResultsHub(api)
+
+	poll, err := api.AddPoll(ctx, "Colour", "Which one?", []string{"red", "blue"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := hub.join(ctx, poll.PollID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.leave(poll.PollID, client)
+
+	//Votes counted while the subscription was down are caught up with
+	stub.version.Store(9)
+	store.drop()
+
+	if ev := receive(t, client); ev.version != 9 {
+		t.Errorf("client got version %d after the resubscription, want 9", ev.version)
+	}
+	if n := store.count(); n != 2 {
+		t.Errorf("subscribed %d times, want 2", n)
+	}
+}
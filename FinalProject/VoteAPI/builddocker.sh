@@ -1,2 +1,2 @@
 #!/bin/bash
-docker build --tag finalproject/vote-api:v1  -f ./dockerfile .
+docker build --tag finalproject/vote-api:v1  -f ./dockerfile ..
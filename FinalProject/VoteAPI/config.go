@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"common"
+)
+
+// Configuration of the VoteAPI, the settings every service has are in
+// common/config.go.  TracerName names the service in its logs, traces and
+// usage message.
+const (
+	TracerName  = "vote-api"
+	DefaultPort = 1080
+)
+
+type Config struct {
+	*common.Config
+
+	VoterUrl string
+	PollUrl  string
+
+	RateMinuteRetention time.Duration
+	RateHourRetention   time.Duration
+
+	LiveIdleTimeout    time.Duration
+	LiveMaxConnections int
+
+	ReconcileResults bool
+	Replay           string
+}
+
+func (cfg *Config) Register(fs *flag.FlagSet) []common.ConfigOption {
+	fs.StringVar(&cfg.VoterUrl, "voter-url", VoterDefaultLocation, "Base URL of the voter API")
+	fs.StringVar(&cfg.PollUrl, "poll-url", PollDefaultLocation, "Base URL of the poll API")
+
+	//Vote rates kept per minute and per hour, see timeseries.go
+	fs.DurationVar(&cfg.RateMinuteRetention, "timeseries-minute-retention", VoteRateDefaultMinuteRetention, "How long votes per minute are kept, 0 for ever")
+	fs.DurationVar(&cfg.RateHourRetention, "timeseries-hour-retention", VoteRateDefaultHourRetention, "How long votes per hour are kept, 0 for ever")
+
+	//Websocket clients of /vote/live, see live.go
+	fs.DurationVar(&cfg.LiveIdleTimeout, "live-idle-timeout", LiveDefaultIdleTimeout, "Time a live client may go without answering a ping")
+	fs.IntVar(&cfg.LiveMaxConnections, "live-max-connections", LiveDefaultMaxConnections, "Live clients accepted at once")
+
+	//Maintenance commands, the service exits once they are done
+	fs.BoolVar(&cfg.ReconcileResults, "reconcile-results", false, "Recount the results of every poll from the votes and exit")
+	fs.StringVar(&cfg.Replay, "replay", "", "Rebuild projections (comma separated, or all) from the vote events and exit")
+
+	return []common.ConfigOption{
+		{Flag: "voter-url", Key: "voter-url", Env: "VOTER_URL"},
+		{Flag: "poll-url", Key: "poll-url", Env: "POLL_URL"},
+		{Flag: "timeseries-minute-retention", Key: "timeseries-minute-retention", Env: "TIMESERIES_MINUTE_RETENTION"},
+		{Flag: "timeseries-hour-retention", Key: "timeseries-hour-retention", Env: "TIMESERIES_HOUR_RETENTION"},
+		{Flag: "live-idle-timeout", Key: "live-idle-timeout", Env: "LIVE_IDLE_TIMEOUT"},
+		{Flag: "live-max-connections", Key: "live-max-connections", Env: "LIVE_MAX_CONNECTIONS"},
+	}
+}
+
+func (cfg *Config) Validate() []error {
+	errs := []error{
+		common.ValidateServiceUrl("voter-url", cfg.VoterUrl),
+		common.ValidateServiceUrl("poll-url", cfg.PollUrl),
+	}
+
+	if cfg.RateMinuteRetention != 0 && cfg.RateMinuteRetention < time.Hour {
+		errs = append(errs, fmt.Errorf("timeseries-minute-retention: %s is less than an hour", cfg.RateMinuteRetention))
+	}
+	if cfg.RateHourRetention != 0 && (cfg.RateMinuteRetention == 0 || cfg.RateHourRetention < cfg.RateMinuteRetention) {
+		errs = append(errs, fmt.Errorf("timeseries-hour-retention: %s is shorter than timeseries-minute-retention", cfg.RateHourRetention))
+	}
+	if cfg.LiveIdleTimeout < time.Second {
+		errs = append(errs, fmt.Errorf("live-idle-timeout: %s is less than a second", cfg.LiveIdleTimeout))
+	}
+	if cfg.LiveMaxConnections < 1 {
+		errs = append(errs, fmt.Errorf("live-max-connections: %d is not positive", cfg.LiveMaxConnections))
+	}
+	if cfg.Replay != "" {
+		if _, err := findProjections(cfg.Replay); err != nil {
+			errs = append(errs, fmt.Errorf("replay: %w", err))
+		}
+	}
+	return errs
+}
+
+// LoadConfig builds the configuration from the defaults, the config file,
+// the environment and the command line arguments, in that order
+func LoadConfig(args []string) (*Config, error) {
+	cfg := &Config{}
+
+	var err error
+	if cfg.Config, err = common.LoadConfig(TracerName, DefaultPort, args, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"common"
+)
+
+// Live voting.  GET /vote/live upgrades to a websocket that a client keeps
+// open for the length of a talk: it authenticates, subscribes to the polls
+// it shows and casts votes over the one connection.  Messages are JSON
+// objects with a type, requests may carry an id that is echoed back in
+// their reply:
+//
+//	{"type":"auth","token":"ak_3.xxxx"}                    -> authenticated
+//	{"type":"subscribe","pollID":7}                        -> subscribed
+//	{"type":"unsubscribe","pollID":7}                      -> unsubscribed
+//	{"type":"vote","id":"1","voterID":4,"pollID":7,"voteValue":2} -> vote
+//
+// Failed requests get {"type":"error","status":...,"error":...} with the
+// status the HTTP routes would have answered.  Votes go through AddVote
+// like POST /vote does.  The PollApi's outbox relay publishes its events
+// on PollEventsChannel, every replica holds one subscription to it and
+// passes poll.opened and poll.closed on to the clients subscribed to the
+// poll as {"type":"poll.closed","pollID":7}.
+//
+// The server pings every half idle timeout, a client that sends nothing,
+// not even a pong, for the idle timeout is dropped, as is a client that
+// can't keep up with its messages.  Browsers can't set headers on a
+// websocket, so the api key may come in the auth message instead of the
+// Authorization header; when keys are required a client has
+// LiveAuthTimeout to send it.
+const (
+	PollEventsChannel         = common.EventsChannelPrefix + "poll-api"
+	LiveDefaultIdleTimeout    = 60 * time.Second
+	LiveDefaultMaxConnections = 10000
+	LiveAuthTimeout           = 10 * time.Second
+	LiveWriteTimeout          = 10 * time.Second
+	LiveVoteTimeout           = 10 * time.Second
+	LiveMaxMessageSize        = 4096
+	LiveSendBuffer            = 32
+)
+
+type LiveHub struct {
+	api     *VoteApi
+	keys    *common.ApiKeyStore
+	idle    time.Duration
+	max     int
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	conns   map[*liveConn]struct{}
+	count   int
+	active  sync.WaitGroup
+	done    chan struct{}
+	closing sync.Once
+
+	upgrader websocket.Upgrader
+}
+
+type liveConn struct {
+	ws     *websocket.Conn
+	send   chan []byte
+	authed atomic.Bool
+	key    *common.ApiKey
+
+	//Guards polls, read by the hub when it passes events on
+	mu    sync.Mutex
+	polls map[uint]bool
+
+	closeCode   int
+	closeReason string
+	closing     sync.Once
+	closed      chan struct{}
+}
+
+type liveRequest struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Token     string `json:"token"`
+	PollID    uint   `json:"pollID"`
+	VoterID   uint   `json:"voterID"`
+	VoteValue uint   `json:"voteValue"`
+}
+
+type liveReply struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	PollID uint   `json:"pollID,omitempty"`
+	Vote   *Vote  `json:"vote,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// pollEvent is what clients get of a poll event, the data of the event
+// is the poll so its id is read from there
+type pollEvent struct {
+	Type   string `json:"type"`
+	PollID uint   `json:"pollID"`
+}
+
+// NewLiveHub subscribes to the poll events, the subscription is held
+// until Close
+func NewLiveHub(api *VoteApi, keys *common.ApiKeyStore, idle time.Duration, max int) (*LiveHub, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := api.store.Subscribe(ctx, PollEventsChannel)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	h := &LiveHub{
+		api:    api,
+		keys:   keys,
+		idle:   idle,
+		max:    max,
+		cancel: cancel,
+		conns:  map[*liveConn]struct{}{},
+		done:   make(chan struct{}),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			//Idle clients don't hold on to a write buffer
+			WriteBufferPool: &sync.Pool{},
+			//Clients authenticate with an api key, not a cookie, so pages
+			//from any origin may connect
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+	}
+
+	go h.forward(events)
+	return h, nil
+}
+
+// Close disconnects every client, called when the service starts draining
+// (see Wait)
+func (h *LiveHub) Close() {
+	h.closing.Do(func() {
+		close(h.done)
+		h.cancel()
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for conn := range h.conns {
+			conn.close(websocket.CloseGoingAway, "server shutting down")
+		}
+	})
+}
+
+// Wait lets the clients disconnected by Close get their close message.  The
+// server doesn't track websockets once they are upgraded, so its drain
+// doesn't wait for them.
+func (h *LiveHub) Wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *LiveHub) forward(events <-chan []byte) {
+	for message := range events {
+		var ev common.Event
+		if err := json.Unmarshal(message, &ev); err != nil {
+			slog.Warn("Dropped an unreadable poll event", "error", err)
+			continue
+		}
+
+		if ev.Type != "poll.opened" && ev.Type != "poll.closed" {
+			continue
+		}
+
+		event := pollEvent{Type: ev.Type}
+		if err := json.Unmarshal(ev.Data, &event); err != nil {
+			slog.Warn("Dropped an unreadable poll event", "seq", ev.Seq, "error", err)
+			continue
+		}
+
+		message, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+
+		h.mu.Lock()
+		for conn := range h.conns {
+			if conn.subscribed(event.PollID) {
+				conn.push(message)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// reserve takes one of the max connections, false when they are all used
+func (h *LiveHub) reserve() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count >= h.max {
+		return false
+	}
+	h.count++
+	return true
+}
+
+func (h *LiveHub) add(conn *liveConn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	select {
+	case <-h.done:
+		return false
+	default:
+	}
+
+	h.conns[conn] = struct{}{}
+	h.active.Add(1)
+	liveConnections.Inc()
+	return true
+}
+
+func (h *LiveHub) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count--
+}
+
+func (h *LiveHub) remove(conn *liveConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, conn)
+	h.active.Done()
+	liveConnections.Dec()
+}
+
+// Serve upgrades the request and runs the connection until either side
+// closes it
+func (h *LiveHub) Serve(c *gin.Context) {
+	select {
+	case <-h.done:
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	if !h.reserve() {
+		c.Header("Retry-After", "5")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "too many live connections"})
+		return
+	}
+	defer h.release()
+
+	ws, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		//The upgrader already answered the client
+		common.LogFrom(c.Request.Context()).Info("Refused a websocket upgrade", "error", err)
+		return
+	}
+
+	conn := &liveConn{
+		ws:     ws,
+		send:   make(chan []byte, LiveSendBuffer),
+		polls:  map[uint]bool{},
+		closed: make(chan struct{}),
+	}
+
+	if key, ok := common.ApiKeyFromContext(c); ok {
+		conn.key = key
+		conn.authed.Store(true)
+	}
+
+	if !h.add(conn) {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(LiveWriteTimeout))
+		ws.Close()
+		return
+	}
+	defer h.remove(conn)
+
+	logger := common.LogFrom(c.Request.Context())
+	logger.Debug("Live client connected")
+
+	if h.keys.Required() && !conn.authed.Load() {
+		timer := time.AfterFunc(LiveAuthTimeout, func() {
+			if !conn.authed.Load() {
+				conn.close(websocket.ClosePolicyViolation, "an api key is required")
+			}
+		})
+		defer timer.Stop()
+	}
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		h.writeLoop(conn)
+	}()
+
+	err = h.readLoop(c.Request.Context(), conn)
+	conn.close(websocket.CloseNormalClosure, "")
+	<-written
+
+	logger.Debug("Live client disconnected", "error", err)
+}
+
+func (h *LiveHub) writeLoop(conn *liveConn) {
+	defer conn.ws.Close()
+
+	ping := time.NewTicker(h.idle / 2)
+	defer ping.Stop()
+
+	for {
+		select {
+		case message := <-conn.send:
+			conn.ws.SetWriteDeadline(time.Now().Add(LiveWriteTimeout))
+			if err := conn.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(LiveWriteTimeout)); err != nil {
+				return
+			}
+		case <-conn.closed:
+			conn.ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(conn.closeCode, conn.closeReason),
+				time.Now().Add(LiveWriteTimeout))
+			return
+		}
+	}
+}
+
+// readLoop handles the client's requests one at a time, in order, until
+// the connection fails or goes idle
+func (h *LiveHub) readLoop(ctx context.Context, conn *liveConn) error {
+	conn.ws.SetReadLimit(LiveMaxMessageSize)
+	conn.ws.SetReadDeadline(time.Now().Add(h.idle))
+	conn.ws.SetPongHandler(func(string) error {
+		return conn.ws.SetReadDeadline(time.Now().Add(h.idle))
+	})
+
+	for {
+		_, message, err := conn.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.ws.SetReadDeadline(time.Now().Add(h.idle))
+
+		var req liveRequest
+		if err := json.Unmarshal(message, &req); err != nil {
+			conn.reply(liveReply{Type: "error", Status: http.StatusBadRequest, Error: "messages must be JSON objects"})
+			continue
+		}
+
+		conn.reply(h.handle(ctx, conn, &req))
+	}
+}
+
+func (h *LiveHub) handle(ctx context.Context, conn *liveConn, req *liveRequest) liveReply {
+	fail := func(status int, message string) liveReply {
+		return liveReply{Type: "error", ID: req.ID, Status: status, Error: message}
+	}
+
+	if req.Type == "auth" {
+		key, err := h.keys.Authenticate(ctx, req.Token)
+		if errors.Is(err, common.ErrApiKeyRateLimited) {
+			return fail(http.StatusTooManyRequests, err.Error())
+		} else if err != nil {
+			return fail(http.StatusUnauthorized, err.Error())
+		}
+
+		conn.key = key
+		conn.authed.Store(true)
+		return liveReply{Type: "authenticated", ID: req.ID}
+	}
+
+	if h.keys.Required() && !conn.authed.Load() {
+		return fail(http.StatusUnauthorized, "an api key is required")
+	}
+
+	switch req.Type {
+	case "subscribe", "unsubscribe":
+		if !conn.allows("votes:read", req.PollID) {
+			return fail(http.StatusForbidden, "api key is missing scope votes:read")
+		}
+
+		conn.mu.Lock()
+		if req.Type == "subscribe" {
+			conn.polls[req.PollID] = true
+		} else {
+			delete(conn.polls, req.PollID)
+		}
+		conn.mu.Unlock()
+
+		return liveReply{Type: req.Type + "d", ID: req.ID, PollID: req.PollID}
+
+	case "vote":
+		if !conn.allows("votes:write", req.PollID) {
+			return fail(http.StatusForbidden, "api key is missing scope votes:write")
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, LiveVoteTimeout)
+		defer cancel()
+
+		vt, err := h.api.AddVote(ctx, req.VoterID, req.PollID, req.VoteValue)
+		switch {
+		case errors.Is(err, common.ErrNotEligible):
+			return fail(http.StatusForbidden, err.Error())
+		case errors.Is(err, ErrInvalidVoteValue):
+			return fail(http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrPollClosed):
+			return fail(http.StatusConflict, err.Error())
+		case err != nil:
+			common.LogFrom(ctx).Warn("Failed to vote", "voter_id", req.VoterID, "poll_id", req.PollID, "error", err)
+			return fail(http.StatusBadRequest, err.Error())
+		}
+
+		return liveReply{Type: "vote", ID: req.ID, PollID: req.PollID, Vote: vt}
+	}
+
+	return fail(http.StatusBadRequest, fmt.Sprintf("unknown message type %q", req.Type))
+}
+
+// allows is apiKeyAllows for the key the connection authenticated with
+func (c *liveConn) allows(scope string, pollID uint) bool {
+	if c.key == nil {
+		return true
+	}
+	return c.key.Allows(scope, "poll/"+strconv.FormatUint(uint64(pollID), 10))
+}
+
+func (c *liveConn) subscribed(pollID uint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.polls[pollID]
+}
+
+func (c *liveConn) reply(reply liveReply) {
+	message, err := json.Marshal(reply)
+	if err != nil {
+		slog.Error("Failed to encode a live reply", "error", err)
+		return
+	}
+	c.push(message)
+}
+
+// push never blocks, a client that lets LiveSendBuffer messages pile up
+// is disconnected rather than holding up the others
+func (c *liveConn) push(message []byte) {
+	select {
+	case c.send <- message:
+	default:
+		c.close(websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+func (c *liveConn) close(code int, reason string) {
+	c.closing.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.closed)
+	})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"common"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// serveLive runs a hub of at most max clients behind the api key
+// middleware, and returns it with the ws:// url of /vote/live
+func serveLive(t *testing.T, api *VoteApi, keys *common.ApiKeyStore, max int) (*LiveHub, string) {
+	t.Helper()
+
+	hub, err := NewLiveHub(api, keys, time.Minute, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hub.Close)
+
+	r := gin.New()
+	r.Use(keys.Middleware())
+	r.GET("/vote/live", hub.Serve)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	return hub, "ws" + strings.TrimPrefix(srv.URL, "http") + "/vote/live"
+}
+
+func dialLive(t *testing.T, url string, header http.Header) *websocket.Conn {
+	t.Helper()
+
+	ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial: %v (%v)", err, resp)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// exchange sends message and reads the reply
+func exchange(t *testing.T, ws *websocket.Conn, message string) liveReply {
+	t.Helper()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	return readLive(t, ws)
+}
+
+func readLive(t *testing.T, ws *websocket.Conn) liveReply {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var reply liveReply
+	if err := ws.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestLiveVote(t *testing.T) {
+	api, _ := newTestApi(t)
+	_, url := serveLive(t, api, common.NewApiKeyStore(api.store, "", false), 10)
+	ws := dialLive(t, url, nil)
+
+	reply := exchange(t, ws, `{"type":"vote","id":"1","voterID":4,"pollID":7,"voteValue":2}`)
+	if reply.Type != "vote" || reply.ID != "1" || reply.Vote == nil || reply.Vote.VoterID != 4 || reply.Vote.VoteValue != 2 {
+		t.Errorf("vote reply %+v", reply)
+	}
+	if vt, err := api.GetVote(context.Background(), int(reply.Vote.VoteID)); err != nil || vt.PollID != 7 {
+		t.Errorf("stored vote %+v, %v", vt, err)
+	}
+
+	//Failures are replies, the connection stays open
+	cases := []struct {
+		message string
+		status  int
+	}{
+		{`{"type":"vote","id":"2","voterID":5,"pollID":7,"voteValue":9}`, http.StatusBadRequest},
+		{`{"type":"shout","id":"3"}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if reply := exchange(t, ws, tc.message); reply.Type != "error" || reply.Status != tc.status {
+			t.Errorf("%s: %+v, want error %d", tc.message, reply, tc.status)
+		}
+	}
+}
+
+// Poll events only reach the clients subscribed to the poll
+func TestLivePollEvents(t *testing.T) {
+	api, _ := newTestApi(t)
+	_, url := serveLive(t, api, common.NewApiKeyStore(api.store, "", false), 10)
+
+	subscriber := dialLive(t, url, nil)
+	if reply := exchange(t, subscriber, `{"type":"subscribe","pollID":7}`); reply.Type != "subscribed" || reply.PollID != 7 {
+		t.Fatalf("subscribe reply %+v", reply)
+	}
+	other := dialLive(t, url, nil)
+	if reply := exchange(t, other, `{"type":"subscribe","pollID":8}`); reply.Type != "subscribed" {
+		t.Fatalf("subscribe reply %+v", reply)
+	}
+
+	publish := func(eventType string, pollID uint) {
+		data, _ := json.Marshal(map[string]uint{"pollID": pollID})
+		message, _ := json.Marshal(common.Event{Type: eventType, Data: data})
+		if err := api.store.Publish(context.Background(), PollEventsChannel, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("poll.updated", 7)
+	publish("poll.closed", 7)
+
+	if reply := readLive(t, subscriber); reply.Type != "poll.closed" || reply.PollID != 7 {
+		t.Errorf("subscriber got %+v, want poll 7 closed", reply)
+	}
+
+	//The other client hears of its own poll only
+	publish("poll.opened", 8)
+	if reply := readLive(t, other); reply.Type != "poll.opened" || reply.PollID != 8 {
+		t.Errorf("other client got %+v, want poll 8 opened", reply)
+	}
+}
+
+// With keys required, a client authenticates before anything else and is
+// held to the scopes of its key
+func TestLiveAuth(t *testing.T) {
+	api, _ := newTestApi(t)
+	keys := common.NewApiKeyStore(api.store, "", true)
+	_, url := serveLive(t, api, keys, 10)
+
+	_, token, err := keys.CreateKey(context.Background(), nil, "kiosk", []string{"votes:write:poll/7"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws := dialLive(t, url, nil)
+	if reply := exchange(t, ws, `{"type":"vote","voterID":4,"pollID":7,"voteValue":1}`); reply.Status != http.StatusUnauthorized {
+		t.Errorf("vote before auth: %+v, want 401", reply)
+	}
+	if reply := exchange(t, ws, `{"type":"auth","token":"ak_1.wrong"}`); reply.Status != http.StatusUnauthorized {
+		t.Errorf("wrong token: %+v, want 401", reply)
+	}
+	if reply := exchange(t, ws, `{"type":"auth","token":"`+token+`"}`); reply.Type != "authenticated" {
+		t.Fatalf("auth: %+v", reply)
+	}
+
+	if reply := exchange(t, ws, `{"type":"vote","voterID":4,"pollID":7,"voteValue":1}`); reply.Type != "vote" {
+		t.Errorf("vote in scope: %+v", reply)
+	}
+	if reply := exchange(t, ws, `{"type":"vote","voterID":4,"pollID":8,"voteValue":1}`); reply.Status != http.StatusForbidden {
+		t.Errorf("vote out of scope: %+v, want 403", reply)
+	}
+	if reply := exchange(t, ws, `{"type":"subscribe","pollID":7}`); reply.Status != http.StatusForbidden {
+		t.Errorf("subscribe without votes:read: %+v, want 403", reply)
+	}
+
+	//A key on the upgrade request authenticates the connection right away
+	header := http.Header{}
+	header.Set("Authorization", common.ApiKeyAuthScheme+" "+token)
+	ws = dialLive(t, url, header)
+	if reply := exchange(t, ws, `{"type":"vote","voterID":5,"pollID":7,"voteValue":0}`); reply.Type != "vote" {
+		t.Errorf("vote with the key on the upgrade: %+v", reply)
+	}
+}
+
+func TestLiveMaxConnections(t *testing.T) {
+	api, _ := newTestApi(t)
+	_, url := serveLive(t, api, common.NewApiKeyStore(api.store, "", false), 1)
+
+	ws := dialLive(t, url, nil)
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("second client: %v, %v, want a 503 with Retry-After", err, resp)
+	}
+
+	//A client leaving frees its place
+	ws.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		next, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			next.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no place freed: %v", err)
+		}
+	}
+}
+
+// Close tells the clients the server is going away, Wait returns once they
+// are gone and new clients are turned away
+func TestLiveClose(t *testing.T) {
+	api, _ := newTestApi(t)
+	hub, url := serveLive(t, api, common.NewApiKeyStore(api.store, "", false), 10)
+	ws := dialLive(t, url, nil)
+	if reply := exchange(t, ws, `{"type":"subscribe","pollID":7}`); reply.Type != "subscribed" {
+		t.Fatalf("subscribe reply %+v", reply)
+	}
+
+	hub.Close()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after Close: %v, want close 1001", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := hub.Wait(ctx); err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("dial after Close: %v, %v, want a 503", err, resp)
+	}
+}
@@ -1,59 +1,156 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"log"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
-)
+	"time"
 
-var (
-	hostFlag string
-	portFlag uint
+	"common"
 )
 
-func processCmdLineFlags() {
+func main() {
+	cfg, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
 
-	//Note some networking lingo, some frameworks start the server on localhost
-	//this is a local-only interface and is fine for testing but its not accessible
-	//from other machines.  To make the server accessible from other machines, we
-	//need to listen on an interface, that could be an IP address, but modern
-	//cloud servers may have multiple network interfaces for scale.  With TCP/IP
-	//the address 0.0.0.0 instructs the network stack to listen on all interfaces
-	//We set this up as a flag so that we can overwrite it on the command line if
-	//needed
-	flag.StringVar(&hostFlag, "h", "0.0.0.0", "Listen on all interfaces")
-	flag.UintVar(&portFlag, "p", 1080, "Default Port")
+	if cfg.PrintConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
 
-	flag.Parse()
-}
+	common.InitLogging(TracerName, cfg.LogLevel)
 
-func main() {
-	processCmdLineFlags()
+	shutdownTracing, err := common.InitTracing(TracerName, cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		return
+	}
 
-	api, err := NewVoteApi()
+	api, err := NewVoteApi(cfg)
 
 	if err != nil {
-		log.Println("Failed to initialize the API... ", err)
+		slog.Error("Failed to initialize the API", "error", err)
 		return
 	}
 
-	r := gin.Default()
+	if cfg.ReconcileResults {
+		polls, err := api.ReconcileResults(context.Background())
+		api.store.Close()
+		if err != nil {
+			slog.Error("Failed to reconcile the results", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Results reconciled", "polls", polls)
+		return
+	}
 
-	r.GET("/vote", func(c *gin.Context) {
-		votes, err := api.GetAllVotes()
+	if cfg.Replay != "" {
+		projections, err := findProjections(cfg.Replay)
 		if err != nil {
-			log.Println("Failed to get votes from redis...", err)
+			api.store.Close()
+			slog.Error("Failed to find the projections to replay", "error", err)
+			os.Exit(1)
+		}
+		events, err := api.Replay(context.Background(), projections)
+		api.store.Close()
+		if err != nil {
+			slog.Error("Failed to replay the vote events", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Projections replayed", "projections", cfg.Replay, "events", events)
+		return
+	}
+
+	keys := common.NewApiKeyStore(api.store, cfg.AdminApiKey, cfg.ApiKeysRequired)
+	hooks := common.NewWebhooks(api.store, cfg.Config)
+	api.outbox.Relay(hooks)
+	api.rates.Sweep()
+
+	health := common.NewHealth()
+	health.AddCheck(cfg.Store, func(ctx context.Context) error {
+		return api.store.Ping(ctx)
+	})
+	health.AddCheck("voter-api", func(ctx context.Context) error {
+		return api.checkDownstream(ctx, api.VoterUrl)
+	})
+	health.AddCheck("poll-api", func(ctx context.Context) error {
+		return api.checkDownstream(ctx, api.PollUrl)
+	})
+
+	r := gin.New()
+	r.Use(otelgin.Middleware(TracerName))
+	r.Use(common.RequestLogMiddleware())
+	r.Use(common.RecoveryMiddleware())
+	r.Use(cfg.Timeouts.Middleware())
+	r.Use(common.MetricsMiddleware())
+	r.Use(health.Middleware())
+	r.Use(keys.Middleware())
+
+	health.Register(r, "/vote/health")
+	common.RegisterMetricsRoute(r)
+
+	common.RegisterApiKeyRoutes(r, keys)
+	common.RegisterWebhookRoutes(r, keys, hooks)
+	common.RegisterEventRoutes(r, keys, api.outbox)
+	common.RegisterLogLevelRoute(r, keys)
+
+	r.GET("/vote", keys.RequireScope("votes:read"), func(c *gin.Context) {
+		page, err := common.PageFromQuery(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var filter VoteFilter
+		for name, field := range map[string]*uint{"pollID": &filter.PollID, "voterID": &filter.VoterID} {
+			value := c.Query(name)
+			if value == "" {
+				continue
+			}
+			id64, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": name + " must be a number"})
+				return
+			}
+			*field = uint(id64)
+		}
+		if filter.PollID != 0 {
+			common.LogWith(c, "poll_id", filter.PollID)
+		}
+
+		votes, next, err := api.ListVotes(c.Request.Context(), filter, page)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to get votes from the store", "error", err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		c.JSON(http.StatusOK, votes)
+		//Keys narrowed to a poll (votes:read:poll/7) only see its votes,
+		//so their pages may come out short
+		visible := []Vote{}
+		for _, vt := range votes {
+			if common.ApiKeyAllows(c, "votes:read", fmt.Sprint("poll/", vt.PollID)) {
+				visible = append(visible, vt)
+			}
+		}
+
+		common.SetNextLink(c, next)
+		c.JSON(http.StatusOK, visible)
 	})
 
-	r.POST("/vote", func(c *gin.Context) {
+	r.POST("/vote", keys.RequireScope("votes:write"), func(c *gin.Context) {
 
 		type Vote struct {
 			VoterID   uint `json:"voterID"`
@@ -64,14 +161,31 @@ func main() {
 
 		err := c.ShouldBindJSON(&vote)
 		if err != nil {
-			log.Println("Cannot fetch JSON body from vote POST", err)
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from vote POST", "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		newVote, err := api.AddVote(vote.VoterID, vote.PollID, vote.VoterID)
-		if err != nil {
-			log.Println("Failed to vote: ", err)
+		logger := common.LogWith(c, "voter_id", vote.VoterID, "poll_id", vote.PollID)
+
+		if !common.ApiKeyAllows(c, "votes:write", fmt.Sprint("poll/", vote.PollID)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		newVote, err := api.AddVote(c.Request.Context(), vote.VoterID, vote.PollID, vote.VoteValue)
+		if errors.Is(err, common.ErrNotEligible) {
+			logger.Info("Voter is not eligible for the poll")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, ErrInvalidVoteValue) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, ErrPollClosed) || errors.Is(err, ErrPollSealed) || errors.Is(err, common.ErrConflict) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			logger.Warn("Failed to vote", "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
@@ -79,19 +193,27 @@ func main() {
 		c.JSON(http.StatusOK, newVote)
 	})
 
-	r.GET("/vote/:id", func(c *gin.Context) {
+	r.GET("/vote/:id", keys.RequireScope("votes:read"), func(c *gin.Context) {
 		id := c.Param("id")
 		id64, err := strconv.ParseUint(id, 10, 32)
 		if err != nil {
-			log.Println("Error converting id to int64: ", err)
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		vt, err := api.GetVote(int(id64))
+		logger := common.LogWith(c, "vote_id", id64)
+
+		vt, err := api.GetVote(c.Request.Context(), int(id64))
 		if err != nil {
-			log.Println("Failed to fetch a vote from the DB!")
+			logger.Warn("Failed to fetch a vote from the DB", "error", err)
 			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if !common.ApiKeyAllows(c, "votes:read", fmt.Sprint("poll/", vt.PollID)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
 		}
 
 		pollUrl := fmt.Sprint("/poll/", vt.PollID)
@@ -105,17 +227,301 @@ func main() {
 
 	})
 
-	// Hardcoded health status
-	r.GET("/vote/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":             "ok",
-			"version":            "1.0.0",
-			"uptime":             100,
-			"users_processed":    1000,
-			"errors_encountered": 10,
-		})
+	r.PUT("/vote/:id", keys.RequireScope("votes:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "vote_id", id64)
+
+		var body struct {
+			VoteValue *uint `json:"voteValue"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.VoteValue == nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "voteValue is required"})
+			return
+		}
+
+		vt, err := api.GetVote(c.Request.Context(), int(id64))
+		if err != nil {
+			logger.Warn("Failed to fetch a vote from the DB", "error", err)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if !common.ApiKeyAllows(c, "votes:write", fmt.Sprint("poll/", vt.PollID)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		changed, err := api.ChangeVote(c.Request.Context(), int(id64), *body.VoteValue)
+		if errors.Is(err, ErrInvalidVoteValue) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, ErrPollClosed) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, ErrVoteNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Error("Failed to change the vote", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, changed)
 	})
 
-	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
-	r.Run(serverPath)
+	r.DELETE("/vote/:id", keys.RequireScope("votes:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "vote_id", id64)
+
+		vt, err := api.GetVote(c.Request.Context(), int(id64))
+		if err != nil {
+			logger.Warn("Failed to fetch a vote from the DB", "error", err)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if !common.ApiKeyAllows(c, "votes:write", fmt.Sprint("poll/", vt.PollID)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		err = api.RetractVote(c.Request.Context(), int(id64))
+		if errors.Is(err, ErrVoteNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Error("Failed to retract the vote", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// Read by the PollApi for GET /poll/:id/results
+	r.GET("/vote/poll/:id/results", keys.RequireScope("votes:read"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "votes:read", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		//?asOf=<RFC3339> is the tally at that time rather than now
+		var results *PollResults
+		if value := c.Query("asOf"); value != "" {
+			asOf, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "asOf must be an RFC3339 time"})
+				return
+			}
+			results, err = api.ResultsAsOf(c.Request.Context(), uint(id64), asOf)
+		} else {
+			results, err = api.GetResults(c.Request.Context(), uint(id64))
+		}
+		if errors.Is(err, ErrResultsUnknown) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to read the results", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, results)
+	})
+
+	// Read by the PollApi for GET /poll/:id/timeseries, see timeseries.go
+	r.GET("/vote/poll/:id/timeseries", keys.RequireScope("votes:read"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, "votes:read", fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		bucket := c.DefaultQuery("bucket", "1m")
+		step, from, to, err := parseSeriesQuery(bucket, c.Query("from"), c.Query("to"), time.Now())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		series, err := api.rates.Series(c.Request.Context(), uint(id64), step, from, to)
+		if err != nil {
+			logger.Error("Failed to read the vote rates", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		series.Bucket = bucket
+		c.JSON(http.StatusOK, series)
+	})
+
+	// Websocket for live voting, see live.go.  The connection is authorized
+	// message by message, so there is no RequireScope here.
+	live, err := NewLiveHub(api, keys, cfg.LiveIdleTimeout, cfg.LiveMaxConnections)
+	if err != nil {
+		slog.Error("Failed to subscribe to the poll events", "error", err)
+		return
+	}
+	cfg.Timeouts.NoDeadline("GET /vote/live")
+	r.GET("/vote/live", live.Serve)
+
+	// Called by the VoterAPI when a voter is erased.  The internal routes
+	// need a key with votes:admin, anonymous callers are always refused.
+	r.POST("/vote/voter/:id/anonymize", keys.RequireScope(VotesAdminScope), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, VotesAdminScope, fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		anonymized, err := api.AnonymizeVoter(c.Request.Context(), uint(id64))
+		if err != nil {
+			logger.Error("Failed to anonymize votes", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"votesAnonymized": anonymized})
+	})
+
+	// Called by the PollApi when a poll is deleted
+	r.POST("/vote/poll/:id/archive", keys.RequireScope(VotesAdminScope), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, VotesAdminScope, fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		archived, err := api.ArchivePollVotes(c.Request.Context(), uint(id64))
+		if err != nil {
+			logger.Error("Failed to archive votes", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"votesArchived": archived})
+	})
+
+	// Called by the PollApi around an edit or a deletion of a poll: POST
+	// stops new votes and tells whether the poll has any, DELETE lets them
+	// in again
+	r.POST("/vote/poll/:id/seal", keys.RequireScope(VotesAdminScope), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, VotesAdminScope, fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		hasVotes, err := api.SealPoll(c.Request.Context(), uint(id64))
+		if err != nil {
+			logger.Error("Failed to seal the poll", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"hasVotes": hasVotes})
+	})
+
+	r.DELETE("/vote/poll/:id/seal", keys.RequireScope(VotesAdminScope), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "poll_id", id64)
+
+		if !common.ApiKeyAllows(c, VotesAdminScope, fmt.Sprint("poll/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if err := api.UnsealPoll(c.Request.Context(), uint(id64)); err != nil {
+			logger.Error("Failed to unseal the poll", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	serverPath := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	server := common.NewServer(serverPath, r, health, cfg.DrainDelay, cfg.DrainTimeout)
+	server.OnDrain(live.Close)
+	server.OnShutdown("tracing", shutdownTracing)
+	server.OnShutdown(cfg.Store, func(context.Context) error {
+		return api.store.Close()
+	})
+	server.OnShutdown("webhooks", hooks.Close)
+	server.OnShutdown("outbox", api.outbox.Close)
+	server.OnShutdown("timeseries", api.rates.Close)
+	server.OnShutdown("live", live.Wait)
+
+	if err := server.Run(); err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,21 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Business metrics of the service, served on /metrics next to the http,
+// redis and outbound metrics of common/metrics.go
+var (
+	votesCast = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "votes_cast_total",
+		Help: "Votes accepted since the service started, by poll.",
+	}, []string{"poll"})
+
+	liveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "live_connections",
+		Help: "Websocket clients connected to /vote/live.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(votesCast, liveConnections)
+}
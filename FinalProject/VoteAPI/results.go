@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"common"
+)
+
+// Live results.  Every poll has a hash voteCounts:<poll id> with one
+// counter per option position, changed in the same batch as the votes
+// themselves, so reading the results of a poll costs O(options) rather
+// than a walk over its votes.  The version field goes up with every
+// change, and after each one the new results are published on
+// voteResults:<poll id> for the PollApi replicas streaming them.
+const (
+	RedisCountsPrefix    = "voteCounts:"
+	ResultsChannelPrefix = "voteResults:"
+	ResultsVersionField  = "version"
+)
+
+// ErrResultsUnknown is returned for a time before the stream held the
+// votes of the poll as they were then
+var ErrResultsUnknown = errors.New("the results of this poll are not known that far back")
+
+type PollResults struct {
+	PollID  uint             `json:"pollID"`
+	Counts  map[string]int64 `json:"counts"`
+	Total   int64            `json:"total"`
+	Version int64            `json:"version"`
+	AsOf    *time.Time       `json:"asOf,omitempty"`
+}
+
+func voteCountsKey(pollID uint) string {
+	return fmt.Sprintf("%s%d", RedisCountsPrefix, pollID)
+}
+
+func resultsChannel(pollID uint) string {
+	return fmt.Sprintf("%s%d", ResultsChannelPrefix, pollID)
+}
+
+// countVote adds the counter change of a vote to a batch, delta is 1 when
+// the vote is cast and -1 when it is taken back
+func countVote(b *common.Batch, vt *Vote, delta int64) {
+	b.IncrField(voteCountsKey(vt.PollID), fmt.Sprint(vt.VoteValue), delta)
+	b.IncrField(voteCountsKey(vt.PollID), ResultsVersionField, 1)
+}
+
+// publishResults sends the current results of a poll to its streams.  A
+// failure is only logged, the vote is stored and the streams catch up
+// with the next change.
+func (t *VoteApi) publishResults(ctx context.Context, pollID uint) {
+	results, err := t.GetResults(ctx, pollID)
+	if err != nil {
+		common.LogFrom(ctx).Warn("Failed to read the results to publish", "poll_id", pollID, "error", err)
+		return
+	}
+
+	message, err := json.Marshal(results)
+	if err != nil {
+		common.LogFrom(ctx).Warn("Failed to encode the results to publish", "poll_id", pollID, "error", err)
+		return
+	}
+
+	if err := t.store.Publish(ctx, resultsChannel(pollID), message); err != nil {
+		common.LogFrom(ctx).Warn("Failed to publish the results", "poll_id", pollID, "error", err)
+	}
+}
+
+// GetResults returns the vote counts of a poll by option position.  Options
+// without votes are left out.
+func (t *VoteApi) GetResults(ctx context.Context, pollID uint) (*PollResults, error) {
+	counters, err := t.store.Counters(ctx, voteCountsKey(pollID))
+	if err != nil {
+		return nil, err
+	}
+
+	results := &PollResults{PollID: pollID, Counts: map[string]int64{}}
+	for value, n := range counters {
+		if value == ResultsVersionField {
+			results.Version = n
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		results.Counts[value] = n
+		results.Total += n
+	}
+
+	return results, nil
+}
+
+// ResultsAsOf is the tally of a poll as it stood at asOf, every vote
+// event of the poll up to then applied in order.  There are no counters
+// for the past, the events are read each time.  A seeded vote is only
+// known from its time on, before it ErrResultsUnknown is returned unless
+// the vote wasn't cast yet.
+func (t *VoteApi) ResultsAsOf(ctx context.Context, pollID uint, asOf time.Time) (*PollResults, error) {
+	counts := map[string]int64{}
+	count := func(vt *Vote, delta int64) {
+		counts[fmt.Sprint(vt.VoteValue)] += delta
+	}
+
+	page := common.Page{Limit: common.MaxPageLimit}
+	for {
+		events, next, err := common.ListPage[VoteEvent](ctx, t.store, voteEventsOfPoll(pollID), page, voteEventKey, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range events {
+			ev := &events[i]
+			if ev.Time.After(asOf) {
+				if ev.Seeded && (ev.Vote.CastAt == nil || !asOf.Before(*ev.Vote.CastAt)) {
+					return nil, ErrResultsUnknown
+				}
+				continue
+			}
+
+			switch ev.Type {
+			case VoteEventCast:
+				count(&ev.Vote, 1)
+			case VoteEventChanged:
+				count(ev.Previous, -1)
+				count(&ev.Vote, 1)
+			case VoteEventRetracted, VoteEventArchived:
+				count(&ev.Vote, -1)
+			}
+		}
+
+		if next == 0 {
+			break
+		}
+		page.After = next
+	}
+
+	results := &PollResults{PollID: pollID, Counts: map[string]int64{}, AsOf: &asOf}
+	for value, n := range counts {
+		if n != 0 {
+			results.Counts[value] = n
+			results.Total += n
+		}
+	}
+
+	return results, nil
+}
+
+// ReconcileResults rebuilds the counters of every poll from the votes,
+// for when they have drifted, e.g. after two changes of the same vote
+// raced each other.  Votes cast while it runs can be miscounted, so run
+// it while the API is quiet.  Returns the number of polls with votes.
+func (t *VoteApi) ReconcileResults(ctx context.Context) (int, error) {
+	counts := map[uint]map[string]int64{}
+
+	err := t.eachVote(ctx, VoteFilter{}, func(vt *Vote) error {
+		if counts[vt.PollID] == nil {
+			counts[vt.PollID] = map[string]int64{}
+		}
+		counts[vt.PollID][fmt.Sprint(vt.VoteValue)]++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	existing, err := t.store.Keys(ctx, RedisCountsPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	//Versions keep going up, streams resuming from an older version
+	//must see the recount
+	versions := map[uint]int64{}
+	for _, key := range existing {
+		pollID, err := strconv.ParseUint(key[len(RedisCountsPrefix):], 10, 32)
+		if err != nil {
+			continue
+		}
+		counters, err := t.store.Counters(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		versions[uint(pollID)] = counters[ResultsVersionField]
+	}
+
+	//Dropping and recounting in one batch, readers never see the counters
+	//half rebuilt
+	var b common.Batch
+	for _, key := range existing {
+		b.Delete(key)
+	}
+	for pollID, byValue := range counts {
+		for value, n := range byValue {
+			b.IncrField(voteCountsKey(pollID), value, n)
+		}
+	}
+
+	//Polls that lost all their votes get a new version too
+	polls := map[uint]bool{}
+	for pollID := range versions {
+		polls[pollID] = true
+	}
+	for pollID := range counts {
+		polls[pollID] = true
+	}
+	for pollID := range polls {
+		b.IncrField(voteCountsKey(pollID), ResultsVersionField, versions[pollID]+1)
+	}
+
+	if err := t.store.Commit(ctx, &b); err != nil {
+		return 0, err
+	}
+
+	for pollID := range polls {
+		t.publishResults(ctx, pollID)
+	}
+
+	return len(counts), nil
+}
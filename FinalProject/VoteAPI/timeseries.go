@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"common"
+)
+
+// Vote rates, the votes cast per minute, hour and day of each poll, for
+// charting turnout over time.  They are rollups kept by the voteRates
+// projection: every cast adds one to its minute, its hour and its day in
+// the counters of voteRate:<poll id>:<resolution>[:<partition>], a field
+// per bucket holding its unix start time.
+//
+// Minutes and hours are partitioned, by day and by 30 days, so old buckets
+// go a whole key at a time.  The partitions are indexed: the starts of the
+// partitions of a resolution in voteRatePartitions:<resolution>, and the
+// polls with buckets in one in voteRatePartitions:<resolution>:<start>.
+// A sweeper in one replica (it holds lease:voteRates) walks them oldest
+// first and drops the minute partitions older than
+// timeseries-minute-retention and the hour partitions older than
+// timeseries-hour-retention; days are kept as long as the poll.  A series
+// is read from the coarsest resolution that divides its bucket, 1m buckets
+// only go back as far as the minutes are kept.
+const (
+	VoteRatePrefix                 = "voteRate:"
+	VoteRatePartitionPrefix        = "voteRatePartitions:"
+	VoteRateSweepInterval          = 10 * time.Minute
+	VoteRateSweepLease             = 2 * VoteRateSweepInterval
+	VoteRateDefaultPoints          = 1440
+	VoteRateMaxPoints              = 10000
+	VoteRateDefaultMinuteRetention = 48 * time.Hour
+	VoteRateDefaultHourRetention   = 90 * 24 * time.Hour
+)
+
+type rateResolution struct {
+	Name string
+	Step time.Duration
+
+	//Buckets of a partition share a key, 0 keeps them all in one
+	Partition time.Duration
+}
+
+var rateResolutions = []rateResolution{
+	{Name: "1m", Step: time.Minute, Partition: 24 * time.Hour},
+	{Name: "1h", Step: time.Hour, Partition: 30 * 24 * time.Hour},
+	{Name: "1d", Step: 24 * time.Hour},
+}
+
+type VoteRatePoint struct {
+	Time  time.Time `json:"time"`
+	Votes int64     `json:"votes"`
+}
+
+type VoteRateSeries struct {
+	PollID     uint            `json:"pollID"`
+	Bucket     string          `json:"bucket"`
+	Resolution string          `json:"resolution"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Total      int64           `json:"total"`
+	Points     []VoteRatePoint `json:"points"`
+}
+
+type VoteRates struct {
+	store common.Store
+
+	//By resolution, 0 keeps the buckets forever
+	retention map[string]time.Duration
+	owner     string
+
+	stop     chan struct{}
+	stopping sync.Once
+	running  sync.WaitGroup
+}
+
+// NewVoteRates only reads the rates, Sweep starts dropping the old ones
+func NewVoteRates(store common.Store, minuteRetention, hourRetention time.Duration) *VoteRates {
+	owner := make([]byte, 8)
+	rand.Read(owner)
+
+	return &VoteRates{
+		store: store,
+		retention: map[string]time.Duration{
+			"1m": minuteRetention,
+			"1h": hourRetention,
+		},
+		owner: hex.EncodeToString(owner),
+		stop:  make(chan struct{}),
+	}
+}
+
+func pollRatePrefix(pollID uint) string {
+	return fmt.Sprintf("%s%d:", VoteRatePrefix, pollID)
+}
+
+func (r rateResolution) key(pollID uint, at time.Time) string {
+	if r.Partition == 0 {
+		return pollRatePrefix(pollID) + r.Name
+	}
+	return fmt.Sprintf("%s%s:%d", pollRatePrefix(pollID), r.Name, at.Truncate(r.Partition).Unix())
+}
+
+func (r rateResolution) field(at time.Time) string {
+	return strconv.FormatInt(at.Truncate(r.Step).Unix(), 10)
+}
+
+// partitions indexes the starts of the partitions of the resolution
+func (r rateResolution) partitions() string {
+	return VoteRatePartitionPrefix + r.Name
+}
+
+// pollsIn indexes the polls with buckets in the partition starting at start
+func (r rateResolution) pollsIn(start uint64) string {
+	return fmt.Sprintf("%s%s:%d", VoteRatePartitionPrefix, r.Name, start)
+}
+
+// partitionedRates are the resolutions whose partitions are indexed
+func partitionedRates() []rateResolution {
+	var partitioned []rateResolution
+	for _, r := range rateResolutions {
+		if r.Partition != 0 {
+			partitioned = append(partitioned, r)
+		}
+	}
+	return partitioned
+}
+
+// eachPartition calls fn with the start of every partition of r, oldest
+// first, until fn reports it is done
+func eachPartition(ctx context.Context, store common.Store, r rateResolution, fn func(start uint64) (bool, error)) error {
+	var after uint64
+	for {
+		starts, err := store.IndexRange(ctx, r.partitions(), after, common.MaxPageLimit)
+		if err != nil || len(starts) == 0 {
+			return err
+		}
+
+		for _, start := range starts {
+			if done, err := fn(start); err != nil || done {
+				return err
+			}
+		}
+		after = starts[len(starts)-1]
+	}
+}
+
+// dropPartition deletes every bucket of a partition along with its index
+// entries, a page of polls at a time
+func dropPartition(ctx context.Context, store common.Store, r rateResolution, start uint64) error {
+	for {
+		polls, err := store.IndexRange(ctx, r.pollsIn(start), 0, common.MaxPageLimit)
+		if err != nil {
+			return err
+		}
+
+		var b common.Batch
+		for _, pollID := range polls {
+			b.Delete(r.key(uint(pollID), time.Unix(int64(start), 0)))
+			b.IndexRemove(r.pollsIn(start), pollID)
+		}
+		if len(polls) < common.MaxPageLimit {
+			b.IndexRemove(r.partitions(), start)
+		}
+		if err := store.Commit(ctx, &b); err != nil || len(polls) < common.MaxPageLimit {
+			return err
+		}
+	}
+}
+
+// voteRatesProjection counts every cast in the buckets of its poll.  Votes
+// stored before the stream have no castAt and are left out.  A replay
+// brings back buckets the sweeper had dropped, until its next pass.
+// Version 2 indexes the partitions; its reset lists the keys, only way to
+// find the buckets stored before the index.
+var voteRatesProjection = &Projection{
+	Name:    "voteRates",
+	Version: 2,
+	Reset: func(ctx context.Context, t *VoteApi) error {
+		for _, r := range partitionedRates() {
+			err := eachPartition(ctx, t.store, r, func(start uint64) (bool, error) {
+				return false, dropPartition(ctx, t.store, r, start)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		keys, err := t.store.Keys(ctx, VoteRatePrefix)
+		if err != nil {
+			return err
+		}
+
+		//The buckets go a page at a time
+		for len(keys) > 0 {
+			page := keys[:min(len(keys), common.MaxPageLimit)]
+			if err := t.holdProjections(ctx); err != nil {
+				return err
+			}
+			if err := t.store.Delete(ctx, page...); err != nil {
+				return err
+			}
+			keys = keys[len(page):]
+		}
+		return nil
+	},
+	Apply: func(b *common.Batch, ev *VoteEvent) {
+		vt := &ev.Vote
+		if ev.Type != VoteEventCast || vt.CastAt == nil {
+			return
+		}
+
+		for _, r := range rateResolutions {
+			b.IncrField(r.key(vt.PollID, *vt.CastAt), r.field(*vt.CastAt), 1)
+			if r.Partition != 0 {
+				start := uint64(vt.CastAt.Truncate(r.Partition).Unix())
+				b.IndexAdd(r.partitions(), start)
+				b.IndexAdd(r.pollsIn(start), uint64(vt.PollID))
+			}
+		}
+	},
+}
+
+//------------------------------------------------------------
+// READING
+//------------------------------------------------------------
+
+// parseSeriesQuery checks the bucket, from and to of a series request.
+// Buckets are whole minutes, 1m, 15m, 1h, 1d...  to defaults to now and
+// from to VoteRateDefaultPoints buckets before it.
+func parseSeriesQuery(bucket, from, to string, now time.Time) (time.Duration, time.Time, time.Time, error) {
+	var step time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(bucket, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		step = time.Duration(n) * 24 * time.Hour
+	} else {
+		step, err = time.ParseDuration(bucket)
+	}
+	if err != nil || step < time.Minute || step%time.Minute != 0 {
+		return 0, time.Time{}, time.Time{}, errors.New("bucket must be a whole number of minutes, e.g. 1m, 1h or 1d")
+	}
+
+	end := now
+	if to != "" {
+		if end, err = time.Parse(time.RFC3339, to); err != nil {
+			return 0, time.Time{}, time.Time{}, errors.New("to must be an RFC3339 time")
+		}
+	}
+
+	start := end.Add(-VoteRateDefaultPoints * step)
+	if from != "" {
+		if start, err = time.Parse(time.RFC3339, from); err != nil {
+			return 0, time.Time{}, time.Time{}, errors.New("from must be an RFC3339 time")
+		}
+	}
+
+	//Buckets start on a multiple of their size, from the first one
+	//holding start
+	start = start.Truncate(step)
+	if !end.After(start) {
+		return 0, time.Time{}, time.Time{}, errors.New("from must be before to")
+	}
+	if (end.Sub(start)+step-1)/step > VoteRateMaxPoints {
+		return 0, time.Time{}, time.Time{}, fmt.Errorf("at most %d buckets fit between from and to", VoteRateMaxPoints)
+	}
+
+	return step, start.UTC(), end.UTC(), nil
+}
+
+// resolution picks the coarsest resolution that divides bucket, the one
+// read the least and kept the longest
+func resolution(bucket time.Duration) rateResolution {
+	var chosen rateResolution
+	for _, r := range rateResolutions {
+		if bucket%r.Step == 0 {
+			chosen = r
+		}
+	}
+	return chosen
+}
+
+// Series returns the votes cast in each bucket between from and to, the
+// ones without a vote included.  from and to come from parseSeriesQuery.
+func (v *VoteRates) Series(ctx context.Context, pollID uint, bucket time.Duration, from, to time.Time) (*VoteRateSeries, error) {
+	r := resolution(bucket)
+
+	points := make([]VoteRatePoint, (to.Sub(from)+bucket-1)/bucket)
+	for i := range points {
+		points[i].Time = from.Add(time.Duration(i) * bucket)
+	}
+
+	keys := []string{r.key(pollID, from)}
+	if r.Partition != 0 {
+		keys = keys[:0]
+		for p := from.Truncate(r.Partition); p.Before(to); p = p.Add(r.Partition) {
+			keys = append(keys, r.key(pollID, p))
+		}
+	}
+
+	series := &VoteRateSeries{
+		PollID:     pollID,
+		Resolution: r.Name,
+		From:       from,
+		To:         to,
+		Points:     points,
+	}
+
+	for _, key := range keys {
+		counters, err := v.store.Counters(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		for field, n := range counters {
+			start, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			at := time.Unix(start, 0)
+			if at.Before(from) || !at.Before(to) {
+				continue
+			}
+			points[at.Sub(from)/bucket].Votes += n
+			series.Total += n
+		}
+	}
+
+	return series, nil
+}
+
+// deletePollRates drops every bucket of the poll, looking for it in each
+// partition still kept
+func deletePollRates(ctx context.Context, store common.Store, pollID uint) error {
+	var b common.Batch
+	for _, r := range rateResolutions {
+		if r.Partition == 0 {
+			b.Delete(r.key(pollID, time.Time{}))
+			continue
+		}
+
+		err := eachPartition(ctx, store, r, func(start uint64) (bool, error) {
+			b.Delete(r.key(pollID, time.Unix(int64(start), 0)))
+			b.IndexRemove(r.pollsIn(start), uint64(pollID))
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.Commit(ctx, &b)
+}
+
+//------------------------------------------------------------
+// RETENTION
+//------------------------------------------------------------
+
+// Sweep starts dropping the partitions past their retention, in the
+// replica holding the lease.  Close stops it.
+func (v *VoteRates) Sweep() {
+	v.running.Add(1)
+	go func() {
+		defer v.running.Done()
+
+		ticker := time.NewTicker(VoteRateSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			ctx := context.Background()
+			held, err := v.store.Lease(ctx, common.LeasePrefix+"voteRates", v.owner, VoteRateSweepLease)
+			if err != nil {
+				slog.Warn("Failed to take the vote rates lease", "error", err)
+			} else if held {
+				if err := v.sweep(ctx); err != nil {
+					slog.Warn("Failed to sweep the vote rates", "error", err)
+				}
+			}
+
+			select {
+			case <-v.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the sweeper
+func (v *VoteRates) Close(ctx context.Context) error {
+	v.stopping.Do(func() { close(v.stop) })
+
+	finished := make(chan struct{})
+	go func() {
+		v.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sweep drops the partitions past their retention, oldest first up to
+// the first one to keep
+func (v *VoteRates) sweep(ctx context.Context) error {
+	now := time.Now()
+
+	for _, r := range partitionedRates() {
+		keep := v.retention[r.Name]
+		if keep == 0 {
+			continue
+		}
+
+		err := eachPartition(ctx, v.store, r, func(start uint64) (bool, error) {
+			if !time.Unix(int64(start), 0).Add(r.Partition).Before(now.Add(-keep)) {
+				return true, nil
+			}
+
+			slog.Debug("Dropping old vote rates", "resolution", r.Name, "partition", start)
+			return false, dropPartition(ctx, v.store, r, start)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
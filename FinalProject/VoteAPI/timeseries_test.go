@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"common"
+)
+
+// castAt counts a cast in the rates as the projection does, at a time a
+// real cast can't have
+func castAt(t *testing.T, api *VoteApi, pollID uint, at time.Time) {
+	t.Helper()
+
+	var b common.Batch
+	voteRatesProjection.Apply(&b, &VoteEvent{Type: VoteEventCast, Vote: Vote{PollID: pollID, CastAt: &at}})
+	if err := api.store.Commit(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ratesOf(t *testing.T, api *VoteApi, r rateResolution, pollID uint, at time.Time) int64 {
+	t.Helper()
+
+	counters, err := api.store.Counters(context.Background(), r.key(pollID, at))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, n := range counters {
+		total += n
+	}
+	return total
+}
+
+func partitionsOf(t *testing.T, api *VoteApi, r rateResolution) []uint64 {
+	t.Helper()
+
+	starts, err := api.store.IndexRange(context.Background(), r.partitions(), 0, common.MaxPageLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return starts
+}
+
+func TestSweepDropsOldPartitions(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+	minutes := rateResolutions[0]
+
+	now := time.Now()
+	old := now.Add(-5 * 24 * time.Hour)
+	castAt(t, api, 1, old)
+	castAt(t, api, 2, old)
+	castAt(t, api, 1, now)
+
+	api.rates.retention["1m"] = 48 * time.Hour
+	if err := api.rates.sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ratesOf(t, api, minutes, 1, old) + ratesOf(t, api, minutes, 2, old); n != 0 {
+		t.Errorf("%d old minute buckets kept", n)
+	}
+	if n := ratesOf(t, api, minutes, 1, now); n != 1 {
+		t.Errorf("recent minutes count %d votes, want 1", n)
+	}
+	if starts := partitionsOf(t, api, minutes); len(starts) != 1 || starts[0] != uint64(now.Truncate(minutes.Partition).Unix()) {
+		t.Errorf("minute partitions %v, want today's only", starts)
+	}
+
+	//Hours are kept longer, days for ever
+	if n := ratesOf(t, api, rateResolutions[1], 2, old); n != 1 {
+		t.Errorf("old hours count %d votes, want 1", n)
+	}
+	if n := ratesOf(t, api, rateResolutions[2], 2, old); n != 1 {
+		t.Errorf("days count %d votes, want 1", n)
+	}
+}
+
+func TestDeletePollRates(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	now := time.Now()
+	castAt(t, api, 1, now.Add(-24*time.Hour))
+	castAt(t, api, 1, now)
+	castAt(t, api, 2, now)
+
+	if err := deletePollRates(ctx, api.store, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range rateResolutions {
+		for _, at := range []time.Time{now.Add(-24 * time.Hour), now} {
+			if n := ratesOf(t, api, r, 1, at); n != 0 {
+				t.Errorf("%s buckets of the deleted poll still count %d votes", r.Name, n)
+			}
+		}
+		if n := ratesOf(t, api, r, 2, now); n != 1 {
+			t.Errorf("%s buckets of the other poll count %d votes, want 1", r.Name, n)
+		}
+
+		if r.Partition == 0 {
+			continue
+		}
+		polls, err := api.store.IndexRange(ctx, r.pollsIn(uint64(now.Truncate(r.Partition).Unix())), 0, common.MaxPageLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(polls) != 1 || polls[0] != 2 {
+			t.Errorf("%s partition lists polls %v, want 2 only", r.Name, polls)
+		}
+	}
+}
+
+func TestResetVoteRates(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	now := time.Now()
+	castAt(t, api, 1, now)
+
+	if err := voteRatesProjection.Reset(ctx, api); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range rateResolutions {
+		if n := ratesOf(t, api, r, 1, now); n != 0 {
+			t.Errorf("%s buckets count %d votes after the reset", r.Name, n)
+		}
+		if r.Partition != 0 && len(partitionsOf(t, api, r)) != 0 {
+			t.Errorf("%s partitions are still indexed", r.Name)
+		}
+	}
+}
@@ -2,235 +2,613 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
 	"github.com/go-resty/resty/v2"
-	"github.com/nitishm/go-rejson/v4"
-	"log"
-	"os"
+	"sync"
+	"time"
+
+	"common"
 )
 
 const (
 	RedisNilError        = "redis: nil"
-	RedisDefaultLocation = "0.0.0.0:6379"
 	RedisKeyPrefix       = "vote:"
 	RedisIDKey           = "voteCnt:"
-	VoterDefaultLocation = "0.0.0.0:2080"
-	PollDefaultLocation  = "0.0.0.0:3080"
+	RedisArchivePrefix   = "voteArchive:"
+	PollSealPrefix       = "votePollSeal:"
+	PollSealTTL          = 30 * time.Second
+	VoteIndex            = "voteIdx:"
+	VoterDefaultLocation = "http://0.0.0.0:2080"
+	PollDefaultLocation  = "http://0.0.0.0:3080"
+
+	//Scope of the routes the other services call to anonymize or archive
+	//votes, it always needs a key
+	VotesAdminScope = "votes:admin"
+)
+
+var (
+	ErrVoteNotFound     = errors.New("vote does not exist")
+	ErrInvalidVoteValue = errors.New("vote value is not an option of the poll")
+	ErrPollClosed       = errors.New("poll is closed for voting")
+	ErrPollSealed       = errors.New("poll is being edited or deleted, try again")
 )
 
 type Vote struct {
-	VoteID    uint `json:"voteID"`
-	VoterID   uint `json:"voterID"`
-	PollID    uint `json:"pollID"`
-	VoteValue uint `json:"voteValue"`
+	VoteID     uint       `json:"voteID"`
+	VoterID    uint       `json:"voterID"`
+	PollID     uint       `json:"pollID"`
+	VoteValue  uint       `json:"voteValue"`
+	Anonymized bool       `json:"anonymized,omitempty"`
+	CastAt     *time.Time `json:"castAt,omitempty"`
+	ChangedAt  *time.Time `json:"changedAt,omitempty"`
 }
 
 type VoteApi struct {
-	cacheClient *redis.Client
-	jsonHelper  *rejson.Handler
-	context     context.Context
-	apiClient   *resty.Client
-	VoterUrl    string
-	PollUrl     string
-	idCnter     uint
+	store     common.Store
+	apiClient *resty.Client
+	VoterUrl  string
+	PollUrl   string
+	outbox    *common.Outbox
+	rates     *VoteRates
+	owner     string
+
+	//Serializes the votes of this replica on the id counter
+	mu sync.Mutex
 }
 
-func NewVoteApi() (*VoteApi, error) {
-	redisUrl := os.Getenv("REDIS_URL")
-	if redisUrl == "" {
-		redisUrl = RedisDefaultLocation
+func NewVoteApi(cfg *Config) (*VoteApi, error) {
+	store, err := common.NewStore(cfg.Config)
+	if err != nil {
+		return &VoteApi{}, err
 	}
 
-	voterUrl := os.Getenv("VOTER_URL")
-	if redisUrl == "" {
-		redisUrl = VoterDefaultLocation
-	}
+	//There is no context kept here, every call passes the context of the
+	//request it serves
+	owner := make([]byte, 8)
+	rand.Read(owner)
+	api := &VoteApi{store: store, owner: hex.EncodeToString(owner)}
+	api.outbox = common.NewOutbox(store, TracerName, cfg.OutboxRetention)
+	api.rates = NewVoteRates(store, cfg.RateMinuteRetention, cfg.RateHourRetention)
 
-	pollUrl := os.Getenv("POLL_URL")
-	if pollUrl == "" {
-		pollUrl = PollDefaultLocation
+	api.apiClient = resty.New()
+	common.InstrumentClient(api.apiClient)
+	common.TraceClient(api.apiClient)
+	common.ForwardRequestID(api.apiClient)
+
+	//When the voter and poll APIs require api keys, VoteAPI authenticates
+	//with a key of its own (voters:read, voters:write and polls:read)
+	if cfg.ServiceApiKey != "" {
+		api.apiClient.SetAuthScheme(common.ApiKeyAuthScheme)
+		api.apiClient.SetAuthToken(cfg.ServiceApiKey)
 	}
-
-	api, err := NewDbWithInstance(redisUrl)
+	api.VoterUrl = cfg.VoterUrl
+	api.PollUrl = cfg.PollUrl
+
+	//Votes cast before the indexes existed are indexed once at startup
+	err = common.RebuildIndex(context.Background(), api.store, VoteIndex, RedisKeyPrefix, func(ctx context.Context, vt *Vote) error {
+		var b common.Batch
+		indexVote(&b, vt)
+		return api.store.Commit(ctx, &b)
+	})
 	if err != nil {
 		return &VoteApi{}, err
 	}
 
-	api.apiClient = resty.New()
-	api.VoterUrl = voterUrl
-	api.PollUrl = pollUrl
+	//-replay is what brings outdated projections up to date
+	if cfg.Replay == "" {
+		if err := api.prepareProjections(context.Background()); err != nil {
+			return &VoteApi{}, err
+		}
+	}
+
+	return api, nil
+}
+
+// In redis, our keys will be strings, they will look like
+// todo:<number>.  This function will take an integer and
+// return a string that can be used as a key in redis
+func redisKeyFromId(id int) string {
+	return fmt.Sprintf("%s%d", RedisKeyPrefix, id)
+}
 
-	itemObject, err := api.jsonHelper.JSONGet(RedisIDKey, ".")
+// Votes are listed through voteIdx:, the pollID and voterID filters use
+// voteIdx:poll:<id> and voteIdx:voter:<id>
+func voteKey(id uint64) string {
+	return redisKeyFromId(int(id))
+}
+
+func votePollIndex(pollID uint) string {
+	return fmt.Sprintf("%spoll:%d", VoteIndex, pollID)
+}
+
+func voteVoterIndex(voterID uint) string {
+	return fmt.Sprintf("%svoter:%d", VoteIndex, voterID)
+}
+
+// A poll is sealed while the PollApi edits or deletes it: it asks whether
+// the poll has votes only once no new vote can be stored, every vote being
+// committed on the condition that the seal didn't change.  Edits seal for
+// PollSealTTL, archiving for good.
+type pollSeal struct {
+	Until    *time.Time `json:"until,omitempty"`
+	Archived bool       `json:"archived,omitempty"`
+}
+
+func pollSealKey(pollID uint) string {
+	return fmt.Sprintf("%s%d", PollSealPrefix, pollID)
+}
+
+func (s *pollSeal) holds() bool {
+	return s != nil && (s.Archived || (s.Until != nil && time.Now().Before(*s.Until)))
+}
+
+// checkSeal fails with ErrPollSealed for a sealed poll, otherwise it makes
+// b depend on the poll staying unsealed
+func (t *VoteApi) checkSeal(ctx context.Context, b *common.Batch, pollID uint) error {
+	docs, err := t.store.GetMany(ctx, []string{pollSealKey(pollID)})
 	if err != nil {
-		// There's no entry for the current number of voter,
-		// assume 0
-		return api, nil
+		return err
 	}
 
-	//JSONGet returns an "any" object, or empty interface,
-	//we need to convert it to a byte array, which is the
-	//underlying type of the object, then we can unmarshal
-	//it into our ToDoItem struct
-	err = json.Unmarshal(itemObject.([]byte), &api.idCnter)
-	if err != nil {
-		return &VoteApi{}, err
+	if docs[0] != nil {
+		var seal pollSeal
+		if err := json.Unmarshal(docs[0], &seal); err != nil {
+			return err
+		}
+		if seal.holds() {
+			return ErrPollSealed
+		}
 	}
 
-	return api, nil
+	b.Unchanged(pollSealKey(pollID), docs[0])
+	return nil
 }
 
-func NewDbWithInstance(location string) (*VoteApi, error) {
+// SealPoll stops new votes for PollSealTTL, or until UnsealPoll, and then
+// tells whether the poll has votes.  The answer holds as long as the seal.
+func (t *VoteApi) SealPoll(ctx context.Context, pollID uint) (bool, error) {
+	err := common.Update(ctx, t.store, pollSealKey(pollID), func(seal *pollSeal, b *common.Batch) error {
+		if seal != nil && seal.Archived {
+			return nil
+		}
+
+		until := time.Now().Add(PollSealTTL)
+		b.Set(pollSealKey(pollID), pollSeal{Until: &until})
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr: location,
+	votes, err := t.store.IndexRange(ctx, votePollIndex(pollID), 0, 1)
+	return len(votes) > 0, err
+}
+
+// UnsealPoll lets votes in again, unless the poll was archived
+func (t *VoteApi) UnsealPoll(ctx context.Context, pollID uint) error {
+	return common.Update(ctx, t.store, pollSealKey(pollID), func(seal *pollSeal, b *common.Batch) error {
+		if seal != nil && !seal.Archived {
+			b.Delete(pollSealKey(pollID))
+		}
+		return nil
 	})
+}
 
-	ctx := context.Background()
+func indexVote(b *common.Batch, vt *Vote) {
+	id := uint64(vt.VoteID)
 
-	err := client.Ping(ctx).Err()
-	if err != nil {
-		log.Println("Error connecting to redis" + err.Error())
-		return nil, err
+	b.IndexAdd(VoteIndex, id)
+	b.IndexAdd(votePollIndex(vt.PollID), id)
+	if !vt.Anonymized {
+		b.IndexAdd(voteVoterIndex(vt.VoterID), id)
 	}
+}
 
-	jsonHelper := rejson.NewReJSONHandler()
-	jsonHelper.SetGoRedisClientWithContext(ctx, client)
+func unindexVote(b *common.Batch, vt *Vote) {
+	id := uint64(vt.VoteID)
 
-	//Return a pointer to a new ToDo struct
-	return &VoteApi{
-			cacheClient: client,
-			jsonHelper:  jsonHelper,
-			context:     ctx,
-		},
-		nil
+	b.IndexRemove(VoteIndex, id)
+	b.IndexRemove(votePollIndex(vt.PollID), id)
+	b.IndexRemove(voteVoterIndex(vt.VoterID), id)
 }
 
-// In redis, our keys will be strings, they will look like
-// todo:<number>.  This function will take an integer and
-// return a string that can be used as a key in redis
-func redisKeyFromId(id int) string {
-	return fmt.Sprintf("%s%d", RedisKeyPrefix, id)
+// voteSubject is what the outbox events of a vote are about: its voter,
+// so that erasing the voter finds the events naming them
+func voteSubject(vt *Vote) string {
+	if vt.Anonymized {
+		return ""
+	}
+	return fmt.Sprint("voter/", vt.VoterID)
 }
 
-func (t *VoteApi) getVoteFromRedis(key string, vote *Vote) error {
+// anonymizeVoteData takes the voter out of the vote an event carries
+func anonymizeVoteData(data json.RawMessage) (json.RawMessage, error) {
+	var vt Vote
+	if err := json.Unmarshal(data, &vt); err != nil {
+		return nil, err
+	}
 
-	//Lets query redis for the item, note we can return parts of the
-	//json structure, the second parameter "." means return the entire
-	//json structure
-	itemObject, err := t.jsonHelper.JSONGet(key, ".")
+	vt.VoterID = 0
+	vt.Anonymized = true
+	return json.Marshal(vt)
+}
+
+// votePoll is the part of a PollApi poll that voting needs
+type votePoll struct {
+	PollOptions []string            `json:"pollOptions"`
+	Eligibility *common.Eligibility `json:"eligibility"`
+	Closed      bool                `json:"closed"`
+}
+
+func (t *VoteApi) getPoll(ctx context.Context, pollID uint) (*votePoll, error) {
+	var poll votePoll
+	pollUrl := fmt.Sprint(t.PollUrl, "/poll/", pollID)
+	resp, err := t.apiClient.R().SetContext(ctx).SetResult(&poll).Get(pollUrl)
 	if err != nil {
-		return err
+		common.LogFrom(ctx).Error("Error when trying to reach poll api", "url", pollUrl, "error", err)
+		return nil, err
 	}
 
-	//JSONGet returns an "any" object, or empty interface,
-	//we need to convert it to a byte array, which is the
-	//underlying type of the object, then we can unmarshal
-	//it into our ToDoItem struct
-	err = json.Unmarshal(itemObject.([]byte), vote)
-	if err != nil {
-		return err
+	if resp.StatusCode() == 404 {
+		return nil, errors.New("The poll you are trying to vote in does not exist!!")
+	} else if resp.IsError() {
+		return nil, fmt.Errorf("poll api returned %s", resp.Status())
 	}
 
-	return nil
+	return &poll, nil
 }
 
-func (t *VoteApi) AddVote(voterID uint, pollID uint, value uint) (*Vote, error) {
-
-	//Before we add an item to the DB, lets make sure
-	//it does not exist, if it does, return an error
-	redisKey := redisKeyFromId(int(t.idCnter + 1))
-	var existingItem Vote
-	if err := t.getVoteFromRedis(redisKey, &existingItem); err == nil {
-		return &Vote{}, errors.New("Vote already exists!")
+// Votes refer to options by position, and only open polls take them
+func (p *votePoll) checkValue(value uint) error {
+	if p.Closed {
+		return ErrPollClosed
 	}
+	if int(value) >= len(p.PollOptions) {
+		return fmt.Errorf("%w: the poll has %d options", ErrInvalidVoteValue, len(p.PollOptions))
+	}
+	return nil
+}
+
+func (t *VoteApi) AddVote(ctx context.Context, voterID uint, pollID uint, value uint) (*Vote, error) {
 
 	// Make sure that the voter exists
+	var voter common.EligibilityVoter
 	voterUrl := fmt.Sprint(t.VoterUrl, "/voter/", voterID)
-	resp, err := t.apiClient.R().Get(voterUrl)
+	resp, err := t.apiClient.R().SetContext(ctx).SetResult(&voter).Get(voterUrl)
 	if err != nil {
-		log.Println("Error when trying to reach voter api: ", voterUrl)
+		common.LogFrom(ctx).Error("Error when trying to reach voter api", "url", voterUrl, "error", err)
 		return &Vote{}, err
 	}
 
 	if resp.StatusCode() == 404 {
 		return &Vote{}, errors.New("The voter submitting a vote does not exist!!")
+	} else if resp.IsError() {
+		return &Vote{}, fmt.Errorf("voter api returned %s", resp.Status())
 	}
 
-	// Make sure that the poll exists
-	pollUrl := fmt.Sprint(t.PollUrl, "/poll/", pollID)
-	resp, err = t.apiClient.R().Get(pollUrl)
+	// Make sure that the poll exists and the value is one of its options
+	poll, err := t.getPoll(ctx, pollID)
 	if err != nil {
-		log.Println("Error when trying to reach poll api: ", pollUrl)
 		return &Vote{}, err
 	}
 
-	if resp.StatusCode() == 404 {
-		return &Vote{}, errors.New("The poll you are trying to vote in does not exist!!")
+	if err := poll.checkValue(value); err != nil {
+		return &Vote{}, err
 	}
 
-	voterNewPollUrl := fmt.Sprint(voterUrl, "/", pollID)
-	resp, err = t.apiClient.R().SetHeader("Content-Type", "application/json").Post(voterNewPollUrl)
+	// Make sure the poll allows this voter to vote
+	if !poll.Eligibility.Admits(&voter) {
+		return &Vote{}, common.ErrNotEligible
+	}
+
+	//From here on the vote is written, a client going away or the server
+	//shutting down must not leave it half done
+	ctx = context.WithoutCancel(ctx)
+
+	//The id is the next value of the counter, taken by a compare-and-set
+	//on it along with the vote, so replicas can't hand out the same one.
+	//The lock keeps the votes of this replica from fighting over it.  The
+	//vote is only stored if the poll isn't sealed by then either.
+	var newVote Vote
+	t.mu.Lock()
+	err = common.Update(ctx, t.store, RedisIDKey, func(last *uint, b *common.Batch) error {
+		if err := t.checkSeal(ctx, b, pollID); err != nil {
+			return err
+		}
+
+		var id uint = 1
+		if last != nil {
+			id = *last + 1
+		}
+
+		//The server's clock, the same time goes in the vote and its event
+		now := time.Now()
+		newVote = Vote{
+			VoteID:    id,
+			VoterID:   voterID,
+			PollID:    pollID,
+			VoteValue: value,
+			CastAt:    &now,
+		}
+
+		//The vote event with its projections, the id counter and the
+		//outbox event are written together, the results can't miss a
+		//stored vote
+		b.Set(RedisIDKey, id)
+		appendVoteEvent(b, &VoteEvent{Type: VoteEventCast, Time: now, Vote: newVote})
+		return t.outbox.RecordAbout(ctx, b, voteSubject(&newVote), "vote.cast", newVote)
+	})
+	t.mu.Unlock()
 	if err != nil {
-		log.Println("Could not connect to voter-api to post new poll history.  url: ", voterNewPollUrl, " err: ", err)
 		return &Vote{}, err
 	}
 
-	newVote := Vote{
-		VoteID:    t.idCnter + 1,
-		VoterID:   voterID,
-		PollID:    pollID,
-		VoteValue: value,
+	//The history only follows a stored vote, if it can't be added the
+	//vote stands
+	voterNewPollUrl := fmt.Sprint(voterUrl, "/", pollID)
+	resp, err = t.apiClient.R().SetContext(ctx).SetHeader("Content-Type", "application/json").Post(voterNewPollUrl)
+	if err == nil && resp.IsError() {
+		err = fmt.Errorf("voter api returned %s", resp.Status())
 	}
-
-	//Add item to database with JSON Set
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", newVote); err != nil {
-		return &Vote{}, err
+	if err != nil {
+		common.LogFrom(ctx).Error("Vote stored without its voter history entry", "url", voterNewPollUrl, "vote_id", newVote.VoteID, "error", err)
 	}
 
-	t.idCnter += 1
+	t.publishResults(ctx, pollID)
 
-	if _, err := t.jsonHelper.JSONSet(RedisIDKey, ".", t.idCnter); err != nil {
-		return &Vote{}, err
-	}
+	votesCast.WithLabelValues(fmt.Sprint(pollID)).Inc()
 
 	//If everything is ok, return nil for the error
 	return &newVote, nil
 }
 
-func (t *VoteApi) GetVote(voteID int) (Vote, error) {
+func (t *VoteApi) GetVote(ctx context.Context, voteID int) (Vote, error) {
 
 	// Check if item exists before trying to get it
 	// this is a good practice, return an error if the
 	// item does not exist
 	var vote Vote
 	pattern := redisKeyFromId(voteID)
-	err := t.getVoteFromRedis(pattern, &vote)
-	if err != nil {
+	err := t.store.Get(ctx, pattern, &vote)
+	if errors.Is(err, common.ErrNotFound) {
+		return Vote{}, ErrVoteNotFound
+	} else if err != nil {
 		return Vote{}, err
 	}
 
 	return vote, nil
 }
 
-func (t *VoteApi) GetAllVotes() ([]Vote, error) {
+// errVoteUnchanged lets the change of updateVote leave the vote as it is
+var errVoteUnchanged = errors.New("vote is unchanged")
+
+// updateVote is a read-modify-write of a vote.  change adds the event of
+// the vote as read to b, which is committed only if the vote is still
+// the same, otherwise change runs again on what it has become.  A vote
+// retracted meanwhile is ErrVoteNotFound, it can't be written back.
+func (t *VoteApi) updateVote(ctx context.Context, voteID uint, change func(vt *Vote, b *common.Batch) error) error {
+	return common.Update(ctx, t.store, redisKeyFromId(int(voteID)), func(vt *Vote, b *common.Batch) error {
+		if vt == nil {
+			return ErrVoteNotFound
+		}
+		return change(vt, b)
+	})
+}
 
-	//Now that we have the DB loaded, lets crate a slice
-	var voteList []Vote
-	var vt Vote
+// ChangeVote moves a vote to another option of its poll, the counters
+// move with it
+func (t *VoteApi) ChangeVote(ctx context.Context, voteID int, value uint) (*Vote, error) {
+	vt, err := t.GetVote(ctx, voteID)
+	if err != nil {
+		return nil, err
+	}
 
-	//Lets query redis for all of the items
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := t.cacheClient.Keys(t.context, pattern).Result()
-	for _, key := range ks {
-		err := t.getVoteFromRedis(key, &vt)
+	//A vote stays in its poll, the poll is checked once up front
+	poll, err := t.getPoll(ctx, vt.PollID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := poll.checkValue(value); err != nil {
+		return nil, err
+	}
+
+	var changed Vote
+	err = t.updateVote(ctx, uint(voteID), func(vt *Vote, b *common.Batch) error {
+		changed = *vt
+		if vt.VoteValue == value {
+			return errVoteUnchanged
+		}
+
+		previous := *vt
+		now := time.Now()
+		changed.VoteValue = value
+		changed.ChangedAt = &now
+
+		appendVoteEvent(b, &VoteEvent{Type: VoteEventChanged, Time: now, Vote: changed, Previous: &previous})
+		return t.outbox.RecordAbout(ctx, b, voteSubject(&changed), "vote.changed", changed)
+	})
+	if errors.Is(err, errVoteUnchanged) {
+		return &changed, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	t.publishResults(ctx, changed.PollID)
+	return &changed, nil
+}
+
+// RetractVote deletes a vote and takes it off the counters.  The voter's
+// history in the VoterAPI still shows they voted in the poll.
+func (t *VoteApi) RetractVote(ctx context.Context, voteID int) error {
+	var retracted Vote
+	err := t.updateVote(ctx, uint(voteID), func(vt *Vote, b *common.Batch) error {
+		retracted = *vt
+
+		appendVoteEvent(b, &VoteEvent{Type: VoteEventRetracted, Vote: retracted})
+		return t.outbox.RecordAbout(ctx, b, voteSubject(&retracted), "vote.retracted", retracted)
+	})
+	if err != nil {
+		return err
+	}
+
+	t.publishResults(ctx, retracted.PollID)
+	return nil
+}
+
+// VoteFilter narrows a listing down to one poll and/or one voter, zero
+// values match everything
+type VoteFilter struct {
+	PollID  uint
+	VoterID uint
+}
+
+func (f VoteFilter) matches(vt *Vote) bool {
+	if f.PollID != 0 && vt.PollID != f.PollID {
+		return false
+	}
+	if f.VoterID != 0 && (vt.Anonymized || vt.VoterID != f.VoterID) {
+		return false
+	}
+	return true
+}
+
+// ListVotes returns a page of votes in id order and the cursor of the
+// next page, 0 on the last one
+func (t *VoteApi) ListVotes(ctx context.Context, filter VoteFilter, page common.Page) ([]Vote, uint64, error) {
+
+	//Walk the narrowest index, the other filter is checked on each vote
+	index := VoteIndex
+	switch {
+	case filter.PollID != 0:
+		index = votePollIndex(filter.PollID)
+	case filter.VoterID != 0:
+		index = voteVoterIndex(filter.VoterID)
+	}
+
+	return common.ListPage(ctx, t.store, index, page, voteKey, filter.matches)
+}
+
+// eachVote calls fn with every vote matching the filter, a page at a time
+func (t *VoteApi) eachVote(ctx context.Context, filter VoteFilter, fn func(vt *Vote) error) error {
+	page := common.Page{Limit: common.MaxPageLimit}
+
+	for {
+		votes, next, err := t.ListVotes(ctx, filter, page)
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		for i := range votes {
+			if err := fn(&votes[i]); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		page.After = next
+	}
+}
+
+// AnonymizeVoter detaches a voter from every vote they cast, used when a
+// voter is erased.  The poll and value are kept so tallies stay correct.
+func (t *VoteApi) AnonymizeVoter(ctx context.Context, voterID uint) (int, error) {
+
+	anonymized := 0
+	err := t.eachVote(ctx, VoteFilter{VoterID: voterID}, func(listed *Vote) error {
+		err := t.updateVote(ctx, listed.VoteID, func(vt *Vote, b *common.Batch) error {
+			if vt.Anonymized || vt.VoterID != voterID {
+				return errVoteUnchanged
+			}
+
+			//The voter is taken out of the earlier events of the vote
+			//too, the stream must not keep what the erasure removes.
+			//Replayed, those events never index the vote under the
+			//voter, so the entry is dropped here rather than by the
+			//projection.
+			if err := t.redactVoteEvents(ctx, b, vt.VoteID); err != nil {
+				return err
+			}
+			b.IndexRemove(voteVoterIndex(vt.VoterID), uint64(vt.VoteID))
+
+			vt.VoterID = 0
+			vt.Anonymized = true
+
+			appendVoteEvent(b, &VoteEvent{Type: VoteEventAnonymous, Vote: *vt})
+			return t.outbox.Record(ctx, b, "vote.anonymized", vt)
+		})
+
+		//Retracted or anonymized since it was listed, nothing left to do
+		if errors.Is(err, errVoteUnchanged) || errors.Is(err, ErrVoteNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		anonymized++
+		return nil
+	})
+	if err != nil {
+		return anonymized, err
+	}
+
+	//The outbox events and webhook deliveries of the votes still name the
+	//voter.  Done last, once no new event can, and again on a retry.
+	return anonymized, t.outbox.Redact(ctx, fmt.Sprint("voter/", voterID), anonymizeVoteData)
+}
+
+// ArchivePollVotes moves the votes of a poll out of the live key space,
+// used when a poll is deleted.  The poll is sealed for good first, so no
+// vote lands once they are listed.
+func (t *VoteApi) ArchivePollVotes(ctx context.Context, pollID uint) (int, error) {
+
+	if err := t.store.Set(ctx, pollSealKey(pollID), pollSeal{Archived: true}); err != nil {
+		return 0, err
+	}
+
+	archived := 0
+	err := t.eachVote(ctx, VoteFilter{PollID: pollID}, func(listed *Vote) error {
+		err := t.updateVote(ctx, listed.VoteID, func(vt *Vote, b *common.Batch) error {
+			appendVoteEvent(b, &VoteEvent{Type: VoteEventArchived, Vote: *vt})
+			return t.outbox.RecordAbout(ctx, b, voteSubject(vt), "vote.archived", vt)
+		})
+
+		//Retracted since it was listed
+		if errors.Is(err, ErrVoteNotFound) {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		voteList = append(voteList, vt)
+		archived++
+		return nil
+	})
+	if err != nil {
+		return archived, err
 	}
 
-	return voteList, nil
+	//The poll is going away, so are its results and its turnout
+	if err := t.store.Delete(ctx, voteCountsKey(pollID)); err != nil {
+		return archived, err
+	}
+	return archived, deletePollRates(ctx, t.store, pollID)
+}
+
+// checkDownstream is the readiness check for the voter and poll APIs,
+// a vote can't be accepted unless both of them are ready
+func (t *VoteApi) checkDownstream(ctx context.Context, baseUrl string) error {
+	resp, err := t.apiClient.R().SetContext(ctx).Get(baseUrl + common.ReadinessPath)
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		return fmt.Errorf("%s", resp.Status())
+	}
+
+	return nil
 }
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"common"
+)
+
+// downstream stands in for the voter and poll APIs: every voter exists and
+// every poll has three options.  onPoll, when set, runs on the next poll
+// lookup, i.e. while a vote change is in flight.  voted counts the votes
+// added to voter histories.
+type downstream struct {
+	*httptest.Server
+	onPoll func()
+	voted  atomic.Int32
+}
+
+func newDownstream(t *testing.T) *downstream {
+	t.Helper()
+
+	d := &downstream{}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/poll/"):
+			if hook := d.onPoll; hook != nil {
+				d.onPoll = nil
+				hook()
+			}
+			w.Write([]byte(`{"pollOptions": ["red", "green", "blue"]}`))
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/voter/"):
+			w.Write([]byte(`{"id": 1, "FirstName": "Ada", "LastName": "Lovelace"}`))
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/voter/"):
+			d.voted.Add(1)
+			w.Write([]byte(`{}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	t.Cleanup(d.Close)
+	return d
+}
+
+func newTestApi(t *testing.T) (*VoteApi, *downstream) {
+	t.Helper()
+
+	d := newDownstream(t)
+	cfg := &Config{
+		Config:   &common.Config{Store: common.StoreMemory, OutboxRetention: time.Hour},
+		VoterUrl: d.URL,
+		PollUrl:  d.URL,
+	}
+
+	api, err := NewVoteApi(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api, d
+}
+
+// commitHook runs hook once, right before the next commit, when the
+// writes of a vote are ready
+type commitHook struct {
+	common.Store
+	hook func()
+}
+
+func (s *commitHook) Commit(ctx context.Context, b *common.Batch) error {
+	if hook := s.hook; hook != nil {
+		s.hook = nil
+		hook()
+	}
+	return s.Store.Commit(ctx, b)
+}
+
+// replicaOf is another VoteAPI on the same store
+func replicaOf(api *VoteApi) *VoteApi {
+	return &VoteApi{
+		store:     api.store,
+		apiClient: api.apiClient,
+		VoterUrl:  api.VoterUrl,
+		PollUrl:   api.PollUrl,
+		outbox:    api.outbox,
+		rates:     api.rates,
+		owner:     "replica",
+	}
+}
+
+func countsOf(t *testing.T, api *VoteApi, pollID uint) map[string]int64 {
+	t.Helper()
+
+	results, err := api.GetResults(context.Background(), pollID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results.Counts
+}
+
+// A retraction landing while a change is in flight wins, the change must
+// not bring the vote back or count it again
+func TestChangeVoteAfterConcurrentRetract(t *testing.T) {
+	ctx := context.Background()
+	api, d := newTestApi(t)
+
+	vt, err := api.AddVote(ctx, 1, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.onPoll = func() {
+		if err := api.RetractVote(ctx, int(vt.VoteID)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := api.ChangeVote(ctx, int(vt.VoteID), 2); !errors.Is(err, ErrVoteNotFound) {
+		t.Errorf("change of a retracted vote: %v, want ErrVoteNotFound", err)
+	}
+	if _, err := api.GetVote(ctx, int(vt.VoteID)); !errors.Is(err, ErrVoteNotFound) {
+		t.Errorf("retracted vote came back: %v", err)
+	}
+	for option, n := range countsOf(t, api, 1) {
+		if n != 0 {
+			t.Errorf("option %s counts %d votes, want none", option, n)
+		}
+	}
+}
+
+func TestChangeAndRetractVoteCounts(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	vt, err := api.AddVote(ctx, 1, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := api.ChangeVote(ctx, int(vt.VoteID), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.VoteValue != 2 || changed.ChangedAt == nil {
+		t.Errorf("changed vote = %+v, want value 2 with changedAt", changed)
+	}
+
+	counts := countsOf(t, api, 1)
+	if counts["0"] != 0 || counts["2"] != 1 {
+		t.Errorf("counts after the change = %v, want one vote for 2", counts)
+	}
+
+	if err := api.RetractVote(ctx, int(vt.VoteID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.RetractVote(ctx, int(vt.VoteID)); !errors.Is(err, ErrVoteNotFound) {
+		t.Errorf("second retraction: %v, want ErrVoteNotFound", err)
+	}
+
+	counts = countsOf(t, api, 1)
+	if counts["2"] != 0 {
+		t.Errorf("counts after the retraction = %v, want none", counts)
+	}
+}
+
+// Anonymizing a voter takes them out of the outbox events of their votes
+// as well as out of the votes
+func TestAnonymizeVoterRedactsEvents(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	vt, err := api.AddVote(ctx, 7, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.ChangeVote(ctx, int(vt.VoteID), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	anonymized, err := api.AnonymizeVoter(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anonymized != 1 {
+		t.Errorf("anonymized %d votes, want 1", anonymized)
+	}
+
+	events, err := api.outbox.Events(ctx, 0, common.MaxPageLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("%d events, want cast, changed and anonymized", len(events))
+	}
+	for _, ev := range events {
+		var data Vote
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.VoterID != 0 {
+			t.Errorf("%s event still names voter %d", ev.Type, data.VoterID)
+		}
+	}
+}
+
+func TestSealedPollTakesNoVotes(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	hasVotes, err := api.SealPoll(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasVotes {
+		t.Error("a poll without votes has votes")
+	}
+
+	if _, err := api.AddVote(ctx, 1, 1, 0); !errors.Is(err, ErrPollSealed) {
+		t.Errorf("vote in a sealed poll: %v, want ErrPollSealed", err)
+	}
+
+	if err := api.UnsealPoll(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.AddVote(ctx, 1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if hasVotes, err = api.SealPoll(ctx, 1); err != nil || !hasVotes {
+		t.Errorf("seal of a poll with a vote: %v, %v, want it to have votes", hasVotes, err)
+	}
+}
+
+// A vote already past its checks when the poll is sealed must not land,
+// the PollApi was told the poll had no votes
+func TestSealStopsVoteInFlight(t *testing.T) {
+	ctx := context.Background()
+	api, d := newTestApi(t)
+
+	var hasVotes bool
+	store := &commitHook{Store: api.store}
+	store.hook = func() {
+		var err error
+		if hasVotes, err = api.SealPoll(ctx, 1); err != nil {
+			t.Error(err)
+		}
+	}
+	api.store = store
+
+	if _, err := api.AddVote(ctx, 1, 1, 0); !errors.Is(err, ErrPollSealed) {
+		t.Errorf("vote sealed out while cast: %v, want ErrPollSealed", err)
+	}
+	if hasVotes {
+		t.Error("the seal saw a vote")
+	}
+	if counts := countsOf(t, api, 1); counts["0"] != 0 {
+		t.Errorf("counts = %v, want no vote", counts)
+	}
+	if n := d.voted.Load(); n != 0 {
+		t.Errorf("%d votes went in the voter history, want none", n)
+	}
+}
+
+// Replicas share the id counter of the store, no vote overwrites another
+func TestReplicasHandOutDistinctIds(t *testing.T) {
+	ctx := context.Background()
+	api, d := newTestApi(t)
+	replicas := []*VoteApi{api, replicaOf(api)}
+
+	const votes = 40
+	ids := make(chan uint, votes)
+	var wg sync.WaitGroup
+	for i := 0; i < votes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vt, err := replicas[i%2].AddVote(ctx, uint(i+1), 1, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- vt.VoteID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[uint]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("vote id %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+	if counts := countsOf(t, api, 1); counts["0"] != votes {
+		t.Errorf("counts = %v, want %d votes", counts, votes)
+	}
+	if n := d.voted.Load(); n != votes {
+		t.Errorf("%d votes went in the voter history, want %d", n, votes)
+	}
+}
+
+func TestArchivedPollStaysSealed(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	if _, err := api.AddVote(ctx, 1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if archived, err := api.ArchivePollVotes(ctx, 1); err != nil || archived != 1 {
+		t.Fatalf("archived %d votes: %v, want 1", archived, err)
+	}
+
+	if err := api.UnsealPoll(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.AddVote(ctx, 1, 1, 0); !errors.Is(err, ErrPollSealed) {
+		t.Errorf("vote in an archived poll: %v, want ErrPollSealed", err)
+	}
+}
+
+// Listing by poll and voter walks a page at a time, an anonymized vote no
+// longer lists under its voter
+func TestListVotesFilters(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	for _, v := range []struct{ voter, poll uint }{{1, 1}, {2, 1}, {3, 1}, {1, 2}, {2, 2}, {3, 3}} {
+		if _, err := api.AddVote(ctx, v.voter, v.poll, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := api.AnonymizeVoter(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(filter VoteFilter) []uint {
+		t.Helper()
+
+		var ids []uint
+		page := common.Page{Limit: 1}
+		for {
+			votes, next, err := api.ListVotes(ctx, filter, page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, vt := range votes {
+				ids = append(ids, vt.VoteID)
+			}
+			if next == 0 {
+				return ids
+			}
+			page.After = next
+		}
+	}
+
+	for _, tc := range []struct {
+		filter VoteFilter
+		want   []uint
+	}{
+		{VoteFilter{}, []uint{1, 2, 3, 4, 5, 6}},
+		{VoteFilter{PollID: 1}, []uint{1, 2, 3}},
+		{VoteFilter{VoterID: 1}, []uint{1, 4}},
+		{VoteFilter{PollID: 2, VoterID: 2}, []uint{5}},
+		{VoteFilter{VoterID: 3}, nil},
+		{VoteFilter{PollID: 9}, nil},
+	} {
+		if got := list(tc.filter); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: votes %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
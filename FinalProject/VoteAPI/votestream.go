@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"common"
+)
+
+// Votes are event sourced.  The source of truth is the append only stream
+// of vote events voteEvent:<seq>, listed in order by voteEventIdx:, and
+// what the API reads, the vote documents and the per poll counters, are
+// projections of it.  Every write appends its event and applies every
+// projection to it in one batch, so the projections never lag behind the
+// stream.
+//
+// A projection can be rebuilt from the stream with -replay.  Each one has
+// a version kept in voteProjection:<name>; when the code of a projection
+// changes its version goes up, and a VoteAPI starting on a store built by
+// an older version refuses to start until it is replayed.  A new
+// projection is backfilled the same way.  Replays rewrite the read models
+// in place, so like -reconcile-results they run while no votes come in.
+// A replay holds the lease lease:voteProjections for its whole duration,
+// a second one fails rather than replay as well.
+//
+// Events are numbered by the commit that stores them, voteEventIdx:poll:
+// <poll id> lists them along, so it is only written by the pollEvents
+// projection on a replay.
+//
+// Events are only ever appended, with one exception: erasing a voter
+// takes them out of the earlier events of their votes as well.  The events
+// of a vote are listed by voteEventIdx:vote:<vote id> for that.
+const (
+	VoteEventPrefix    = "voteEvent:"
+	VoteEventIndex     = "voteEventIdx:"
+	VoteEventSeqKey    = "voteEventSeq:"
+	ProjectionPrefix   = "voteProjection:"
+	ReplayAll          = "all"
+	ProjectionLease    = 30 * time.Second
+	VoteEventCast      = "VoteCast"
+	VoteEventChanged   = "VoteChanged"
+	VoteEventRetracted = "VoteRetracted"
+	VoteEventAnonymous = "VoteAnonymized"
+	VoteEventArchived  = "VoteArchived"
+)
+
+var (
+	ErrUnknownProjection   = errors.New("unknown projection")
+	ErrReplayRunning       = errors.New("another VoteAPI is replaying the vote events")
+	ErrProjectionsOutdated = errors.New("projections need a replay")
+)
+
+// VoteEvent is one change of a vote.  Vote is the vote once changed,
+// Previous what it was before for the events that change an existing
+// vote, so a projection needs nothing but the event.  Seeded events stand
+// for a vote stored before the stream, see seedVoteEvents.
+type VoteEvent struct {
+	Seq      uint64    `json:"seq"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Seeded   bool      `json:"seeded,omitempty"`
+	Vote     Vote      `json:"vote"`
+	Previous *Vote     `json:"previous,omitempty"`
+}
+
+// Projection turns the vote events into a read model.  Reset drops what
+// it has built so far, Apply adds the writes of one event to a batch.
+// Legacy read models were there before the stream, they already hold the
+// events seeded from the stored votes.
+type Projection struct {
+	Name    string
+	Version int
+	Legacy  bool
+	Reset   func(ctx context.Context, t *VoteApi) error
+	Apply   func(b *common.Batch, ev *VoteEvent)
+}
+
+type projectionState struct {
+	Version    int       `json:"version"`
+	ReplayedTo uint64    `json:"replayedTo"`
+	ReplayedAt time.Time `json:"replayedAt"`
+}
+
+var voteProjections = []*Projection{votesProjection, resultsProjection, pollEventsProjection, voteRatesProjection}
+
+func voteEventKey(seq uint64) string {
+	return fmt.Sprintf("%s%d", VoteEventPrefix, seq)
+}
+
+func voteEventsOfVote(voteID uint) string {
+	return fmt.Sprintf("%svote:%d", VoteEventIndex, voteID)
+}
+
+func voteEventsOfPoll(pollID uint) string {
+	return fmt.Sprintf("%spoll:%d", VoteEventIndex, pollID)
+}
+
+func projectionKey(name string) string {
+	return ProjectionPrefix + name
+}
+
+//------------------------------------------------------------
+// WRITING
+//------------------------------------------------------------
+
+// appendVoteEvent adds the event to b along with what every projection
+// makes of it.  The event has no seq until b is committed.
+func appendVoteEvent(b *common.Batch, ev *VoteEvent) {
+	recordVoteEvent(b, ev)
+
+	for _, p := range voteProjections {
+		p.Apply(b, ev)
+	}
+}
+
+func recordVoteEvent(b *common.Batch, ev *VoteEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.SetSequenced(VoteEventSeqKey, VoteEventPrefix, ev,
+		VoteEventIndex, voteEventsOfVote(ev.Vote.VoteID), voteEventsOfPoll(ev.Vote.PollID))
+}
+
+// redactVoteEvents adds to b the removal of the voter from the events of
+// a vote recorded so far
+func (t *VoteApi) redactVoteEvents(ctx context.Context, b *common.Batch, voteID uint) error {
+	page := common.Page{Limit: common.MaxPageLimit}
+
+	for {
+		events, next, err := common.ListPage[VoteEvent](ctx, t.store, voteEventsOfVote(voteID), page, voteEventKey, nil)
+		if err != nil {
+			return err
+		}
+
+		for i := range events {
+			ev := &events[i]
+			ev.Vote.VoterID = 0
+			ev.Vote.Anonymized = true
+			if ev.Previous != nil {
+				ev.Previous.VoterID = 0
+				ev.Previous.Anonymized = true
+			}
+			b.Set(voteEventKey(ev.Seq), ev)
+		}
+
+		if next == 0 {
+			return nil
+		}
+		page.After = next
+	}
+}
+
+//------------------------------------------------------------
+// REPLAY
+//------------------------------------------------------------
+
+// findProjections resolves names, ReplayAll or a comma separated list
+func findProjections(names string) ([]*Projection, error) {
+	if names == ReplayAll {
+		return voteProjections, nil
+	}
+
+	var found []*Projection
+next:
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		for _, p := range voteProjections {
+			if p.Name == name {
+				found = append(found, p)
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("%w %q", ErrUnknownProjection, name)
+	}
+	return found, nil
+}
+
+// holdProjections takes or extends the lease of the replays, it fails
+// with ErrReplayRunning while another VoteAPI holds it
+func (t *VoteApi) holdProjections(ctx context.Context) error {
+	held, err := t.store.Lease(ctx, common.LeasePrefix+"voteProjections", t.owner, ProjectionLease)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return ErrReplayRunning
+	}
+	return nil
+}
+
+// Replay rebuilds the projections from the whole stream and returns the
+// number of events replayed
+func (t *VoteApi) Replay(ctx context.Context, projections []*Projection) (int, error) {
+	if err := t.holdProjections(ctx); err != nil {
+		return 0, err
+	}
+
+	//A store that predates the stream has its votes seeded as the first
+	//events, the legacy projections already hold them
+	states, err := t.projectionStates(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(states) == 0 {
+		last, err := t.seedVoteEvents(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		var legacy []*Projection
+		for _, p := range voteProjections {
+			if p.Legacy {
+				legacy = append(legacy, p)
+			}
+		}
+		if err := t.markReplayed(ctx, legacy, last); err != nil {
+			return 0, err
+		}
+	}
+
+	//A reset isn't undone if the replay stops half way, the projections
+	//are marked unbuilt first so the next start replays them again
+	for _, p := range projections {
+		if err := t.store.Set(ctx, projectionKey(p.Name), projectionState{}); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, p := range projections {
+		if err := p.Reset(ctx, t); err != nil {
+			return 0, fmt.Errorf("resetting %s: %w", p.Name, err)
+		}
+	}
+
+	replayed := 0
+	var last uint64
+	page := common.Page{Limit: common.MaxPageLimit}
+
+	for {
+		events, next, err := common.ListPage[VoteEvent](ctx, t.store, VoteEventIndex, page, voteEventKey, nil)
+		if err != nil {
+			return replayed, err
+		}
+
+		if err := t.holdProjections(ctx); err != nil {
+			return replayed, err
+		}
+
+		//A page of events is applied in one batch
+		var b common.Batch
+		for i := range events {
+			for _, p := range projections {
+				p.Apply(&b, &events[i])
+			}
+			last = events[i].Seq
+		}
+
+		if err := t.store.Commit(ctx, &b); err != nil {
+			return replayed, err
+		}
+		replayed += len(events)
+
+		if next == 0 {
+			break
+		}
+		page.After = next
+	}
+
+	return replayed, t.markReplayed(ctx, projections, last)
+}
+
+// commitReset commits a chunk of a reset and empties b, the lease is
+// extended along so no other replay starts meanwhile
+func (t *VoteApi) commitReset(ctx context.Context, b *common.Batch) error {
+	if err := t.holdProjections(ctx); err != nil {
+		return err
+	}
+	if err := t.store.Commit(ctx, b); err != nil {
+		return err
+	}
+	*b = common.Batch{}
+	return nil
+}
+
+// prepareProjections runs at startup.  Replays rewrite the read models in
+// place, which the VoteAPIs of the older version taking votes meanwhile
+// would undo, so they are left to -replay: a VoteAPI whose projections
+// are missing or built by another version of their code refuses to start.
+// A store with nothing to replay, no votes and no events, is marked built.
+func (t *VoteApi) prepareProjections(ctx context.Context) error {
+	states, err := t.projectionStates(ctx)
+	if err != nil {
+		return err
+	}
+
+	outdated := outdatedProjections(states)
+	if len(outdated) == 0 {
+		return nil
+	}
+
+	for _, index := range []string{VoteEventIndex, VoteIndex} {
+		ids, err := t.store.IndexRange(ctx, index, 0, 1)
+		if err != nil {
+			return err
+		}
+		if len(ids) != 0 {
+			var names []string
+			for _, p := range outdated {
+				names = append(names, p.Name)
+			}
+			list := strings.Join(names, ",")
+			return fmt.Errorf("%w: %s, stop the older VoteAPIs and run vote-api -replay %s", ErrProjectionsOutdated, list, list)
+		}
+	}
+
+	return t.markReplayed(ctx, outdated, 0)
+}
+
+// projectionStates returns the state of the projections built so far
+func (t *VoteApi) projectionStates(ctx context.Context) (map[string]projectionState, error) {
+	states := map[string]projectionState{}
+	for _, p := range voteProjections {
+		var state projectionState
+		err := t.store.Get(ctx, projectionKey(p.Name), &state)
+		if errors.Is(err, common.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		states[p.Name] = state
+	}
+	return states, nil
+}
+
+// outdatedProjections returns the projections missing from states or
+// built by another version
+func outdatedProjections(states map[string]projectionState) []*Projection {
+	var outdated []*Projection
+	for _, p := range voteProjections {
+		if states[p.Name].Version != p.Version {
+			outdated = append(outdated, p)
+		}
+	}
+	return outdated
+}
+
+// seedVoteEvents records a VoteCast for every stored vote and returns the
+// last seq, the projections already hold the votes.  The event is at the
+// time the vote got its current value, ChangedAt or CastAt; its earlier
+// values are lost.  Votes older than CastAt have no time, they are at the
+// time of the seed.
+func (t *VoteApi) seedVoteEvents(ctx context.Context) (uint64, error) {
+	seeded := 0
+	now := time.Now()
+
+	err := t.eachVote(ctx, VoteFilter{}, func(vt *Vote) error {
+		ev := VoteEvent{Type: VoteEventCast, Time: now, Seeded: true, Vote: *vt}
+		if vt.ChangedAt != nil {
+			ev.Time = *vt.ChangedAt
+		} else if vt.CastAt != nil {
+			ev.Time = *vt.CastAt
+		}
+
+		var b common.Batch
+		recordVoteEvent(&b, &ev)
+		if err := t.store.Commit(ctx, &b); err != nil {
+			return err
+		}
+
+		seeded++
+		if seeded%common.MaxPageLimit == 0 {
+			return t.holdProjections(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if seeded > 0 {
+		slog.Info("Seeded the vote events from the stored votes", "votes", seeded)
+	}
+	return t.lastVoteEvent(ctx)
+}
+
+// lastVoteEvent returns the seq of the latest event, 0 for none
+func (t *VoteApi) lastVoteEvent(ctx context.Context) (uint64, error) {
+	var last uint64
+	for {
+		seqs, err := t.store.IndexRange(ctx, VoteEventIndex, last, common.MaxPageLimit)
+		if err != nil || len(seqs) == 0 {
+			return last, err
+		}
+		last = seqs[len(seqs)-1]
+	}
+}
+
+func (t *VoteApi) markReplayed(ctx context.Context, projections []*Projection, last uint64) error {
+	for _, p := range projections {
+		state := projectionState{Version: p.Version, ReplayedTo: last, ReplayedAt: time.Now()}
+		if err := t.store.Set(ctx, projectionKey(p.Name), state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------
+// PROJECTIONS
+//------------------------------------------------------------
+
+// votesProjection keeps vote:<id> and the vote indexes, and moves
+// archived votes to voteArchive:<id>.  Changes write the whole vote, the
+// writers commit them with updateVote so they can't bring back a vote
+// retracted in the meantime.
+var votesProjection = &Projection{
+	Name:    "votes",
+	Version: 1,
+	Legacy:  true,
+	Reset: func(ctx context.Context, t *VoteApi) error {
+		//Archived votes are left alone, the replay writes them again.
+		//The votes are dropped a page at a time, the projection is
+		//marked unbuilt so a reset stopping half way is done again
+		var b common.Batch
+		dropped := 0
+		err := t.eachVote(ctx, VoteFilter{}, func(vt *Vote) error {
+			b.Delete(redisKeyFromId(int(vt.VoteID)))
+			unindexVote(&b, vt)
+
+			dropped++
+			if dropped%common.MaxPageLimit != 0 {
+				return nil
+			}
+			return t.commitReset(ctx, &b)
+		})
+		if err != nil {
+			return err
+		}
+		return t.store.Commit(ctx, &b)
+	},
+	Apply: func(b *common.Batch, ev *VoteEvent) {
+		vt := &ev.Vote
+		key := redisKeyFromId(int(vt.VoteID))
+
+		switch ev.Type {
+		case VoteEventCast:
+			b.Set(key, vt)
+			indexVote(b, vt)
+		case VoteEventChanged, VoteEventAnonymous:
+			b.Set(key, vt)
+		case VoteEventRetracted:
+			b.Delete(key)
+			unindexVote(b, vt)
+		case VoteEventArchived:
+			b.Set(fmt.Sprintf("%s%d", RedisArchivePrefix, vt.VoteID), vt)
+			b.Delete(key)
+			unindexVote(b, vt)
+		}
+	},
+}
+
+// resultsProjection keeps the counters of voteCounts:<poll id>
+var resultsProjection = &Projection{
+	Name:    "results",
+	Version: 1,
+	Legacy:  true,
+	Reset: func(ctx context.Context, t *VoteApi) error {
+		keys, err := t.store.Keys(ctx, RedisCountsPrefix)
+		if err != nil {
+			return err
+		}
+
+		//The counts go back to zero but the versions stay, streams
+		//resuming from an older version must see the recount.  Each
+		//page of polls is zeroed in a batch of its own.
+		var b common.Batch
+		for i, key := range keys {
+			counters, err := t.store.Counters(ctx, key)
+			if err != nil {
+				return err
+			}
+			for field, n := range counters {
+				if field != ResultsVersionField && n != 0 {
+					b.IncrField(key, field, -n)
+				}
+			}
+
+			if (i+1)%common.MaxPageLimit == 0 {
+				if err := t.commitReset(ctx, &b); err != nil {
+					return err
+				}
+			}
+		}
+		return t.store.Commit(ctx, &b)
+	},
+	Apply: func(b *common.Batch, ev *VoteEvent) {
+		switch ev.Type {
+		case VoteEventCast:
+			countVote(b, &ev.Vote, 1)
+		case VoteEventChanged:
+			countVote(b, ev.Previous, -1)
+			countVote(b, &ev.Vote, 1)
+		case VoteEventRetracted, VoteEventArchived:
+			countVote(b, &ev.Vote, -1)
+		}
+	},
+}
+
+// pollEventsProjection lists the events of each poll in
+// voteEventIdx:poll:<poll id>, for results as of a past time.  New events
+// are listed as they are stored, Apply only fills in the index of the
+// events replayed, which have their seq.
+var pollEventsProjection = &Projection{
+	Name:    "pollEvents",
+	Version: 1,
+	Reset: func(ctx context.Context, t *VoteApi) error {
+		//Adding an event to an index twice changes nothing, a replay
+		//only fills in what is missing
+		return nil
+	},
+	Apply: func(b *common.Batch, ev *VoteEvent) {
+		if ev.Seq != 0 {
+			b.IndexAdd(voteEventsOfPoll(ev.Vote.PollID), ev.Seq)
+		}
+	},
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"common"
+)
+
+func indexOf(t *testing.T, api *VoteApi, index string) []uint64 {
+	t.Helper()
+
+	seqs, err := api.store.IndexRange(context.Background(), index, 0, common.MaxPageLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+// A vote that fails to commit takes no number, the events stay numbered
+// without holes and listed by poll as they are stored
+func TestVoteEventsNumberedByCommit(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	if _, err := api.AddVote(ctx, 1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &commitHook{Store: api.store}
+	store.hook = func() {
+		if _, err := api.SealPoll(ctx, 2); err != nil {
+			t.Error(err)
+		}
+	}
+	api.store = store
+	if _, err := api.AddVote(ctx, 2, 2, 0); !errors.Is(err, ErrPollSealed) {
+		t.Fatalf("vote sealed out while cast: %v, want ErrPollSealed", err)
+	}
+
+	if _, err := api.AddVote(ctx, 3, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if seqs := indexOf(t, api, VoteEventIndex); !reflect.DeepEqual(seqs, []uint64{1, 2}) {
+		t.Errorf("events %v, want 1 and 2", seqs)
+	}
+	if seqs := indexOf(t, api, voteEventsOfPoll(1)); !reflect.DeepEqual(seqs, []uint64{1, 2}) {
+		t.Errorf("events of poll 1 %v, want 1 and 2", seqs)
+	}
+	for _, seq := range []uint64{1, 2} {
+		var ev VoteEvent
+		if err := api.store.Get(ctx, voteEventKey(seq), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Seq != seq {
+			t.Errorf("event %d holds seq %d", seq, ev.Seq)
+		}
+	}
+}
+
+func TestReplayRebuildsProjections(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	kept, err := api.AddVote(ctx, 1, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retracted, err := api.AddVote(ctx, 2, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.RetractVote(ctx, int(retracted.VoteID)); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := api.Replay(ctx, voteProjections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 3 {
+		t.Errorf("replayed %d events, want 3", replayed)
+	}
+
+	if _, err := api.GetVote(ctx, int(kept.VoteID)); err != nil {
+		t.Errorf("kept vote: %v", err)
+	}
+	if _, err := api.GetVote(ctx, int(retracted.VoteID)); !errors.Is(err, ErrVoteNotFound) {
+		t.Errorf("retracted vote: %v, want ErrVoteNotFound", err)
+	}
+	if counts := countsOf(t, api, 1); counts["0"] != 1 || counts["1"] != 0 {
+		t.Errorf("counts = %v, want one vote for option 0", counts)
+	}
+	if seqs := indexOf(t, api, voteEventsOfPoll(1)); !reflect.DeepEqual(seqs, []uint64{1, 2, 3}) {
+		t.Errorf("events of poll 1 %v, want 1 to 3", seqs)
+	}
+
+	states, err := api.projectionStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outdatedProjections(states)) != 0 {
+		t.Errorf("states %v after the replay", states)
+	}
+}
+
+// commitCounter counts the commits made through it
+type commitCounter struct {
+	common.Store
+	commits int
+}
+
+func (s *commitCounter) Commit(ctx context.Context, b *common.Batch) error {
+	s.commits++
+	return s.Store.Commit(ctx, b)
+}
+
+// A reset drops the votes a page at a time rather than in one batch
+func TestResetDropsVotesInPages(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	const votes = common.MaxPageLimit + 10
+	var b common.Batch
+	for id := uint(1); id <= votes; id++ {
+		vt := Vote{VoteID: id, VoterID: id, PollID: 1, VoteValue: 0}
+		b.Set(redisKeyFromId(int(id)), vt)
+		indexVote(&b, &vt)
+	}
+	if err := api.store.Commit(ctx, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := &commitCounter{Store: api.store}
+	api.store = counter
+	if err := votesProjection.Reset(ctx, api); err != nil {
+		t.Fatal(err)
+	}
+	if counter.commits != 2 {
+		t.Errorf("reset took %d commits, want 2", counter.commits)
+	}
+
+	if ids := indexOf(t, api, VoteIndex); len(ids) != 0 {
+		t.Errorf("%d votes left indexed", len(ids))
+	}
+	for _, id := range []int{1, common.MaxPageLimit, votes} {
+		if _, err := api.GetVote(ctx, id); !errors.Is(err, ErrVoteNotFound) {
+			t.Errorf("vote %d: %v, want ErrVoteNotFound", id, err)
+		}
+	}
+}
+
+// A VoteAPI doesn't replay at startup, outdated projections keep it from
+// starting until -replay rebuilt them, and only one replay runs at a time
+func TestOutdatedProjectionsNeedReplay(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	if _, err := api.AddVote(ctx, 1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	//An interrupted replay leaves its projections unbuilt
+	if err := api.store.Set(ctx, projectionKey(votesProjection.Name), projectionState{}); err != nil {
+		t.Fatal(err)
+	}
+	err := api.prepareProjections(ctx)
+	if !errors.Is(err, ErrProjectionsOutdated) || !strings.Contains(err.Error(), "-replay votes") {
+		t.Errorf("start with an unbuilt projection: %v, want ErrProjectionsOutdated naming it", err)
+	}
+
+	lease := common.LeasePrefix + "voteProjections"
+	if held, err := api.store.Lease(ctx, lease, "other", time.Minute); err != nil || !held {
+		t.Fatalf("lease: %v, %v", held, err)
+	}
+	if _, err := api.Replay(ctx, []*Projection{votesProjection}); !errors.Is(err, ErrReplayRunning) {
+		t.Errorf("replay under another lease: %v, want ErrReplayRunning", err)
+	}
+
+	if err := api.store.Delete(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Replay(ctx, []*Projection{votesProjection}); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.prepareProjections(ctx); err != nil {
+		t.Errorf("start after the replay: %v", err)
+	}
+}
+
+// A new store has nothing to replay, its projections are built right away
+func TestEmptyStoreNeedsNoReplay(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	var b common.Batch
+	for _, p := range voteProjections {
+		b.Delete(projectionKey(p.Name))
+	}
+	if err := api.store.Commit(ctx, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := api.prepareProjections(ctx); err != nil {
+		t.Fatal(err)
+	}
+	states, err := api.projectionStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outdated := outdatedProjections(states); len(outdated) != 0 {
+		t.Errorf("%d projections left outdated", len(outdated))
+	}
+}
+
+// Votes stored before the stream are seeded at the time they got their
+// value, the results before it aren't made up
+func TestSeededVotesKeepTheirTime(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newTestApi(t)
+
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	var b common.Batch
+	for _, vt := range []Vote{
+		{VoteID: 1, VoterID: 1, PollID: 1, VoteValue: 0, CastAt: at(-3 * time.Hour)},
+		{VoteID: 2, VoterID: 2, PollID: 1, VoteValue: 1, CastAt: at(-3 * time.Hour), ChangedAt: at(-time.Hour)},
+		{VoteID: 3, VoterID: 3, PollID: 2, VoteValue: 2},
+	} {
+		b.Set(redisKeyFromId(int(vt.VoteID)), vt)
+		indexVote(&b, &vt)
+	}
+	for _, p := range voteProjections {
+		b.Delete(projectionKey(p.Name))
+	}
+	if err := api.store.Commit(ctx, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := api.prepareProjections(ctx); !errors.Is(err, ErrProjectionsOutdated) {
+		t.Fatalf("start on a store before the stream: %v, want ErrProjectionsOutdated", err)
+	}
+	if _, err := api.Replay(ctx, voteProjections); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		pollID uint
+		asOf   *time.Time
+		counts map[string]int64
+		err    error
+	}{
+		{1, at(-30 * time.Minute), map[string]int64{"0": 1, "1": 1}, nil},
+		{1, at(-4 * time.Hour), map[string]int64{}, nil},
+		{1, at(-2 * time.Hour), nil, ErrResultsUnknown},
+		{2, at(-time.Minute), nil, ErrResultsUnknown},
+		{2, at(time.Minute), map[string]int64{"2": 1}, nil},
+	} {
+		results, err := api.ResultsAsOf(ctx, tc.pollID, *tc.asOf)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("poll %d as of %s: %v, want %v", tc.pollID, tc.asOf.Sub(now), err, tc.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(results.Counts, tc.counts) {
+			t.Errorf("poll %d as of %s: %v, want %v", tc.pollID, tc.asOf.Sub(now), results.Counts, tc.counts)
+		}
+	}
+}
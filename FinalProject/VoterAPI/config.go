@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"common"
+)
+
+// Configuration of the VoterAPI, the settings every service has are in
+// common/config.go.  TracerName names the service in its logs, traces and
+// usage message.
+const (
+	TracerName  = "voter-api"
+	DefaultPort = 2080
+)
+
+type Config struct {
+	*common.Config
+
+	VoteUrl           string
+	ErasureSigningKey string
+}
+
+func (cfg *Config) Register(fs *flag.FlagSet) []common.ConfigOption {
+	fs.StringVar(&cfg.VoteUrl, "vote-url", VoteDefaultLocation, "Base URL of the vote API")
+
+	//Erasure certificates are signed with this key, erasures are refused
+	//without it
+	fs.StringVar(&cfg.ErasureSigningKey, "erasure-signing-key", "", "HMAC key for erasure certificates")
+
+	return []common.ConfigOption{
+		{Flag: "vote-url", Key: "vote-url", Env: "VOTE_URL"},
+		{Flag: "erasure-signing-key", Key: "erasure-signing-key", Env: "ERASURE_SIGNING_KEY", Secret: true},
+	}
+}
+
+// placeholderKeys are signing keys found in examples, certificates signed
+// with them could be forged by anyone
+var placeholderKeys = []string{"change-me", "changeme", "secret"}
+
+func (cfg *Config) Validate() []error {
+	errs := []error{
+		common.ValidateServiceUrl("vote-url", cfg.VoteUrl),
+	}
+
+	for _, placeholder := range placeholderKeys {
+		if strings.EqualFold(cfg.ErasureSigningKey, placeholder) {
+			errs = append(errs, fmt.Errorf("erasure-signing-key: %q is a placeholder, use a random key", cfg.ErasureSigningKey))
+		}
+	}
+	return errs
+}
+
+// LoadConfig builds the configuration from the defaults, the config file,
+// the environment and the command line arguments, in that order
+func LoadConfig(args []string) (*Config, error) {
+	cfg := &Config{}
+
+	var err error
+	if cfg.Config, err = common.LoadConfig(TracerName, DefaultPort, args, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
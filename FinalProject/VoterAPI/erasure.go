@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"common"
+)
+
+// Right-to-be-forgotten support.  An erasure either deletes the voter or
+// replaces their personal data with a pseudonym, and in both cases asks the
+// VoteAPI to detach the voter from their votes.  The votes themselves stay,
+// so poll tallies do not change.  Each erasure produces a certificate signed
+// with HMAC-SHA256 that is kept in the store for later audits.
+const (
+	ErasureModeDelete       = "delete"
+	ErasureModePseudonymize = "pseudonymize"
+	ErasureCertPrefix       = "erasureCert:"
+	ErasureAlgorithm        = "HMAC-SHA256"
+	ErasedFirstName         = "Erased"
+)
+
+var (
+	ErrErasureDisabled    = errors.New("voter erasure requires ERASURE_SIGNING_KEY")
+	ErrInvalidErasureMode = fmt.Errorf("erasure must be %s or %s", ErasureModeDelete, ErasureModePseudonymize)
+	ErrVoterErased        = errors.New("voter has been erased")
+)
+
+// checkErasureMode is done before anything is erased, so a mistyped mode
+// never gets as far as the VoteAPI
+func checkErasureMode(mode string) error {
+	if mode != ErasureModeDelete && mode != ErasureModePseudonymize {
+		return fmt.Errorf("%w, not %q", ErrInvalidErasureMode, mode)
+	}
+	return nil
+}
+
+// voterSubject is what the events naming a voter are about, see
+// common.Outbox.Redact
+func voterSubject(voterID uint) string {
+	return fmt.Sprint("voter/", voterID)
+}
+
+// forgetPoll takes the poll out of a voter.voted event, which would
+// otherwise tell what the voter took part in
+func forgetPoll(data json.RawMessage) (json.RawMessage, error) {
+	var ev voterEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, err
+	}
+
+	ev.PollID = 0
+	return json.Marshal(ev)
+}
+
+type ErasureCertificate struct {
+	CertificateID   string    `json:"certificateID"`
+	VoterID         uint      `json:"voterID"`
+	Mode            string    `json:"mode"`
+	VotesAnonymized int       `json:"votesAnonymized"`
+	ErasedAt        time.Time `json:"erasedAt"`
+	Algorithm       string    `json:"algorithm"`
+	Signature       string    `json:"signature"`
+}
+
+func erasureCertKey(voterID uint) string {
+	return fmt.Sprintf("%s%d", ErasureCertPrefix, voterID)
+}
+
+// The signature covers the JSON encoding of the certificate with an empty
+// signature field
+func (t *VoterAPI) certificateSignature(cert ErasureCertificate) (string, error) {
+	cert.Signature = ""
+	payload, err := json.Marshal(cert)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, t.erasureKey)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (t *VoterAPI) VerifyErasureCertificate(cert *ErasureCertificate) bool {
+	expected, err := t.certificateSignature(*cert)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(expected), []byte(cert.Signature))
+}
+
+// anonymizeVotes asks the VoteAPI to strip the voter from every vote they
+// cast and returns how many votes were touched
+func (t *VoterAPI) anonymizeVotes(ctx context.Context, voterID uint) (int, error) {
+	type AnonymizeResult struct {
+		VotesAnonymized int `json:"votesAnonymized"`
+	}
+	var result AnonymizeResult
+
+	url := fmt.Sprint(t.VoteUrl, "/vote/voter/", voterID, "/anonymize")
+	resp, err := t.apiClient.R().SetContext(ctx).SetResult(&result).Post(url)
+	if err != nil {
+		common.LogFrom(ctx).Error("Could not connect to vote-api to anonymize votes", "url", url, "error", err)
+		return 0, err
+	}
+
+	if resp.IsError() {
+		return 0, fmt.Errorf("vote-api refused to anonymize votes: %s", resp.Status())
+	}
+
+	return result.VotesAnonymized, nil
+}
+
+// EraseVoter removes the personal data of a voter.  The votes are detached
+// first, so a failure there leaves the voter untouched and the erasure can
+// simply be retried.
+func (t *VoterAPI) EraseVoter(ctx context.Context, id int, mode string) (*ErasureCertificate, error) {
+	if len(t.erasureKey) == 0 {
+		return nil, ErrErasureDisabled
+	}
+
+	if err := checkErasureMode(mode); err != nil {
+		return nil, err
+	}
+
+	voter, err := t.GetVoter(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	//Only the pseudonym of an erased voter is left to delete
+	if voter.Erased && mode != ErasureModeDelete {
+		return nil, ErrVoterErased
+	}
+
+	votesAnonymized, err := t.anonymizeVotes(ctx, voter.VoterID)
+	if err != nil {
+		return nil, err
+	}
+
+	//The votes are detached, finish the erasure even if the client goes
+	//away so the voter isn't left half erased
+	ctx = context.WithoutCancel(ctx)
+
+	event := voterEvent{VoterID: voter.VoterID, Mode: mode}
+	if mode == ErasureModeDelete {
+		err = t.deleteVoter(ctx, id, "voter.erased", event)
+	} else {
+		pseudonym := make([]byte, 8)
+		if _, err := rand.Read(pseudonym); err != nil {
+			return nil, err
+		}
+
+		_, err = t.updateVoter(ctx, voter.VoterID, func(vtr *Voter, b *common.Batch) error {
+			leaveAllGroups(b, vtr)
+			vtr.VoterProfile = VoterProfile{
+				FirstName: ErasedFirstName,
+				LastName:  hex.EncodeToString(pseudonym),
+			}
+			//The polls voted in would tell who the pseudonym is
+			vtr.VoteHistory = []voterPoll{}
+			vtr.Erased = true
+			return nil
+		}, "voter.erased", event)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.outbox.Redact(ctx, voterSubject(voter.VoterID), forgetPoll); err != nil {
+		return nil, err
+	}
+
+	certID := make([]byte, 16)
+	if _, err := rand.Read(certID); err != nil {
+		return nil, err
+	}
+
+	cert := ErasureCertificate{
+		CertificateID:   hex.EncodeToString(certID),
+		VoterID:         voter.VoterID,
+		Mode:            mode,
+		VotesAnonymized: votesAnonymized,
+		ErasedAt:        time.Now().UTC(),
+		Algorithm:       ErasureAlgorithm,
+	}
+
+	cert.Signature, err = t.certificateSignature(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.store.Set(ctx, erasureCertKey(cert.VoterID), cert); err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func (t *VoterAPI) GetErasureCertificate(ctx context.Context, voterID int) (*ErasureCertificate, error) {
+	var cert ErasureCertificate
+	if err := t.store.Get(ctx, erasureCertKey(uint(voterID)), &cert); err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"common"
+)
+
+// newErasureTestApi is a VoterAPI that can erase, its VoteAPI is a stub
+// counting the anonymize calls
+func newErasureTestApi(t *testing.T) (*VoterAPI, *int) {
+	t.Helper()
+
+	anonymized := 0
+	voteApi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		anonymized++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"votesAnonymized": 1}`))
+	}))
+	t.Cleanup(voteApi.Close)
+
+	cfg := &Config{
+		Config:            &common.Config{Store: common.StoreMemory, OutboxRetention: time.Hour},
+		VoteUrl:           voteApi.URL,
+		ErasureSigningKey: "test-key",
+	}
+	api, err := NewVoterApi(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api, &anonymized
+}
+
+func TestEraseVoterRejectsUnknownMode(t *testing.T) {
+	ctx := context.Background()
+	api, anonymized := newErasureTestApi(t)
+
+	vtr, err := api.AddVoter(ctx, VoterProfile{FirstName: "Ada", LastName: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = api.EraseVoter(ctx, int(vtr.VoterID), "forget")
+	if !errors.Is(err, ErrInvalidErasureMode) {
+		t.Fatalf("err = %v, want ErrInvalidErasureMode", err)
+	}
+	if *anonymized != 0 {
+		t.Errorf("the VoteAPI was asked to anonymize %d times, want none", *anonymized)
+	}
+
+	got, err := api.GetVoter(ctx, int(vtr.VoterID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Erased || got.LastName != "Lovelace" {
+		t.Errorf("voter = %+v, want it untouched", got)
+	}
+}
+
+func TestPseudonymizeForgetsVotes(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newErasureTestApi(t)
+
+	vtr, err := api.AddVoter(ctx, VoterProfile{FirstName: "Ada", LastName: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Vote(ctx, int(vtr.VoterID), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := api.EraseVoter(ctx, int(vtr.VoterID), ErasureModePseudonymize); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := api.GetVoter(ctx, int(vtr.VoterID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Erased || len(got.VoteHistory) != 0 {
+		t.Errorf("voter erased = %v with %d votes, want erased with none", got.Erased, len(got.VoteHistory))
+	}
+
+	events, err := api.outbox.Events(ctx, 0, common.MaxPageLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	voted := 0
+	for _, ev := range events {
+		if ev.Type != "voter.voted" {
+			continue
+		}
+		voted++
+
+		var data voterEvent
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.PollID != 0 {
+			t.Errorf("voter.voted still names poll %d", data.PollID)
+		}
+	}
+	if voted != 1 {
+		t.Errorf("%d voter.voted events, want 1", voted)
+	}
+}
+
+// What is left of an erased voter is a pseudonym, nothing can be written
+// to it again
+func TestErasedVoterTakesNoWrites(t *testing.T) {
+	ctx := context.Background()
+	api, _ := newErasureTestApi(t)
+
+	vtr, err := api.AddVoter(ctx, VoterProfile{FirstName: "Ada", LastName: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.AddGroup(ctx, "engineering", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.EraseVoter(ctx, int(vtr.VoterID), ErasureModePseudonymize); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = api.UpdateVoter(ctx, vtr.VoterID, func(v *Voter) {
+		v.FirstName = "Ada"
+		v.Email = "ada@example.com"
+	})
+	if !errors.Is(err, ErrVoterErased) {
+		t.Errorf("update: %v, want ErrVoterErased", err)
+	}
+	if err := api.AddGroupMember(ctx, "engineering", vtr.VoterID); !errors.Is(err, ErrVoterErased) {
+		t.Errorf("group member: %v, want ErrVoterErased", err)
+	}
+	if err := api.Vote(ctx, int(vtr.VoterID), 7); !errors.Is(err, ErrVoterErased) {
+		t.Errorf("vote: %v, want ErrVoterErased", err)
+	}
+	if _, err := api.EraseVoter(ctx, int(vtr.VoterID), ErasureModePseudonymize); !errors.Is(err, ErrVoterErased) {
+		t.Errorf("second pseudonymization: %v, want ErrVoterErased", err)
+	}
+
+	//The email wasn't claimed by the pseudonym
+	if _, err := api.AddVoter(ctx, VoterProfile{FirstName: "Grace", LastName: "Hopper", Email: "ada@example.com"}); err != nil {
+		t.Fatalf("email left claimed: %v", err)
+	}
+
+	got, err := api.GetVoter(ctx, int(vtr.VoterID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != ErasedFirstName || got.Email != "" || len(got.Groups) != 0 {
+		t.Errorf("erased voter is now %+v", got)
+	}
+
+	//Deleting the pseudonym is still possible
+	if _, err := api.EraseVoter(ctx, int(vtr.VoterID), ErasureModeDelete); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigRefusesPlaceholderSigningKey(t *testing.T) {
+	if _, err := LoadConfig([]string{"-erasure-signing-key", "change-me"}); err == nil {
+		t.Error("the placeholder key was taken")
+	}
+	if _, err := LoadConfig([]string{"-erasure-signing-key", "3f9c2a7d41e8b6"}); err != nil {
+		t.Error(err)
+	}
+}
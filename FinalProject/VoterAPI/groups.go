@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"common"
+)
+
+// Voter groups, e.g. "engineering" or "district-5", are used by polls to
+// restrict who may vote.  The group itself lives in voterGroup:<name>, its
+// members in the set voterGroupMembers:<name>, and every voter carries the
+// names of their groups so the VoteAPI can check eligibility from the voter
+// record alone.
+const (
+	RedisGroupPrefix   = "voterGroup:"
+	RedisMembersPrefix = "voterGroupMembers:"
+)
+
+var (
+	ErrGroupExists   = errors.New("group already exists")
+	ErrGroupNotFound = errors.New("group does not exist")
+	ErrVoterNotFound = errors.New("voter does not exist")
+
+	groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+type VoterGroup struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Members     []uint    `json:"members,omitempty"`
+}
+
+func redisGroupKey(name string) string {
+	return RedisGroupPrefix + name
+}
+
+func redisMembersKey(name string) string {
+	return RedisMembersPrefix + name
+}
+
+func memberID(voterID uint) string {
+	return strconv.FormatUint(uint64(voterID), 10)
+}
+
+func (t *VoterAPI) getGroup(ctx context.Context, name string) (*VoterGroup, error) {
+	var group VoterGroup
+	if err := t.store.Get(ctx, redisGroupKey(name), &group); err != nil {
+		if errors.Is(err, common.ErrNotFound) {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (t *VoterAPI) AddGroup(ctx context.Context, name string, description string) (*VoterGroup, error) {
+	if !groupNamePattern.MatchString(name) {
+		return nil, &ValidationError{Fields: []FieldError{{
+			Field:   "name",
+			Message: "must be lower case letters, digits, - or _ and at most 64 characters",
+		}}}
+	}
+
+	group := VoterGroup{
+		Name:        name,
+		Description: description,
+		CreatedAt:   time.Now(),
+	}
+
+	//NX so that two concurrent creates can't overwrite each other
+	created, err := t.store.SetNX(ctx, redisGroupKey(name), group)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrGroupExists
+	}
+
+	//A batch has no NX, so the event follows in a batch of its own and
+	//the group is taken back if that fails
+	var b common.Batch
+	err = t.outbox.Record(ctx, &b, "group.created", voterEvent{Group: name})
+	if err == nil {
+		err = t.store.Commit(ctx, &b)
+	}
+	if err != nil {
+		if err := t.store.Delete(ctx, redisGroupKey(name)); err != nil {
+			common.LogFrom(ctx).Warn("Failed to take back the group", "group", name, "error", err)
+		}
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// GetGroup returns the group along with the ids of its members
+func (t *VoterAPI) GetGroup(ctx context.Context, name string) (*VoterGroup, error) {
+	group, err := t.getGroup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := t.store.Members(ctx, redisMembersKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range members {
+		id, err := strconv.ParseUint(m, 10, 32)
+		if err != nil {
+			continue
+		}
+		group.Members = append(group.Members, uint(id))
+	}
+	sort.Slice(group.Members, func(i, j int) bool { return group.Members[i] < group.Members[j] })
+
+	return group, nil
+}
+
+func (t *VoterAPI) GetAllGroups(ctx context.Context) ([]VoterGroup, error) {
+	groupList := []VoterGroup{}
+
+	ks, err := t.store.Keys(ctx, RedisGroupPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := common.GetMany[VoterGroup](ctx, t.store, ks)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		if group != nil {
+			groupList = append(groupList, *group)
+		}
+	}
+
+	sort.Slice(groupList, func(i, j int) bool { return groupList[i].Name < groupList[j].Name })
+	return groupList, nil
+}
+
+// DeleteGroup removes the group and takes it off every member
+func (t *VoterAPI) DeleteGroup(ctx context.Context, name string) error {
+	group, err := t.GetGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range group.Members {
+		if err := t.RemoveGroupMember(ctx, name, id); err != nil && !errors.Is(err, ErrVoterNotFound) {
+			return err
+		}
+	}
+
+	var b common.Batch
+	b.Delete(redisGroupKey(name))
+	b.Delete(redisMembersKey(name))
+
+	if err := t.outbox.Record(ctx, &b, "group.deleted", voterEvent{Group: name}); err != nil {
+		return err
+	}
+
+	return t.store.Commit(ctx, &b)
+}
+
+func (t *VoterAPI) AddGroupMember(ctx context.Context, name string, voterID uint) error {
+	if _, err := t.getGroup(ctx, name); err != nil {
+		return err
+	}
+
+	_, err := t.updateVoter(ctx, voterID, func(vtr *Voter, b *common.Batch) error {
+		for _, g := range vtr.Groups {
+			if g == name {
+				return errUnchanged
+			}
+		}
+
+		vtr.Groups = append(vtr.Groups, name)
+		sort.Strings(vtr.Groups)
+		b.AddMember(redisMembersKey(name), memberID(voterID))
+		return nil
+	}, "group.member_added", voterEvent{VoterID: voterID, Group: name})
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+func (t *VoterAPI) RemoveGroupMember(ctx context.Context, name string, voterID uint) error {
+	_, err := t.updateVoter(ctx, voterID, func(vtr *Voter, b *common.Batch) error {
+		groups := []string{}
+		for _, g := range vtr.Groups {
+			if g != name {
+				groups = append(groups, g)
+			}
+		}
+
+		if len(groups) == len(vtr.Groups) {
+			return errUnchanged
+		}
+
+		vtr.Groups = groups
+		b.RemoveMember(redisMembersKey(name), memberID(voterID))
+		return nil
+	}, "group.member_removed", voterEvent{VoterID: voterID, Group: name})
+
+	//The member set may still hold a voter that is gone, or that left the
+	//group without the set being updated
+	if errors.Is(err, errUnchanged) || errors.Is(err, ErrVoterNotFound) {
+		if err := t.store.RemoveMember(ctx, redisMembersKey(name), memberID(voterID)); err != nil {
+			return err
+		}
+	}
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+// leaveAllGroups adds the removal of the voter from the member sets of
+// their groups to b, used when the voter is deleted or erased
+func leaveAllGroups(b *common.Batch, voter *Voter) {
+	for _, g := range voter.Groups {
+		b.RemoveMember(redisMembersKey(g), memberID(voter.VoterID))
+	}
+	voter.Groups = nil
+}
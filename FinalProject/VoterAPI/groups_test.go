@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"common"
+)
+
+// The groups of a voter and the member set of a group are kept in step, so
+// the VoteAPI can tell eligibility from the voter alone
+func TestGroupMembership(t *testing.T) {
+	ctx := context.Background()
+	api := newTestApi(t)
+
+	ada, err := api.AddVoter(ctx, VoterProfile{FirstName: "Ada", LastName: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alan, err := api.AddVoter(ctx, VoterProfile{FirstName: "Alan", LastName: "Turing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"engineering", "district-5"} {
+		if _, err := api.AddGroup(ctx, name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Joining twice changes nothing
+	for _, m := range []struct {
+		group string
+		voter uint
+	}{
+		{"engineering", ada.VoterID},
+		{"engineering", ada.VoterID},
+		{"district-5", ada.VoterID},
+		{"engineering", alan.VoterID},
+	} {
+		if err := api.AddGroupMember(ctx, m.group, m.voter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	group, err := api.GetGroup(ctx, "engineering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{ada.VoterID, alan.VoterID}; !reflect.DeepEqual(group.Members, want) {
+		t.Errorf("members = %v, want %v", group.Members, want)
+	}
+	if got := groupsOf(t, api, ada.VoterID); !reflect.DeepEqual(got, []string{"district-5", "engineering"}) {
+		t.Errorf("groups of ada = %v", got)
+	}
+
+	members, _, err := api.ListVoters(ctx, "district-5", common.Page{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].VoterID != ada.VoterID {
+		t.Errorf("voters of district-5 = %v, want ada", members)
+	}
+
+	if err := api.RemoveGroupMember(ctx, "engineering", ada.VoterID); err != nil {
+		t.Fatal(err)
+	}
+	if got := groupsOf(t, api, ada.VoterID); !reflect.DeepEqual(got, []string{"district-5"}) {
+		t.Errorf("groups of ada after leaving = %v", got)
+	}
+
+	//A deleted group is taken off its members
+	if err := api.DeleteGroup(ctx, "engineering"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.GetGroup(ctx, "engineering"); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("deleted group: %v, want ErrGroupNotFound", err)
+	}
+	if got := groupsOf(t, api, alan.VoterID); len(got) != 0 {
+		t.Errorf("groups of alan after the delete = %v", got)
+	}
+}
+
+func TestGroupErrors(t *testing.T) {
+	ctx := context.Background()
+	api := newTestApi(t)
+
+	if _, err := api.AddGroup(ctx, "Engineering!", ""); !errors.As(err, new(*ValidationError)) {
+		t.Errorf("invalid name: %v, want a ValidationError", err)
+	}
+	if _, err := api.AddGroup(ctx, "engineering", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.AddGroup(ctx, "engineering", ""); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("second create: %v, want ErrGroupExists", err)
+	}
+	if err := api.AddGroupMember(ctx, "sales", 1); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("join a missing group: %v, want ErrGroupNotFound", err)
+	}
+	if err := api.AddGroupMember(ctx, "engineering", 42); !errors.Is(err, ErrVoterNotFound) {
+		t.Errorf("missing voter joins: %v, want ErrVoterNotFound", err)
+	}
+}
+
+func groupsOf(t *testing.T, api *VoterAPI, id uint) []string {
+	t.Helper()
+
+	vtr, err := api.GetVoter(context.Background(), int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vtr.Groups
+}
@@ -1,7 +1,7 @@
 
-curl -d '{ "FirstName": "Steven", "LastName": "Portley"}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
-curl -d '{ "FirstName": "ABCD", "LastName": "Portley"}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
-curl -d '{ "FirstName": "EFGH", "LastName": "Portley"}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
+curl -d '{ "FirstName": "Steven", "LastName": "Portley", "Email": "steven@example.com", "DateOfBirth": "1990-04-12", "District": "district-5"}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
+curl -d '{ "FirstName": "ABCD", "LastName": "Portley", "Email": "abcd@example.com", "Address": { "Street": "1 Main St", "City": "Philadelphia", "PostalCode": "19104", "Country": "US" }}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
+curl -d '{ "FirstName": "EFGH", "LastName": "Portley", "District": "district-5", "Attributes": { "team": "engineering" }}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
 curl -d '{ "FirstName": "IJKL", "LastName": "Portley"}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
 curl -d '{ "FirstName": "MNOP", "LastName": "Portley"}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
 curl -d '{ "FirstName": "QRST", "LastName": "Portley"}' -H "Content-Type: application/json" -X POST http://localhost:2080/voter
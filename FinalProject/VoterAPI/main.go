@@ -1,137 +1,555 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"log"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
-)
 
-var (
-	hostFlag string
-	portFlag uint
+	"common"
 )
 
-func processCmdLineFlags() {
+func main() {
+	cfg, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
 
-	//Note some networking lingo, some frameworks start the server on localhost
-	//this is a local-only interface and is fine for testing but its not accessible
-	//from other machines.  To make the server accessible from other machines, we
-	//need to listen on an interface, that could be an IP address, but modern
-	//cloud servers may have multiple network interfaces for scale.  With TCP/IP
-	//the address 0.0.0.0 instructs the network stack to listen on all interfaces
-	//We set this up as a flag so that we can overwrite it on the command line if
-	//needed
-	flag.StringVar(&hostFlag, "h", "0.0.0.0", "Listen on all interfaces")
-	flag.UintVar(&portFlag, "p", 2080, "Default Port")
+	if cfg.PrintConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
 
-	flag.Parse()
-}
+	common.InitLogging(TracerName, cfg.LogLevel)
 
-func main() {
-	processCmdLineFlags()
+	shutdownTracing, err := common.InitTracing(TracerName, cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		return
+	}
 
-	api, err := NewVoterApi()
+	api, err := NewVoterApi(cfg)
 
 	if err != nil {
-		log.Println("Failed to initialize the API... ", err)
+		slog.Error("Failed to initialize the API", "error", err)
 		return
 	}
 
-	r := gin.Default()
+	keys := common.NewApiKeyStore(api.store, cfg.AdminApiKey, cfg.ApiKeysRequired)
+	hooks := common.NewWebhooks(api.store, cfg.Config)
+	api.outbox.Relay(hooks)
+
+	health := common.NewHealth()
+	health.AddCheck(cfg.Store, func(ctx context.Context) error {
+		return api.store.Ping(ctx)
+	})
+
+	r := gin.New()
+	r.Use(otelgin.Middleware(TracerName))
+	r.Use(common.RequestLogMiddleware())
+	r.Use(common.RecoveryMiddleware())
+	r.Use(cfg.Timeouts.Middleware())
+	r.Use(common.MetricsMiddleware())
+	r.Use(health.Middleware())
+	r.Use(keys.Middleware())
+
+	health.Register(r, "/voter/health")
+	common.RegisterMetricsRoute(r)
 
-	r.GET("/voter", func(c *gin.Context) {
-		voters, err := api.GetAllVoters()
+	common.RegisterApiKeyRoutes(r, keys)
+	common.RegisterWebhookRoutes(r, keys, hooks)
+	common.RegisterEventRoutes(r, keys, api.outbox)
+	common.RegisterLogLevelRoute(r, keys)
+
+	r.GET("/voter", keys.RequireScope("voters:read"), func(c *gin.Context) {
+		page, err := common.PageFromQuery(c)
 		if err != nil {
-			log.Println("Failed to fetch all of the voters!", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		voters, next, err := api.ListVoters(c.Request.Context(), c.Query("group"), page)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to fetch all of the voters", "error", err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		c.JSON(http.StatusOK, voters)
+		//Keys narrowed to single voters (voters:read:voter/3) only see those
+		visible := []Voter{}
+		for _, vtr := range voters {
+			if common.ApiKeyAllows(c, "voters:read", fmt.Sprint("voter/", vtr.VoterID)) {
+				visible = append(visible, vtr)
+			}
+		}
+
+		common.SetNextLink(c, next)
+		c.JSON(http.StatusOK, visible)
 		return
 	})
 
-	r.POST("/voter", func(c *gin.Context) {
-
-		type Voter struct {
-			FirstName string `json:"FirstName"`
-			LastName  string `json:"LastName"`
+	r.POST("/voter", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		if !common.ApiKeyHolds(c, "voters:write") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
 		}
 
-		var voter Voter
+		var profile VoterProfile
 
-		err := c.ShouldBindJSON(&voter)
+		err := c.ShouldBindJSON(&profile)
 		if err != nil {
-			log.Println("Cannot fetch JSON body from voter POST", err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from voter POST", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		newVoter, err := api.AddVoter(voter.FirstName, voter.LastName)
+		newVoter, err := api.AddVoter(c.Request.Context(), profile)
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			abortVoterWrite(c, err)
 		} else {
 			c.JSON(http.StatusOK, newVoter)
 		}
 	})
 
-	r.GET("/voter/:id", func(c *gin.Context) {
+	r.GET("/voter/:id", keys.RequireScope("voters:read"), func(c *gin.Context) {
 		id := c.Param("id")
 		id64, err := strconv.ParseUint(id, 10, 32)
 		if err != nil {
-			log.Println("Error converting id to int64: ", err)
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		vtr, err := api.GetVoter(int(id64))
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:read", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		vtr, err := api.GetVoter(c.Request.Context(), int(id64))
 		if err != nil {
-			log.Println("Failed to fetch a voter from the DB!")
+			common.LogFrom(c.Request.Context()).Warn("Failed to fetch a voter from the DB", "error", err)
 			c.AbortWithStatus(http.StatusNotFound)
 		} else {
 			c.JSON(http.StatusOK, *vtr)
 		}
 	})
 
-	r.POST("/voter/:id/:pollid", func(c *gin.Context) {
+	r.PUT("/voter/:id", keys.RequireScope("voters:write"), func(c *gin.Context) {
 		id := c.Param("id")
 		id64, err := strconv.ParseUint(id, 10, 32)
 		if err != nil {
-			log.Println("Error converting id to int64: ", err)
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		pid := c.Param("pollid")
-		pid64, err := strconv.ParseUint(pid, 10, 32)
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:write", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		var profile VoterProfile
+
+		err = c.ShouldBindJSON(&profile)
 		if err != nil {
-			log.Println("Error converting id to int64: ", err)
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from voter PUT", "error", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		err = api.Vote(int(id64), uint(pid64))
+		//The vote history is owned by the voting process, a PUT only
+		//replaces the fields a client is allowed to set
+		vtr, err := api.UpdateVoter(c.Request.Context(), uint(id64), func(vtr *Voter) {
+			vtr.VoterProfile = profile
+		})
 		if err != nil {
+			abortVoterWrite(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, *vtr)
+	})
+
+	r.PATCH("/voter/:id", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:write", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		//Pointers tell us which fields were present in the body
+		type VoterPatch struct {
+			FirstName   *string            `json:"FirstName"`
+			LastName    *string            `json:"LastName"`
+			Email       *string            `json:"Email"`
+			DateOfBirth *string            `json:"DateOfBirth"`
+			Address     *Address           `json:"Address"`
+			District    *string            `json:"District"`
+			Attributes  *map[string]string `json:"Attributes"`
+		}
+
+		var patch VoterPatch
+
+		err = c.ShouldBindJSON(&patch)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from voter PATCH", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		vtr, err := api.UpdateVoter(c.Request.Context(), uint(id64), func(vtr *Voter) {
+			if patch.FirstName != nil {
+				vtr.FirstName = *patch.FirstName
+			}
+			if patch.LastName != nil {
+				vtr.LastName = *patch.LastName
+			}
+			if patch.Email != nil {
+				vtr.Email = *patch.Email
+			}
+			if patch.DateOfBirth != nil {
+				vtr.DateOfBirth = *patch.DateOfBirth
+			}
+			if patch.Address != nil {
+				vtr.Address = patch.Address
+			}
+			if patch.District != nil {
+				vtr.District = *patch.District
+			}
+			if patch.Attributes != nil {
+				vtr.Attributes = *patch.Attributes
+			}
+		})
+		if err != nil {
+			abortVoterWrite(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, *vtr)
+	})
+
+	// DELETE /voter/:id removes the voter record.  With ?erasure=delete or
+	// ?erasure=pseudonymize it becomes a right-to-be-forgotten request that
+	// also detaches the voter from their votes and returns a certificate.
+	r.DELETE("/voter/:id", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:write", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		mode := c.Query("erasure")
+		if mode == "" {
+			if err := api.DeleteVoter(c.Request.Context(), int(id64)); err != nil {
+				c.AbortWithStatus(http.StatusNotFound)
+				return
+			}
+
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		if err := checkErasureMode(mode); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, err := api.GetVoter(c.Request.Context(), int(id64)); err != nil {
 			c.AbortWithStatus(http.StatusNotFound)
+			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{})
+		cert, err := api.EraseVoter(c.Request.Context(), int(id64), mode)
+		if errors.Is(err, ErrErasureDisabled) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, ErrVoterErased) {
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to erase voter", "mode", mode, "error", err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, cert)
 	})
 
-	// Hardcoded health status
-	r.GET("/voter/health", func(c *gin.Context) {
+	r.GET("/voter/:id/erasure-certificate", keys.RequireScope("voters:read"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:read", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		cert, err := api.GetErasureCertificate(c.Request.Context(), int(id64))
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{
-			"status":             "ok",
-			"version":            "1.0.0",
-			"uptime":             100,
-			"users_processed":    1000,
-			"errors_encountered": 10,
+			"certificate": cert,
+			"verified":    api.VerifyErasureCertificate(cert),
 		})
 	})
 
-	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
-	r.Run(serverPath)
+	r.POST("/voter/:id/:pollid", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:write", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		pid := c.Param("pollid")
+		pid64, err := strconv.ParseUint(pid, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting poll id to int64", "poll_id", pid, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		logger := common.LogWith(c, "poll_id", pid64)
+
+		err = api.Vote(c.Request.Context(), int(id64), uint(pid64))
+		if errors.Is(err, ErrVoterNotFound) {
+			logger.Warn("Failed to record the vote in the voter history", "error", err)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrVoterErased) {
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to record the vote in the voter history", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	//Groups span voters, a key narrowed to some voters can't touch them
+	r.POST("/group", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		if !common.ApiKeyHolds(c, "voters:write") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		type Group struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		var group Group
+
+		if err := c.ShouldBindJSON(&group); err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from group POST", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		newGroup, err := api.AddGroup(c.Request.Context(), group.Name, group.Description)
+		if err != nil {
+			abortGroupChange(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, newGroup)
+	})
+
+	r.GET("/group", keys.RequireScope("voters:read"), func(c *gin.Context) {
+		if !common.ApiKeyHolds(c, "voters:read") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		groups, err := api.GetAllGroups(c.Request.Context())
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Error("Failed to fetch all of the groups", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, groups)
+	})
+
+	r.GET("/group/:name", keys.RequireScope("voters:read"), func(c *gin.Context) {
+		if !common.ApiKeyHolds(c, "voters:read") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		group, err := api.GetGroup(c.Request.Context(), c.Param("name"))
+		if err != nil {
+			abortGroupChange(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, group)
+	})
+
+	r.DELETE("/group/:name", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		if !common.ApiKeyHolds(c, "voters:write") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if err := api.DeleteGroup(c.Request.Context(), c.Param("name")); err != nil {
+			abortGroupChange(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	r.PUT("/group/:name/members/:id", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:write", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if err := api.AddGroupMember(c.Request.Context(), c.Param("name"), uint(id64)); err != nil {
+			abortGroupChange(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	r.DELETE("/group/:name/members/:id", keys.RequireScope("voters:write"), func(c *gin.Context) {
+		id := c.Param("id")
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			common.LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", id, "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		common.LogWith(c, "voter_id", id64)
+
+		if !common.ApiKeyAllows(c, "voters:write", fmt.Sprint("voter/", id64)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if err := api.RemoveGroupMember(c.Request.Context(), c.Param("name"), uint(id64)); err != nil {
+			abortGroupChange(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	serverPath := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	server := common.NewServer(serverPath, r, health, cfg.DrainDelay, cfg.DrainTimeout)
+	server.OnShutdown("tracing", shutdownTracing)
+	server.OnShutdown(cfg.Store, func(context.Context) error {
+		return api.store.Close()
+	})
+	server.OnShutdown("webhooks", hooks.Close)
+	server.OnShutdown("outbox", api.outbox.Close)
+
+	if err := server.Run(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// abortVoterWrite maps the errors of AddVoter and UpdateVoter to responses,
+// validation problems are reported field by field
+func abortVoterWrite(c *gin.Context, err error) {
+	var verr *ValidationError
+
+	switch {
+	case errors.As(err, &verr):
+		c.AbortWithStatusJSON(http.StatusBadRequest, verr)
+	case errors.Is(err, ErrEmailTaken):
+		c.AbortWithStatusJSON(http.StatusConflict, ValidationError{
+			Fields: []FieldError{{Field: "Email", Message: "is already registered"}},
+		})
+	case errors.Is(err, ErrVoterNotFound):
+		c.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, ErrVoterErased):
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		common.LogFrom(c.Request.Context()).Error("Failed to save voter", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
+func abortGroupChange(c *gin.Context, err error) {
+	var verr *ValidationError
+
+	switch {
+	case errors.As(err, &verr):
+		c.AbortWithStatusJSON(http.StatusBadRequest, verr)
+	case errors.Is(err, ErrGroupNotFound), errors.Is(err, ErrVoterNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrGroupExists):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrVoterErased):
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		common.LogFrom(c.Request.Context()).Error("Failed to change group", "group", c.Param("name"), "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,16 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Business metrics of the service, served on /metrics next to the http,
+// redis and outbound metrics of common/metrics.go
+var (
+	votersRegistered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "voters_registered_total",
+		Help: "Voters registered since the service started.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(votersRegistered)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DateOfBirthLayout = "2006-01-02"
+	MaxNameLength     = 100
+	MaxDistrictLength = 64
+	MaxAttributes     = 32
+	MaxAttributeKey   = 64
+	MaxAttributeValue = 256
+	MaxVoterAge       = 150
+)
+
+var (
+	postalCodePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 -]{1,10}[A-Za-z0-9]$`)
+	countryPattern    = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a request, so clients can
+// fix them all in one go instead of one per round trip
+type ValidationError struct {
+	Fields []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+" "+f.Message)
+	}
+	return "invalid voter: " + strings.Join(msgs, ", ")
+}
+
+func (e *ValidationError) add(field string, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// normalizeProfile trims the text fields and lower cases the email, so
+// the stored values and the email index agree with each other
+func normalizeProfile(p *VoterProfile) {
+	p.FirstName = strings.TrimSpace(p.FirstName)
+	p.LastName = strings.TrimSpace(p.LastName)
+	p.Email = strings.ToLower(strings.TrimSpace(p.Email))
+	p.DateOfBirth = strings.TrimSpace(p.DateOfBirth)
+	p.District = strings.TrimSpace(p.District)
+
+	if p.Address != nil {
+		p.Address.Street = strings.TrimSpace(p.Address.Street)
+		p.Address.City = strings.TrimSpace(p.Address.City)
+		p.Address.PostalCode = strings.TrimSpace(p.Address.PostalCode)
+		p.Address.Country = strings.ToUpper(strings.TrimSpace(p.Address.Country))
+	}
+}
+
+// validateProfile normalizes the profile and returns a *ValidationError
+// listing every field that is wrong with it
+func validateProfile(p *VoterProfile) error {
+	normalizeProfile(p)
+
+	verr := &ValidationError{}
+
+	checkName := func(field string, value string) {
+		switch {
+		case value == "":
+			verr.add(field, "is required")
+		case len(value) > MaxNameLength:
+			verr.add(field, "must be at most %d characters", MaxNameLength)
+		}
+	}
+	checkName("FirstName", p.FirstName)
+	checkName("LastName", p.LastName)
+
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil || addr.Address != p.Email {
+			verr.add("Email", "is not a valid email address")
+		}
+	}
+
+	if p.DateOfBirth != "" {
+		dob, err := time.Parse(DateOfBirthLayout, p.DateOfBirth)
+		switch {
+		case err != nil:
+			verr.add("DateOfBirth", "must be a date formatted as YYYY-MM-DD")
+		case dob.After(time.Now()):
+			verr.add("DateOfBirth", "can't be in the future")
+		case dob.Before(time.Now().AddDate(-MaxVoterAge, 0, 0)):
+			verr.add("DateOfBirth", "is more than %d years ago", MaxVoterAge)
+		}
+	}
+
+	if p.Address != nil {
+		if p.Address.Street == "" {
+			verr.add("Address.Street", "is required")
+		}
+		if p.Address.City == "" {
+			verr.add("Address.City", "is required")
+		}
+		if !postalCodePattern.MatchString(p.Address.PostalCode) {
+			verr.add("Address.PostalCode", "is not a valid postal code")
+		}
+		if !countryPattern.MatchString(p.Address.Country) {
+			verr.add("Address.Country", "must be a two letter ISO 3166 country code")
+		}
+	}
+
+	if len(p.District) > MaxDistrictLength {
+		verr.add("District", "must be at most %d characters", MaxDistrictLength)
+	}
+
+	if len(p.Attributes) > MaxAttributes {
+		verr.add("Attributes", "can't have more than %d entries", MaxAttributes)
+	}
+	for k, v := range p.Attributes {
+		switch {
+		case k == "" || len(k) > MaxAttributeKey:
+			verr.add("Attributes", "keys must be 1 to %d characters", MaxAttributeKey)
+		case len(v) > MaxAttributeValue:
+			verr.add("Attributes."+k, "must be at most %d characters", MaxAttributeValue)
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
@@ -2,21 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
-	"github.com/nitishm/go-rejson/v4"
-	"log"
-	"os"
+	"github.com/go-resty/resty/v2"
+	"log/slog"
+	"sync"
 	"time"
+
+	"common"
 )
 
 const (
-	RedisNilError        = "redis: nil"
-	RedisDefaultLocation = "0.0.0.0:6379"
-	RedisKeyPrefix       = "voter:"
-	RedisIDKey           = "voterCnt:"
+	RedisNilError       = "redis: nil"
+	RedisKeyPrefix      = "voter:"
+	RedisIDKey          = "voterCnt:"
+	VoterIndex          = "voterIdx:"
+	RedisEmailPrefix    = "voterEmail:"
+	VoteDefaultLocation = "http://0.0.0.0:1080"
 )
 
 type voterPoll struct {
@@ -24,78 +26,99 @@ type voterPoll struct {
 	VoteDate time.Time `json:"VoteData"`
 }
 
+type Address struct {
+	Street     string `json:"Street"`
+	City       string `json:"City"`
+	PostalCode string `json:"PostalCode"`
+	Country    string `json:"Country"`
+}
+
+// VoterProfile is everything about a voter that clients can set
+type VoterProfile struct {
+	FirstName   string            `json:"FirstName"`
+	LastName    string            `json:"LastName"`
+	Email       string            `json:"Email,omitempty"`
+	DateOfBirth string            `json:"DateOfBirth,omitempty"`
+	Address     *Address          `json:"Address,omitempty"`
+	District    string            `json:"District,omitempty"`
+	Attributes  map[string]string `json:"Attributes,omitempty"`
+}
+
 type Voter struct {
-	VoterID     uint        `json:"id"`
-	FirstName   string      `json:"FirstName"`
-	LastName    string      `json:"LastName"`
+	VoterID uint `json:"id"`
+	VoterProfile
+	Groups      []string    `json:"Groups,omitempty"`
 	VoteHistory []voterPoll `json:"VoteHistory"`
+	Erased      bool        `json:"Erased,omitempty"`
 }
 
-type VoterAPI struct {
-	cacheClient *redis.Client
-	jsonHelper  *rejson.Handler
-	context     context.Context
-	idCnter     uint
+var ErrEmailTaken = errors.New("email is already registered to another voter")
+
+// voterEvent is the data of the voter and group events.  They carry ids
+// only, the feed keeps events for the outbox retention and must not keep
+// the profile of an erased voter with them.
+type voterEvent struct {
+	VoterID uint   `json:"voterID,omitempty"`
+	PollID  uint   `json:"pollID,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Mode    string `json:"mode,omitempty"`
 }
 
-func NewVoterApi() (*VoterAPI, error) {
-	redisUrl := os.Getenv("REDIS_URL")
-	if redisUrl == "" {
-		redisUrl = RedisDefaultLocation
-	}
+type VoterAPI struct {
+	store      common.Store
+	apiClient  *resty.Client
+	VoteUrl    string
+	erasureKey []byte
+	outbox     *common.Outbox
+
+	//Serializes the registrations of this replica on the id counter
+	mu sync.Mutex
+}
 
-	api, err := NewDbWithInstance(redisUrl)
+func NewVoterApi(cfg *Config) (*VoterAPI, error) {
+	store, err := common.NewStore(cfg.Config)
 	if err != nil {
-		log.Println("Failed to initialize the voter API!")
+		slog.Error("Failed to initialize the voter API", "error", err)
 		return &VoterAPI{}, err
 	}
 
-	itemObject, err := api.jsonHelper.JSONGet(RedisIDKey, ".")
-	if err != nil {
-		// There's no entry for the current number of voters,
-		// assume 0
-		return api, nil
+	//There is no context kept here, every call passes the context of the
+	//request it serves
+	api := &VoterAPI{store: store}
+	api.outbox = common.NewOutbox(store, TracerName, cfg.OutboxRetention)
+
+	api.apiClient = resty.New()
+	common.InstrumentClient(api.apiClient)
+	common.TraceClient(api.apiClient)
+	common.ForwardRequestID(api.apiClient)
+	api.VoteUrl = cfg.VoteUrl
+
+	//Erasures cascade into the VoteAPI, which may require an api key
+	if cfg.ServiceApiKey != "" {
+		api.apiClient.SetAuthScheme(common.ApiKeyAuthScheme)
+		api.apiClient.SetAuthToken(cfg.ServiceApiKey)
 	}
 
-	//JSONGet returns an "any" object, or empty interface,
-	//we need to convert it to a byte array, which is the
-	//underlying type of the object, then we can unmarshal
-	//it into our ToDoItem struct
-	err = json.Unmarshal(itemObject.([]byte), &api.idCnter)
-	if err != nil {
-		return &VoterAPI{}, err
+	//Erasure certificates are signed with this key, without it erasures
+	//are refused since the certificate could not be trusted
+	api.erasureKey = []byte(cfg.ErasureSigningKey)
+	if len(api.erasureKey) == 0 {
+		slog.Warn("erasure-signing-key is not set, voter erasure is disabled")
 	}
 
-	return api, nil
-}
-
-func NewDbWithInstance(location string) (*VoterAPI, error) {
-
-	client := redis.NewClient(&redis.Options{
-		Addr: location,
+	//Voters registered before the index existed are indexed once at startup
+	err = common.RebuildIndex(context.Background(), api.store, VoterIndex, RedisKeyPrefix, func(ctx context.Context, vtr *Voter) error {
+		return api.store.IndexAdd(ctx, VoterIndex, uint64(vtr.VoterID))
 	})
-
-	ctx := context.Background()
-
-	err := client.Ping(ctx).Err()
 	if err != nil {
-		log.Println("Error connecting to redis" + err.Error())
-		return nil, err
+		return &VoterAPI{}, err
 	}
 
-	jsonHelper := rejson.NewReJSONHandler()
-	jsonHelper.SetGoRedisClientWithContext(ctx, client)
-
-	return &VoterAPI{
-			cacheClient: client,
-			jsonHelper:  jsonHelper,
-			context:     ctx,
-		},
-		nil
+	return api, nil
 }
 
 //------------------------------------------------------------
-// REDIS HELPERS
+// STORE HELPERS
 //------------------------------------------------------------
 
 // In redis, our keys will be strings, they will look like
@@ -105,69 +128,114 @@ func redisKeyFromId(id int) string {
 	return fmt.Sprintf("%s%d", RedisKeyPrefix, id)
 }
 
-func (t *VoterAPI) getVoterFromRedis(key string, item *Voter) error {
+// Emails are unique across voters.  voterEmail:<email> holds the id of
+// the voter owning the address, SetNX makes claiming it atomic.
+func redisEmailKey(email string) string {
+	return RedisEmailPrefix + email
+}
 
-	//Lets query redis for the item, note we can return parts of the
-	//json structure, the second parameter "." means return the entire
-	//json structure
-	itemObject, err := t.jsonHelper.JSONGet(key, ".")
-	if err != nil {
-		return err
+func (t *VoterAPI) claimEmail(ctx context.Context, email string, voterID uint) error {
+	if email == "" {
+		return nil
 	}
 
-	//JSONGet returns an "any" object, or empty interface,
-	//we need to convert it to a byte array, which is the
-	//underlying type of the object, then we can unmarshal
-	//it into our ToDoItem struct
-	err = json.Unmarshal(itemObject.([]byte), item)
+	claimed, err := t.store.SetNX(ctx, redisEmailKey(email), voterID)
 	if err != nil {
 		return err
 	}
 
+	if !claimed {
+		var owner uint
+		err := t.store.Get(ctx, redisEmailKey(email), &owner)
+		if err != nil || owner != voterID {
+			return ErrEmailTaken
+		}
+	}
+
 	return nil
 }
 
-func (t *VoterAPI) AddVoter(fn string, ln string) (*Voter, error) {
-
-	//Before we add an item to the DB, lets make sure
-	//it does not exist, if it does, return an error
-	redisKey := redisKeyFromId(int(t.idCnter + 1))
-	var existingItem Voter
-	if err := t.getVoterFromRedis(redisKey, &existingItem); err == nil {
-		return &Voter{}, errors.New("Voter already exists!")
+func (t *VoterAPI) releaseEmail(ctx context.Context, email string) {
+	if email == "" {
+		return
 	}
 
-	newVoter := Voter{
-		VoterID:     t.idCnter + 1,
-		FirstName:   fn,
-		LastName:    ln,
-		VoteHistory: []voterPoll{},
+	if err := t.store.Delete(ctx, redisEmailKey(email)); err != nil {
+		common.LogFrom(ctx).Warn("Failed to release email index entry", "error", err)
 	}
+}
 
-	//Add item to database with JSON Set
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", newVoter); err != nil {
+func voterKey(id uint64) string {
+	return redisKeyFromId(int(id))
+}
+
+func (t *VoterAPI) AddVoter(ctx context.Context, profile VoterProfile) (*Voter, error) {
+
+	if err := validateProfile(&profile); err != nil {
 		return &Voter{}, err
 	}
 
-	//Increment the API counter only after we have succesfully added a new voter to the DB
-	t.idCnter += 1
+	//The id is the next value of the counter, taken by a compare-and-set
+	//on it along with the voter, so concurrent registrations, here or on
+	//other replicas, can't get the same one.  The lock keeps the
+	//registrations of this replica from fighting over it.
+	var newVoter Voter
+	var claimedFor uint
+	t.mu.Lock()
+	err := common.Update(ctx, t.store, RedisIDKey, func(last *uint, b *common.Batch) error {
+		var id uint = 1
+		if last != nil {
+			id = *last + 1
+		}
+
+		newVoter = Voter{
+			VoterID:      id,
+			VoterProfile: profile,
+			VoteHistory:  []voterPoll{},
+		}
 
-	if _, err := t.jsonHelper.JSONSet(RedisIDKey, ".", t.idCnter); err != nil {
+		//The email points at the id, a retry that got another one moves
+		//the claim over
+		if claimedFor != 0 && claimedFor != id {
+			t.releaseEmail(ctx, profile.Email)
+			claimedFor = 0
+		}
+		if claimedFor == 0 {
+			if err := t.claimEmail(ctx, profile.Email, id); err != nil {
+				return err
+			}
+			claimedFor = id
+		}
+
+		//The voter, its index entry, the id counter and the event are
+		//written together
+		b.Set(redisKeyFromId(int(id)), newVoter)
+		b.IndexAdd(VoterIndex, uint64(id))
+		b.Set(RedisIDKey, id)
+		return t.outbox.Record(ctx, b, "voter.registered", voterEvent{VoterID: id})
+	})
+	t.mu.Unlock()
+	if err != nil {
+		if claimedFor != 0 {
+			t.releaseEmail(ctx, profile.Email)
+		}
 		return &Voter{}, err
 	}
 
+	votersRegistered.Inc()
+
 	//If everything is ok, return nil for the error
 	return &newVoter, nil
 }
 
-func (t *VoterAPI) GetVoter(id int) (*Voter, error) {
+func (t *VoterAPI) GetVoter(ctx context.Context, id int) (*Voter, error) {
 
 	// Check if item exists before trying to get it
 	// this is a good practice, return an error if the
 	// item does not exist
 	var voter Voter
 	pattern := redisKeyFromId(id)
-	err := t.getVoterFromRedis(pattern, &voter)
+	err := t.store.Get(ctx, pattern, &voter)
 	if err != nil {
 		return &Voter{}, err
 	}
@@ -175,58 +243,158 @@ func (t *VoterAPI) GetVoter(id int) (*Voter, error) {
 	return &voter, nil
 }
 
-func (t *VoterAPI) UpdateVoter(voter Voter) error {
+// UpdateVoter applies change to the voter, e.g. a new profile, and returns
+// the voter as written.  The vote history may grow while this runs, the
+// write is retried rather than put back an older history.
+func (t *VoterAPI) UpdateVoter(ctx context.Context, id uint, change func(vtr *Voter)) (*Voter, error) {
+	return t.updateVoter(ctx, id, func(vtr *Voter, b *common.Batch) error {
+		change(vtr)
+		return nil
+	}, "voter.updated", voterEvent{VoterID: id})
+}
+
+// errUnchanged lets the change of updateVoter leave the voter as it is,
+// nothing is written and updateVoter returns it
+var errUnchanged = errors.New("voter is unchanged")
+
+// updateVoter is a read-modify-write of the voter.  change edits the voter
+// and adds the writes that go with it to b, they are committed along with
+// the voter and the event describing them, but only if the voter was not
+// changed in the meantime; otherwise change runs again on the new record.
+// change must not do anything but edit the voter and fill b.
+func (t *VoterAPI) updateVoter(ctx context.Context, id uint, change func(vtr *Voter, b *common.Batch) error, event string, data voterEvent) (*Voter, error) {
+	redisKey := redisKeyFromId(int(id))
+
+	var updated Voter
+	var oldEmail, claimed string
+	err := common.Update(ctx, t.store, redisKey, func(vtr *Voter, b *common.Batch) error {
+		if vtr == nil {
+			return ErrVoterNotFound
+		}
+
+		//An erased voter is only a pseudonym now, it takes no new data
+		if vtr.Erased {
+			return ErrVoterErased
+		}
+
+		oldEmail = vtr.Email
+		err := change(vtr, b)
+		updated = *vtr
+		if err != nil {
+			return err
+		}
+
+		//The pseudonym an erasure leaves is not subject to the profile
+		//rules
+		if !vtr.Erased {
+			if err := validateProfile(&vtr.VoterProfile); err != nil {
+				return err
+			}
+		}
+
+		if vtr.Email != oldEmail && vtr.Email != claimed {
+			if err := t.claimEmail(ctx, vtr.Email, id); err != nil {
+				return err
+			}
+			claimed = vtr.Email
+		}
 
-	//Before we add an item to the DB, lets make sure
-	//it does not exist, if it does, return an error
-	redisKey := redisKeyFromId(int(voter.VoterID))
-	var existingVoter Voter
-	if err := t.getVoterFromRedis(redisKey, &existingVoter); err != nil {
-		return errors.New("voter does not exist")
+		b.Set(redisKey, vtr)
+		updated = *vtr
+		return t.outbox.Record(ctx, b, event, data)
+	})
+	if err != nil {
+		if claimed != "" && claimed != oldEmail {
+			t.releaseEmail(ctx, claimed)
+		}
+		return &updated, err
 	}
 
-	//Add item to database with JSON Set.  Note there is no update
-	//functionality, so we just overwrite the existing item
-	if _, err := t.jsonHelper.JSONSet(redisKey, ".", voter); err != nil {
-		return err
+	if updated.Email != oldEmail {
+		t.releaseEmail(ctx, oldEmail)
 	}
 
-	//If everything is ok, return nil for the error
-	return nil
+	return &updated, nil
 }
 
-func (t *VoterAPI) GetAllVoters() ([]Voter, error) {
+func (t *VoterAPI) DeleteVoter(ctx context.Context, id int) error {
+	return t.deleteVoter(ctx, id, "voter.deleted", voterEvent{VoterID: uint(id)})
+}
 
-	//Now that we have the DB loaded, lets crate a slice
-	var voterList []Voter
-	var vtr Voter
+// deleteVoter removes the voter from the store and their groups, event
+// tells a deletion from an erasure
+func (t *VoterAPI) deleteVoter(ctx context.Context, id int, event string, data voterEvent) error {
 
-	//Lets query redis for all of the items
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := t.cacheClient.Keys(t.context, pattern).Result()
-	for _, key := range ks {
-		err := t.getVoterFromRedis(key, &vtr)
-		if err != nil {
-			return nil, err
+	redisKey := redisKeyFromId(id)
+
+	//Compared and deleted like an update, so a group joined meanwhile is
+	//left as well
+	var email string
+	err := common.Update(ctx, t.store, redisKey, func(vtr *Voter, b *common.Batch) error {
+		if vtr == nil {
+			return ErrVoterNotFound
 		}
-		voterList = append(voterList, vtr)
+
+		b.Delete(redisKey)
+		b.IndexRemove(VoterIndex, uint64(id))
+		leaveAllGroups(b, vtr)
+		email = vtr.Email
+
+		return t.outbox.Record(ctx, b, event, data)
+	})
+	if err != nil {
+		return err
 	}
 
-	return voterList, nil
+	t.releaseEmail(ctx, email)
+	return nil
 }
 
-func (t *VoterAPI) Vote(id int, pollid uint) error {
+// ListVoters returns a page of voters in id order and the cursor of the
+// next page, 0 on the last one.  A non empty group only keeps its members.
+func (t *VoterAPI) ListVoters(ctx context.Context, group string, page common.Page) ([]Voter, uint64, error) {
+	var keep func(vtr *Voter) bool
+	if group != "" {
+		keep = func(vtr *Voter) bool {
+			for _, g := range vtr.Groups {
+				if g == group {
+					return true
+				}
+			}
+			return false
+		}
+	}
 
-	voter, err := t.GetVoter(id)
-	if err != nil {
+	return common.ListPage(ctx, t.store, VoterIndex, page, voterKey, keep)
+}
+
+// Vote appends to the history in the store instead of writing back the
+// whole voter, so two votes at the same time can't drop each other's entry
+func (t *VoterAPI) Vote(ctx context.Context, id int, pollid uint) error {
+
+	//A batch doesn't stop at an append to a missing voter, so the voter
+	//is looked up first
+	var existing Voter
+	err := t.store.Get(ctx, redisKeyFromId(id), &existing)
+	if errors.Is(err, common.ErrNotFound) {
+		return ErrVoterNotFound
+	} else if err != nil {
 		return err
 	}
+	if existing.Erased {
+		return ErrVoterErased
+	}
 
-	voter.VoteHistory = append(voter.VoteHistory, voterPoll{pollid, time.Now()})
+	var b common.Batch
+	b.Append(redisKeyFromId(id), "VoteHistory", voterPoll{pollid, time.Now()})
 
-	err = t.UpdateVoter(*voter)
-	if err != nil {
+	if err := t.outbox.RecordAbout(ctx, &b, voterSubject(uint(id)), "voter.voted", voterEvent{VoterID: uint(id), PollID: pollid}); err != nil {
 		return err
 	}
-	return nil
+
+	err = t.store.Commit(ctx, &b)
+	if errors.Is(err, common.ErrNotFound) {
+		return ErrVoterNotFound
+	}
+	return err
 }
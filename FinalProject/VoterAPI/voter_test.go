@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"common"
+)
+
+func newTestApi(t *testing.T) *VoterAPI {
+	t.Helper()
+
+	cfg := &Config{Config: &common.Config{Store: common.StoreMemory, OutboxRetention: time.Hour}}
+	api, err := NewVoterApi(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+func TestUpdateVoterKeepsConcurrentVotes(t *testing.T) {
+	ctx := context.Background()
+	api := newTestApi(t)
+
+	vtr, err := api.AddVoter(ctx, VoterProfile{FirstName: "Ada", LastName: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.AddGroup(ctx, "engineering", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	//Votes are appends, none of them may fail however many updates race
+	//them.  The updates are read-modify-writes, like a client they try
+	//again when they give up on conflicts.
+	const votes = 300
+	const updates = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, votes+2*updates)
+	for i := 1; i <= votes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- api.Vote(ctx, int(vtr.VoterID), uint(i))
+		}(i)
+	}
+	retry := func(write func() error) error {
+		for {
+			if err := write(); !errors.Is(err, common.ErrConflict) {
+				return err
+			}
+		}
+	}
+	for i := 1; i <= updates; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- retry(func() error {
+				_, err := api.UpdateVoter(ctx, vtr.VoterID, func(v *Voter) {
+					v.LastName = fmt.Sprint("Lovelace-", i)
+				})
+				return err
+			})
+		}(i)
+		go func() {
+			defer wg.Done()
+			errs <- retry(func() error {
+				return api.AddGroupMember(ctx, "engineering", vtr.VoterID)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//No update may write back a history missing a vote
+	got, err := api.GetVoter(ctx, int(vtr.VoterID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.VoteHistory) != votes {
+		t.Errorf("vote history has %d entries, want %d", len(got.VoteHistory), votes)
+	}
+	polls := map[uint]bool{}
+	for _, entry := range got.VoteHistory {
+		polls[entry.PollID] = true
+	}
+	if len(polls) != votes {
+		t.Errorf("vote history has %d distinct polls, want %d", len(polls), votes)
+	}
+	if !strings.HasPrefix(got.LastName, "Lovelace-") {
+		t.Errorf("last name = %q, want one of the updates", got.LastName)
+	}
+	if len(got.Groups) != 1 || got.Groups[0] != "engineering" {
+		t.Errorf("groups = %v, want [engineering]", got.Groups)
+	}
+}
+
+// A vote recorded while an update is between its read and its write must
+// survive the update
+func TestUpdateVoterKeepsVoteCastMeanwhile(t *testing.T) {
+	ctx := context.Background()
+	api := newTestApi(t)
+
+	vtr, err := api.AddVoter(ctx, VoterProfile{FirstName: "Ada", LastName: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	voted := false
+	_, err = api.UpdateVoter(ctx, vtr.VoterID, func(v *Voter) {
+		if !voted {
+			voted = true
+			if err := api.Vote(ctx, int(vtr.VoterID), 7); err != nil {
+				t.Fatal(err)
+			}
+		}
+		v.LastName = "Byron"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := api.GetVoter(ctx, int(vtr.VoterID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastName != "Byron" || len(got.VoteHistory) != 1 {
+		t.Errorf("voter = %s with %d votes, want Byron with the vote", got.LastName, len(got.VoteHistory))
+	}
+}
+
+func TestUpdateVoterNotFound(t *testing.T) {
+	api := newTestApi(t)
+
+	_, err := api.UpdateVoter(context.Background(), 42, func(v *Voter) { v.LastName = "Nobody" })
+	if !errors.Is(err, ErrVoterNotFound) {
+		t.Errorf("err = %v, want ErrVoterNotFound", err)
+	}
+}
+
+func TestReplicasRegisterDistinctIds(t *testing.T) {
+	ctx := context.Background()
+	api := newTestApi(t)
+	//A second replica on the same store
+	other := &VoterAPI{store: api.store, apiClient: api.apiClient, VoteUrl: api.VoteUrl, outbox: api.outbox}
+
+	const voters = 40
+	ids := make(chan uint, voters)
+	var wg sync.WaitGroup
+	for i := 0; i < voters; i++ {
+		replica := api
+		if i%2 == 1 {
+			replica = other
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vtr, err := replica.AddVoter(ctx, VoterProfile{FirstName: "Voter", LastName: fmt.Sprint(i), Email: fmt.Sprintf("voter%d@example.com", i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- vtr.VoterID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[uint]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("id %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+	for id := uint(1); id <= voters; id++ {
+		if _, err := api.GetVoter(ctx, int(id)); err != nil {
+			t.Errorf("voter %d: %v", id, err)
+		}
+	}
+}
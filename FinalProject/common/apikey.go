@@ -0,0 +1,582 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API keys let external tools (dashboards, integrations) call the API
+// without a user account.  A key is handed out once as ak_<id>.<secret>,
+// only a SHA-256 hash of the secret is kept in the store.  With the redis
+// or a shared sqlite store a key created through any of the services works
+// against all of them.
+const (
+	ApiKeyRedisPrefix       = "apikey:"
+	ApiKeyIDKey             = "apikeyCnt:"
+	ApiKeyRatePrefix        = "apikeyRate:"
+	ApiKeyTokenPrefix       = "ak_"
+	ApiKeyAuthScheme        = "ApiKey"
+	ApiKeyContextKey        = "apiKey"
+	ApiKeyDefaultRateLimit  = 600
+	ApiKeyManageScope       = "apikeys:manage"
+	ApiKeyAdminScope        = "admin"
+	ApiKeyAdminName         = "admin"
+	ApiKeyRateWindowSeconds = 60
+	ApiKeyLastUsedInterval  = time.Minute
+)
+
+var (
+	ErrApiKeyInvalid     = errors.New("invalid api key")
+	ErrApiKeyRevoked     = errors.New("api key has been revoked")
+	ErrApiKeyRateLimited = errors.New("api key rate limit exceeded")
+	ErrApiKeyNotFound    = errors.New("api key does not exist")
+	ErrApiKeyScopeDenied = errors.New("a key can't grant a scope it doesn't have")
+)
+
+type ApiKey struct {
+	KeyID     uint       `json:"keyID"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Hash      string     `json:"hash,omitempty"`
+	RateLimit uint       `json:"rateLimit"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	Revoked   bool       `json:"revoked"`
+}
+
+type ApiKeyStore struct {
+	store    Store
+	adminKey string
+	required bool
+}
+
+// NewApiKeyStore reuses the store of the API.  The admin key
+// (api-admin-key) has every scope so the first real keys can be created,
+// and required (api-keys-required) rejects requests that do not carry a key.
+func NewApiKeyStore(store Store, adminKey string, required bool) *ApiKeyStore {
+	return &ApiKeyStore{
+		store:    store,
+		adminKey: adminKey,
+		required: required,
+	}
+}
+
+// Required tells if requests without a key are rejected
+func (s *ApiKeyStore) Required() bool {
+	return s.required
+}
+
+//------------------------------------------------------------
+// SCOPES
+//------------------------------------------------------------
+
+// Scopes look like <resource>:<action>, optionally narrowed to a single
+// resource with a third part, e.g. polls:read or votes:read:poll/7
+func validateScope(scope string) error {
+	if scope == "*" {
+		return nil
+	}
+
+	parts := strings.Split(scope, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("scope %q must look like resource:action[:target]", scope)
+	}
+
+	for _, p := range parts {
+		if p == "" {
+			return fmt.Errorf("scope %q has an empty part", scope)
+		}
+	}
+
+	return nil
+}
+
+// Allows reports whether the key grants scope (resource:action) for the
+// given target.  An empty target asks about the route as a whole, which
+// any narrowed scope for the same resource and action satisfies; the
+// handler is then expected to check the individual records.
+func (k *ApiKey) Allows(scope string, target string) bool {
+	for _, s := range k.Scopes {
+		if s == "*" || s == scope {
+			return true
+		}
+
+		if qualifier, ok := strings.CutPrefix(s, scope+":"); ok {
+			if target == "" || target == qualifier {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Grants reports whether the key holds scope as a whole, so it may hand
+// it on to a new key.  A narrowed scope is granted by the same scope or
+// the un-narrowed one, the others only by themselves or *.
+func (k *ApiKey) Grants(scope string) bool {
+	if parts := strings.SplitN(scope, ":", 3); len(parts) == 3 {
+		return k.Allows(parts[0]+":"+parts[1], parts[2])
+	}
+
+	for _, s := range k.Scopes {
+		if s == "*" || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *ApiKey) public() ApiKey {
+	pub := *k
+	pub.Hash = ""
+	return pub
+}
+
+//------------------------------------------------------------
+// REDIS HELPERS
+//------------------------------------------------------------
+
+func apiKeyRedisKey(id uint) string {
+	return fmt.Sprintf("%s%d", ApiKeyRedisPrefix, id)
+}
+
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newApiKeySecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func apiKeyToken(id uint, secret string) string {
+	return fmt.Sprintf("%s%d.%s", ApiKeyTokenPrefix, id, secret)
+}
+
+func parseApiKeyToken(token string) (uint, string, error) {
+	rest, ok := strings.CutPrefix(token, ApiKeyTokenPrefix)
+	if !ok {
+		return 0, "", ErrApiKeyInvalid
+	}
+
+	idStr, secret, ok := strings.Cut(rest, ".")
+	if !ok || secret == "" {
+		return 0, "", ErrApiKeyInvalid
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return 0, "", ErrApiKeyInvalid
+	}
+
+	return uint(id), secret, nil
+}
+
+func (s *ApiKeyStore) getKey(ctx context.Context, id uint) (*ApiKey, error) {
+	var key ApiKey
+	if err := s.store.Get(ctx, apiKeyRedisKey(id), &key); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrApiKeyNotFound
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (s *ApiKeyStore) putKey(ctx context.Context, key *ApiKey) error {
+	return s.store.Set(ctx, apiKeyRedisKey(key.KeyID), key)
+}
+
+//------------------------------------------------------------
+// KEY MANAGEMENT
+//------------------------------------------------------------
+
+// CreateKey stores a new key and returns it along with the plaintext
+// token, which is never available again after this call.  The new key
+// only gets scopes granter Grants, a nil granter is the service itself.
+func (s *ApiKeyStore) CreateKey(ctx context.Context, granter *ApiKey, name string, scopes []string, rateLimit uint) (*ApiKey, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", errors.New("an api key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if err := validateScope(scope); err != nil {
+			return nil, "", err
+		}
+		if granter != nil && !granter.Grants(scope) {
+			return nil, "", fmt.Errorf("%w: %s", ErrApiKeyScopeDenied, scope)
+		}
+	}
+
+	if rateLimit == 0 {
+		rateLimit = ApiKeyDefaultRateLimit
+	}
+
+	secret, err := newApiKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	//The counter is shared by every service, so let the store hand out
+	//the ids instead of keeping a local counter
+	id, err := s.store.Incr(ctx, ApiKeyIDKey, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := ApiKey{
+		KeyID:     uint(id),
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashApiKeySecret(secret),
+		RateLimit: rateLimit,
+		CreatedAt: time.Now(),
+	}
+
+	if err := s.putKey(ctx, &key); err != nil {
+		return nil, "", err
+	}
+
+	return &key, apiKeyToken(key.KeyID, secret), nil
+}
+
+func (s *ApiKeyStore) ListKeys(ctx context.Context) ([]ApiKey, error) {
+	keyList := []ApiKey{}
+
+	ks, err := s.store.Keys(ctx, ApiKeyRedisPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	//Only apikey:<id>, the prefix may pick up other records
+	records := []string{}
+	for _, k := range ks {
+		if _, err := strconv.ParseUint(strings.TrimPrefix(k, ApiKeyRedisPrefix), 10, 32); err == nil {
+			records = append(records, k)
+		}
+	}
+
+	found, err := GetMany[ApiKey](ctx, s.store, records)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range found {
+		if key != nil {
+			keyList = append(keyList, key.public())
+		}
+	}
+
+	return keyList, nil
+}
+
+// RevokeKey keeps the record around so it still shows up in listings,
+// it just stops authenticating
+func (s *ApiKeyStore) RevokeKey(ctx context.Context, id uint) (*ApiKey, error) {
+	var revoked ApiKey
+	err := Update(ctx, s.store, apiKeyRedisKey(id), func(key *ApiKey, b *Batch) error {
+		if key == nil {
+			return ErrApiKeyNotFound
+		}
+
+		key.Revoked = true
+		b.Set(apiKeyRedisKey(id), key)
+		revoked = *key
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &revoked, nil
+}
+
+// RotateKey replaces the secret of a key, the old token stops working
+// immediately.  Scopes, limits and the key id stay the same.  A key
+// revoked meanwhile stays revoked, the write only lands on the record it
+// was based on.
+func (s *ApiKeyStore) RotateKey(ctx context.Context, id uint) (*ApiKey, string, error) {
+	secret, err := newApiKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var rotated ApiKey
+	err = Update(ctx, s.store, apiKeyRedisKey(id), func(key *ApiKey, b *Batch) error {
+		if key == nil {
+			return ErrApiKeyNotFound
+		}
+		if key.Revoked {
+			return ErrApiKeyRevoked
+		}
+
+		now := time.Now()
+		key.Hash = hashApiKeySecret(secret)
+		key.RotatedAt = &now
+		b.Set(apiKeyRedisKey(id), key)
+		rotated = *key
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &rotated, apiKeyToken(id, secret), nil
+}
+
+//------------------------------------------------------------
+// AUTHENTICATION
+//------------------------------------------------------------
+
+// Authenticate resolves a token to its key, enforcing revocation and the
+// per-key rate limit, and records when the key was last used, to the
+// minute
+func (s *ApiKeyStore) Authenticate(ctx context.Context, token string) (*ApiKey, error) {
+	if s.adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminKey)) == 1 {
+		return &ApiKey{Name: ApiKeyAdminName, Scopes: []string{"*"}}, nil
+	}
+
+	id, secret, err := parseApiKeyToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.getKey(ctx, id)
+	if err != nil {
+		return nil, ErrApiKeyInvalid
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashApiKeySecret(secret))) != 1 {
+		return nil, ErrApiKeyInvalid
+	}
+
+	if key.Revoked {
+		return nil, ErrApiKeyRevoked
+	}
+
+	if err := s.checkRateLimit(ctx, key); err != nil {
+		return nil, err
+	}
+
+	//lastUsed is only kept to the minute, a busy key would otherwise write
+	//its record on every request
+	now := time.Now()
+	if key.LastUsed == nil || now.Sub(*key.LastUsed) >= ApiKeyLastUsedInterval {
+		key.LastUsed = &now
+		if err := s.store.SetField(ctx, apiKeyRedisKey(key.KeyID), "lastUsed", now); err != nil {
+			LogFrom(ctx).Warn("Failed to record api key usage", "key_id", key.KeyID, "error", err)
+		}
+	}
+
+	return key, nil
+}
+
+// Fixed window rate limiting, one counter per key per minute
+func (s *ApiKeyStore) checkRateLimit(ctx context.Context, key *ApiKey) error {
+	window := time.Now().Unix() / ApiKeyRateWindowSeconds
+	rateKey := fmt.Sprintf("%s%d:%d", ApiKeyRatePrefix, key.KeyID, window)
+
+	count, err := s.store.Incr(ctx, rateKey, 2*ApiKeyRateWindowSeconds*time.Second)
+	if err != nil {
+		return err
+	}
+
+	if uint(count) > key.RateLimit {
+		return ErrApiKeyRateLimited
+	}
+
+	return nil
+}
+
+// Middleware authenticates any request carrying an "Authorization: ApiKey"
+// header and stores the key on the gin context.  Requests without one pass
+// through untouched, the per-route RequireScope decides what to do with them.
+func (s *ApiKeyStore) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, ApiKeyAuthScheme) {
+			c.Next()
+			return
+		}
+
+		key, err := s.Authenticate(c.Request.Context(), strings.TrimSpace(token))
+		switch {
+		case errors.Is(err, ErrApiKeyRateLimited):
+			c.Header("Retry-After", strconv.Itoa(ApiKeyRateWindowSeconds))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(ApiKeyContextKey, key)
+		LogWith(c, "api_key", key.Name)
+		c.Next()
+	}
+}
+
+// RequireScope guards a route.  Anonymous requests are let through unless
+// api keys are required, except for key management, webhooks and the admin
+// routes (admin or <resource>:admin) which always need a key.
+func (s *ApiKeyStore) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := ApiKeyFromContext(c)
+		if !ok {
+			if s.required || scope == ApiKeyManageScope || scope == WebhookScope || isAdminScope(scope) {
+				c.Header("WWW-Authenticate", ApiKeyAuthScheme)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "an api key is required"})
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if !key.Allows(scope, "") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key is missing scope " + scope})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func isAdminScope(scope string) bool {
+	return scope == ApiKeyAdminScope || strings.HasSuffix(scope, ":"+ApiKeyAdminScope)
+}
+
+func ApiKeyFromContext(c *gin.Context) (*ApiKey, bool) {
+	value, ok := c.Get(ApiKeyContextKey)
+	if !ok {
+		return nil, false
+	}
+	key, ok := value.(*ApiKey)
+	return key, ok
+}
+
+// ApiKeyAllows is the per-record check for narrowed scopes, requests
+// without a key already passed RequireScope so they are allowed here
+func ApiKeyAllows(c *gin.Context, scope string, target string) bool {
+	key, ok := ApiKeyFromContext(c)
+	if !ok {
+		return true
+	}
+	return key.Allows(scope, target)
+}
+
+// ApiKeyHolds is the check of the routes that take no single record,
+// creating one or reading across them: a narrowed scope isn't enough
+func ApiKeyHolds(c *gin.Context, scope string) bool {
+	key, ok := ApiKeyFromContext(c)
+	if !ok {
+		return true
+	}
+	return key.Grants(scope)
+}
+
+//------------------------------------------------------------
+// ROUTES
+//------------------------------------------------------------
+
+func RegisterApiKeyRoutes(r *gin.Engine, keys *ApiKeyStore) {
+	manage := r.Group("/apikey", keys.RequireScope(ApiKeyManageScope))
+
+	manage.POST("", func(c *gin.Context) {
+		type NewKey struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			RateLimit uint     `json:"rateLimit"`
+		}
+		var req NewKey
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from apikey POST", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		//The route takes a key, a new one can't get more than it has
+		granter, _ := ApiKeyFromContext(c)
+		key, token, err := keys.CreateKey(c.Request.Context(), granter, req.Name, req.Scopes, req.RateLimit)
+		if errors.Is(err, ErrApiKeyScopeDenied) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"key":   key.public(),
+			"token": token,
+		})
+	})
+
+	manage.GET("", func(c *gin.Context) {
+		keyList, err := keys.ListKeys(c.Request.Context())
+		if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to list api keys", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, keyList)
+	})
+
+	manage.DELETE("/:id", func(c *gin.Context) {
+		id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", c.Param("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		key, err := keys.RevokeKey(c.Request.Context(), uint(id64))
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.JSON(http.StatusOK, key.public())
+	})
+
+	manage.POST("/:id/rotate", func(c *gin.Context) {
+		id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", c.Param("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		key, token, err := keys.RotateKey(c.Request.Context(), uint(id64))
+		if errors.Is(err, ErrApiKeyRevoked) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"key":   key.public(),
+			"token": token,
+		})
+	})
+}
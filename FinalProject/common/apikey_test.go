@@ -0,0 +1,286 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestApiKeyAllows(t *testing.T) {
+	key := &ApiKey{Scopes: []string{"polls:read", "votes:write:poll/7"}}
+
+	cases := []struct {
+		scope  string
+		target string
+		want   bool
+	}{
+		{"polls:read", "", true},
+		{"polls:read", "poll/3", true},
+		{"polls:write", "", false},
+		{"votes:write", "", true},
+		{"votes:write", "poll/7", true},
+		{"votes:write", "poll/8", false},
+		{"votes:admin", "poll/7", false},
+	}
+
+	for _, tc := range cases {
+		if got := key.Allows(tc.scope, tc.target); got != tc.want {
+			t.Errorf("Allows(%q, %q) = %v, want %v", tc.scope, tc.target, got, tc.want)
+		}
+	}
+}
+
+// scopedRouter serves GET /thing/:id behind RequireScope(scope) and the
+// per-record check on thing/<id>
+func scopedRouter(keys *ApiKeyStore, scope string) *gin.Engine {
+	r := gin.New()
+	r.Use(keys.Middleware())
+	r.GET("/thing/:id", keys.RequireScope(scope), func(c *gin.Context) {
+		if !ApiKeyAllows(c, scope, "thing/"+c.Param("id")) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	return r
+}
+
+func serve(r http.Handler, path string, token string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", ApiKeyAuthScheme+" "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRequireScope(t *testing.T) {
+	ctx := context.Background()
+	keys := NewApiKeyStore(newMemoryStore(), "", false)
+
+	_, narrowed, err := keys.CreateKey(ctx, nil, "narrowed", []string{"things:write:thing/1", "things:admin:thing/1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := keys.CreateKey(ctx, nil, "other", []string{"polls:read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := scopedRouter(keys, "things:write")
+	admin := scopedRouter(keys, "things:admin")
+
+	cases := []struct {
+		name   string
+		router http.Handler
+		path   string
+		token  string
+		want   int
+	}{
+		{"anonymous write", write, "/thing/1", "", http.StatusNoContent},
+		{"narrowed write to its record", write, "/thing/1", narrowed, http.StatusNoContent},
+		{"narrowed write to another record", write, "/thing/2", narrowed, http.StatusForbidden},
+		{"write without the scope", write, "/thing/1", other, http.StatusForbidden},
+		{"anonymous admin", admin, "/thing/1", "", http.StatusUnauthorized},
+		{"narrowed admin to its record", admin, "/thing/1", narrowed, http.StatusNoContent},
+		{"narrowed admin to another record", admin, "/thing/2", narrowed, http.StatusForbidden},
+		{"admin without the scope", admin, "/thing/1", other, http.StatusForbidden},
+		{"invalid key", write, "/thing/1", "ak_1.nope", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		if got := serve(tc.router, tc.path, tc.token); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequireScopeWhenKeysRequired(t *testing.T) {
+	keys := NewApiKeyStore(newMemoryStore(), "adm", true)
+	r := scopedRouter(keys, "things:write")
+
+	if got := serve(r, "/thing/1", ""); got != http.StatusUnauthorized {
+		t.Errorf("anonymous: status %d, want 401", got)
+	}
+	if got := serve(r, "/thing/1", "adm"); got != http.StatusNoContent {
+		t.Errorf("admin key: status %d, want 204", got)
+	}
+}
+
+func TestAuthenticateThrottlesLastUsed(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	keys := NewApiKeyStore(store, "", false)
+
+	created, token, err := keys.CreateKey(ctx, nil, "busy", []string{"polls:read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keys.Authenticate(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	first, err := keys.getKey(ctx, created.KeyID)
+	if err != nil || first.LastUsed == nil {
+		t.Fatalf("lastUsed not recorded: %v", err)
+	}
+
+	if _, err := keys.Authenticate(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := keys.getKey(ctx, created.KeyID)
+	if !second.LastUsed.Equal(*first.LastUsed) {
+		t.Errorf("lastUsed rewritten within a minute: %s then %s", first.LastUsed, second.LastUsed)
+	}
+
+	//Once the minute is over the next request records it again
+	stale := first.LastUsed.Add(-ApiKeyLastUsedInterval)
+	if err := store.SetField(ctx, apiKeyRedisKey(created.KeyID), "lastUsed", stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Authenticate(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	third, _ := keys.getKey(ctx, created.KeyID)
+	if !third.LastUsed.After(stale) || time.Since(*third.LastUsed) > time.Minute {
+		t.Errorf("lastUsed not refreshed after a minute: %s", third.LastUsed)
+	}
+}
+
+// A key managing keys can only hand out what it holds itself
+func TestCreateKeyOnlyGrantsHeldScopes(t *testing.T) {
+	ctx := context.Background()
+	keys := NewApiKeyStore(newMemoryStore(), "", false)
+	r := gin.New()
+	r.Use(keys.Middleware())
+	RegisterApiKeyRoutes(r, keys)
+
+	_, manager, err := keys.CreateKey(ctx, nil, "manager", []string{ApiKeyManageScope, "polls:read", "votes:write:poll/7"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for scope, want := range map[string]int{
+		"*":                  http.StatusForbidden,
+		"polls:write":        http.StatusForbidden,
+		"votes:write":        http.StatusForbidden,
+		"votes:write:poll/8": http.StatusForbidden,
+		"votes:write:poll/7": http.StatusCreated,
+		"polls:read":         http.StatusCreated,
+		"polls:read:poll/3":  http.StatusCreated,
+		ApiKeyManageScope:    http.StatusCreated,
+	} {
+		body, _ := json.Marshal(gin.H{"name": "minted", "scopes": []string{scope}})
+		req := httptest.NewRequest(http.MethodPost, "/apikey", strings.NewReader(string(body)))
+		req.Header.Set("Authorization", ApiKeyAuthScheme+" "+manager)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != want {
+			t.Errorf("minting %s: status %d, want %d", scope, w.Code, want)
+		}
+	}
+}
+
+// Routes across records turn narrowed keys down, the per-record ones don't
+func TestApiKeyHolds(t *testing.T) {
+	ctx := context.Background()
+	keys := NewApiKeyStore(newMemoryStore(), "", false)
+	r := gin.New()
+	r.Use(keys.Middleware())
+	r.GET("/things", keys.RequireScope("things:write"), func(c *gin.Context) {
+		if !ApiKeyHolds(c, "things:write") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	_, narrowed, err := keys.CreateKey(ctx, nil, "narrowed", []string{"things:write:thing/1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, whole, err := keys.CreateKey(ctx, nil, "whole", []string{"things:write"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		token string
+		want  int
+	}{
+		"anonymous": {"", http.StatusNoContent},
+		"narrowed":  {narrowed, http.StatusForbidden},
+		"whole":     {whole, http.StatusNoContent},
+	} {
+		if got := serve(r, "/things", tc.token); got != tc.want {
+			t.Errorf("%s: status %d, want %d", name, got, tc.want)
+		}
+	}
+}
+
+// readHook runs hook once, right after the first record is read
+type readHook struct {
+	Store
+	hook func()
+}
+
+func (s *readHook) GetMany(ctx context.Context, keys []string) ([]json.RawMessage, error) {
+	docs, err := s.Store.GetMany(ctx, keys)
+	if hook := s.hook; hook != nil {
+		s.hook = nil
+		hook()
+	}
+	return docs, err
+}
+
+// A rotation based on the record from before a revocation must not bring
+// the key back
+func TestRotateKeyAfterConcurrentRevoke(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		keys := NewApiKeyStore(store, "", false)
+		created, _, err := keys.CreateKey(ctx, nil, "leaked", []string{"polls:read"}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hooked := &readHook{Store: store}
+		hooked.hook = func() {
+			if _, err := keys.RevokeKey(ctx, created.KeyID); err != nil {
+				t.Error(err)
+			}
+		}
+
+		_, token, err := NewApiKeyStore(hooked, "", false).RotateKey(ctx, created.KeyID)
+		if !errors.Is(err, ErrApiKeyRevoked) {
+			t.Errorf("%s: rotate of a key revoked meanwhile: %v, want ErrApiKeyRevoked", name, err)
+		}
+
+		got, err := keys.getKey(ctx, created.KeyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Revoked {
+			t.Errorf("%s: the key is no longer revoked", name)
+		}
+		if token != "" {
+			if _, err := keys.Authenticate(ctx, token); err == nil {
+				t.Errorf("%s: the rotated token authenticates", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package common
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration.  Every setting has a key in the YAML config file, an
+// environment variable and a command line flag.  The file is given with
+// -config or CONFIG_FILE; a flag beats the environment, which beats the
+// file, which beats the default.  Everything is validated before the
+// service starts, and -print-config shows the effective configuration,
+// secrets redacted, in the file format.
+const (
+	ConfigFileEnv  = "CONFIG_FILE"
+	ConfigRedacted = "<redacted>"
+)
+
+type Config struct {
+	Host            string
+	Port            uint
+	Store           string
+	SqlitePath      string
+	StoreBatchSize  int
+	Redis           RedisConfig
+	ServiceApiKey   string
+	AdminApiKey     string
+	ApiKeysRequired bool
+	LogLevel        string
+	TracesExporter  string
+	TracesFile      string
+	DrainDelay      time.Duration
+	DrainTimeout    time.Duration
+	Timeouts        *RouteTimeouts
+
+	WebhookMaxAttempts  int
+	WebhookRetention    time.Duration
+	WebhookAllowPrivate bool
+	OutboxRetention     time.Duration
+
+	PrintConfig bool
+
+	flags   *flag.FlagSet
+	options []ConfigOption
+}
+
+// ConfigOption ties a flag to its key in the file and its environment
+// variable.  List options take comma separated values from the file and
+// the environment, and may be repeated on the command line.  Secrets are
+// hidden by -print-config, Redact hides part of a value instead.
+type ConfigOption struct {
+	Flag   string
+	Key    string
+	Env    string
+	Secret bool
+	List   bool
+	Redact func(string) string
+}
+
+// listValue is the flag of a list option.  Set adds to the list, Reset
+// empties it so a source replaces the list given by the ones below it
+// rather than adding to it.
+type listValue interface {
+	flag.Value
+	Reset()
+}
+
+// ServiceConfig is the part of the configuration owned by one service.
+// Register adds its flags and returns their options, Validate checks
+// them once everything is loaded.
+type ServiceConfig interface {
+	Register(fs *flag.FlagSet) []ConfigOption
+	Validate() []error
+}
+
+func (cfg *Config) register(fs *flag.FlagSet, port uint) {
+	//Note some networking lingo, some frameworks start the server on localhost
+	//this is a local-only interface and is fine for testing but its not accessible
+	//from other machines.  To make the server accessible from other machines, we
+	//need to listen on an interface, that could be an IP address, but modern
+	//cloud servers may have multiple network interfaces for scale.  With TCP/IP
+	//the address 0.0.0.0 instructs the network stack to listen on all interfaces
+	fs.StringVar(&cfg.Host, "h", "0.0.0.0", "Listen on all interfaces")
+	fs.UintVar(&cfg.Port, "p", port, "Default Port")
+
+	//Where the records are kept, see store.go.  The redis-* settings only
+	//matter with the redis store.
+	fs.StringVar(&cfg.Store, "store", StoreRedis, "redis, sqlite or memory")
+	fs.StringVar(&cfg.SqlitePath, "sqlite-path", SqliteDefaultPath, "Database file of the sqlite store")
+	fs.IntVar(&cfg.StoreBatchSize, "store-batch-size", StoreDefaultBatchSize, "Keys read per round trip when listing")
+	cfg.Redis.register(fs)
+
+	fs.StringVar(&cfg.ServiceApiKey, "service-api-key", "", "Api key used to call the other services")
+	fs.StringVar(&cfg.AdminApiKey, "api-admin-key", "", "Bootstrap key with every scope")
+	fs.BoolVar(&cfg.ApiKeysRequired, "api-keys-required", false, "Reject requests without an api key")
+	fs.IntVar(&cfg.WebhookMaxAttempts, "webhook-max-attempts", WebhookDefaultMaxAttempts, "Failed attempts before a webhook delivery is dead")
+	fs.DurationVar(&cfg.WebhookRetention, "webhook-retention", WebhookDefaultRetention, "How long finished webhook deliveries are kept")
+	fs.BoolVar(&cfg.WebhookAllowPrivate, "webhook-allow-private", false, "Let webhooks post to loopback and private addresses")
+	fs.DurationVar(&cfg.OutboxRetention, "outbox-retention", OutboxDefaultRetention, "How long relayed events stay in the event feed")
+
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "debug, info, warn or error")
+	fs.StringVar(&cfg.TracesExporter, "traces-exporter", TracesExporterNone, "none, stdout or file")
+	fs.StringVar(&cfg.TracesFile, "traces-file", TracesDefaultFile, "File written by the file trace exporter")
+
+	//On shutdown the service reports not ready for drain-delay, then
+	//waits up to drain-timeout for in-flight requests to finish
+	fs.DurationVar(&cfg.DrainDelay, "drain-delay", DefaultDrainDelay, "Time to report not ready before draining")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", DefaultDrainTimeout, "Time allowed for in-flight requests on shutdown")
+
+	//Deadlines for the request contexts, see deadline.go
+	fs.DurationVar(&cfg.Timeouts.Default, "request-timeout", DefaultRequestTimeout, "Deadline for a request, 0 for none")
+	fs.Var(cfg.Timeouts, "route-timeout", "Deadline for one route, e.g. \"GET /thing/:id=2s\", may be repeated")
+
+	cfg.options = []ConfigOption{
+		{Flag: "h", Key: "host", Env: "HOST"},
+		{Flag: "p", Key: "port", Env: "PORT"},
+		{Flag: "store", Key: "store", Env: "STORE"},
+		{Flag: "sqlite-path", Key: "sqlite-path", Env: "SQLITE_PATH"},
+		{Flag: "store-batch-size", Key: "store-batch-size", Env: "STORE_BATCH_SIZE"},
+		{Flag: "service-api-key", Key: "service-api-key", Env: "SERVICE_API_KEY", Secret: true},
+		{Flag: "api-admin-key", Key: "api-admin-key", Env: "API_ADMIN_KEY", Secret: true},
+		{Flag: "api-keys-required", Key: "api-keys-required", Env: "API_KEYS_REQUIRED"},
+		{Flag: "webhook-max-attempts", Key: "webhook-max-attempts", Env: "WEBHOOK_MAX_ATTEMPTS"},
+		{Flag: "webhook-retention", Key: "webhook-retention", Env: "WEBHOOK_RETENTION"},
+		{Flag: "webhook-allow-private", Key: "webhook-allow-private", Env: "WEBHOOK_ALLOW_PRIVATE"},
+		{Flag: "outbox-retention", Key: "outbox-retention", Env: "OUTBOX_RETENTION"},
+		{Flag: "log-level", Key: "log-level", Env: "LOG_LEVEL"},
+		{Flag: "traces-exporter", Key: "traces-exporter", Env: "OTEL_TRACES_EXPORTER"},
+		{Flag: "traces-file", Key: "traces-file", Env: "OTEL_TRACES_FILE"},
+		{Flag: "drain-delay", Key: "drain-delay", Env: "DRAIN_DELAY"},
+		{Flag: "drain-timeout", Key: "drain-timeout", Env: "DRAIN_TIMEOUT"},
+		{Flag: "request-timeout", Key: "request-timeout", Env: "REQUEST_TIMEOUT"},
+		{Flag: "route-timeout", Key: "route-timeouts", Env: "ROUTE_TIMEOUTS", List: true},
+	}
+	cfg.options = append(cfg.options, redisOptions...)
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+
+	if cfg.Port == 0 || cfg.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is out of range", cfg.Port))
+	}
+
+	switch cfg.Store {
+	case StoreRedis:
+		errs = append(errs, cfg.Redis.validate()...)
+	case StoreSqlite:
+		if cfg.SqlitePath == "" {
+			errs = append(errs, errors.New("sqlite-path: required by the sqlite store"))
+		}
+	case StoreMemory:
+	default:
+		errs = append(errs, fmt.Errorf("store: unknown store %q", cfg.Store))
+	}
+	if cfg.StoreBatchSize < 1 || cfg.StoreBatchSize > StoreMaxBatchSize {
+		errs = append(errs, fmt.Errorf("store-batch-size: %d is not between 1 and %d", cfg.StoreBatchSize, StoreMaxBatchSize))
+	}
+	if cfg.WebhookMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhook-max-attempts: %d is not positive", cfg.WebhookMaxAttempts))
+	}
+	if cfg.WebhookRetention < time.Minute {
+		errs = append(errs, fmt.Errorf("webhook-retention: %s is less than a minute", cfg.WebhookRetention))
+	}
+	if cfg.OutboxRetention < time.Minute {
+		errs = append(errs, fmt.Errorf("outbox-retention: %s is less than a minute", cfg.OutboxRetention))
+	}
+	errs = append(errs, validateCommon(cfg)...)
+	return errors.Join(errs...)
+}
+
+//------------------------------------------------------------
+// LOADING
+//------------------------------------------------------------
+
+// LoadConfig builds the configuration of the service from the defaults,
+// the config file, the environment and the command line arguments, in
+// that order.  The service adds its own settings through svc.
+func LoadConfig(name string, port uint, args []string, svc ServiceConfig) (*Config, error) {
+	cfg := &Config{Timeouts: NewRouteTimeouts()}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var configFile string
+	fs.StringVar(&configFile, "config", "", "YAML config file, also "+ConfigFileEnv)
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "Print the effective configuration and exit")
+
+	cfg.register(fs, port)
+	cfg.options = append(cfg.options, svc.Register(fs)...)
+	cfg.flags = fs
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	//Flags given on the command line are final
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	if configFile == "" {
+		configFile = os.Getenv(ConfigFileEnv)
+	}
+
+	if configFile != "" {
+		if err := cfg.loadFile(configFile, explicit); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range cfg.options {
+		value, ok := os.LookupEnv(opt.Env)
+		if !ok || explicit[opt.Flag] {
+			continue
+		}
+		if err := cfg.set(opt, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", opt.Env, err)
+		}
+	}
+
+	if err := errors.Join(cfg.validate(), errors.Join(svc.Validate()...)); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, value := range values {
+		opt, ok := cfg.option(key)
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		if explicit[opt.Flag] {
+			continue
+		}
+
+		if err := cfg.setFromFile(opt, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *Config) option(key string) (ConfigOption, bool) {
+	for _, opt := range cfg.options {
+		if opt.Key == key {
+			return opt, true
+		}
+	}
+	return ConfigOption{}, false
+}
+
+// Lists may be written in the file as a YAML list, a mapping (for route
+// timeouts, route: duration) or a comma separated string
+func (cfg *Config) setFromFile(opt ConfigOption, value any) error {
+	switch v := value.(type) {
+	case []any:
+		cfg.resetList(opt)
+		for _, item := range v {
+			if err := cfg.flags.Set(opt.Flag, fmt.Sprint(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		cfg.resetList(opt)
+		for k, item := range v {
+			if err := cfg.flags.Set(opt.Flag, fmt.Sprintf("%s=%v", k, item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case nil:
+		return nil
+	}
+
+	return cfg.set(opt, fmt.Sprint(value))
+}
+
+func (cfg *Config) set(opt ConfigOption, value string) error {
+	if !opt.List {
+		return cfg.flags.Set(opt.Flag, value)
+	}
+
+	cfg.resetList(opt)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if err := cfg.flags.Set(opt.Flag, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetList empties a list option before a source sets it, the whole list
+// comes from the highest source giving it
+func (cfg *Config) resetList(opt ConfigOption) {
+	if list, ok := cfg.flags.Lookup(opt.Flag).Value.(listValue); ok && opt.List {
+		list.Reset()
+	}
+}
+
+//------------------------------------------------------------
+// VALIDATION
+//------------------------------------------------------------
+
+func validateCommon(cfg *Config) []error {
+	var errs []error
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log-level: %w", err))
+	}
+
+	switch strings.ToLower(cfg.TracesExporter) {
+	case TracesExporterNone, TracesExporterStd, TracesExporterFile:
+	default:
+		errs = append(errs, fmt.Errorf("traces-exporter: unknown exporter %q", cfg.TracesExporter))
+	}
+
+	durations := map[string]time.Duration{
+		"drain-delay":     cfg.DrainDelay,
+		"drain-timeout":   cfg.DrainTimeout,
+		"request-timeout": cfg.Timeouts.Default,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s: %s is negative", name, d))
+		}
+	}
+
+	return errs
+}
+
+func validateHostPort(name string, value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("%s: %q is not a host:port address", name, value)
+	}
+	return nil
+}
+
+func ValidateServiceUrl(name string, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: %q is not an http(s) URL", name, value)
+	}
+	return nil
+}
+
+//------------------------------------------------------------
+// PRINTING
+//------------------------------------------------------------
+
+// Print writes the effective configuration as a config file
+func (cfg *Config) Print(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, opt := range cfg.options {
+		value := cfg.flags.Lookup(opt.Flag).Value.String()
+		if opt.Secret && value != "" {
+			value = ConfigRedacted
+		}
+		if opt.Redact != nil {
+			value = opt.Redact(value)
+		}
+
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: opt.Key},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value},
+		)
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testServiceConfig struct {
+	Url string
+}
+
+func (s *testServiceConfig) Register(fs *flag.FlagSet) []ConfigOption {
+	fs.StringVar(&s.Url, "other-url", "http://localhost:1", "")
+	return []ConfigOption{{Flag: "other-url", Key: "other-url", Env: "OTHER_URL"}}
+}
+
+func (s *testServiceConfig) Validate() []error {
+	return []error{ValidateServiceUrl("other-url", s.Url)}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "port: 4000\nlog-level: debug\nother-url: http://file:1\n")
+	t.Setenv(ConfigFileEnv, path)
+	t.Setenv("LOG_LEVEL", "warn")
+
+	svc := &testServiceConfig{}
+	cfg, err := LoadConfig("test", 9000, []string{"-log-level", "error"}, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != 4000 {
+		t.Errorf("port = %d, want the file's 4000", cfg.Port)
+	}
+	if cfg.LogLevel != "error" {
+		t.Errorf("log-level = %s, want the flag's error", cfg.LogLevel)
+	}
+	if svc.Url != "http://file:1" {
+		t.Errorf("other-url = %s, want the file's", svc.Url)
+	}
+}
+
+func TestLoadConfigListReplacedByHigherSource(t *testing.T) {
+	path := writeConfigFile(t, `route-timeouts:
+  GET /a: 1s
+  GET /b: 2s
+redis-addrs: [file-1:6379, file-2:6379]
+`)
+	t.Setenv(ConfigFileEnv, path)
+	t.Setenv("ROUTE_TIMEOUTS", "GET /c=3s")
+	t.Setenv("REDIS_ADDRS", "env:6379")
+
+	cfg, err := LoadConfig("test", 9000, nil, &testServiceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantRoutes := map[string]time.Duration{"GET /c": 3 * time.Second}
+	if !reflect.DeepEqual(cfg.Timeouts.Routes, wantRoutes) {
+		t.Errorf("route timeouts = %v, want only the environment's %v", cfg.Timeouts.Routes, wantRoutes)
+	}
+	if got := []string(cfg.Redis.Addrs); !reflect.DeepEqual(got, []string{"env:6379"}) {
+		t.Errorf("redis addrs = %v, want only the environment's", got)
+	}
+}
+
+func TestLoadConfigListFromOneSource(t *testing.T) {
+	path := writeConfigFile(t, "redis-addrs: file-1:6379, file-2:6379\n")
+	t.Setenv(ConfigFileEnv, path)
+
+	cfg, err := LoadConfig("test", 9000, []string{"-route-timeout", "GET /a=1s", "-route-timeout", "GET /b=2s"}, &testServiceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Timeouts.Routes) != 2 {
+		t.Errorf("route timeouts = %v, want both flags", cfg.Timeouts.Routes)
+	}
+	if got := []string(cfg.Redis.Addrs); !reflect.DeepEqual(got, []string{"file-1:6379", "file-2:6379"}) {
+		t.Errorf("redis addrs = %v, want the file's two", got)
+	}
+}
+
+func TestLoadConfigValidatesService(t *testing.T) {
+	t.Setenv("OTHER_URL", "not a url")
+
+	_, err := LoadConfig("test", 9000, nil, &testServiceConfig{})
+	if err == nil || !strings.Contains(err.Error(), "other-url") {
+		t.Errorf("err = %v, want the service's other-url check", err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg, err := LoadConfig("test", 9000, []string{"-api-admin-key", "s3cret"}, &testServiceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cret") || !strings.Contains(out.String(), "api-admin-key: "+ConfigRedacted) {
+		t.Errorf("printed config does not redact the admin key:\n%s", out.String())
+	}
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server side deadlines.  Every request context gets a deadline, so a slow
+// redis or downstream API can't hold a handler forever, and the work is
+// cancelled as soon as the client goes away.  The default comes from
+// -request-timeout, routes can be given their own with -route-timeout
+// "METHOD /route=duration" using the gin pattern, e.g. "GET /vote/:id=2s".
+// A timeout of 0 means no deadline.
+const DefaultRequestTimeout = 10 * time.Second
+
+type RouteTimeouts struct {
+	Default time.Duration
+	Routes  map[string]time.Duration
+}
+
+func NewRouteTimeouts() *RouteTimeouts {
+	return &RouteTimeouts{
+		Default: DefaultRequestTimeout,
+		Routes:  map[string]time.Duration{},
+	}
+}
+
+// String and Set make RouteTimeouts a flag.Value, so -route-timeout can be
+// repeated
+func (rt *RouteTimeouts) String() string {
+	if rt == nil {
+		return ""
+	}
+
+	var routes []string
+	for route, timeout := range rt.Routes {
+		routes = append(routes, fmt.Sprintf("%s=%s", route, timeout))
+	}
+	sort.Strings(routes)
+	return strings.Join(routes, ",")
+}
+
+func (rt *RouteTimeouts) Set(value string) error {
+	route, timeout, found := strings.Cut(value, "=")
+	method, path, hasPath := strings.Cut(strings.TrimSpace(route), " ")
+	if !found || !hasPath || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("route timeout %q must look like \"METHOD /route=duration\"", value)
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(timeout))
+	if err != nil || d < 0 {
+		return fmt.Errorf("route timeout %q has an invalid duration", value)
+	}
+
+	rt.Routes[strings.ToUpper(method)+" "+strings.TrimSpace(path)] = d
+	return nil
+}
+
+// Reset drops the routes, a config source giving route-timeouts replaces
+// the ones of the sources below it
+func (rt *RouteTimeouts) Reset() {
+	rt.Routes = map[string]time.Duration{}
+}
+
+// NoDeadline exempts a long lived route, e.g. an event stream, from the
+// default timeout.  A timeout configured for the route still applies.
+func (rt *RouteTimeouts) NoDeadline(route string) {
+	if _, ok := rt.Routes[route]; !ok {
+		rt.Routes[route] = 0
+	}
+}
+
+func (rt *RouteTimeouts) timeoutFor(method string, route string) time.Duration {
+	if d, ok := rt.Routes[method+" "+route]; ok {
+		return d
+	}
+	return rt.Default
+}
+
+// deadlineWriter answers 504 instead of whatever error the handler picked
+// when the failure came from the deadline running out
+type deadlineWriter struct {
+	gin.ResponseWriter
+	ctx context.Context
+}
+
+func (w *deadlineWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		code = http.StatusGatewayTimeout
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (rt *RouteTimeouts) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := rt.timeoutFor(c.Request.Method, c.FullPath())
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Writer = &deadlineWriter{ResponseWriter: c.Writer, ctx: ctx}
+		c.Next()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			LogFrom(ctx).Warn("Request deadline exceeded", "timeout", timeout.String())
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Poll eligibility.  A poll without eligibility rules is open to every
+// voter.  Otherwise a voter may vote when any of the declared rules admits
+// them: they are on the explicit voter list, they belong to one of the
+// groups, or they match every attribute predicate.
+//
+// The PollApi and the VoteAPI carry the same copy of this file, the VoteAPI
+// evaluates it when a vote is cast and the PollApi to list eligible voters.
+const (
+	PredicateEq     = "eq"
+	PredicateNe     = "ne"
+	PredicateIn     = "in"
+	PredicateExists = "exists"
+	PredicateGte    = "gte"
+	PredicateLte    = "lte"
+
+	VoterDateOfBirthLayout = "2006-01-02"
+)
+
+var ErrNotEligible = errors.New("voter is not eligible to vote in this poll")
+
+// AttributePredicate tests one attribute of a voter.  Attribute is one of
+// District, Email, Age, Address.<field> or Attributes.<key>.  Age is
+// computed from the date of birth and is the only numeric attribute.
+type AttributePredicate struct {
+	Attribute string   `json:"attribute"`
+	Op        string   `json:"op"`
+	Value     string   `json:"value,omitempty"`
+	Values    []string `json:"values,omitempty"`
+}
+
+type Eligibility struct {
+	Groups     []string             `json:"groups,omitempty"`
+	Attributes []AttributePredicate `json:"attributes,omitempty"`
+	Voters     []uint               `json:"voters,omitempty"`
+}
+
+// EligibilityVoter is the part of a VoterAPI voter record that eligibility
+// rules can look at
+type EligibilityVoter struct {
+	VoterID     uint              `json:"id"`
+	FirstName   string            `json:"FirstName"`
+	LastName    string            `json:"LastName"`
+	Email       string            `json:"Email"`
+	DateOfBirth string            `json:"DateOfBirth"`
+	District    string            `json:"District"`
+	Address     map[string]string `json:"Address"`
+	Attributes  map[string]string `json:"Attributes"`
+	Groups      []string          `json:"Groups"`
+}
+
+func (e *Eligibility) IsEmpty() bool {
+	return e == nil || (len(e.Groups) == 0 && len(e.Attributes) == 0 && len(e.Voters) == 0)
+}
+
+func ValidateEligibility(e *Eligibility) error {
+	if e == nil {
+		return nil
+	}
+
+	for _, p := range e.Attributes {
+		attr, key, _ := strings.Cut(p.Attribute, ".")
+		switch attr {
+		case "District", "Email", "Age":
+		case "Address", "Attributes":
+			if key == "" {
+				return fmt.Errorf("attribute %q needs a field name, e.g. %s.<name>", p.Attribute, attr)
+			}
+		default:
+			return fmt.Errorf("unknown attribute %q", p.Attribute)
+		}
+
+		switch p.Op {
+		case PredicateEq, PredicateNe, PredicateExists:
+		case PredicateIn:
+			if len(p.Values) == 0 {
+				return fmt.Errorf("predicate on %q needs values for op in", p.Attribute)
+			}
+		case PredicateGte, PredicateLte:
+			if _, err := strconv.ParseFloat(p.Value, 64); err != nil {
+				return fmt.Errorf("predicate on %q needs a numeric value for op %s", p.Attribute, p.Op)
+			}
+		default:
+			return fmt.Errorf("unknown predicate op %q", p.Op)
+		}
+	}
+
+	return nil
+}
+
+func (v *EligibilityVoter) attribute(name string) (string, bool) {
+	attr, key, _ := strings.Cut(name, ".")
+
+	var value string
+	switch attr {
+	case "District":
+		value = v.District
+	case "Email":
+		value = v.Email
+	case "Age":
+		dob, err := time.Parse(VoterDateOfBirthLayout, v.DateOfBirth)
+		if err != nil {
+			return "", false
+		}
+		now := time.Now()
+		age := now.Year() - dob.Year()
+		if now.Month() < dob.Month() || (now.Month() == dob.Month() && now.Day() < dob.Day()) {
+			age--
+		}
+		value = strconv.Itoa(age)
+	case "Address":
+		value = v.Address[key]
+	case "Attributes":
+		value = v.Attributes[key]
+	}
+
+	return value, value != ""
+}
+
+func (p *AttributePredicate) matches(v *EligibilityVoter) bool {
+	value, ok := v.attribute(p.Attribute)
+
+	switch p.Op {
+	case PredicateExists:
+		return ok
+	case PredicateEq:
+		return ok && value == p.Value
+	case PredicateNe:
+		return value != p.Value
+	case PredicateIn:
+		for _, candidate := range p.Values {
+			if ok && value == candidate {
+				return true
+			}
+		}
+		return false
+	case PredicateGte, PredicateLte:
+		have, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			return false
+		}
+		want, err := strconv.ParseFloat(p.Value, 64)
+		if err != nil {
+			return false
+		}
+		if p.Op == PredicateGte {
+			return have >= want
+		}
+		return have <= want
+	}
+
+	return false
+}
+
+// Admits reports whether the voter may vote under these rules
+func (e *Eligibility) Admits(v *EligibilityVoter) bool {
+	if e.IsEmpty() {
+		return true
+	}
+
+	for _, id := range e.Voters {
+		if id == v.VoterID {
+			return true
+		}
+	}
+
+	for _, group := range e.Groups {
+		for _, member := range v.Groups {
+			if group == member {
+				return true
+			}
+		}
+	}
+
+	if len(e.Attributes) == 0 {
+		return false
+	}
+
+	for _, p := range e.Attributes {
+		if !p.matches(v) {
+			return false
+		}
+	}
+
+	return true
+}
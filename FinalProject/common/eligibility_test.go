@@ -0,0 +1,95 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// birthday returns the date of birth of someone turning years old today
+func birthday(years int) string {
+	return time.Now().AddDate(-years, 0, 0).Format(VoterDateOfBirthLayout)
+}
+
+func TestEligibilityAdmits(t *testing.T) {
+	ada := &EligibilityVoter{
+		VoterID:     1,
+		Email:       "ada@example.com",
+		DateOfBirth: birthday(36),
+		District:    "5",
+		Address:     map[string]string{"City": "London"},
+		Attributes:  map[string]string{"role": "engineer"},
+		Groups:      []string{"engineering", "district-5"},
+	}
+	kid := &EligibilityVoter{VoterID: 2, DateOfBirth: birthday(17), District: "6"}
+
+	age := func(op, value string) AttributePredicate {
+		return AttributePredicate{Attribute: "Age", Op: op, Value: value}
+	}
+
+	cases := []struct {
+		name  string
+		rules *Eligibility
+		voter *EligibilityVoter
+		want  bool
+	}{
+		{"no rules", nil, kid, true},
+		{"empty rules", &Eligibility{}, kid, true},
+		{"on the voter list", &Eligibility{Voters: []uint{2, 3}}, kid, true},
+		{"off the voter list", &Eligibility{Voters: []uint{3}}, kid, false},
+		{"in a group", &Eligibility{Groups: []string{"sales", "engineering"}}, ada, true},
+		{"in no group", &Eligibility{Groups: []string{"sales"}}, ada, false},
+		{"group or voter list", &Eligibility{Groups: []string{"sales"}, Voters: []uint{1}}, ada, true},
+		{"eq", &Eligibility{Attributes: []AttributePredicate{{Attribute: "District", Op: PredicateEq, Value: "5"}}}, ada, true},
+		{"eq other value", &Eligibility{Attributes: []AttributePredicate{{Attribute: "District", Op: PredicateEq, Value: "5"}}}, kid, false},
+		{"ne", &Eligibility{Attributes: []AttributePredicate{{Attribute: "District", Op: PredicateNe, Value: "5"}}}, kid, true},
+		{"ne missing", &Eligibility{Attributes: []AttributePredicate{{Attribute: "Attributes.role", Op: PredicateNe, Value: "engineer"}}}, kid, true},
+		{"in", &Eligibility{Attributes: []AttributePredicate{{Attribute: "Address.City", Op: PredicateIn, Values: []string{"Paris", "London"}}}}, ada, true},
+		{"in missing", &Eligibility{Attributes: []AttributePredicate{{Attribute: "Address.City", Op: PredicateIn, Values: []string{"London"}}}}, kid, false},
+		{"exists", &Eligibility{Attributes: []AttributePredicate{{Attribute: "Email", Op: PredicateExists}}}, ada, true},
+		{"exists missing", &Eligibility{Attributes: []AttributePredicate{{Attribute: "Email", Op: PredicateExists}}}, kid, false},
+		{"gte age", &Eligibility{Attributes: []AttributePredicate{age(PredicateGte, "18")}}, ada, true},
+		{"gte age under", &Eligibility{Attributes: []AttributePredicate{age(PredicateGte, "18")}}, kid, false},
+		{"lte age", &Eligibility{Attributes: []AttributePredicate{age(PredicateLte, "17")}}, kid, true},
+		{"age on the birthday", &Eligibility{Attributes: []AttributePredicate{age(PredicateGte, "36")}}, ada, true},
+		{"age without a date of birth", &Eligibility{Attributes: []AttributePredicate{age(PredicateGte, "0")}}, &EligibilityVoter{VoterID: 3}, false},
+		{"every predicate", &Eligibility{Attributes: []AttributePredicate{
+			{Attribute: "District", Op: PredicateEq, Value: "5"},
+			{Attribute: "Attributes.role", Op: PredicateEq, Value: "manager"},
+		}}, ada, false},
+		{"predicates or group", &Eligibility{Groups: []string{"district-5"}, Attributes: []AttributePredicate{age(PredicateLte, "17")}}, ada, true},
+	}
+
+	for _, tc := range cases {
+		if got := tc.rules.Admits(tc.voter); got != tc.want {
+			t.Errorf("%s: Admits = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidateEligibility(t *testing.T) {
+	cases := []struct {
+		name      string
+		predicate AttributePredicate
+		valid     bool
+	}{
+		{"eq", AttributePredicate{Attribute: "District", Op: PredicateEq, Value: "5"}, true},
+		{"address field", AttributePredicate{Attribute: "Address.City", Op: PredicateExists}, true},
+		{"address without field", AttributePredicate{Attribute: "Address", Op: PredicateExists}, false},
+		{"unknown attribute", AttributePredicate{Attribute: "Shoe", Op: PredicateEq, Value: "42"}, false},
+		{"unknown op", AttributePredicate{Attribute: "District", Op: "like", Value: "5"}, false},
+		{"in without values", AttributePredicate{Attribute: "District", Op: PredicateIn}, false},
+		{"gte not a number", AttributePredicate{Attribute: "Age", Op: PredicateGte, Value: "adult"}, false},
+		{"lte", AttributePredicate{Attribute: "Age", Op: PredicateLte, Value: "65"}, true},
+	}
+
+	for _, tc := range cases {
+		err := ValidateEligibility(&Eligibility{Attributes: []AttributePredicate{tc.predicate}})
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: err = %v, want valid %v", tc.name, err, tc.valid)
+		}
+	}
+
+	if err := ValidateEligibility(nil); err != nil {
+		t.Errorf("no rules: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Health reporting.  /livez only says the process is up and serving,
+// /readyz runs the registered checks (the store, downstream APIs) and answers
+// 503 when any of them fails, so orchestrators hold traffic back until the
+// service can actually do its job.
+const (
+	ServiceVersion     = "1.0.0"
+	LivenessPath       = "/livez"
+	ReadinessPath      = "/readyz"
+	HealthCheckTimeout = 2 * time.Second
+)
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type Health struct {
+	started  time.Time
+	requests atomic.Uint64
+	errors   atomic.Uint64
+	checks   []healthCheck
+	stopping atomic.Bool
+}
+
+func NewHealth() *Health {
+	return &Health{started: time.Now()}
+}
+
+// AddCheck registers a readiness check, it must be done before the
+// server starts
+func (h *Health) AddCheck(name string, check func(ctx context.Context) error) {
+	h.checks = append(h.checks, healthCheck{name, check})
+}
+
+// SetShuttingDown makes readiness fail from now on, so traffic moves away
+// while the server drains
+func (h *Health) SetShuttingDown() {
+	h.stopping.Store(true)
+}
+
+// Middleware counts the requests served and the ones that failed on our
+// side (5xx), the probes themselves are left out
+func (h *Health) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		switch c.FullPath() {
+		case LivenessPath, ReadinessPath:
+			return
+		}
+
+		h.requests.Add(1)
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			h.errors.Add(1)
+		}
+	}
+}
+
+// Ready runs every check concurrently and returns the result per check
+func (h *Health) Ready(ctx context.Context) (bool, map[string]string) {
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ready := true
+	results := map[string]string{}
+
+	for _, hc := range h.checks {
+		wg.Add(1)
+		go func(hc healthCheck) {
+			defer wg.Done()
+
+			status := "ok"
+			if err := hc.check(ctx); err != nil {
+				status = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[hc.name] = status
+			if status != "ok" {
+				ready = false
+			}
+		}(hc)
+	}
+
+	wg.Wait()
+
+	if h.stopping.Load() {
+		ready = false
+		results["shutdown"] = "draining"
+	}
+
+	return ready, results
+}
+
+func (h *Health) Register(r *gin.Engine, healthPath string) {
+	r.GET(LivenessPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "alive"})
+	})
+
+	r.GET(ReadinessPath, func(c *gin.Context) {
+		ready, checks := h.Ready(c.Request.Context())
+
+		status, code := "ready", http.StatusOK
+		if !ready {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+
+		c.JSON(code, gin.H{
+			"status": status,
+			"checks": checks,
+		})
+	})
+
+	r.GET(healthPath, func(c *gin.Context) {
+		ready, checks := h.Ready(c.Request.Context())
+
+		status := "ok"
+		if !ready {
+			status = "degraded"
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":             status,
+			"version":            ServiceVersion,
+			"uptime_seconds":     int64(time.Since(h.started).Seconds()),
+			"requests_processed": h.requests.Load(),
+			"errors_encountered": h.errors.Load(),
+			"checks":             checks,
+		})
+	})
+}
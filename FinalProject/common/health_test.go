@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthRouter serves the probes and /thing/health, GET /ok and GET /fail
+// are counted by the middleware
+func healthRouter(h *Health) *gin.Engine {
+	r := gin.New()
+	r.Use(h.Middleware())
+	h.Register(r, "/thing/health")
+	r.GET("/ok", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/fail", func(c *gin.Context) { c.Status(http.StatusBadGateway) })
+	return r
+}
+
+func probe(t *testing.T, r http.Handler, path string) (int, map[string]any) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return w.Code, body
+}
+
+func TestReadinessRunsTheChecks(t *testing.T) {
+	var storeDown atomic.Bool
+	h := NewHealth()
+	h.AddCheck("redis", func(ctx context.Context) error {
+		if storeDown.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	h.AddCheck("voter-api", func(ctx context.Context) error { return nil })
+	r := healthRouter(h)
+
+	code, body := probe(t, r, ReadinessPath)
+	if code != http.StatusOK || body["status"] != "ready" {
+		t.Errorf("ready: %d %v", code, body)
+	}
+
+	storeDown.Store(true)
+	code, body = probe(t, r, ReadinessPath)
+	checks, _ := body["checks"].(map[string]any)
+	if code != http.StatusServiceUnavailable || checks["redis"] != "connection refused" || checks["voter-api"] != "ok" {
+		t.Errorf("store down: %d %v, want a 503 naming the failing check", code, body)
+	}
+
+	//The process is still alive, only not ready
+	if code, body := probe(t, r, LivenessPath); code != http.StatusOK || body["status"] != "alive" {
+		t.Errorf("liveness with the store down: %d %v", code, body)
+	}
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	h := NewHealth()
+	h.AddCheck("redis", func(ctx context.Context) error { return nil })
+	r := healthRouter(h)
+
+	h.SetShuttingDown()
+	code, body := probe(t, r, ReadinessPath)
+	checks, _ := body["checks"].(map[string]any)
+	if code != http.StatusServiceUnavailable || checks["shutdown"] != "draining" {
+		t.Errorf("draining: %d %v, want a 503", code, body)
+	}
+	if code, _ := probe(t, r, LivenessPath); code != http.StatusOK {
+		t.Errorf("liveness while draining: %d", code)
+	}
+}
+
+// The health report counts the requests served and the 5xx, not the probes
+func TestHealthReportCountsRequests(t *testing.T) {
+	h := NewHealth()
+	h.AddCheck("redis", func(ctx context.Context) error { return errors.New("timeout") })
+	r := healthRouter(h)
+
+	for _, path := range []string{"/ok", "/ok", "/fail", LivenessPath, ReadinessPath} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	code, body := probe(t, r, "/thing/health")
+	if code != http.StatusOK {
+		t.Errorf("health: %d", code)
+	}
+	if body["status"] != "degraded" || body["version"] != ServiceVersion {
+		t.Errorf("health = %v, want degraded at %s", body, ServiceVersion)
+	}
+	if body["requests_processed"] != 3.0 || body["errors_encountered"] != 1.0 {
+		t.Errorf("requests %v, errors %v, want 3 and 1", body["requests_processed"], body["errors_encountered"])
+	}
+	if _, ok := body["uptime_seconds"]; !ok {
+		t.Errorf("health = %v, want uptime_seconds", body)
+	}
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Structured logging with log/slog, every line is a JSON object.  Lines
+// written while serving a request carry its request ID and route, and the
+// voter and poll IDs once the handler knows them.  The request ID comes
+// from the X-Request-ID header when the caller sends one, otherwise one is
+// generated, and it is passed on to the services we call.
+//
+// The level starts at the configured log-level (default info) and can be
+// changed at runtime through /admin/log-level, which needs a key with the
+// admin scope.
+const (
+	RequestIDHeader    = "X-Request-ID"
+	RequestIDMaxLength = 128
+	LogLevelPath       = "/admin/log-level"
+)
+
+var logLevel = new(slog.LevelVar)
+
+type requestIDKey struct{}
+type requestLogKey struct{}
+
+// requestLog is shared by everything handling the request, so attributes
+// added by a handler also show up on the access log line
+type requestLog struct {
+	logger *slog.Logger
+}
+
+// InitLogging installs the JSON logger as the default, the standard log
+// package is routed through it as well
+func InitLogging(serviceName string, level string) {
+	//The level was validated with the rest of the config
+	logLevel.UnmarshalText([]byte(level))
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(handler).With("service", serviceName))
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestLogMiddleware sets up the request scoped logger and writes one
+// access log line per request.  It goes after otelgin so the lines can be
+// matched with the trace.
+func RequestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > RequestIDMaxLength {
+			id = newRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		logger := slog.Default().With(
+			"request_id", id,
+			"method", c.Request.Method,
+			"route", route,
+		)
+		if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String())
+		}
+
+		rl := &requestLog{logger: logger}
+		ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, requestLogKey{}, rl)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		rl.logger.Log(ctx, level, "Request served",
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// RecoveryMiddleware replaces gin's recovery so panics are logged with
+// the request they happened in
+func RecoveryMiddleware() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		LogFrom(c.Request.Context()).Error("Panic while serving request", "panic", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
+
+// LogFrom returns the logger of the request ctx belongs to, or the default
+// logger outside of a request
+func LogFrom(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// LogWith adds attributes (voter_id, poll_id...) to every line logged for
+// the rest of the request and returns the updated logger
+func LogWith(c *gin.Context, args ...any) *slog.Logger {
+	rl, ok := c.Request.Context().Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return slog.Default().With(args...)
+	}
+	rl.logger = rl.logger.With(args...)
+	return rl.logger
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ForwardRequestID passes the request ID on with every call made through
+// the resty client, requests need SetContext for it to be known
+func ForwardRequestID(client *resty.Client) {
+	client.OnBeforeRequest(func(c *resty.Client, req *resty.Request) error {
+		if id := requestIDFrom(req.Context()); id != "" {
+			req.SetHeader(RequestIDHeader, id)
+		}
+		return nil
+	})
+}
+
+//------------------------------------------------------------
+// ROUTES
+//------------------------------------------------------------
+
+func RegisterLogLevelRoute(r *gin.Engine, keys *ApiKeyStore) {
+	admin := r.Group(LogLevelPath, keys.RequireScope(ApiKeyAdminScope))
+
+	admin.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"level": strings.ToLower(logLevel.Level().String())})
+	})
+
+	admin.PUT("", func(c *gin.Context) {
+		type LogLevel struct {
+			Level string `json:"level"`
+		}
+		var req LogLevel
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from log level PUT", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		previous := logLevel.Level()
+		if err := logLevel.UnmarshalText([]byte(req.Level)); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		LogFrom(c.Request.Context()).Info("Log level changed",
+			"from", previous.String(),
+			"to", logLevel.Level().String(),
+		)
+		c.JSON(http.StatusOK, gin.H{"level": strings.ToLower(logLevel.Level().String())})
+	})
+}
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+)
+
+// captureLogs makes the default logger write its JSON lines to the
+// returned buffer for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: logLevel})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line map[string]any
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func loggedRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(RequestLogMiddleware())
+	r.Use(RecoveryMiddleware())
+	r.GET("/voter/:id", func(c *gin.Context) {
+		LogWith(c, "voter_id", c.Param("id"))
+		LogFrom(c.Request.Context()).Warn("Looking the voter up")
+		c.Status(http.StatusNotFound)
+	})
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+	return r
+}
+
+// Every line of a request carries its ID and route, and the attributes a
+// handler adds show up on the access log line too
+func TestRequestLogLines(t *testing.T) {
+	buf := captureLogs(t)
+	r := loggedRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/voter/7", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if got := w.Header().Get(RequestIDHeader); got != "req-1" {
+		t.Errorf("response request id %q, want the caller's", got)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("%d lines logged, want the handler's and the access line", len(lines))
+	}
+	for _, line := range lines {
+		if line["request_id"] != "req-1" || line["route"] != "/voter/:id" || line["voter_id"] != "7" {
+			t.Errorf("line %v, want the request id, route and voter id", line)
+		}
+	}
+	access := lines[1]
+	if access["msg"] != "Request served" || access["status"] != 404.0 || access["path"] != "/voter/7" {
+		t.Errorf("access line %v", access)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	captureLogs(t)
+	r := loggedRouter()
+
+	for _, sent := range []string{"", strings.Repeat("x", RequestIDMaxLength+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/voter/7", nil)
+		if sent != "" {
+			req.Header.Set(RequestIDHeader, sent)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if got := w.Header().Get(RequestIDHeader); len(got) != 32 || got == sent {
+			t.Errorf("sent %d chars, got request id %q, want a generated one", len(sent), got)
+		}
+	}
+}
+
+func TestRecoveryLogsThePanic(t *testing.T) {
+	buf := captureLogs(t)
+	r := loggedRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", w.Code)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 || lines[0]["panic"] != "boom" || lines[1]["level"] != "ERROR" {
+		t.Errorf("lines %v, want the panic and an error access line", lines)
+	}
+	if lines[0]["request_id"] == nil || lines[0]["request_id"] != lines[1]["request_id"] {
+		t.Errorf("panic line %v isn't tied to the request", lines[0])
+	}
+}
+
+// The request ID of the caller goes along with the calls it makes
+func TestForwardRequestID(t *testing.T) {
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(RequestIDHeader)
+	}))
+	defer srv.Close()
+
+	client := resty.New()
+	ForwardRequestID(client)
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-2")
+	if _, err := client.R().SetContext(ctx).Get(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if received != "req-2" {
+		t.Errorf("downstream got request id %q, want req-2", received)
+	}
+
+	if _, err := client.R().Get(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if received != "" {
+		t.Errorf("call outside a request sent request id %q", received)
+	}
+}
+
+func TestLogLevelRoute(t *testing.T) {
+	captureLogs(t)
+	previous := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(previous) })
+
+	keys := NewApiKeyStore(newMemoryStore(), "admin-secret", true)
+	r := gin.New()
+	r.Use(keys.Middleware())
+	RegisterLogLevelRoute(r, keys)
+
+	put := func(body string, token string) int {
+		req := httptest.NewRequest(http.MethodPut, LogLevelPath, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", ApiKeyAuthScheme+" "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := put(`{"level":"debug"}`, ""); code != http.StatusUnauthorized {
+		t.Errorf("without a key: %d, want 401", code)
+	}
+	if code := put(`{"level":"loud"}`, "admin-secret"); code != http.StatusBadRequest {
+		t.Errorf("unknown level: %d, want 400", code)
+	}
+	if code := put(`{"level":"debug"}`, "admin-secret"); code != http.StatusOK {
+		t.Errorf("admin: %d, want 200", code)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("level %s, want debug", logLevel.Level())
+	}
+}
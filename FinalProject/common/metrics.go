@@ -0,0 +1,171 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served in the text format on /metrics.  The http,
+// redis, outbound and webhook metrics are the same in every service so
+// dashboards can be shared, each service registers its business counters
+// next to its own code.
+const MetricsPath = "/metrics"
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests served, by gin route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	redisCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_command_duration_seconds",
+		Help:    "Latency of the redis commands issued, by command.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+
+	redisCommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_command_errors_total",
+		Help: "Redis commands that failed, a missing key is not counted as a failure.",
+	}, []string{"command"})
+
+	outboundRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "outbound_request_duration_seconds",
+		Help:    "Latency of the calls made to other services, by downstream host and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"downstream", "method", "status"})
+
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Webhook delivery attempts, by result: delivered, retry or dead.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestDuration,
+		redisCommandDuration,
+		redisCommandErrors,
+		outboundRequestDuration,
+		webhookDeliveries,
+	)
+}
+
+func RegisterMetricsRoute(r *gin.Engine) {
+	r.GET(MetricsPath, gin.WrapH(promhttp.Handler()))
+}
+
+// MetricsMiddleware labels requests with the route pattern (/vote/:id)
+// rather than the raw path to keep the number of series bounded
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpRequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+//------------------------------------------------------------
+// REDIS
+//------------------------------------------------------------
+
+type redisStartKey struct{}
+
+// redisMetricsHook times every command sent through the go-redis client
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedisCommand(ctx, cmd)
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		observeRedisCommand(ctx, cmd)
+	}
+	return nil
+}
+
+func observeRedisCommand(ctx context.Context, cmd redis.Cmder) {
+	name := cmd.Name()
+
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		redisCommandDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+
+	if err := cmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
+		redisCommandErrors.WithLabelValues(name).Inc()
+	}
+}
+
+//------------------------------------------------------------
+// OUTBOUND CALLS
+//------------------------------------------------------------
+
+// InstrumentClient records every call made through the resty client,
+// failed connections are reported with the status "error"
+func InstrumentClient(client *resty.Client) {
+	instrumentClient(client, downstreamHost)
+}
+
+// InstrumentClientAs is InstrumentClient for a client calling hosts it
+// doesn't know in advance, e.g. webhook receivers, whose calls are all
+// recorded as downstream so the label doesn't grow with every host
+func InstrumentClientAs(client *resty.Client, downstream string) {
+	instrumentClient(client, func(string) string { return downstream })
+}
+
+func instrumentClient(client *resty.Client, downstream func(rawUrl string) string) {
+	client.OnAfterResponse(func(c *resty.Client, resp *resty.Response) error {
+		outboundRequestDuration.
+			WithLabelValues(downstream(resp.Request.URL), resp.Request.Method, strconv.Itoa(resp.StatusCode())).
+			Observe(resp.Time().Seconds())
+		return nil
+	})
+
+	//A failed connection comes as a ResponseError too, only one without
+	//a raw response was left out by OnAfterResponse
+	client.OnError(func(req *resty.Request, err error) {
+		var respErr *resty.ResponseError
+		if errors.As(err, &respErr) && respErr.Response.RawResponse != nil {
+			return
+		}
+
+		outboundRequestDuration.
+			WithLabelValues(downstream(req.URL), req.Method, "error").
+			Observe(time.Since(req.Time).Seconds())
+	})
+}
+
+func downstreamHost(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+)
+
+// scrape returns the lines of /metrics holding every one of parts
+func scrape(t *testing.T, parts ...string) []string {
+	t.Helper()
+
+	r := gin.New()
+	RegisterMetricsRoute(r)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: %d", MetricsPath, w.Code)
+	}
+
+	var found []string
+next:
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		for _, part := range parts {
+			if !strings.Contains(line, part) {
+				continue next
+			}
+		}
+		found = append(found, line)
+	}
+	return found
+}
+
+// counted sums the series of /metrics holding every one of parts, the
+// registry is shared by every test so they look at what they add to it
+func counted(t *testing.T, parts ...string) float64 {
+	t.Helper()
+
+	var sum float64
+	for _, line := range scrape(t, parts...) {
+		_, value, _ := strings.Cut(line, " ")
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		sum += n
+	}
+	return sum
+}
+
+// Requests are labeled with their route rather than their path, the ones
+// matching no route share a single label
+func TestMetricsMiddlewareLabelsRoutes(t *testing.T) {
+	r := gin.New()
+	r.Use(MetricsMiddleware())
+	r.GET("/metricstest/:id", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	routed := []string{"http_request_duration_seconds_count", `route="/metricstest/:id"`, `status="418"`}
+	unmatched := []string{"http_request_duration_seconds_count", `route="unmatched"`, `status="404"`}
+	before, beforeUnmatched := counted(t, routed...), counted(t, unmatched...)
+
+	for _, path := range []string{"/metricstest/1", "/metricstest/2", "/metricstest/2/nothing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if n := counted(t, routed...) - before; n != 2 {
+		t.Errorf("%v requests under the route, want both", n)
+	}
+	if lines := scrape(t, "http_request_duration_seconds_count", `route="/metricstest/1"`); len(lines) != 0 {
+		t.Errorf("a series by path: %v", lines)
+	}
+	if n := counted(t, unmatched...) - beforeUnmatched; n != 1 {
+		t.Errorf("%v unmatched requests, want 1", n)
+	}
+}
+
+func TestInstrumentClientRecordsCalls(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	client := resty.New()
+	InstrumentClient(client)
+	if _, err := client.R().Post(srv.URL + "/thing"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := counted(t, "outbound_request_duration_seconds_count", `downstream="`+host+`"`, `method="POST"`, `status="202"`); n != 1 {
+		t.Errorf("%v calls recorded, want 1", n)
+	}
+
+	//A downstream that can't be reached is an error, not a status
+	srv.Close()
+	if _, err := client.R().Post(srv.URL + "/thing"); err == nil {
+		t.Fatal("call to a closed server went through")
+	}
+	if n := counted(t, "outbound_request_duration_seconds_count", `downstream="`+host+`"`, `status="error"`); n != 1 {
+		t.Errorf("%v failed calls recorded, want 1", n)
+	}
+
+	//Calls to hosts not known in advance share a label
+	hooks := resty.New()
+	InstrumentClientAs(hooks, "webhook")
+	webhook := []string{"outbound_request_duration_seconds_count", `downstream="webhook"`, `status="200"`}
+	before := counted(t, webhook...)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	if _, err := hooks.R().Get(other.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := counted(t, webhook...) - before; n != 1 {
+		t.Errorf("%v webhook calls recorded, want 1", n)
+	}
+}
@@ -0,0 +1,405 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Transactional outbox.  Every change of state writes its domain event in
+// the same Store.Commit as the change itself, so an event exists if and
+// only if the change was stored.  Events are numbered per service by a
+// counter in the store and make the service's change feed,
+// GET /events?since=<seq>, oldest first.
+//
+// A relay in one replica of each service (it holds a lease in the store)
+// publishes the events in order on events:<service> and queues their
+// webhook deliveries, then moves outboxRelayed:<service> past them.  A
+// relay that dies between the two publishes some events again, consumers
+// should ignore a seq they have already seen.
+//
+// Numbers are taken by the commit (Batch.SetSequenced), so the events are
+// numbered in the order they were stored and the feed has no holes.  With
+// a redis cluster they are taken just before the commit instead, there a
+// later event can land before an earlier one and a failed commit leaves a
+// hole; readers stop at a hole until it is filled or OutboxGapTimeout has
+// passed, so the feed never skips an event that was still being written.
+// Relayed events older than outbox-retention are trimmed.
+//
+// An event may be about a subject, e.g. voter/7, whose events are listed
+// by outboxIdx:<service>:<subject>.  Erasing a voter redacts the events
+// about them, and the webhook deliveries made of them.
+const (
+	OutboxPrefix           = "outbox:"
+	OutboxIndexPrefix      = "outboxIdx:"
+	OutboxSeqPrefix        = "outboxSeq:"
+	OutboxRelayedPrefix    = "outboxRelayed:"
+	EventsChannelPrefix    = "events:"
+	OutboxGapTimeout       = 5 * time.Second
+	OutboxRelayInterval    = 250 * time.Millisecond
+	OutboxTrimInterval     = time.Minute
+	OutboxLease            = 10 * time.Second
+	OutboxRelayBatch       = 100
+	OutboxDefaultRetention = 7 * 24 * time.Hour
+)
+
+type Event struct {
+	Seq     uint64          `json:"seq"`
+	Type    string          `json:"type"`
+	Subject string          `json:"subject,omitempty"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Redaction rewrites the data of an event to take out what an erasure
+// removes
+type Redaction func(data json.RawMessage) (json.RawMessage, error)
+
+type Outbox struct {
+	store     Store
+	service   string
+	retention time.Duration
+	owner     string
+
+	stop     chan struct{}
+	stopping sync.Once
+	running  sync.WaitGroup
+}
+
+// NewOutbox only records events, Relay starts publishing them
+func NewOutbox(store Store, service string, retention time.Duration) *Outbox {
+	owner := make([]byte, 8)
+	rand.Read(owner)
+
+	return &Outbox{
+		store:     store,
+		service:   service,
+		retention: retention,
+		owner:     hex.EncodeToString(owner),
+		stop:      make(chan struct{}),
+	}
+}
+
+func (o *Outbox) eventPrefix() string {
+	return fmt.Sprintf("%s%s:", OutboxPrefix, o.service)
+}
+
+func (o *Outbox) eventKey(seq uint64) string {
+	return fmt.Sprint(o.eventPrefix(), seq)
+}
+
+func (o *Outbox) index() string {
+	return OutboxIndexPrefix + o.service
+}
+
+func (o *Outbox) subjectIndex(subject string) string {
+	return fmt.Sprintf("%s%s:%s", OutboxIndexPrefix, o.service, subject)
+}
+
+//------------------------------------------------------------
+// RECORDING
+//------------------------------------------------------------
+
+// Record adds the event to b, the batch holding the change it describes
+func (o *Outbox) Record(ctx context.Context, b *Batch, eventType string, data any) error {
+	return o.RecordAbout(ctx, b, "", eventType, data)
+}
+
+// RecordAbout is Record for an event about subject, which Redact can find
+// it by
+func (o *Outbox) RecordAbout(ctx context.Context, b *Batch, subject string, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	indexes := []string{o.index()}
+	if subject != "" {
+		indexes = append(indexes, o.subjectIndex(subject))
+	}
+
+	b.SetSequenced(OutboxSeqPrefix+o.service, o.eventPrefix(), Event{
+		Type:    eventType,
+		Subject: subject,
+		Time:    time.Now(),
+		Data:    payload,
+	}, indexes...)
+	return nil
+}
+
+// Redact rewrites the events about subject recorded so far, and the
+// webhook deliveries made of them.  Each is a compare-and-set of its own,
+// redaction must give the same result when it runs again, e.g. when an
+// erasure is retried.
+func (o *Outbox) Redact(ctx context.Context, subject string, redact Redaction) error {
+	err := redactRecords(ctx, o.store, o.subjectIndex(subject), o.eventKey, func(ev *Event) error {
+		var err error
+		ev.Data, err = redact(ev.Data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return redactDeliveries(ctx, o.store, subject, redact)
+}
+
+// redactRecords applies redact to every record listed by index, records
+// gone since they were listed are skipped
+func redactRecords[T any](ctx context.Context, store Store, index string, key func(id uint64) string, redact func(v *T) error) error {
+	var after uint64
+
+	for {
+		ids, err := store.IndexRange(ctx, index, after, MaxPageLimit)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		for _, id := range ids {
+			err := Update(ctx, store, key(id), func(v *T, b *Batch) error {
+				if v == nil {
+					return ErrNotFound
+				}
+				if err := redact(v); err != nil {
+					return err
+				}
+				b.Set(key(id), v)
+				return nil
+			})
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+
+		after = ids[len(ids)-1]
+	}
+}
+
+// Events returns up to limit events after since, in order, stopping at a
+// hole that may still be filled
+func (o *Outbox) Events(ctx context.Context, since uint64, limit int) ([]Event, error) {
+	seqs, err := o.store.IndexRange(ctx, o.index(), since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(seqs))
+	for i, seq := range seqs {
+		keys[i] = o.eventKey(seq)
+	}
+
+	found, err := GetMany[Event](ctx, o.store, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	//The relay has settled every hole up to the events it relayed, and
+	//only relayed events are trimmed
+	var relayed uint64
+	if err := o.store.Get(ctx, OutboxRelayedPrefix+o.service, &relayed); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	events := []Event{}
+	expected := since + 1
+	for i, ev := range found {
+		if ev == nil {
+			continue
+		}
+
+		if seqs[i] > relayed && seqs[i] != expected && time.Since(ev.Time) < OutboxGapTimeout {
+			break
+		}
+
+		events = append(events, *ev)
+		expected = seqs[i] + 1
+	}
+
+	return events, nil
+}
+
+//------------------------------------------------------------
+// RELAY
+//------------------------------------------------------------
+
+// Relay starts publishing the events, hooks queues their webhook
+// deliveries.  Close stops it.
+func (o *Outbox) Relay(hooks *Webhooks) {
+	o.running.Add(1)
+	go func() {
+		defer o.running.Done()
+
+		ticker := time.NewTicker(OutboxRelayInterval)
+		defer ticker.Stop()
+
+		var trimmed time.Time
+
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-ticker.C:
+			}
+
+			ctx := context.Background()
+			if !o.lease(ctx) {
+				continue
+			}
+
+			if err := o.relay(ctx, hooks); err != nil {
+				slog.Warn("Failed to relay the outbox", "error", err)
+				continue
+			}
+
+			if time.Since(trimmed) < OutboxTrimInterval {
+				continue
+			}
+			trimmed = time.Now()
+
+			if err := o.trim(ctx); err != nil {
+				slog.Warn("Failed to trim the outbox", "error", err)
+			}
+		}
+	}()
+}
+
+// Close stops the relay, letting it finish what it was publishing
+func (o *Outbox) Close(ctx context.Context) error {
+	o.stopping.Do(func() { close(o.stop) })
+
+	finished := make(chan struct{})
+	go func() {
+		o.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lease takes or renews the right to relay, only one replica does
+func (o *Outbox) lease(ctx context.Context) bool {
+	held, err := o.store.Lease(ctx, LeasePrefix+"outbox:"+o.service, o.owner, OutboxLease)
+	if err != nil {
+		slog.Warn("Failed to take the outbox lease", "error", err)
+	}
+	return held
+}
+
+func (o *Outbox) relay(ctx context.Context, hooks *Webhooks) error {
+	var relayed uint64
+	if err := o.store.Get(ctx, OutboxRelayedPrefix+o.service, &relayed); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	events, err := o.Events(ctx, relayed, OutboxRelayBatch)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	//The pointer is moved after every event, a failure only sends the
+	//events from the failed one again
+	for i := range events {
+		message, err := json.Marshal(events[i])
+		if err != nil {
+			return err
+		}
+
+		if err := o.store.Publish(ctx, EventsChannelPrefix+o.service, message); err != nil {
+			return err
+		}
+		if err := hooks.Emit(ctx, events[i]); err != nil {
+			return err
+		}
+
+		if err := o.store.Set(ctx, OutboxRelayedPrefix+o.service, events[i].Seq); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trim drops the relayed events that are past the retention, a batch of
+// them at a time until it reaches the first one to keep
+func (o *Outbox) trim(ctx context.Context) error {
+	var relayed uint64
+	if err := o.store.Get(ctx, OutboxRelayedPrefix+o.service, &relayed); errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-o.retention)
+	for {
+		events, err := o.Events(ctx, 0, OutboxRelayBatch)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		var b Batch
+		for _, ev := range events {
+			if ev.Seq > relayed || ev.Time.After(cutoff) {
+				break
+			}
+			b.Delete(o.eventKey(ev.Seq))
+			b.IndexRemove(o.index(), ev.Seq)
+			if ev.Subject != "" {
+				b.IndexRemove(o.subjectIndex(ev.Subject), ev.Seq)
+			}
+		}
+
+		if len(b.ops) == 0 {
+			return nil
+		}
+		if err := o.store.Commit(ctx, &b); err != nil {
+			return err
+		}
+	}
+}
+
+//------------------------------------------------------------
+// ROUTES
+//------------------------------------------------------------
+
+func RegisterEventRoutes(r *gin.Engine, keys *ApiKeyStore, o *Outbox) {
+	r.GET("/events", keys.RequireScope("events:read"), func(c *gin.Context) {
+		since, err := strconv.ParseUint(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "since must be a number"})
+			return
+		}
+
+		limit := DefaultPageLimit
+		if value := c.Query("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > MaxPageLimit {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MaxPageLimit)})
+				return
+			}
+		}
+
+		events, err := o.Events(c.Request.Context(), since, limit)
+		if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to read the events", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, events)
+	})
+}
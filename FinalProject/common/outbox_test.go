@@ -0,0 +1,246 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOutboxNumbersEventsInCommitOrder(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		o := NewOutbox(store, "test", time.Hour)
+
+		var first, second, failed Batch
+		for _, rec := range []struct {
+			b         *Batch
+			eventType string
+		}{{&first, "first"}, {&second, "second"}, {&failed, "failed"}} {
+			if err := o.Record(ctx, rec.b, rec.eventType, map[string]int{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		//Recorded first but stored last, and a batch that never commits
+		if err := store.Commit(ctx, &second); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Commit(ctx, &first); err != nil {
+			t.Fatal(err)
+		}
+		failed.Unchanged("missing", json.RawMessage(`{}`))
+		if err := store.Commit(ctx, &failed); err == nil {
+			t.Fatal("guarded batch committed")
+		}
+
+		var third Batch
+		if err := o.Record(ctx, &third, "third", map[string]int{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Commit(ctx, &third); err != nil {
+			t.Fatal(err)
+		}
+
+		events, err := o.Events(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"second", "first", "third"}
+		if len(events) != len(want) {
+			t.Fatalf("%s: %d events, want %d", name, len(events), len(want))
+		}
+		for i, ev := range events {
+			if ev.Seq != uint64(i+1) || ev.Type != want[i] {
+				t.Errorf("%s: event %d is %s #%d, want %s #%d", name, i, ev.Type, ev.Seq, want[i], i+1)
+			}
+		}
+	}
+}
+
+func TestStoreLease(t *testing.T) {
+	ctx := context.Background()
+	const ttl = 200 * time.Millisecond
+
+	for name, store := range testStores(t) {
+		check := func(owner string, want bool) {
+			t.Helper()
+			held, err := store.Lease(ctx, LeasePrefix+"test", owner, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held != want {
+				t.Errorf("%s: lease for %s = %v, want %v", name, owner, held, want)
+			}
+		}
+
+		check("a", true)
+		check("b", false)
+		check("a", true)
+
+		time.Sleep(ttl + 50*time.Millisecond)
+		check("b", true)
+		check("a", false)
+	}
+}
+
+func TestOutboxTrimsPastOneBatch(t *testing.T) {
+	ctx := context.Background()
+	const recorded = 3*OutboxRelayBatch + 10
+
+	for name, store := range testStores(t) {
+		o := NewOutbox(store, "test", time.Hour)
+
+		for i := 0; i < recorded; i++ {
+			var b Batch
+			if err := o.Record(ctx, &b, "test", map[string]int{"i": i}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Commit(ctx, &b); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		//All relayed, and all but the last ten past the retention
+		if err := store.Set(ctx, OutboxRelayedPrefix+"test", recorded); err != nil {
+			t.Fatal(err)
+		}
+		o.retention = -time.Hour
+		for seq := uint64(recorded - 9); seq <= recorded; seq++ {
+			err := store.SetField(ctx, o.eventKey(seq), "time", time.Now().Add(2*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := o.trim(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		events, err := o.Events(ctx, 0, MaxPageLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 10 || events[0].Seq != recorded-9 {
+			t.Errorf("%s: %d events left, want the last 10", name, len(events))
+		}
+	}
+}
+
+func TestOutboxRelayPublishesInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newMemoryStore()
+	o := NewOutbox(store, "test", time.Hour)
+	hooks := NewWebhooks(store, &Config{WebhookMaxAttempts: 1, WebhookRetention: time.Hour})
+	defer hooks.Close(ctx)
+
+	messages, err := store.Subscribe(ctx, EventsChannelPrefix+"test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		var b Batch
+		if err := o.Record(ctx, &b, "test", map[string]int{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Commit(ctx, &b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o.Relay(hooks)
+	defer o.Close(ctx)
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		select {
+		case message := <-messages:
+			var ev Event
+			if err := json.Unmarshal(message, &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Seq != seq {
+				t.Errorf("relayed event #%d, want #%d", ev.Seq, seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event #%d was not relayed", seq)
+		}
+	}
+}
+
+func TestOutboxRedactsEventsAndDeliveries(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		o := NewOutbox(store, "test", time.Hour)
+
+		//Deliveries are only queued here, never sent
+		hooks := NewWebhooks(store, &Config{WebhookMaxAttempts: 1, WebhookRetention: time.Hour})
+		if err := hooks.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hooks.CreateWebhook(ctx, "https://example.com/hook", []string{"*"}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, subject := range []string{"voter/1", "voter/2", ""} {
+			var b Batch
+			if err := o.RecordAbout(ctx, &b, subject, "vote.cast", map[string]string{"who": subject}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Commit(ctx, &b); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		events, err := o.Events(ctx, 0, MaxPageLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range events {
+			if err := hooks.Emit(ctx, ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		forget := func(data json.RawMessage) (json.RawMessage, error) {
+			return json.RawMessage(`{"who":"nobody"}`), nil
+		}
+		if err := o.Redact(ctx, "voter/1", forget); err != nil {
+			t.Fatal(err)
+		}
+
+		events, err = o.Events(ctx, 0, MaxPageLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range events {
+			redacted := string(ev.Data) == `{"who":"nobody"}`
+			if redacted != (ev.Subject == "voter/1") {
+				t.Errorf("%s: event about %q has data %s", name, ev.Subject, ev.Data)
+			}
+		}
+
+		deliveries, _, err := hooks.ListDeliveries(ctx, 1, Page{Limit: MaxPageLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != len(events) {
+			t.Fatalf("%s: %d deliveries, want %d", name, len(deliveries), len(events))
+		}
+		for _, d := range deliveries {
+			var payload webhookPayload
+			if err := json.Unmarshal(d.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			redacted := string(payload.Data) == `{"who":"nobody"}`
+			if redacted != (d.Subject == "voter/1") {
+				t.Errorf("%s: delivery about %q has data %s", name, d.Subject, payload.Data)
+			}
+		}
+	}
+}
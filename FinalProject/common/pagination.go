@@ -0,0 +1,191 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cursor pagination for the list endpoints.  Records come in id order,
+// which is the order they were created in, limit at a time (default 100,
+// at most 1000).  When there may be more, the response carries a Link
+// header with rel="next" and the URL of the next page; its cursor is
+// opaque to clients.  The ids are read from the sorted indexes kept next
+// to the records, so a page costs O(limit) instead of a walk over every key.
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+var ErrInvalidPage = errors.New("invalid page")
+
+type Page struct {
+	Limit int
+	After uint64
+}
+
+// PageFromQuery reads ?limit= and ?cursor=
+func PageFromQuery(c *gin.Context) (Page, error) {
+	page := Page{Limit: DefaultPageLimit}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxPageLimit {
+			return page, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidPage, MaxPageLimit)
+		}
+		page.Limit = n
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return page, fmt.Errorf("%w: bad cursor", ErrInvalidPage)
+		}
+		page.After = after
+	}
+
+	return page, nil
+}
+
+func encodeCursor(id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(id, 10)))
+}
+
+func decodeCursor(cursor string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(raw), 10, 64)
+}
+
+// SetNextLink points the client at the next page, the other query
+// parameters (filters, limit) are kept.  No header when next is 0.
+func SetNextLink(c *gin.Context, next uint64) {
+	if next == 0 {
+		return
+	}
+
+	query := c.Request.URL.Query()
+	query.Set("cursor", encodeCursor(next))
+	link := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+
+	c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", link.String()))
+}
+
+// NextPageUrl finds the rel="next" link of a list response, resolved
+// against the base URL of the service it came from.  Empty on the last page.
+func NextPageUrl(base string, header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, found := strings.Cut(strings.TrimSpace(link), ";")
+			if !found || !strings.Contains(params, `rel="next"`) {
+				continue
+			}
+
+			ref, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+			if err != nil {
+				return ""
+			}
+			baseUrl, err := url.Parse(base)
+			if err != nil {
+				return ""
+			}
+			return baseUrl.ResolveReference(ref).String()
+		}
+	}
+	return ""
+}
+
+// ListPage walks an index from page.After and reads the records it names
+// in batches until the page is full.  key maps an id to its record key,
+// keep (optional) drops records that don't match the filters, and records
+// missing from the store are skipped.  The second result is the cursor of
+// the next page, 0 when this one is the last.
+func ListPage[T any](ctx context.Context, store Store, index string, page Page,
+	key func(id uint64) string, keep func(item *T) bool) ([]T, uint64, error) {
+
+	items := []T{}
+	after := page.After
+
+	for len(items) < page.Limit {
+		ids, err := store.IndexRange(ctx, index, after, page.Limit)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = key(id)
+		}
+
+		records, err := GetMany[T](ctx, store, keys)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for i, item := range records {
+			after = ids[i]
+
+			if item != nil && (keep == nil || keep(item)) {
+				items = append(items, *item)
+				if len(items) == page.Limit {
+					break
+				}
+			}
+		}
+
+		if len(ids) < page.Limit && len(items) < page.Limit {
+			return items, 0, nil
+		}
+	}
+
+	//The page is full, only hand out a cursor if there is something after it
+	more, err := store.IndexRange(ctx, index, after, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(more) == 0 {
+		return items, 0, nil
+	}
+
+	return items, after, nil
+}
+
+// RebuildIndex fills an empty index from the records under prefix, for
+// data written before the indexes existed.  index is called with every
+// record to add it to whichever indexes apply.
+func RebuildIndex[T any](ctx context.Context, store Store, main string, prefix string, index func(ctx context.Context, item *T) error) error {
+	ids, err := store.IndexRange(ctx, main, 0, 1)
+	if err != nil || len(ids) > 0 {
+		return err
+	}
+
+	keys, err := store.Keys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	records, err := GetMany[T](ctx, store, keys)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range records {
+		if item == nil {
+			continue
+		}
+		if err := index(ctx, item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
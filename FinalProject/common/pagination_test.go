@@ -0,0 +1,149 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type pagedDoc struct {
+	ID uint64 `json:"id"`
+}
+
+func pagedKey(id uint64) string {
+	return fmt.Sprint("paged:", id)
+}
+
+// storePaged writes the records 1 to n and indexes them, plus an index
+// entry for a record that is gone
+func storePaged(t *testing.T, store Store, n uint64) {
+	t.Helper()
+
+	var b Batch
+	for id := uint64(1); id <= n; id++ {
+		b.Set(pagedKey(id), pagedDoc{ID: id})
+		b.IndexAdd("pagedIdx:", id)
+	}
+	b.IndexAdd("pagedIdx:", n+1)
+	if err := store.Commit(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listAll walks every page and returns the ids and the size of each page
+func listAll(t *testing.T, store Store, limit int, keep func(d *pagedDoc) bool) ([]uint64, []int) {
+	t.Helper()
+
+	var ids []uint64
+	var sizes []int
+	page := Page{Limit: limit}
+	for {
+		items, next, err := ListPage(context.Background(), store, "pagedIdx:", page, pagedKey, keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(items))
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		if next == 0 {
+			return ids, sizes
+		}
+		page.After = next
+	}
+}
+
+func TestListPage(t *testing.T) {
+	for name, store := range testStores(t) {
+		storePaged(t, store, 25)
+
+		ids, sizes := listAll(t, store, 10, nil)
+		if len(ids) != 25 || ids[0] != 1 || ids[24] != 25 {
+			t.Errorf("%s: listed %v, want 1 to 25 in order", name, ids)
+		}
+		if fmt.Sprint(sizes) != "[10 10 5]" {
+			t.Errorf("%s: pages of %v, want 10, 10 and 5", name, sizes)
+		}
+
+		//A page reaching the end of the index hands out no cursor
+		if _, sizes := listAll(t, store, 26, nil); fmt.Sprint(sizes) != "[25]" {
+			t.Errorf("%s: pages of %v, want a single one", name, sizes)
+		}
+
+		//Filtered pages are filled from further down the index
+		odd := func(d *pagedDoc) bool { return d.ID%2 == 1 }
+		ids, sizes = listAll(t, store, 5, odd)
+		if len(ids) != 13 || fmt.Sprint(sizes) != "[5 5 3]" {
+			t.Errorf("%s: odd ids %v in pages of %v, want 13 in 5, 5 and 3", name, ids, sizes)
+		}
+		for _, id := range ids {
+			if id%2 == 0 {
+				t.Errorf("%s: filter let %d through", name, id)
+			}
+		}
+	}
+}
+
+func pageOf(t *testing.T, query string) (Page, error) {
+	t.Helper()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/vote?"+query, nil)
+	return PageFromQuery(c)
+}
+
+func TestPageFromQuery(t *testing.T) {
+	page, err := pageOf(t, "")
+	if err != nil || page.Limit != DefaultPageLimit || page.After != 0 {
+		t.Errorf("no query: %+v, %v", page, err)
+	}
+
+	page, err = pageOf(t, "limit=5&cursor="+encodeCursor(42))
+	if err != nil || page.Limit != 5 || page.After != 42 {
+		t.Errorf("limit and cursor: %+v, %v", page, err)
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "limit=ten", "cursor=%21%21", "cursor=" + url.QueryEscape("bm90LWEtbnVtYmVy")} {
+		if _, err := pageOf(t, query); err == nil {
+			t.Errorf("%s was taken", query)
+		}
+	}
+}
+
+// The next link keeps the filters and the limit, and resolves against the
+// service it came from
+func TestNextLink(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/vote?pollID=7&limit=2", nil)
+
+	SetNextLink(c, 0)
+	if link := w.Header().Get("Link"); link != "" {
+		t.Errorf("last page has link %q", link)
+	}
+
+	SetNextLink(c, 9)
+	next := NextPageUrl("http://vote-api:1080", w.Header())
+	u, err := url.Parse(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Host != "vote-api:1080" || u.Path != "/vote" || query.Get("pollID") != "7" || query.Get("limit") != "2" {
+		t.Errorf("next page %s", next)
+	}
+	if after, err := decodeCursor(query.Get("cursor")); err != nil || after != 9 {
+		t.Errorf("cursor of %s is %d, %v", next, after, err)
+	}
+
+	header := http.Header{}
+	header.Add("Link", `<http://example.com/docs>; rel="help"`)
+	if next := NextPageUrl("http://vote-api:1080", header); next != "" {
+		t.Errorf("next page %q out of a help link", next)
+	}
+}
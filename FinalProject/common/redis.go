@@ -0,0 +1,372 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis connection.  redis-url is either a plain host:port or a URI,
+// redis://[user:password@]host:port[/db] or rediss:// for TLS, and the
+// other redis-* settings add to it or override what the URI says.  The
+// mode picks the client: standalone talks to one server, sentinel asks
+// the sentinels in redis-addrs for the master named redis-master, and
+// cluster uses redis-addrs as the seed nodes.  Without redis-addrs the
+// host of redis-url is used.
+const (
+	RedisDefaultLocation = "0.0.0.0:6379"
+	RedisModeStandalone  = "standalone"
+	RedisModeSentinel    = "sentinel"
+	RedisModeCluster     = "cluster"
+
+	//Keys asked for per SCAN round trip when listing keys
+	RedisScanCount = 1000
+)
+
+type RedisConfig struct {
+	Url              string
+	Mode             string
+	Addrs            stringList
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	DB               int
+	TLS              bool
+	TLSCA            string
+	TLSServerName    string
+	TLSSkipVerify    bool
+	PoolSize         int
+	DialTimeout      time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) Reset() {
+	*l = nil
+}
+
+var redisOptions = []ConfigOption{
+	{Flag: "redis-url", Key: "redis-url", Env: "REDIS_URL", Redact: redactRedisUrl},
+	{Flag: "redis-mode", Key: "redis-mode", Env: "REDIS_MODE"},
+	{Flag: "redis-addr", Key: "redis-addrs", Env: "REDIS_ADDRS", List: true},
+	{Flag: "redis-master", Key: "redis-master", Env: "REDIS_MASTER"},
+	{Flag: "redis-username", Key: "redis-username", Env: "REDIS_USERNAME"},
+	{Flag: "redis-password", Key: "redis-password", Env: "REDIS_PASSWORD", Secret: true},
+	{Flag: "redis-sentinel-password", Key: "redis-sentinel-password", Env: "REDIS_SENTINEL_PASSWORD", Secret: true},
+	{Flag: "redis-db", Key: "redis-db", Env: "REDIS_DB"},
+	{Flag: "redis-tls", Key: "redis-tls", Env: "REDIS_TLS"},
+	{Flag: "redis-tls-ca", Key: "redis-tls-ca", Env: "REDIS_TLS_CA"},
+	{Flag: "redis-tls-server-name", Key: "redis-tls-server-name", Env: "REDIS_TLS_SERVER_NAME"},
+	{Flag: "redis-tls-skip-verify", Key: "redis-tls-skip-verify", Env: "REDIS_TLS_SKIP_VERIFY"},
+	{Flag: "redis-pool-size", Key: "redis-pool-size", Env: "REDIS_POOL_SIZE"},
+	{Flag: "redis-dial-timeout", Key: "redis-dial-timeout", Env: "REDIS_DIAL_TIMEOUT"},
+	{Flag: "redis-read-timeout", Key: "redis-read-timeout", Env: "REDIS_READ_TIMEOUT"},
+	{Flag: "redis-write-timeout", Key: "redis-write-timeout", Env: "REDIS_WRITE_TIMEOUT"},
+}
+
+func (rc *RedisConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&rc.Url, "redis-url", RedisDefaultLocation, "Redis address, host:port or redis(s)://[user:password@]host:port[/db]")
+	fs.StringVar(&rc.Mode, "redis-mode", RedisModeStandalone, "standalone, sentinel or cluster")
+	fs.Var(&rc.Addrs, "redis-addr", "Sentinel or cluster seed address, may be repeated")
+	fs.StringVar(&rc.MasterName, "redis-master", "", "Master name, sentinel mode only")
+
+	//Zero values leave whatever redis-url says, or the go-redis default
+	fs.StringVar(&rc.Username, "redis-username", "", "ACL user")
+	fs.StringVar(&rc.Password, "redis-password", "", "Password for the ACL user, or requirepass")
+	fs.StringVar(&rc.SentinelPassword, "redis-sentinel-password", "", "Password of the sentinels")
+	fs.IntVar(&rc.DB, "redis-db", 0, "Database number, not supported in cluster mode")
+
+	fs.BoolVar(&rc.TLS, "redis-tls", false, "Connect with TLS, implied by rediss://")
+	fs.StringVar(&rc.TLSCA, "redis-tls-ca", "", "PEM file with the CA to trust instead of the system roots")
+	fs.StringVar(&rc.TLSServerName, "redis-tls-server-name", "", "Name to verify the server certificate against")
+	fs.BoolVar(&rc.TLSSkipVerify, "redis-tls-skip-verify", false, "Don't verify the server certificate, testing only")
+
+	fs.IntVar(&rc.PoolSize, "redis-pool-size", 0, "Connections per node, 0 for 10 per CPU")
+	fs.DurationVar(&rc.DialTimeout, "redis-dial-timeout", 0, "Timeout for new connections, 0 for 5s")
+	fs.DurationVar(&rc.ReadTimeout, "redis-read-timeout", 0, "Socket read timeout, 0 for 3s")
+	fs.DurationVar(&rc.WriteTimeout, "redis-write-timeout", 0, "Socket write timeout, 0 for the read timeout")
+}
+
+func (rc *RedisConfig) validate() []error {
+	var errs []error
+
+	db := rc.DB
+	if isRedisUri(rc.Url) {
+		parsed, err := redis.ParseURL(rc.Url)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			//The URI may hold a password, don't echo it back
+			err = urlErr.Err
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("redis-url: %w", err))
+		} else if db == 0 {
+			db = parsed.DB
+		}
+	} else if err := validateHostPort("redis-url", rc.Url); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, addr := range rc.Addrs {
+		errs = append(errs, validateHostPort("redis-addrs", addr))
+	}
+
+	switch rc.Mode {
+	case RedisModeStandalone:
+	case RedisModeSentinel:
+		if rc.MasterName == "" {
+			errs = append(errs, errors.New("redis-master: required in sentinel mode"))
+		}
+	case RedisModeCluster:
+		if db != 0 {
+			errs = append(errs, errors.New("redis-db: cluster mode only has database 0"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("redis-mode: unknown mode %q", rc.Mode))
+	}
+
+	if rc.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis-db: %d is negative", rc.DB))
+	}
+	if rc.PoolSize < 0 {
+		errs = append(errs, fmt.Errorf("redis-pool-size: %d is negative", rc.PoolSize))
+	}
+
+	durations := map[string]time.Duration{
+		"redis-dial-timeout":  rc.DialTimeout,
+		"redis-read-timeout":  rc.ReadTimeout,
+		"redis-write-timeout": rc.WriteTimeout,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s: %s is negative", name, d))
+		}
+	}
+
+	if rc.TLSCA != "" {
+		if _, err := os.Stat(rc.TLSCA); err != nil {
+			errs = append(errs, fmt.Errorf("redis-tls-ca: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// redactRedisUrl hides the password of a redis:// URI, host:port is
+// printed as is
+func redactRedisUrl(value string) string {
+	if !isRedisUri(value) {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return ConfigRedacted
+	}
+	return u.Redacted()
+}
+
+func isRedisUri(value string) bool {
+	return strings.HasPrefix(value, "redis://") || strings.HasPrefix(value, "rediss://")
+}
+
+// options merges the URI with the explicit settings
+func (rc *RedisConfig) options() (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{}
+	addr := rc.Url
+
+	if isRedisUri(rc.Url) {
+		parsed, err := redis.ParseURL(rc.Url)
+		if err != nil {
+			return nil, err
+		}
+		addr = parsed.Addr
+		opts.Username = parsed.Username
+		opts.Password = parsed.Password
+		opts.DB = parsed.DB
+		opts.TLSConfig = parsed.TLSConfig
+	}
+
+	opts.Addrs = rc.Addrs
+	if len(opts.Addrs) == 0 {
+		opts.Addrs = []string{addr}
+	}
+	opts.MasterName = rc.MasterName
+	opts.SentinelPassword = rc.SentinelPassword
+
+	if rc.Username != "" {
+		opts.Username = rc.Username
+	}
+	if rc.Password != "" {
+		opts.Password = rc.Password
+	}
+	if rc.DB != 0 {
+		opts.DB = rc.DB
+	}
+
+	if rc.TLS || opts.TLSConfig != nil {
+		tlsConfig, err := rc.tlsConfig(opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	opts.PoolSize = rc.PoolSize
+	opts.DialTimeout = rc.DialTimeout
+	opts.ReadTimeout = rc.ReadTimeout
+	opts.WriteTimeout = rc.WriteTimeout
+
+	return opts, nil
+}
+
+func (rc *RedisConfig) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+
+	if rc.TLSServerName != "" {
+		tlsConfig.ServerName = rc.TLSServerName
+	}
+	tlsConfig.InsecureSkipVerify = rc.TLSSkipVerify
+
+	if rc.TLSCA != "" {
+		pem, err := os.ReadFile(rc.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", rc.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	//Cluster and sentinel clients connect to several hosts, without an
+	//explicit name each connection is checked against its own host
+	if rc.Mode != RedisModeStandalone && rc.TLSServerName == "" {
+		tlsConfig.ServerName = ""
+	}
+
+	return tlsConfig, nil
+}
+
+// newRedisClient connects according to the mode and checks the server
+// answers.  The metrics and tracing hooks are added here so every mode
+// is instrumented the same way.
+func newRedisClient(rc *RedisConfig) (redis.UniversalClient, error) {
+	opts, err := rc.options()
+	if err != nil {
+		return nil, err
+	}
+
+	var client redis.UniversalClient
+	switch rc.Mode {
+	case RedisModeSentinel:
+		client = redis.NewFailoverClient(opts.Failover())
+	case RedisModeCluster:
+		client = redis.NewClusterClient(opts.Cluster())
+	default:
+		client = redis.NewClient(opts.Simple())
+	}
+	client.AddHook(redisMetricsHook{})
+	client.AddHook(redisTracingHook{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout(opts))
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		slog.Error("Error connecting to redis",
+			"mode", rc.Mode,
+			"addresses", strings.Join(opts.Addrs, ","),
+			"error", err,
+		)
+		client.Close()
+		return nil, err
+	}
+
+	slog.Info("Connected to redis",
+		"mode", rc.Mode,
+		"addresses", strings.Join(opts.Addrs, ","),
+		"tls", opts.TLSConfig != nil,
+	)
+	return client, nil
+}
+
+// redisConnectTimeout bounds the first ping, sentinel and cluster clients
+// may have to try several nodes before one answers
+func redisConnectTimeout(opts *redis.UniversalOptions) time.Duration {
+	dial := opts.DialTimeout
+	if dial == 0 {
+		dial = 5 * time.Second
+	}
+	return dial * time.Duration(len(opts.Addrs)+1)
+}
+
+// redisKeys lists the keys matching pattern.  It walks them with SCAN, a
+// page at a time, so redis keeps serving the other clients meanwhile.  A
+// cluster client would only ask one node, so in cluster mode every master
+// is asked.
+func redisKeys(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return redisScan(ctx, client, pattern)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		ks, err := redisScan(ctx, node, pattern)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		keys = append(keys, ks...)
+		mu.Unlock()
+		return nil
+	})
+	return keys, err
+}
+
+// redisScan returns each key once, SCAN may repeat a key that moved while
+// it was walking
+func redisScan(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	seen := map[string]bool{}
+	keys := []string{}
+
+	iter := client.Scan(ctx, 0, pattern, RedisScanCount).Iterator()
+	for iter.Next(ctx) {
+		if key := iter.Val(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, iter.Err()
+}
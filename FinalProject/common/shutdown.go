@@ -0,0 +1,119 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown.  On SIGTERM (docker stop) or SIGINT the service first
+// reports not ready so load balancers and dependent services stop sending
+// it work, waits for the drain delay to let them notice, then stops
+// accepting connections and gives in-flight requests up to the drain
+// timeout to finish.  The closers (the store, tracing exporter) run
+// last, in reverse order of registration.
+const (
+	DefaultDrainDelay   = 5 * time.Second
+	DefaultDrainTimeout = 20 * time.Second
+)
+
+type closer struct {
+	name  string
+	close func(ctx context.Context) error
+}
+
+type Server struct {
+	http         *http.Server
+	health       *Health
+	drainDelay   time.Duration
+	drainTimeout time.Duration
+	closers      []closer
+}
+
+func NewServer(addr string, handler http.Handler, health *Health, drainDelay, drainTimeout time.Duration) *Server {
+	return &Server{
+		http: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+		},
+		health:       health,
+		drainDelay:   drainDelay,
+		drainTimeout: drainTimeout,
+	}
+}
+
+// OnShutdown registers something to close once the last request is done
+func (s *Server) OnShutdown(name string, close func(ctx context.Context) error) {
+	s.closers = append(s.closers, closer{name, close})
+}
+
+// OnDrain registers something to stop as soon as the server stops
+// accepting connections, for long lived requests like event streams that
+// would otherwise hold up the drain until its timeout
+func (s *Server) OnDrain(stop func()) {
+	s.http.RegisterOnShutdown(stop)
+}
+
+// Run serves until a signal arrives or the listener fails, and returns
+// once the server is drained and everything registered is closed
+func (s *Server) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server listening", "address", s.http.Addr)
+		serveErr <- s.http.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		slog.Error("Server stopped unexpectedly", "error", err)
+	case <-ctx.Done():
+		//A second signal kills the process right away
+		stop()
+		err = s.drain()
+	}
+
+	s.close()
+	return err
+}
+
+func (s *Server) drain() error {
+	slog.Info("Shutdown requested, draining",
+		"drain_delay", s.drainDelay.String(),
+		"drain_timeout", s.drainTimeout.String(),
+	)
+
+	s.health.SetShuttingDown()
+	time.Sleep(s.drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		slog.Error("Requests still running after the drain timeout", "error", err)
+		return err
+	}
+
+	slog.Info("Server drained")
+	return nil
+}
+
+func (s *Server) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		c := s.closers[i]
+		if err := c.close(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Warn("Failed to close on shutdown", "name", c.name, "error", err)
+		}
+	}
+}
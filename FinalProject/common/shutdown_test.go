@@ -0,0 +1,173 @@
+package common
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	t.Fatalf("nothing listening on %s", addr)
+}
+
+// shutdownRecord is what happened during a shutdown, in order
+type shutdownRecord struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *shutdownRecord) add(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *shutdownRecord) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// On SIGTERM the service reports not ready, lets the request in flight
+// finish, then closes what was registered, last registered first
+func TestShutdownDrainsRequests(t *testing.T) {
+	h := NewHealth()
+	record := &shutdownRecord{}
+	started := make(chan struct{})
+
+	r := gin.New()
+	h.Register(r, "/thing/health")
+	r.GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		record.add("request done")
+		c.Status(http.StatusOK)
+	})
+
+	addr := freeAddr(t)
+	srv := NewServer(addr, r, h, 100*time.Millisecond, 2*time.Second)
+	srv.OnDrain(func() { record.add("drain") })
+	srv.OnShutdown("store", func(ctx context.Context) error {
+		record.add("store closed")
+		return nil
+	})
+	srv.OnShutdown("tracing", func(ctx context.Context) error {
+		record.add("tracing closed")
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Run() }()
+	waitListening(t, addr)
+
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			t.Error(err)
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	//During the drain delay the server still answers, but isn't ready
+	time.Sleep(30 * time.Millisecond)
+	resp, err := http.Get("http://" + addr + ReadinessPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readiness while draining: %d, want 503", resp.StatusCode)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't stop")
+	}
+
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("request in flight got %d, want it to finish", code)
+	}
+	want := []string{"drain", "request done", "tracing closed", "store closed"}
+	if got := record.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("shutdown went %v, want %v", got, want)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("the server still accepts connections")
+	}
+}
+
+// A request still running at the drain timeout fails the shutdown, what
+// was registered is closed all the same
+func TestShutdownGivesUpAtTheTimeout(t *testing.T) {
+	h := NewHealth()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	r := gin.New()
+	r.GET("/stuck", func(c *gin.Context) {
+		close(started)
+		<-release
+	})
+
+	addr := freeAddr(t)
+	srv := NewServer(addr, r, h, 0, 100*time.Millisecond)
+	closed := false
+	srv.OnShutdown("store", func(ctx context.Context) error {
+		closed = true
+		return nil
+	})
+
+	go srv.http.ListenAndServe()
+	waitListening(t, addr)
+	go http.Get("http://" + addr + "/stuck")
+	<-started
+
+	if err := srv.drain(); err == nil {
+		t.Error("drain with a request stuck returned no error")
+	}
+	srv.close()
+	if !closed {
+		t.Error("the store wasn't closed")
+	}
+}
@@ -0,0 +1,314 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Storage backends.  Records are JSON documents under string keys, e.g.
+// vote:3 or apikey:1, along with a few counters and sets.  The store is
+// picked with the store setting:
+//
+//	redis   RedisJSON, shared by every service (the default)
+//	sqlite  an embedded SQLite file, services pointed at the same
+//	        sqlite-path share it like they share redis
+//	memory  a map in the process, lost on restart and not shared, handy
+//	        to run a service without docker; messages published by one
+//	        service never reach the others
+const (
+	StoreRedis        = "redis"
+	StoreSqlite       = "sqlite"
+	StoreMemory       = "memory"
+	SqliteDefaultPath = "voting.db"
+
+	//Reads of many documents go out this many keys per round trip
+	StoreDefaultBatchSize = 100
+	StoreMaxBatchSize     = 10000
+
+	//Update starts over this many times when the record keeps changing
+	StoreUpdateAttempts = 10
+
+	//Leases of background work shared by the replicas, see Store.Lease
+	LeasePrefix = "lease:"
+
+	//The field of a SetSequenced record holding its number
+	SequenceField = "seq"
+)
+
+var (
+	ErrNotFound = errors.New("record does not exist")
+	ErrConflict = errors.New("record was changed by someone else")
+)
+
+type Store interface {
+	// Get unmarshals the document at key into v, ErrNotFound if missing
+	Get(ctx context.Context, key string, v any) error
+	// GetMany reads several documents, batch size keys per round trip.
+	// The result lines up with keys, missing documents are nil.
+	GetMany(ctx context.Context, keys []string) ([]json.RawMessage, error)
+	Set(ctx context.Context, key string, v any) error
+	// SetNX only writes a document that doesn't exist yet and reports
+	// whether it did
+	SetNX(ctx context.Context, key string, v any) (bool, error)
+	// SetField replaces one top level field of an existing document
+	SetField(ctx context.Context, key string, field string, v any) error
+	// Append adds v to the end of an array field of an existing document
+	// in one step, so concurrent appends don't lose each other's values
+	Append(ctx context.Context, key string, field string, v any) error
+	Delete(ctx context.Context, keys ...string) error
+	// Rename moves a document to a new key, replacing what was there
+	Rename(ctx context.Context, from string, to string) error
+	// Keys lists the keys starting with prefix, in no particular order.
+	// Only redis lists indexes along, empty them with IndexRemove.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+
+	// Incr adds one to a counter and returns the new value.  A ttl above 0
+	// expires the counter that long after it was created.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+
+	// Lease takes the lease at key for owner, or extends it when owner
+	// already holds it, for ttl.  It reports whether owner holds it, so
+	// that work one replica should do runs on one replica at a time.
+	Lease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error)
+
+	Members(ctx context.Context, key string) ([]string, error)
+	AddMember(ctx context.Context, key string, member string) error
+	RemoveMember(ctx context.Context, key string, member string) error
+
+	// Indexes are sorted sets of record ids, so records can be listed in
+	// id order a page at a time.  IndexRange returns up to limit ids
+	// greater than after, in ascending order.
+	IndexAdd(ctx context.Context, index string, id uint64) error
+	IndexRemove(ctx context.Context, index string, id uint64) error
+	IndexRange(ctx context.Context, index string, after uint64, limit int) ([]uint64, error)
+
+	// Counters reads a hash of named counters, e.g. the votes per option
+	// of a poll.  They are changed with Batch.IncrField.
+	Counters(ctx context.Context, key string) (map[string]int64, error)
+
+	// Commit applies the writes of a batch all together or not at all.
+	// It fails with ErrConflict, writing nothing, when a record the batch
+	// depends on (Batch.Unchanged) was changed.
+	Commit(ctx context.Context, b *Batch) error
+
+	// Publish sends a message to whoever is subscribed to the channel, on
+	// any service sharing the store.  Nothing is kept for late subscribers.
+	Publish(ctx context.Context, channel string, message []byte) error
+	// Subscribe delivers the messages of a channel until ctx is done, then
+	// closes the returned channel
+	Subscribe(ctx context.Context, channel string) (<-chan []byte, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// NewStore opens the backend picked in the configuration
+func NewStore(cfg *Config) (Store, error) {
+	switch cfg.Store {
+	case StoreRedis:
+		client, err := newRedisClient(&cfg.Redis)
+		if err != nil {
+			return nil, err
+		}
+		return &redisStore{client: client, batchSize: cfg.StoreBatchSize}, nil
+	case StoreSqlite:
+		return newSqliteStore(cfg.SqlitePath, cfg.StoreBatchSize)
+	case StoreMemory:
+		return newMemoryStore(), nil
+	}
+
+	return nil, fmt.Errorf("unknown store %q", cfg.Store)
+}
+
+// Batch collects writes for Store.Commit, e.g. a vote along with its
+// indexes and the counter it adds to.  The writes are applied in order.
+type Batch struct {
+	ops    []batchOp
+	guards []batchGuard
+}
+
+// batchGuard is a record the batch was computed from, doc is what GetMany
+// returned for it, nil when it was missing
+type batchGuard struct {
+	key string
+	doc json.RawMessage
+}
+
+type batchOpKind int
+
+const (
+	batchSet batchOpKind = iota
+	batchDelete
+	batchIncrField
+	batchIndexAdd
+	batchIndexRemove
+	batchAppend
+	batchAddMember
+	batchRemoveMember
+	batchSetSequenced
+)
+
+type batchOp struct {
+	kind  batchOpKind
+	key   string
+	value any
+	doc   []byte
+	field string
+	delta int64
+	id    uint64
+
+	//SetSequenced: the key prefix of the record and its indexes
+	prefix  string
+	indexes []string
+}
+
+func (b *Batch) Set(key string, v any) {
+	b.ops = append(b.ops, batchOp{kind: batchSet, key: key, value: v})
+}
+
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{kind: batchDelete, key: key})
+}
+
+// IncrField adds delta, which may be negative, to one counter of a hash
+func (b *Batch) IncrField(key string, field string, delta int64) {
+	b.ops = append(b.ops, batchOp{kind: batchIncrField, key: key, field: field, delta: delta})
+}
+
+func (b *Batch) IndexAdd(index string, id uint64) {
+	b.ops = append(b.ops, batchOp{kind: batchIndexAdd, key: index, id: id})
+}
+
+func (b *Batch) IndexRemove(index string, id uint64) {
+	b.ops = append(b.ops, batchOp{kind: batchIndexRemove, key: index, id: id})
+}
+
+// Append fails the commit when the document is missing, but redis runs the
+// rest of a transaction anyway, so callers check that it exists first
+func (b *Batch) Append(key string, field string, v any) {
+	b.ops = append(b.ops, batchOp{kind: batchAppend, key: key, field: field, value: v})
+}
+
+func (b *Batch) AddMember(key string, member string) {
+	b.ops = append(b.ops, batchOp{kind: batchAddMember, key: key, field: member})
+}
+
+func (b *Batch) RemoveMember(key string, member string) {
+	b.ops = append(b.ops, batchOp{kind: batchRemoveMember, key: key, field: member})
+}
+
+// SetSequenced stores v at prefix<seq>, seq being the next value of the
+// counter at key.  The number is taken as the batch is committed, so the
+// records are numbered in the order they were stored, with no holes.  v
+// must marshal to an object, seq is set in its SequenceField and added to
+// the indexes.
+func (b *Batch) SetSequenced(key string, prefix string, v any, indexes ...string) {
+	b.ops = append(b.ops, batchOp{kind: batchSetSequenced, key: key, prefix: prefix, value: v, indexes: indexes})
+}
+
+// withSeq returns the document of a SetSequenced op numbered seq
+func (op *batchOp) withSeq(seq int64) (string, []byte) {
+	fields := map[string]json.RawMessage{}
+	json.Unmarshal(op.doc, &fields)
+	fields[SequenceField] = json.RawMessage(strconv.FormatInt(seq, 10))
+
+	doc, _ := json.Marshal(fields)
+	return op.prefix + strconv.FormatInt(seq, 10), doc
+}
+
+// Unchanged makes the commit depend on the record at key still being doc,
+// as GetMany returned it (nil for a missing record).  Use Update rather
+// than calling it directly.
+func (b *Batch) Unchanged(key string, doc json.RawMessage) {
+	b.guards = append(b.guards, batchGuard{key: key, doc: doc})
+}
+
+func (g batchGuard) holds(doc []byte) bool {
+	if g.doc == nil {
+		return doc == nil
+	}
+	return doc != nil && string(doc) == string(g.doc)
+}
+
+// encode marshals the documents up front, so a bad one fails the batch
+// before anything is written
+func (b *Batch) encode() error {
+	for i := range b.ops {
+		op := &b.ops[i]
+		if op.kind != batchSet && op.kind != batchAppend && op.kind != batchSetSequenced {
+			continue
+		}
+
+		doc, err := json.Marshal(op.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op.key, err)
+		}
+		if op.kind == batchSetSequenced && (len(doc) == 0 || doc[0] != '{') {
+			return fmt.Errorf("%s: a sequenced record must be an object", op.prefix)
+		}
+		op.doc = doc
+	}
+	return nil
+}
+
+// GetMany reads the documents at keys and decodes each into a fresh T, so
+// no field carries over from one record to the next.  The result lines up
+// with keys, nil where the document is missing.
+func GetMany[T any](ctx context.Context, store Store, keys []string) ([]*T, error) {
+	docs, err := store.GetMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*T, len(docs))
+	for i, doc := range docs {
+		if doc == nil {
+			continue
+		}
+
+		items[i] = new(T)
+		if err := json.Unmarshal(doc, items[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", keys[i], err)
+		}
+	}
+
+	return items, nil
+}
+
+// Update is a read-modify-write of the record at key that can't lose a
+// concurrent change.  change gets the record (nil when it is missing) and
+// adds the writes based on it to b; they are committed only if the record
+// was not changed in the meantime, otherwise Update reads it again and
+// starts over.  change may run several times and must not have other
+// side effects.
+func Update[T any](ctx context.Context, store Store, key string, change func(v *T, b *Batch) error) error {
+	for attempt := 1; ; attempt++ {
+		docs, err := store.GetMany(ctx, []string{key})
+		if err != nil {
+			return err
+		}
+
+		var v *T
+		if docs[0] != nil {
+			v = new(T)
+			if err := json.Unmarshal(docs[0], v); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+
+		var b Batch
+		b.Unchanged(key, docs[0])
+		if err := change(v, &b); err != nil {
+			return err
+		}
+
+		err = store.Commit(ctx, &b)
+		if !errors.Is(err, ErrConflict) || attempt == StoreUpdateAttempts {
+			return err
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The list benchmarks read every record of a store holding 10k and 100k of
+// them, one Get per key against GetMany and ListPage, which read in
+// batches.  They run on the in-process stores, and on redis as well when
+// BENCH_REDIS_URL points at a server whose "bench:" keys may be replaced:
+//
+//	BENCH_REDIS_URL=redis://localhost:6379/15 go test -run - -bench List -benchtime 3x
+
+const benchIndex = "benchIdx:"
+
+type benchRecord struct {
+	ID        uint64            `json:"id"`
+	FirstName string            `json:"FirstName"`
+	LastName  string            `json:"LastName"`
+	Email     string            `json:"Email"`
+	Tags      map[string]string `json:"Tags"`
+}
+
+func benchKey(id uint64) string {
+	return fmt.Sprint("bench:", id)
+}
+
+// benchStores returns the stores to benchmark filled with n records
+func benchStores(b *testing.B, n int) map[string]Store {
+	b.Helper()
+
+	sqlite, err := newSqliteStore(filepath.Join(b.TempDir(), "bench.db"), StoreDefaultBatchSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { sqlite.Close() })
+
+	stores := map[string]Store{"memory": newMemoryStore(), "sqlite": sqlite}
+
+	if url := os.Getenv("BENCH_REDIS_URL"); url != "" {
+		client, err := newRedisClient(&RedisConfig{Url: url})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { client.Close() })
+		stores["redis"] = &redisStore{client: client, batchSize: StoreDefaultBatchSize}
+	}
+
+	for name, store := range stores {
+		if err := fillBenchStore(store, n); err != nil {
+			b.Fatalf("%s: %v", name, err)
+		}
+	}
+	return stores
+}
+
+func fillBenchStore(store Store, n int) error {
+	ctx := context.Background()
+	if err := store.Delete(ctx, benchIndex); err != nil {
+		return err
+	}
+
+	for start := 1; start <= n; start += StoreMaxBatchSize {
+		var b Batch
+		for id := uint64(start); id < uint64(start+StoreMaxBatchSize) && id <= uint64(n); id++ {
+			b.Set(benchKey(id), benchRecord{
+				ID:        id,
+				FirstName: "Ada",
+				LastName:  fmt.Sprint("Lovelace-", id),
+				Email:     fmt.Sprintf("ada%d@example.com", id),
+				Tags:      map[string]string{"district": "5"},
+			})
+			b.IndexAdd(benchIndex, id)
+		}
+		if err := store.Commit(ctx, &b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkList(b *testing.B) {
+	ctx := context.Background()
+
+	for _, n := range []int{10_000, 100_000} {
+		for name, store := range benchStores(b, n) {
+			keys := make([]string, n)
+			for i := range keys {
+				keys[i] = benchKey(uint64(i + 1))
+			}
+
+			b.Run(fmt.Sprintf("%s/%dk/Get", name, n/1000), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for _, key := range keys {
+						var rec benchRecord
+						if err := store.Get(ctx, key, &rec); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "records/s")
+			})
+
+			b.Run(fmt.Sprintf("%s/%dk/GetMany", name, n/1000), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					recs, err := GetMany[benchRecord](ctx, store, keys)
+					if err != nil || len(recs) != n {
+						b.Fatal(len(recs), err)
+					}
+				}
+				b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "records/s")
+			})
+
+			b.Run(fmt.Sprintf("%s/%dk/ListPage", name, n/1000), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					read := 0
+					page := Page{Limit: MaxPageLimit}
+					for {
+						recs, next, err := ListPage[benchRecord](ctx, store, benchIndex, page, benchKey, nil)
+						if err != nil {
+							b.Fatal(err)
+						}
+						read += len(recs)
+						if next == 0 {
+							break
+						}
+						page.After = next
+					}
+					if read != n {
+						b.Fatalf("listed %d records, want %d", read, n)
+					}
+				}
+				b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "records/s")
+			})
+		}
+	}
+}
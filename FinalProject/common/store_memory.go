@@ -0,0 +1,483 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in maps guarded by one lock.  Documents are
+// stored marshalled, so callers never share memory with the store.
+type memoryStore struct {
+	mu       sync.Mutex
+	records  map[string]memoryRecord
+	sets     map[string]map[string]struct{}
+	indexes  map[string]map[uint64]struct{}
+	counters map[string]map[string]int64
+	subs     map[string]map[chan []byte]struct{}
+}
+
+type memoryRecord struct {
+	value   []byte
+	expires time.Time
+}
+
+func (r memoryRecord) expired(now time.Time) bool {
+	return !r.expires.IsZero() && !now.Before(r.expires)
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		records:  map[string]memoryRecord{},
+		sets:     map[string]map[string]struct{}{},
+		indexes:  map[string]map[uint64]struct{}{},
+		counters: map[string]map[string]int64{},
+		subs:     map[string]map[chan []byte]struct{}{},
+	}
+}
+
+// lookup must be called with the lock held, expired records are dropped
+// on the way
+func (s *memoryStore) lookup(key string) (memoryRecord, bool) {
+	r, ok := s.records[key]
+	if ok && r.expired(time.Now()) {
+		delete(s.records, key)
+		return memoryRecord{}, false
+	}
+	return r, ok
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string, v any) error {
+	s.mu.Lock()
+	r, ok := s.lookup(key)
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(r.value, v)
+}
+
+// GetMany takes the lock once for all the keys, there are no round trips
+// to batch
+func (s *memoryStore) GetMany(ctx context.Context, keys []string) ([]json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	docs := make([]json.RawMessage, len(keys))
+	for i, key := range keys {
+		if r, ok := s.lookup(key); ok {
+			docs[i] = append(json.RawMessage(nil), r.value...)
+		}
+	}
+	return docs, nil
+}
+
+func (s *memoryStore) Set(ctx context.Context, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = memoryRecord{value: value}
+	return nil
+}
+
+func (s *memoryStore) SetNX(ctx context.Context, key string, v any) (bool, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.lookup(key); ok {
+		return false, nil
+	}
+	s.records[key] = memoryRecord{value: value}
+	return true, nil
+}
+
+func (s *memoryStore) SetField(ctx context.Context, key string, field string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.lookup(key)
+	if !ok {
+		return ErrNotFound
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(r.value, &doc); err != nil {
+		return err
+	}
+	doc[field] = value
+
+	if r.value, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	s.records[key] = r
+	return nil
+}
+
+func (s *memoryStore) Append(ctx context.Context, key string, field string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.append(key, field, value)
+}
+
+// append must be called with the lock held
+func (s *memoryStore) append(key string, field string, value []byte) error {
+	r, ok := s.lookup(key)
+	if !ok {
+		return ErrNotFound
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(r.value, &doc); err != nil {
+		return err
+	}
+
+	var err error
+	var values []json.RawMessage
+	if err := json.Unmarshal(doc[field], &values); err != nil && doc[field] != nil {
+		return err
+	}
+	if doc[field], err = json.Marshal(append(values, value)); err != nil {
+		return err
+	}
+
+	if r.value, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	s.records[key] = r
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		s.delete(key)
+	}
+	return nil
+}
+
+// delete must be called with the lock held
+func (s *memoryStore) delete(key string) {
+	delete(s.records, key)
+	delete(s.sets, key)
+	delete(s.counters, key)
+}
+
+func (s *memoryStore) Rename(ctx context.Context, from string, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.lookup(from)
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.records, from)
+	s.records[to] = r
+	return nil
+}
+
+func (s *memoryStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.records {
+		if _, ok := s.lookup(key); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.sets {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.counters {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.incr(key, ttl)
+}
+
+// incr must be called with the lock held
+func (s *memoryStore) incr(key string, ttl time.Duration) (int64, error) {
+	r, ok := s.lookup(key)
+	var count int64
+	if ok {
+		var err error
+		if count, err = strconv.ParseInt(string(r.value), 10, 64); err != nil {
+			return 0, err
+		}
+	} else if ttl > 0 {
+		r.expires = time.Now().Add(ttl)
+	}
+
+	count++
+	r.value = []byte(strconv.FormatInt(count, 10))
+	s.records[key] = r
+	return count, nil
+}
+
+func (s *memoryStore) Lease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	value, err := json.Marshal(owner)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.lookup(key); ok && string(r.value) != string(value) {
+		return false, nil
+	}
+
+	s.records[key] = memoryRecord{value: value, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) Members(ctx context.Context, key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := []string{}
+	for m := range s.sets[key] {
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (s *memoryStore) AddMember(ctx context.Context, key string, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addMember(key, member)
+	return nil
+}
+
+func (s *memoryStore) RemoveMember(ctx context.Context, key string, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeMember(key, member)
+	return nil
+}
+
+// addMember and removeMember must be called with the lock held
+func (s *memoryStore) addMember(key string, member string) {
+	if s.sets[key] == nil {
+		s.sets[key] = map[string]struct{}{}
+	}
+	s.sets[key][member] = struct{}{}
+}
+
+func (s *memoryStore) removeMember(key string, member string) {
+	delete(s.sets[key], member)
+	if len(s.sets[key]) == 0 {
+		delete(s.sets, key)
+	}
+}
+
+func (s *memoryStore) IndexAdd(ctx context.Context, index string, id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.indexAdd(index, id)
+	return nil
+}
+
+// indexAdd must be called with the lock held
+func (s *memoryStore) indexAdd(index string, id uint64) {
+	if s.indexes[index] == nil {
+		s.indexes[index] = map[uint64]struct{}{}
+	}
+	s.indexes[index][id] = struct{}{}
+}
+
+func (s *memoryStore) IndexRemove(ctx context.Context, index string, id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.indexes[index], id)
+	return nil
+}
+
+// IndexRange sorts the whole index on every call, fine for the amounts of
+// data the memory store is meant for
+func (s *memoryStore) IndexRange(ctx context.Context, index string, after uint64, limit int) ([]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := []uint64{}
+	for id := range s.indexes[index] {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) Counters(ctx context.Context, key string) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counters := make(map[string]int64, len(s.counters[key]))
+	for field, n := range s.counters[key] {
+		counters[field] = n
+	}
+	return counters, nil
+}
+
+// Commit applies the whole batch under the lock.  The documents are
+// marshalled first, nothing after that can fail half way.
+func (s *memoryStore) Commit(ctx context.Context, b *Batch) error {
+	if err := b.encode(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range b.guards {
+		r, _ := s.lookup(g.key)
+		if !g.holds(r.value) {
+			return ErrConflict
+		}
+	}
+
+	//Nothing is written unless every append has its document and every
+	//sequence is a number
+	for _, op := range b.ops {
+		r, ok := s.lookup(op.key)
+		if op.kind == batchAppend && !ok {
+			return ErrNotFound
+		}
+		if _, err := strconv.ParseInt(string(r.value), 10, 64); op.kind == batchSetSequenced && ok && err != nil {
+			return fmt.Errorf("%s: %w", op.key, err)
+		}
+	}
+
+	for _, op := range b.ops {
+		switch op.kind {
+		case batchSet:
+			s.records[op.key] = memoryRecord{value: op.doc}
+		case batchDelete:
+			s.delete(op.key)
+		case batchIncrField:
+			if s.counters[op.key] == nil {
+				s.counters[op.key] = map[string]int64{}
+			}
+			s.counters[op.key][op.field] += op.delta
+		case batchIndexAdd:
+			s.indexAdd(op.key, op.id)
+		case batchIndexRemove:
+			delete(s.indexes[op.key], op.id)
+		case batchAppend:
+			if err := s.append(op.key, op.field, op.doc); err != nil {
+				return err
+			}
+		case batchAddMember:
+			s.addMember(op.key, op.field)
+		case batchRemoveMember:
+			s.removeMember(op.key, op.field)
+		case batchSetSequenced:
+			seq, _ := s.incr(op.key, 0)
+			key, doc := op.withSeq(seq)
+			s.records[key] = memoryRecord{value: doc}
+			for _, index := range op.indexes {
+				s.indexAdd(index, uint64(seq))
+			}
+		}
+	}
+	return nil
+}
+
+// Publish never blocks, a subscriber that is memoryStoreBacklog messages
+// behind misses the new ones
+func (s *memoryStore) Publish(ctx context.Context, channel string, message []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subs[channel] {
+		select {
+		case sub <- append([]byte(nil), message...):
+		default:
+		}
+	}
+	return nil
+}
+
+const memoryStoreBacklog = 16
+
+func (s *memoryStore) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	sub := make(chan []byte, memoryStoreBacklog)
+
+	s.mu.Lock()
+	if s.subs[channel] == nil {
+		s.subs[channel] = map[chan []byte]struct{}{}
+	}
+	s.subs[channel][sub] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subs[channel], sub)
+		if len(s.subs[channel]) == 0 {
+			delete(s.subs, channel)
+		}
+		close(sub)
+	}()
+
+	return sub, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
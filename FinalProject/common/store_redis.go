@@ -0,0 +1,453 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nitishm/go-rejson/v4"
+	"github.com/nitishm/go-rejson/v4/rjs"
+)
+
+// redisStore keeps documents with RedisJSON, counters as plain strings
+// and members in redis sets
+type redisStore struct {
+	client    redis.UniversalClient
+	batchSize int
+}
+
+// jsonHelperWithContext binds a rejson helper to a request context, so the
+// commands it sends are cancelled with the request and traced as part of it
+func (s *redisStore) jsonHelperWithContext(ctx context.Context) *rejson.Handler {
+	jsonHelper := rejson.NewReJSONHandler()
+	jsonHelper.SetGoRedisClientWithContext(ctx, s.client)
+	return jsonHelper
+}
+
+func (s *redisStore) Get(ctx context.Context, key string, v any) error {
+	itemObject, err := s.jsonHelperWithContext(ctx).JSONGet(key, ".")
+	if errors.Is(err, redis.Nil) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	//JSONGet returns an "any" object, or empty interface,
+	//we need to convert it to a byte array, which is the
+	//underlying type of the object, then we can unmarshal it
+	return json.Unmarshal(itemObject.([]byte), v)
+}
+
+// GetMany sends one JSON.MGET per batch.  A cluster can't serve MGET over
+// keys in different slots, there the batch is a pipeline of JSON.GET,
+// which go-redis splits up by node.
+func (s *redisStore) GetMany(ctx context.Context, keys []string) ([]json.RawMessage, error) {
+	docs := make([]json.RawMessage, 0, len(keys))
+
+	for start := 0; start < len(keys); start += s.batchSize {
+		batch := keys[start:min(start+s.batchSize, len(keys))]
+
+		var replies []any
+		var err error
+		if _, ok := s.client.(*redis.ClusterClient); ok {
+			replies, err = s.pipelineGet(ctx, batch)
+		} else {
+			args := make([]any, 0, len(batch)+2)
+			args = append(args, "JSON.MGET")
+			for _, key := range batch {
+				args = append(args, key)
+			}
+			args = append(args, ".")
+			replies, err = s.client.Do(ctx, args...).Slice()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reply := range replies {
+			doc, _ := reply.(string)
+			if doc == "" {
+				docs = append(docs, nil)
+				continue
+			}
+			docs = append(docs, json.RawMessage(doc))
+		}
+	}
+
+	return docs, nil
+}
+
+func (s *redisStore) pipelineGet(ctx context.Context, keys []string) ([]any, error) {
+	pipe := s.client.Pipeline()
+
+	cmds := make([]*redis.Cmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Do(ctx, "JSON.GET", key, ".")
+	}
+
+	//Exec reports the first failed command, missing keys are expected
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i, cmd := range cmds {
+		doc, err := cmd.Text()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = doc
+	}
+	return replies, nil
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, v any) error {
+	_, err := s.jsonHelperWithContext(ctx).JSONSet(key, ".", v)
+	return err
+}
+
+func (s *redisStore) SetNX(ctx context.Context, key string, v any) (bool, error) {
+	res, err := s.jsonHelperWithContext(ctx).JSONSet(key, ".", v, rjs.SetOptionNX)
+	if err != nil {
+		return false, err
+	}
+	return res != nil, nil
+}
+
+func (s *redisStore) SetField(ctx context.Context, key string, field string, v any) error {
+	_, err := s.jsonHelperWithContext(ctx).JSONSet(key, "."+field, v)
+	return err
+}
+
+func (s *redisStore) Append(ctx context.Context, key string, field string, v any) error {
+	_, err := s.jsonHelperWithContext(ctx).JSONArrAppend(key, "."+field, v)
+	if err != nil && (strings.Contains(err.Error(), "doesn't exist") || strings.Contains(err.Error(), "does not exist")) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *redisStore) Delete(ctx context.Context, keys ...string) error {
+	//One key at a time, in cluster mode the keys may live on different
+	//nodes
+	for _, key := range keys {
+		if err := s.client.Del(ctx, key).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) Rename(ctx context.Context, from string, to string) error {
+	err := s.client.Rename(ctx, from, to).Err()
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *redisStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return redisKeys(ctx, s.client, prefix+"*")
+}
+
+func (s *redisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	count, err := s.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if count == 1 && ttl > 0 {
+		s.client.Expire(ctx, key, ttl)
+	}
+
+	return count, nil
+}
+
+// redisExtendLease extends a lease held by ARGV[1] by ARGV[2] milliseconds
+var redisExtendLease = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`
+
+// Lease is SET NX PX for a free lease, then a compare-and-extend script
+// for the owner, the lease is never taken over before it expires
+func (s *redisStore) Lease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	taken, err := s.client.SetNX(ctx, key, owner, ttl).Result()
+	if err != nil || taken {
+		return taken, err
+	}
+
+	extended, err := s.client.Eval(ctx, redisExtendLease, []string{key}, owner, ttl.Milliseconds()).Int()
+	return extended == 1, err
+}
+
+func (s *redisStore) Members(ctx context.Context, key string) ([]string, error) {
+	return s.client.SMembers(ctx, key).Result()
+}
+
+func (s *redisStore) AddMember(ctx context.Context, key string, member string) error {
+	return s.client.SAdd(ctx, key, member).Err()
+}
+
+func (s *redisStore) RemoveMember(ctx context.Context, key string, member string) error {
+	return s.client.SRem(ctx, key, member).Err()
+}
+
+// Indexes are sorted sets scored by the id itself
+func (s *redisStore) IndexAdd(ctx context.Context, index string, id uint64) error {
+	return s.client.ZAdd(ctx, index, &redis.Z{Score: float64(id), Member: id}).Err()
+}
+
+func (s *redisStore) IndexRemove(ctx context.Context, index string, id uint64) error {
+	return s.client.ZRem(ctx, index, id).Err()
+}
+
+func (s *redisStore) IndexRange(ctx context.Context, index string, after uint64, limit int) ([]uint64, error) {
+	members, err := s.client.ZRangeByScore(ctx, index, &redis.ZRangeBy{
+		Min:   fmt.Sprintf("(%d", after),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.ParseUint(m, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *redisStore) Counters(ctx context.Context, key string) (map[string]int64, error) {
+	fields, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]int64, len(fields))
+	for field, value := range fields {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", key, field, err)
+		}
+		counters[field] = n
+	}
+	return counters, nil
+}
+
+// Commit sends the batch as one MULTI/EXEC.  In cluster mode go-redis runs
+// one transaction per hash slot, so the batch is only atomic per slot, and
+// the records of SetSequenced are numbered before the transaction, which
+// may leave a hole when it fails.
+//
+// A batch with guards WATCHes their records, checks them and runs the
+// MULTI/EXEC on the same connection, so it fails if a guarded record is
+// changed in between.  In cluster mode the guarded records must share a
+// slot; the writes to them go in that transaction and the other writes
+// follow once it succeeded.
+func (s *redisStore) Commit(ctx context.Context, b *Batch) error {
+	if err := b.encode(); err != nil {
+		return err
+	}
+
+	if _, ok := s.client.(*redis.ClusterClient); ok {
+		ops, err := s.numberSequenced(ctx, b.ops)
+		if err != nil {
+			return err
+		}
+		b = &Batch{ops: ops, guards: b.guards}
+	}
+
+	if len(b.guards) == 0 {
+		_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			queueBatch(ctx, pipe, b.ops)
+			return nil
+		})
+		return err
+	}
+
+	guarded := map[string]bool{}
+	keys := make([]string, 0, len(b.guards))
+	for _, g := range b.guards {
+		guarded[g.key] = true
+		keys = append(keys, g.key)
+	}
+
+	inTx, after := b.ops, []batchOp(nil)
+	if _, ok := s.client.(*redis.ClusterClient); ok {
+		inTx = nil
+		for _, op := range b.ops {
+			if guarded[op.key] {
+				inTx = append(inTx, op)
+			} else {
+				after = append(after, op)
+			}
+		}
+	}
+
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		for _, g := range b.guards {
+			cmd := redis.NewCmd(ctx, "JSON.GET", g.key, ".")
+			err := tx.Process(ctx, cmd)
+
+			var doc []byte
+			switch {
+			case errors.Is(err, redis.Nil):
+			case err != nil:
+				return err
+			default:
+				doc = []byte(cmd.Val().(string))
+			}
+
+			if !g.holds(doc) {
+				return ErrConflict
+			}
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			queueBatch(ctx, pipe, inTx)
+			return nil
+		})
+		return err
+	}, keys...)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrConflict
+	}
+	if err != nil || len(after) == 0 {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		queueBatch(ctx, pipe, after)
+		return nil
+	})
+	return err
+}
+
+// redisSetSequenced numbers and stores the record of a SetSequenced op:
+// KEYS[1] is the counter and the others the indexes, ARGV[1] the key
+// prefix and ARGV[2] the document.  The record's key is made up in the
+// script, which a cluster doesn't allow; see Commit.
+var redisSetSequenced = `
+local seq = redis.call('INCR', KEYS[1])
+local key = ARGV[1] .. seq
+redis.call('JSON.SET', key, '.', ARGV[2])
+redis.call('JSON.SET', key, '.` + SequenceField + `', seq)
+for i = 2, #KEYS do
+	redis.call('ZADD', KEYS[i], seq, seq)
+end
+return seq`
+
+// numberSequenced replaces the SetSequenced ops of a batch by the writes
+// they make, numbered now rather than in the transaction
+func (s *redisStore) numberSequenced(ctx context.Context, ops []batchOp) ([]batchOp, error) {
+	numbered := make([]batchOp, 0, len(ops))
+	for i := range ops {
+		op := &ops[i]
+		if op.kind != batchSetSequenced {
+			numbered = append(numbered, *op)
+			continue
+		}
+
+		seq, err := s.client.Incr(ctx, op.key).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		key, doc := op.withSeq(seq)
+		numbered = append(numbered, batchOp{kind: batchSet, key: key, doc: doc})
+		for _, index := range op.indexes {
+			numbered = append(numbered, batchOp{kind: batchIndexAdd, key: index, id: uint64(seq)})
+		}
+	}
+	return numbered, nil
+}
+
+func queueBatch(ctx context.Context, pipe redis.Pipeliner, ops []batchOp) {
+	for _, op := range ops {
+		switch op.kind {
+		case batchSet:
+			pipe.Do(ctx, "JSON.SET", op.key, ".", string(op.doc))
+		case batchDelete:
+			pipe.Del(ctx, op.key)
+		case batchIncrField:
+			pipe.HIncrBy(ctx, op.key, op.field, op.delta)
+		case batchIndexAdd:
+			pipe.ZAdd(ctx, op.key, &redis.Z{Score: float64(op.id), Member: op.id})
+		case batchIndexRemove:
+			pipe.ZRem(ctx, op.key, op.id)
+		case batchAppend:
+			pipe.Do(ctx, "JSON.ARRAPPEND", op.key, "."+op.field, string(op.doc))
+		case batchAddMember:
+			pipe.SAdd(ctx, op.key, op.field)
+		case batchRemoveMember:
+			pipe.SRem(ctx, op.key, op.field)
+		case batchSetSequenced:
+			keys := append([]string{op.key}, op.indexes...)
+			pipe.Eval(ctx, redisSetSequenced, keys, op.prefix, string(op.doc))
+		}
+	}
+}
+
+func (s *redisStore) Publish(ctx context.Context, channel string, message []byte) error {
+	return s.client.Publish(ctx, channel, message).Err()
+}
+
+func (s *redisStore) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	pubsub := s.client.Subscribe(ctx, channel)
+
+	//Wait for the subscription to be confirmed, so nothing published
+	//after Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	messages := make(chan []byte)
+	go func() {
+		defer close(messages)
+		defer pubsub.Close()
+
+		received := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-received:
+				if !ok {
+					return
+				}
+				select {
+				case messages <- []byte(msg.Payload):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,661 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore keeps the documents as JSON text in one table and the set
+// members in another.  Several services may open the same file, writers
+// wait for each other through the busy timeout.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	key        TEXT PRIMARY KEY,
+	value      TEXT NOT NULL,
+	expires_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS records_expires_at ON records (expires_at);
+CREATE TABLE IF NOT EXISTS members (
+	key    TEXT NOT NULL,
+	member TEXT NOT NULL,
+	PRIMARY KEY (key, member)
+);
+CREATE TABLE IF NOT EXISTS indexes (
+	name TEXT NOT NULL,
+	id   INTEGER NOT NULL,
+	PRIMARY KEY (name, id)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS counters (
+	key   TEXT NOT NULL,
+	field TEXT NOT NULL,
+	value INTEGER NOT NULL,
+	PRIMARY KEY (key, field)
+);
+CREATE TABLE IF NOT EXISTS messages (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel    TEXT NOT NULL,
+	body       BLOB NOT NULL,
+	created_at INTEGER NOT NULL
+);`
+
+// sqliteExecer is a connection or a transaction, the writes below are
+// shared by the single calls and Commit
+type sqliteExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func sqliteSet(ctx context.Context, ex sqliteExecer, key string, value []byte) error {
+	_, err := ex.ExecContext(ctx,
+		"INSERT INTO records (key, value) VALUES (?, ?) "+
+			"ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = NULL",
+		key, string(value),
+	)
+	return err
+}
+
+func sqliteDelete(ctx context.Context, ex sqliteExecer, key string) error {
+	for _, table := range []string{"records", "members", "counters"} {
+		if _, err := ex.ExecContext(ctx, "DELETE FROM "+table+" WHERE key = ?", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteAppend adds value to the array in field, creating it if needed
+func sqliteAppend(ctx context.Context, ex sqliteExecer, key string, field string, value []byte) error {
+	path := "$." + field
+	res, err := ex.ExecContext(ctx,
+		"UPDATE records SET value = CASE json_type(value, ?) "+
+			"WHEN 'array' THEN json_insert(value, ? || '[#]', json(?)) "+
+			"ELSE json_set(value, ?, json_array(json(?))) END "+
+			"WHERE key = ? AND "+sqliteLive,
+		path, path, string(value), path, string(value), key, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func sqliteAddMember(ctx context.Context, ex sqliteExecer, key string, member string) error {
+	_, err := ex.ExecContext(ctx,
+		"INSERT INTO members (key, member) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		key, member,
+	)
+	return err
+}
+
+func sqliteRemoveMember(ctx context.Context, ex sqliteExecer, key string, member string) error {
+	_, err := ex.ExecContext(ctx, "DELETE FROM members WHERE key = ? AND member = ?", key, member)
+	return err
+}
+
+func sqliteIndexAdd(ctx context.Context, ex sqliteExecer, index string, id uint64) error {
+	_, err := ex.ExecContext(ctx,
+		"INSERT INTO indexes (name, id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		index, int64(id),
+	)
+	return err
+}
+
+func sqliteIndexRemove(ctx context.Context, ex sqliteExecer, index string, id uint64) error {
+	_, err := ex.ExecContext(ctx, "DELETE FROM indexes WHERE name = ? AND id = ?", index, int64(id))
+	return err
+}
+
+func sqliteSetSequenced(ctx context.Context, tx *sql.Tx, op *batchOp) error {
+	seq, err := sqliteIncr(ctx, tx, op.key, nil)
+	if err != nil {
+		return err
+	}
+
+	key, doc := op.withSeq(seq)
+	if err := sqliteSet(ctx, tx, key, doc); err != nil {
+		return err
+	}
+	for _, index := range op.indexes {
+		if err := sqliteIndexAdd(ctx, tx, index, uint64(seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteCheck fails with ErrConflict unless the record still holds what
+// the guard saw.  The UPDATE takes the write lock before the record is
+// read, so no other process changes it before the transaction commits.
+func sqliteCheck(ctx context.Context, tx *sql.Tx, g batchGuard) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE records SET value = value WHERE key = ?", g.key); err != nil {
+		return err
+	}
+
+	var value string
+	err := tx.QueryRowContext(ctx,
+		"SELECT value FROM records WHERE key = ? AND "+sqliteLive,
+		g.key, time.Now().UnixNano(),
+	).Scan(&value)
+
+	var doc []byte
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return err
+	default:
+		doc = []byte(value)
+	}
+
+	if !g.holds(doc) {
+		return ErrConflict
+	}
+	return nil
+}
+
+type sqliteStore struct {
+	db        *sql.DB
+	batchSize int
+}
+
+func newSqliteStore(path string, batchSize int) (*sqliteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	//One connection, so the writes of this process queue up here instead
+	//of failing on a locked database
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &sqliteStore{db: db, batchSize: batchSize}, nil
+}
+
+// live is the condition for records that haven't expired
+const sqliteLive = "(expires_at IS NULL OR expires_at > ?)"
+
+func (s *sqliteStore) Get(ctx context.Context, key string, v any) error {
+	var value string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT value FROM records WHERE key = ? AND "+sqliteLive,
+		key, time.Now().UnixNano(),
+	).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(value), v)
+}
+
+// GetMany runs one SELECT ... IN (...) per batch
+func (s *sqliteStore) GetMany(ctx context.Context, keys []string) ([]json.RawMessage, error) {
+	found := make(map[string]json.RawMessage, len(keys))
+
+	for start := 0; start < len(keys); start += s.batchSize {
+		batch := keys[start:min(start+s.batchSize, len(keys))]
+
+		args := make([]any, 0, len(batch)+1)
+		for _, key := range batch {
+			args = append(args, key)
+		}
+		args = append(args, time.Now().UnixNano())
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		rows, err := s.db.QueryContext(ctx,
+			"SELECT key, value FROM records WHERE key IN ("+placeholders+") AND "+sqliteLive,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var key, value string
+			if err := rows.Scan(&key, &value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[key] = json.RawMessage(value)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	docs := make([]json.RawMessage, len(keys))
+	for i, key := range keys {
+		docs[i] = found[key]
+	}
+	return docs, nil
+}
+
+func (s *sqliteStore) Set(ctx context.Context, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return sqliteSet(ctx, s.db, key, value)
+}
+
+func (s *sqliteStore) SetNX(ctx context.Context, key string, v any) (bool, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	//An expired record doesn't count as existing
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO records (key, value) VALUES (?, ?) "+
+			"ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = NULL "+
+			"WHERE records.expires_at IS NOT NULL AND records.expires_at <= ?",
+		key, string(value), time.Now().UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqliteStore) SetField(ctx context.Context, key string, field string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE records SET value = json_set(value, '$.' || ?, json(?)) WHERE key = ? AND "+sqliteLive,
+		field, string(value), key, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Append is a single UPDATE, a field that is missing or null becomes a
+// one element array
+func (s *sqliteStore) Append(ctx context.Context, key string, field string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return sqliteAppend(ctx, s.db, key, field, value)
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, keys ...string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, key := range keys {
+		if err := sqliteDelete(ctx, tx, key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Rename(ctx context.Context, from string, to string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM records WHERE key = ?", to); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE records SET key = ? WHERE key = ? AND "+sqliteLive,
+		to, from, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT key FROM records WHERE substr(key, 1, ?) = ? AND "+sqliteLive+
+			" UNION SELECT DISTINCT key FROM members WHERE substr(key, 1, ?) = ?"+
+			" UNION SELECT DISTINCT key FROM counters WHERE substr(key, 1, ?) = ?",
+		len(prefix), prefix, time.Now().UnixNano(), len(prefix), prefix, len(prefix), prefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	//Expired counters start over, rate limit windows would otherwise
+	//pile up forever
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM records WHERE expires_at IS NOT NULL AND expires_at <= ?",
+		now.UnixNano(),
+	); err != nil {
+		return 0, err
+	}
+
+	var expires any
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixNano()
+	}
+
+	count, err := sqliteIncr(ctx, tx, key, expires)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
+
+func sqliteIncr(ctx context.Context, tx *sql.Tx, key string, expires any) (int64, error) {
+	var count int64
+	err := tx.QueryRowContext(ctx,
+		"INSERT INTO records (key, value, expires_at) VALUES (?, '1', ?) "+
+			"ON CONFLICT (key) DO UPDATE SET value = CAST(value AS INTEGER) + 1 "+
+			"RETURNING CAST(value AS INTEGER)",
+		key, expires,
+	).Scan(&count)
+	return count, err
+}
+
+// Lease writes the owner unless someone else holds an unexpired lease,
+// the update of the upsert only happens for the owner or once expired
+func (s *sqliteStore) Lease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	value, err := json.Marshal(owner)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO records (key, value, expires_at) VALUES (?, ?, ?) "+
+			"ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at "+
+			"WHERE records.value = excluded.value OR (records.expires_at IS NOT NULL AND records.expires_at <= ?)",
+		key, string(value), now.Add(ttl).UnixNano(), now.UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqliteStore) Members(ctx context.Context, key string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT member FROM members WHERE key = ?", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+func (s *sqliteStore) AddMember(ctx context.Context, key string, member string) error {
+	return sqliteAddMember(ctx, s.db, key, member)
+}
+
+func (s *sqliteStore) RemoveMember(ctx context.Context, key string, member string) error {
+	return sqliteRemoveMember(ctx, s.db, key, member)
+}
+
+func (s *sqliteStore) IndexAdd(ctx context.Context, index string, id uint64) error {
+	return sqliteIndexAdd(ctx, s.db, index, id)
+}
+
+func (s *sqliteStore) IndexRemove(ctx context.Context, index string, id uint64) error {
+	return sqliteIndexRemove(ctx, s.db, index, id)
+}
+
+func (s *sqliteStore) IndexRange(ctx context.Context, index string, after uint64, limit int) ([]uint64, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id FROM indexes WHERE name = ? AND id > ? ORDER BY id LIMIT ?",
+		index, int64(after), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uint64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint64(id))
+	}
+
+	return ids, rows.Err()
+}
+
+func (s *sqliteStore) Counters(ctx context.Context, key string) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT field, value FROM counters WHERE key = ?", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counters := map[string]int64{}
+	for rows.Next() {
+		var field string
+		var n int64
+		if err := rows.Scan(&field, &n); err != nil {
+			return nil, err
+		}
+		counters[field] = n
+	}
+
+	return counters, rows.Err()
+}
+
+func (s *sqliteStore) Commit(ctx context.Context, b *Batch) error {
+	if err := b.encode(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, g := range b.guards {
+		if err := sqliteCheck(ctx, tx, g); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range b.ops {
+		switch op.kind {
+		case batchSet:
+			err = sqliteSet(ctx, tx, op.key, op.doc)
+		case batchDelete:
+			err = sqliteDelete(ctx, tx, op.key)
+		case batchIncrField:
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO counters (key, field, value) VALUES (?, ?, ?) "+
+					"ON CONFLICT (key, field) DO UPDATE SET value = value + excluded.value",
+				op.key, op.field, op.delta,
+			)
+		case batchIndexAdd:
+			err = sqliteIndexAdd(ctx, tx, op.key, op.id)
+		case batchIndexRemove:
+			err = sqliteIndexRemove(ctx, tx, op.key, op.id)
+		case batchAppend:
+			err = sqliteAppend(ctx, tx, op.key, op.field, op.doc)
+		case batchAddMember:
+			err = sqliteAddMember(ctx, tx, op.key, op.field)
+		case batchRemoveMember:
+			err = sqliteRemoveMember(ctx, tx, op.key, op.field)
+		case batchSetSequenced:
+			err = sqliteSetSequenced(ctx, tx, &op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Messages go through the messages table, subscribers poll it every
+// sqlitePollInterval.  Publishing sweeps messages older than
+// sqliteMessageTTL, by then every subscriber has read them.
+const (
+	sqlitePollInterval = 250 * time.Millisecond
+	sqliteMessageTTL   = time.Minute
+)
+
+func (s *sqliteStore) Publish(ctx context.Context, channel string, message []byte) error {
+	now := time.Now()
+
+	if _, err := s.db.ExecContext(ctx,
+		"INSERT INTO messages (channel, body, created_at) VALUES (?, ?, ?)",
+		channel, message, now.UnixNano(),
+	); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM messages WHERE created_at < ?", now.Add(-sqliteMessageTTL).UnixNano())
+	return err
+}
+
+func (s *sqliteStore) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	//Only what is published from now on
+	var last int64
+	if err := s.db.QueryRowContext(ctx, "SELECT coalesce(max(id), 0) FROM messages").Scan(&last); err != nil {
+		return nil, err
+	}
+
+	messages := make(chan []byte)
+	go func() {
+		defer close(messages)
+
+		ticker := time.NewTicker(sqlitePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			bodies, err := s.messagesAfter(ctx, channel, &last)
+			if err != nil {
+				if ctx.Err() == nil {
+					LogFrom(ctx).Warn("Failed to read messages", "channel", channel, "error", err)
+				}
+				continue
+			}
+
+			for _, body := range bodies {
+				select {
+				case messages <- body:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+func (s *sqliteStore) messagesAfter(ctx context.Context, channel string, last *int64) ([][]byte, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, body FROM messages WHERE channel = ? AND id > ? ORDER BY id",
+		channel, *last,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bodies [][]byte
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(last, &body); err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, body)
+	}
+
+	return bodies, rows.Err()
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
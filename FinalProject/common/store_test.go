@@ -0,0 +1,107 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type counterDoc struct {
+	N       int   `json:"n"`
+	History []int `json:"history"`
+}
+
+// testStores returns a fresh store of every kind that runs without a server
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	sqlite, err := newSqliteStore(filepath.Join(t.TempDir(), "test.db"), StoreDefaultBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+
+	return map[string]Store{"memory": newMemoryStore(), "sqlite": sqlite}
+}
+
+func TestCommitUnchangedGuard(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		if err := store.Set(ctx, "doc", counterDoc{N: 1}); err != nil {
+			t.Fatal(err)
+		}
+		docs, err := store.GetMany(ctx, []string{"doc", "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Append(ctx, "doc", "history", 7); err != nil {
+			t.Fatal(err)
+		}
+
+		var b Batch
+		b.Unchanged("doc", docs[0])
+		b.Set("other", counterDoc{N: 2})
+		if err := store.Commit(ctx, &b); !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: commit on a changed record: %v, want ErrConflict", name, err)
+		}
+		if err := store.Get(ctx, "other", &counterDoc{}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: a conflicting batch was written: %v", name, err)
+		}
+
+		var missing Batch
+		missing.Unchanged("missing", docs[1])
+		missing.Set("missing", counterDoc{N: 3})
+		if err := store.Commit(ctx, &missing); err != nil {
+			t.Errorf("%s: commit on a record still missing: %v", name, err)
+		}
+	}
+}
+
+func TestUpdateKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	const writers = 10
+
+	for name, store := range testStores(t) {
+		if err := store.Set(ctx, "doc", counterDoc{History: []int{}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				errs <- Update(ctx, store, "doc", func(d *counterDoc, b *Batch) error {
+					d.N++
+					b.Set("doc", d)
+					return nil
+				})
+			}()
+			go func(i int) {
+				defer wg.Done()
+				errs <- store.Append(ctx, "doc", "history", i)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		var got counterDoc
+		if err := store.Get(ctx, "doc", &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.N != writers || len(got.History) != writers {
+			t.Errorf("%s: n = %d and %d history entries, want %d of each", name, got.N, len(got.History), writers)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Distributed tracing with OpenTelemetry.  Trace context travels between
+// the services in W3C traceparent headers, so a vote produces a single
+// trace covering the VoteAPI, the calls it makes and the handlers on the
+// other side.  Spans are exported as JSON, either on stdout or appended to
+// a file, so tracing works without a collector.  The exporter is picked
+// with traces-exporter (none, stdout or file, default none) and the file
+// with traces-file (default traces.json).
+const (
+	TracesDefaultFile   = "traces.json"
+	TracesExporterNone  = "none"
+	TracesExporterStd   = "stdout"
+	TracesExporterFile  = "file"
+	redisSpanNamePrefix = "redis "
+)
+
+// tracer starts the spans of the redis commands and outbound calls, it is
+// named after the service by InitTracing
+var tracer = otel.Tracer("common")
+
+// InitTracing installs the tracer provider and the W3C propagator, the
+// returned function flushes and stops the exporter
+func InitTracing(serviceName string, exporter string, path string) (func(context.Context) error, error) {
+	tracer = otel.Tracer(serviceName)
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var opts []stdouttrace.Option
+	var file *os.File
+
+	switch exporter = strings.ToLower(exporter); exporter {
+	case "", TracesExporterNone:
+		//Without a provider spans are not recorded, but incoming trace
+		//context is still passed on to the services we call
+		return func(context.Context) error { return nil }, nil
+	case TracesExporterStd:
+		opts = append(opts, stdouttrace.WithWriter(os.Stdout))
+	case TracesExporterFile:
+		var err error
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", exporter)
+	}
+
+	exp, err := stdouttrace.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(ServiceVersion),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+//------------------------------------------------------------
+// REDIS
+//------------------------------------------------------------
+
+// redisTracingHook adds a span per redis command.  Commands issued outside
+// of a traced request are skipped, they would each start a trace of their own.
+type redisTracingHook struct{}
+
+func (redisTracingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+
+	ctx, _ = tracer.Start(ctx, redisSpanNamePrefix+cmd.Name(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(redisCommandAttributes(cmd)...),
+	)
+	return ctx, nil
+}
+
+func (redisTracingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	endRedisSpan(ctx, cmd.Err())
+	return nil
+}
+
+func (redisTracingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+
+	ctx, _ = tracer.Start(ctx, redisSpanNamePrefix+"pipeline",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemRedis,
+			attribute.Int("db.redis.num_cmd", len(cmds)),
+		),
+	)
+	return ctx, nil
+}
+
+func (redisTracingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmdErr := cmd.Err(); cmdErr != nil && cmdErr != redis.Nil {
+			err = cmdErr
+			break
+		}
+	}
+	endRedisSpan(ctx, err)
+	return nil
+}
+
+// Only the command and the key are recorded, the values may hold
+// personal data
+func redisCommandAttributes(cmd redis.Cmder) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemRedis,
+		semconv.DBOperation(cmd.Name()),
+	}
+
+	if args := cmd.Args(); len(args) > 1 {
+		attrs = append(attrs, attribute.String("db.redis.key", fmt.Sprint(args[1])))
+	}
+
+	return attrs
+}
+
+func endRedisSpan(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+
+	if err != nil && err != redis.Nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//------------------------------------------------------------
+// OUTBOUND CALLS
+//------------------------------------------------------------
+
+// TraceClient starts a client span for each call made through the resty
+// client and injects the traceparent header, requests need SetContext for
+// the span to join the caller's trace
+func TraceClient(client *resty.Client) {
+	client.OnBeforeRequest(func(c *resty.Client, req *resty.Request) error {
+		ctx, _ := tracer.Start(req.Context(), "HTTP "+req.Method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.HTTPMethod(req.Method),
+				semconv.HTTPURL(req.URL),
+			),
+		)
+
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+		req.SetContext(ctx)
+		return nil
+	})
+
+	client.OnAfterResponse(func(c *resty.Client, resp *resty.Response) error {
+		span := trace.SpanFromContext(resp.Request.Context())
+		span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode()))
+		if resp.StatusCode() >= 500 {
+			span.SetStatus(codes.Error, resp.Status())
+		}
+		span.End()
+		return nil
+	})
+
+	//A failed connection comes as a ResponseError too, its span wasn't
+	//ended by OnAfterResponse
+	client.OnError(func(req *resty.Request, err error) {
+		var respErr *resty.ResponseError
+		if errors.As(err, &respErr) && respErr.Response.RawResponse != nil {
+			return
+		}
+
+		span := trace.SpanFromContext(req.Context())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+	})
+}
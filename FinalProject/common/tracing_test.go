@@ -0,0 +1,161 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans has the spans of the test recorded, as InitTracing would
+// export them
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous, previousTracer, previousPropagator := otel.GetTracerProvider(), tracer, otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+		tracer = previousTracer
+	})
+	return recorder
+}
+
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("no ended span %q", name)
+	return nil
+}
+
+func attributeOf(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// A call made in a traced request is a child span, and the service called
+// gets the trace in its traceparent header
+func TestTraceClientJoinsTheTrace(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var received trace.SpanContext
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		received = trace.SpanContextFromContext(ctx)
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	client := resty.New()
+	TraceClient(client)
+
+	ctx, parent := tracer.Start(context.Background(), "request")
+	if _, err := client.R().SetContext(ctx).Get(srv.URL + "/up"); err != nil {
+		t.Fatal(err)
+	}
+
+	span := endedSpan(t, recorder, "HTTP GET")
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("call span is not a child of the request")
+	}
+	if received.TraceID() != parent.SpanContext().TraceID() || received.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("traceparent %s/%s, want the call span", received.TraceID(), received.SpanID())
+	}
+	if status, _ := attributeOf(span, "http.status_code"); status.AsInt64() != http.StatusOK {
+		t.Errorf("status attribute %v, want 200", status.AsInt64())
+	}
+
+	//A 5xx or a failed connection leaves an error span, ended all the same
+	if _, err := client.R().SetContext(ctx).Post(srv.URL + "/down"); err != nil {
+		t.Fatal(err)
+	}
+	if span := endedSpan(t, recorder, "HTTP POST"); span.Status().Code != codes.Error {
+		t.Errorf("span of a 503 has status %v", span.Status())
+	}
+
+	srv.Close()
+	if _, err := client.R().SetContext(ctx).Delete(srv.URL + "/up"); err == nil {
+		t.Fatal("call to a closed server went through")
+	}
+	if span := endedSpan(t, recorder, "HTTP DELETE"); span.Status().Code != codes.Error {
+		t.Errorf("span of a failed connection has status %v", span.Status())
+	}
+	parent.End()
+}
+
+// Redis commands get a span inside a trace only, with the key but never
+// the value
+func TestRedisSpans(t *testing.T) {
+	recorder := recordSpans(t)
+	hook := redisTracingHook{}
+
+	cmd := redis.NewStatusCmd(context.Background(), "set", "voter:1", `{"Email":"ada@example.com"}`)
+	ctx, _ := hook.BeforeProcess(context.Background(), cmd)
+	hook.AfterProcess(ctx, cmd)
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Fatalf("%d spans outside of a trace", len(spans))
+	}
+
+	traced, parent := tracer.Start(context.Background(), "request")
+	ctx, _ = hook.BeforeProcess(traced, cmd)
+	hook.AfterProcess(ctx, cmd)
+
+	span := endedSpan(t, recorder, "redis set")
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("redis span is not a child of the request")
+	}
+	if key, _ := attributeOf(span, "db.redis.key"); key.AsString() != "voter:1" {
+		t.Errorf("key attribute %q, want voter:1", key.AsString())
+	}
+	for _, kv := range span.Attributes() {
+		if kv.Value.AsString() == `{"Email":"ada@example.com"}` {
+			t.Errorf("the value is recorded in %s", kv.Key)
+		}
+	}
+
+	//A missing key is an answer, not a failure
+	missing := redis.NewStringCmd(traced, "get", "voter:2")
+	missing.SetErr(redis.Nil)
+	ctx, _ = hook.BeforeProcess(traced, missing)
+	hook.AfterProcess(ctx, missing)
+	if span := endedSpan(t, recorder, "redis get"); span.Status().Code == codes.Error {
+		t.Errorf("a missing key is an error span")
+	}
+
+	failed := redis.NewStringCmd(traced, "incr", "voteCnt:")
+	failed.SetErr(errors.New("connection reset"))
+	ctx, _ = hook.BeforeProcess(traced, failed)
+	hook.AfterProcess(ctx, failed)
+	if span := endedSpan(t, recorder, "redis incr"); span.Status().Code != codes.Error {
+		t.Errorf("a failed command has status %v", span.Status())
+	}
+	parent.End()
+}
@@ -0,0 +1,1023 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+)
+
+// Outbound webhooks.  Integrators subscribe a URL to some of the domain
+// events (WebhookEvents) through /webhook on any of the services.  The
+// outbox relay turns each event into one delivery per matching webhook,
+// kept in the store, and the worker of one replica (it holds the
+// lease:webhooks lease) posts the pending ones:
+//
+//	POST <url>
+//	X-Webhook-Event: vote.cast
+//	X-Webhook-Delivery: 42
+//	X-Webhook-Timestamp: 1700000000
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+//	{"event":"vote.cast","seq":7,"time":"...","data":{...}}
+//
+// The HMAC key is the webhook's secret, handed out once when it is
+// created.  Anything but a 2xx is a failure, retried after
+// WebhookBackoffBase doubled with every attempt (at most WebhookBackoffMax)
+// until webhook-max-attempts failures move the delivery to the dead letter
+// list.  A delivery can be sent again by hand from the log or the dead
+// letter list.  Deliveries are at least once, receivers should ignore a
+// delivery id, or the seq of an event from the same service, they have
+// already seen.
+//
+// Finished deliveries are trimmed once they are older than
+// webhook-retention, along with their entries in the log.  Receivers must
+// be at public addresses, checked when the URL is resolved, unless
+// webhook-allow-private is set.
+const (
+	WebhookRedisPrefix        = "webhook:"
+	WebhookIDKey              = "webhookCnt:"
+	WebhookIndex              = "webhookIdx:"
+	WebhookDeliveryPrefix     = "webhookDelivery:"
+	WebhookDeliveryIDKey      = "webhookDeliveryCnt:"
+	WebhookClaimPrefix        = "webhookClaim:"
+	WebhookPendingIndex       = "webhookPending:"
+	WebhookDeadIndex          = "webhookDead:"
+	WebhookLogPrefix          = "webhookLog:"
+	WebhookSubjectPrefix      = "webhookSubject:"
+	WebhookTrimmedKey         = "webhookTrimmed:"
+	WebhookSecretPrefix       = "whsec_"
+	WebhookScope              = "webhooks:manage"
+	WebhookDefaultMaxAttempts = 8
+	WebhookBackoffBase        = 10 * time.Second
+	WebhookBackoffMax         = time.Hour
+	WebhookTimeout            = 10 * time.Second
+	WebhookPollInterval       = time.Second
+	WebhookConcurrency        = 16
+	WebhookCacheTTL           = 5 * time.Second
+	WebhookLease              = 10 * time.Second
+	WebhookTrimInterval       = time.Minute
+	WebhookDefaultRetention   = 30 * 24 * time.Hour
+	WebhookDownstream         = "webhook"
+)
+
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+)
+
+// WebhookEvents are the events a webhook may subscribe to, "*" takes them all
+var WebhookEvents = []string{
+	"poll.created", "poll.updated", "poll.deleted", "poll.opened", "poll.closed",
+	"vote.cast", "vote.changed", "vote.retracted", "vote.anonymized", "vote.archived",
+	"voter.registered", "voter.updated", "voter.deleted", "voter.erased", "voter.voted",
+	"group.created", "group.deleted", "group.member_added", "group.member_removed",
+}
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook does not exist")
+	ErrDeliveryNotFound = errors.New("webhook delivery does not exist")
+	ErrInvalidWebhook   = errors.New("invalid webhook")
+)
+
+type Webhook struct {
+	WebhookID uint      `json:"webhookID"`
+	Url       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID  uint            `json:"deliveryID"`
+	WebhookID   uint            `json:"webhookID"`
+	Event       string          `json:"event"`
+	Subject     string          `json:"subject,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastStatus  int             `json:"lastStatus,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	DeliveredAt *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+type webhookPayload struct {
+	Event   string          `json:"event"`
+	Seq     uint64          `json:"seq"`
+	Subject string          `json:"subject,omitempty"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type Webhooks struct {
+	store        Store
+	client       *resty.Client
+	maxAttempts  int
+	retention    time.Duration
+	allowPrivate bool
+	owner        string
+
+	//The webhooks, read again every WebhookCacheTTL so Emit doesn't cost
+	//a list on every event
+	mu       sync.Mutex
+	cached   []Webhook
+	cachedAt time.Time
+
+	stop     chan struct{}
+	stopping sync.Once
+	running  sync.WaitGroup
+	slots    chan struct{}
+}
+
+// NewWebhooks reuses the store of the API and starts the delivery worker,
+// Close stops it
+func NewWebhooks(store Store, cfg *Config) *Webhooks {
+	client := resty.New().SetTimeout(WebhookTimeout)
+	if !cfg.WebhookAllowPrivate {
+		client.SetTransport(publicTransport())
+	}
+	InstrumentClientAs(client, WebhookDownstream)
+
+	owner := make([]byte, 8)
+	rand.Read(owner)
+
+	w := &Webhooks{
+		store:        store,
+		client:       client,
+		maxAttempts:  cfg.WebhookMaxAttempts,
+		retention:    cfg.WebhookRetention,
+		allowPrivate: cfg.WebhookAllowPrivate,
+		owner:        hex.EncodeToString(owner),
+		stop:         make(chan struct{}),
+		slots:        make(chan struct{}, WebhookConcurrency),
+	}
+
+	w.running.Add(1)
+	go w.run()
+	return w
+}
+
+// Close stops the worker and waits for the deliveries in flight
+func (w *Webhooks) Close(ctx context.Context) error {
+	w.stopping.Do(func() { close(w.stop) })
+
+	finished := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//------------------------------------------------------------
+// REDIS HELPERS
+//------------------------------------------------------------
+
+func webhookKey(id uint64) string {
+	return fmt.Sprintf("%s%d", WebhookRedisPrefix, id)
+}
+
+func webhookDeliveryKey(id uint64) string {
+	return fmt.Sprintf("%s%d", WebhookDeliveryPrefix, id)
+}
+
+func webhookClaimKey(id uint) string {
+	return fmt.Sprintf("%s%d", WebhookClaimPrefix, id)
+}
+
+func webhookLogIndex(webhookID uint) string {
+	return fmt.Sprintf("%s%d", WebhookLogPrefix, webhookID)
+}
+
+// webhookSubjectIndex lists the deliveries of the events about a subject,
+// see Outbox.Redact
+func webhookSubjectIndex(subject string) string {
+	return WebhookSubjectPrefix + subject
+}
+
+// The addresses that aren't public beyond what netip tells, e.g. the
+// carrier-grade NAT range
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddr tells whether a webhook may post to addr: not loopback,
+// private, link-local or any of the other ranges that reach the services
+// themselves or their infrastructure
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicTransport only connects to public addresses.  The check is made
+// on the address being dialed, after the name was resolved, so neither a
+// name resolving to an internal address nor a redirect gets past it.
+func publicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: WebhookTimeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(addr) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return WebhookSecretPrefix + hex.EncodeToString(buf), nil
+}
+
+// webhookSignature is what receivers compute to check a delivery
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := WebhookBackoffBase
+	for i := 1; i < attempts && backoff < WebhookBackoffMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, WebhookBackoffMax)
+}
+
+func (h *Webhook) public() Webhook {
+	pub := *h
+	pub.Secret = ""
+	return pub
+}
+
+func (h *Webhook) wants(event string) bool {
+	for _, e := range h.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------
+// WEBHOOK MANAGEMENT
+//------------------------------------------------------------
+
+func validateWebhook(hookUrl string, events []string, allowPrivate bool) error {
+	u, err := url.Parse(hookUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q is not an http(s) URL", ErrInvalidWebhook, hookUrl)
+	}
+
+	//Names are checked again once resolved, see publicTransport; this
+	//only turns down the URLs that can't be right up front
+	if !allowPrivate {
+		host := u.Hostname()
+		addr, err := netip.ParseAddr(host)
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") || (err == nil && !publicAddr(addr)) {
+			return fmt.Errorf("%w: %s is not a public address", ErrInvalidWebhook, host)
+		}
+	}
+
+	if len(events) == 0 {
+		return fmt.Errorf("%w: a webhook needs at least one event", ErrInvalidWebhook)
+	}
+
+next:
+	for _, event := range events {
+		if event == "*" {
+			continue
+		}
+		for _, known := range WebhookEvents {
+			if event == known {
+				continue next
+			}
+		}
+		return fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+	}
+
+	return nil
+}
+
+// CreateWebhook returns the webhook with its secret, which is only shown
+// this once
+func (w *Webhooks) CreateWebhook(ctx context.Context, hookUrl string, events []string) (*Webhook, error) {
+	if err := validateWebhook(hookUrl, events, w.allowPrivate); err != nil {
+		return nil, err
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := w.store.Incr(ctx, WebhookIDKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hook := Webhook{
+		WebhookID: uint(id),
+		Url:       hookUrl,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+
+	var b Batch
+	b.Set(webhookKey(uint64(id)), hook)
+	b.IndexAdd(WebhookIndex, uint64(id))
+	if err := w.store.Commit(ctx, &b); err != nil {
+		return nil, err
+	}
+
+	w.invalidate()
+	return &hook, nil
+}
+
+func (w *Webhooks) GetWebhook(ctx context.Context, id uint) (*Webhook, error) {
+	var hook Webhook
+	err := w.store.Get(ctx, webhookKey(uint64(id)), &hook)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrWebhookNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (w *Webhooks) ListWebhooks(ctx context.Context, page Page) ([]Webhook, uint64, error) {
+	hooks, next, err := ListPage[Webhook](ctx, w.store, WebhookIndex, page, webhookKey, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range hooks {
+		hooks[i] = hooks[i].public()
+	}
+	return hooks, next, nil
+}
+
+// DeleteWebhook stops new deliveries, pending ones are dropped when the
+// worker gets to them.  The delivery log is kept.
+func (w *Webhooks) DeleteWebhook(ctx context.Context, id uint) error {
+	if _, err := w.GetWebhook(ctx, id); err != nil {
+		return err
+	}
+
+	var b Batch
+	b.Delete(webhookKey(uint64(id)))
+	b.IndexRemove(WebhookIndex, uint64(id))
+	if err := w.store.Commit(ctx, &b); err != nil {
+		return err
+	}
+
+	w.invalidate()
+	return nil
+}
+
+func (w *Webhooks) invalidate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cached = nil
+}
+
+func (w *Webhooks) webhooks(ctx context.Context) ([]Webhook, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cached != nil && time.Since(w.cachedAt) < WebhookCacheTTL {
+		return w.cached, nil
+	}
+
+	hooks := []Webhook{}
+	page := Page{Limit: MaxPageLimit}
+	for {
+		found, next, err := ListPage[Webhook](ctx, w.store, WebhookIndex, page, webhookKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, found...)
+		if next == 0 {
+			break
+		}
+		page.After = next
+	}
+
+	w.cached = hooks
+	w.cachedAt = time.Now()
+	return hooks, nil
+}
+
+//------------------------------------------------------------
+// EVENTS
+//------------------------------------------------------------
+
+// Emit queues a delivery of the event to every webhook subscribed to it.
+// The outbox relay calls it for every event it publishes.
+func (w *Webhooks) Emit(ctx context.Context, ev Event) error {
+	hooks, err := w.webhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var payload []byte
+	var b Batch
+
+	for i := range hooks {
+		if !hooks[i].wants(ev.Type) {
+			continue
+		}
+
+		if payload == nil {
+			payload, err = json.Marshal(webhookPayload{Event: ev.Type, Seq: ev.Seq, Subject: ev.Subject, Time: ev.Time, Data: ev.Data})
+			if err != nil {
+				return err
+			}
+		}
+
+		id, err := w.store.Incr(ctx, WebhookDeliveryIDKey, 0)
+		if err != nil {
+			return err
+		}
+
+		delivery := WebhookDelivery{
+			DeliveryID:  uint(id),
+			WebhookID:   hooks[i].WebhookID,
+			Event:       ev.Type,
+			Subject:     ev.Subject,
+			Payload:     payload,
+			Status:      WebhookPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+		}
+
+		b.Set(webhookDeliveryKey(uint64(id)), delivery)
+		b.IndexAdd(WebhookPendingIndex, uint64(id))
+		b.IndexAdd(webhookLogIndex(delivery.WebhookID), uint64(id))
+		if ev.Subject != "" {
+			b.IndexAdd(webhookSubjectIndex(ev.Subject), uint64(id))
+		}
+	}
+
+	if payload == nil {
+		return nil
+	}
+	return w.store.Commit(ctx, &b)
+}
+
+//------------------------------------------------------------
+// DELIVERIES
+//------------------------------------------------------------
+
+// redactDeliveries rewrites the payloads of the deliveries of the events
+// about subject, sent or not
+func redactDeliveries(ctx context.Context, store Store, subject string, redact Redaction) error {
+	return redactRecords(ctx, store, webhookSubjectIndex(subject), webhookDeliveryKey, func(d *WebhookDelivery) error {
+		var payload webhookPayload
+		if err := json.Unmarshal(d.Payload, &payload); err != nil {
+			return fmt.Errorf("delivery %d: %w", d.DeliveryID, err)
+		}
+
+		data, err := redact(payload.Data)
+		if err != nil {
+			return err
+		}
+		payload.Data = data
+
+		d.Payload, err = json.Marshal(payload)
+		return err
+	})
+}
+
+func (w *Webhooks) GetDelivery(ctx context.Context, id uint) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := w.store.Get(ctx, webhookDeliveryKey(uint64(id)), &delivery)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrDeliveryNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// ListDeliveries is the delivery log of a webhook, oldest first
+func (w *Webhooks) ListDeliveries(ctx context.Context, webhookID uint, page Page) ([]WebhookDelivery, uint64, error) {
+	return ListPage[WebhookDelivery](ctx, w.store, webhookLogIndex(webhookID), page, webhookDeliveryKey, nil)
+}
+
+// ListDeadLetters are the deliveries that ran out of attempts
+func (w *Webhooks) ListDeadLetters(ctx context.Context, page Page) ([]WebhookDelivery, uint64, error) {
+	return ListPage[WebhookDelivery](ctx, w.store, WebhookDeadIndex, page, webhookDeliveryKey, nil)
+}
+
+// Redeliver queues a delivery again with a fresh set of attempts, whatever
+// became of it
+func (w *Webhooks) Redeliver(ctx context.Context, id uint) (*WebhookDelivery, error) {
+	delivery, err := w.GetDelivery(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Status = WebhookPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now()
+
+	var b Batch
+	b.Set(webhookDeliveryKey(uint64(id)), delivery)
+	b.IndexRemove(WebhookDeadIndex, uint64(id))
+	b.IndexAdd(WebhookPendingIndex, uint64(id))
+	if err := w.store.Commit(ctx, &b); err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+func (w *Webhooks) run() {
+	defer w.running.Done()
+
+	ticker := time.NewTicker(WebhookPollInterval)
+	defer ticker.Stop()
+
+	var trimmed time.Time
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx := context.Background()
+		if !w.lease(ctx) {
+			continue
+		}
+
+		if err := w.deliverDue(); err != nil {
+			slog.Warn("Failed to read the pending webhook deliveries", "error", err)
+		}
+
+		if time.Since(trimmed) < WebhookTrimInterval {
+			continue
+		}
+		trimmed = time.Now()
+
+		if err := w.trim(ctx); err != nil {
+			slog.Warn("Failed to trim the webhook deliveries", "error", err)
+		}
+	}
+}
+
+// lease takes or renews the right to send the deliveries, so one replica
+// walks the pending ones rather than all of them every second.  Claims
+// still keep a delivery from going out twice when the lease moves.
+func (w *Webhooks) lease(ctx context.Context) bool {
+	held, err := w.store.Lease(ctx, LeasePrefix+"webhooks", w.owner, WebhookLease)
+	if err != nil {
+		slog.Warn("Failed to take the webhook lease", "error", err)
+	}
+	return held
+}
+
+// trim drops the finished deliveries queued more than the retention ago,
+// with their index entries.  Deliveries are numbered as they are queued,
+// so they are walked in order from webhookTrimmed: up to the first one to
+// keep; one still pending holds back the ones after it until it is done.
+// A missing delivery is only passed over once a later one is trimmed, it
+// may be a commit still on its way.
+func (w *Webhooks) trim(ctx context.Context) error {
+	var trimmed, last uint64
+	if err := w.store.Get(ctx, WebhookTrimmedKey, &trimmed); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := w.store.Get(ctx, WebhookDeliveryIDKey, &last); errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-w.retention)
+	for trimmed < last {
+		keys := []string{}
+		for id := trimmed + 1; id <= last && len(keys) < MaxPageLimit; id++ {
+			keys = append(keys, webhookDeliveryKey(id))
+		}
+
+		found, err := GetMany[WebhookDelivery](ctx, w.store, keys)
+		if err != nil {
+			return err
+		}
+
+		var b Batch
+		next := trimmed
+		for i, d := range found {
+			if d == nil {
+				continue
+			}
+			if d.Status == WebhookPending || d.CreatedAt.After(cutoff) {
+				break
+			}
+
+			id := trimmed + uint64(i) + 1
+			b.Delete(webhookDeliveryKey(id))
+			b.IndexRemove(webhookLogIndex(d.WebhookID), id)
+			b.IndexRemove(WebhookDeadIndex, id)
+			if d.Subject != "" {
+				b.IndexRemove(webhookSubjectIndex(d.Subject), id)
+			}
+			next = id
+		}
+
+		if next == trimmed {
+			return nil
+		}
+		b.Set(WebhookTrimmedKey, next)
+		if err := w.store.Commit(ctx, &b); err != nil {
+			return err
+		}
+
+		//Stopped before the end of the batch, the rest is kept
+		if next < trimmed+uint64(len(keys)) {
+			return nil
+		}
+		trimmed = next
+	}
+
+	return nil
+}
+
+// deliverDue walks the pending deliveries and sends the ones whose time
+// has come, at most WebhookConcurrency at once
+func (w *Webhooks) deliverDue() error {
+	ctx := context.Background()
+	page := Page{Limit: MaxPageLimit}
+	now := time.Now()
+
+	for {
+		due, next, err := ListPage[WebhookDelivery](ctx, w.store, WebhookPendingIndex, page,
+			webhookDeliveryKey, func(d *WebhookDelivery) bool { return !d.NextAttempt.After(now) })
+		if err != nil {
+			return err
+		}
+
+		for i := range due {
+			select {
+			case <-w.stop:
+				return nil
+			case w.slots <- struct{}{}:
+			}
+
+			if !w.claim(ctx, due[i].DeliveryID) {
+				<-w.slots
+				continue
+			}
+
+			w.running.Add(1)
+			go func(delivery WebhookDelivery) {
+				defer w.running.Done()
+				defer func() { <-w.slots }()
+				w.attempt(ctx, &delivery)
+			}(due[i])
+		}
+
+		if next == 0 {
+			return nil
+		}
+		page.After = next
+	}
+}
+
+// claim keeps two replicas from sending the same delivery at once.  The
+// claim is dropped after the attempt; one left behind by a replica that
+// died expires after twice the delivery timeout.
+func (w *Webhooks) claim(ctx context.Context, id uint) bool {
+	key := webhookClaimKey(id)
+	until := time.Now().Add(2 * WebhookTimeout).Unix()
+
+	ok, err := w.store.SetNX(ctx, key, until)
+	if err != nil || ok {
+		return ok
+	}
+
+	var held int64
+	if err := w.store.Get(ctx, key, &held); err != nil || time.Now().Unix() < held {
+		return false
+	}
+	return w.store.Set(ctx, key, until) == nil
+}
+
+func (w *Webhooks) attempt(ctx context.Context, delivery *WebhookDelivery) {
+	defer w.store.Delete(ctx, webhookClaimKey(delivery.DeliveryID))
+
+	//Someone may have redelivered or finished it since it was listed
+	current, err := w.GetDelivery(ctx, delivery.DeliveryID)
+	if err != nil || current.Status != WebhookPending || current.Attempts != delivery.Attempts {
+		return
+	}
+	delivery = current
+
+	logger := slog.Default().With("webhook_id", delivery.WebhookID, "delivery_id", delivery.DeliveryID, "event", delivery.Event)
+	id := uint64(delivery.DeliveryID)
+
+	hook, err := w.GetWebhook(ctx, delivery.WebhookID)
+	if errors.Is(err, ErrWebhookNotFound) {
+		delivery.Status = WebhookDead
+		delivery.LastError = "webhook was deleted"
+		err := w.recordAttempt(ctx, delivery, func(b *Batch) {
+			b.IndexRemove(WebhookPendingIndex, id)
+		})
+		if err != nil {
+			logger.Warn("Failed to drop a delivery of a deleted webhook", "error", err)
+		}
+		return
+	} else if err != nil {
+		logger.Warn("Failed to read the webhook", "error", err)
+		return
+	}
+
+	status, err := w.send(hook, delivery)
+	delivery.Attempts++
+	delivery.LastStatus = status
+	delivery.LastError = ""
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+
+	var index func(b *Batch)
+	switch {
+	case err == nil:
+		now := time.Now()
+		delivery.Status = WebhookDelivered
+		delivery.DeliveredAt = &now
+		index = func(b *Batch) { b.IndexRemove(WebhookPendingIndex, id) }
+		webhookDeliveries.WithLabelValues(WebhookDelivered).Inc()
+	case delivery.Attempts >= w.maxAttempts:
+		delivery.Status = WebhookDead
+		index = func(b *Batch) {
+			b.IndexRemove(WebhookPendingIndex, id)
+			b.IndexAdd(WebhookDeadIndex, id)
+		}
+		webhookDeliveries.WithLabelValues(WebhookDead).Inc()
+		logger.Warn("Webhook delivery failed for good", "attempts", delivery.Attempts, "error", err)
+	default:
+		delivery.NextAttempt = time.Now().Add(webhookBackoff(delivery.Attempts))
+		index = func(b *Batch) {}
+		webhookDeliveries.WithLabelValues("retry").Inc()
+		logger.Info("Webhook delivery failed, will retry", "attempts", delivery.Attempts, "next_attempt", delivery.NextAttempt, "error", err)
+	}
+
+	if err := w.recordAttempt(ctx, delivery, index); err != nil {
+		logger.Error("Failed to record the webhook delivery", "error", err)
+	}
+}
+
+// recordAttempt writes the outcome of an attempt and its index changes.
+// The payload is kept as stored, an erasure may have redacted it while
+// the delivery was being sent.
+func (w *Webhooks) recordAttempt(ctx context.Context, delivery *WebhookDelivery, index func(b *Batch)) error {
+	key := webhookDeliveryKey(uint64(delivery.DeliveryID))
+
+	return Update(ctx, w.store, key, func(current *WebhookDelivery, b *Batch) error {
+		if current == nil {
+			return ErrDeliveryNotFound
+		}
+
+		outcome := *delivery
+		outcome.Payload = current.Payload
+		b.Set(key, outcome)
+		index(b)
+		return nil
+	})
+}
+
+// send posts the payload and returns the receiver's status, 0 when it
+// couldn't be reached
+func (w *Webhooks) send(hook *Webhook, delivery *WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	resp, err := w.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Webhook-Event", delivery.Event).
+		SetHeader("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.DeliveryID), 10)).
+		SetHeader("X-Webhook-Timestamp", timestamp).
+		SetHeader("X-Webhook-Signature", webhookSignature(hook.Secret, timestamp, delivery.Payload)).
+		SetBody([]byte(delivery.Payload)).
+		Post(hook.Url)
+	if err != nil {
+		return 0, err
+	}
+
+	if !resp.IsSuccess() {
+		return resp.StatusCode(), fmt.Errorf("receiver answered %s", resp.Status())
+	}
+	return resp.StatusCode(), nil
+}
+
+//------------------------------------------------------------
+// ROUTES
+//------------------------------------------------------------
+
+func RegisterWebhookRoutes(r *gin.Engine, keys *ApiKeyStore, w *Webhooks) {
+	manage := r.Group("/webhook", keys.RequireScope(WebhookScope))
+
+	manage.POST("", func(c *gin.Context) {
+		type NewWebhook struct {
+			Url    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		var req NewWebhook
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			LogFrom(c.Request.Context()).Warn("Cannot fetch JSON body from webhook POST", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		hook, err := w.CreateWebhook(c.Request.Context(), req.Url, req.Events)
+		if errors.Is(err, ErrInvalidWebhook) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to create a webhook", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusCreated, hook)
+	})
+
+	manage.GET("", func(c *gin.Context) {
+		page, err := PageFromQuery(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		hooks, next, err := w.ListWebhooks(c.Request.Context(), page)
+		if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to list webhooks", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		SetNextLink(c, next)
+		c.JSON(http.StatusOK, hooks)
+	})
+
+	manage.GET("/dead-letters", func(c *gin.Context) {
+		page, err := PageFromQuery(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		deliveries, next, err := w.ListDeadLetters(c.Request.Context(), page)
+		if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to list dead letters", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		SetNextLink(c, next)
+		c.JSON(http.StatusOK, deliveries)
+	})
+
+	manage.GET("/:id", func(c *gin.Context) {
+		id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", c.Param("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		hook, err := w.GetWebhook(c.Request.Context(), uint(id64))
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.JSON(http.StatusOK, hook.public())
+	})
+
+	manage.DELETE("/:id", func(c *gin.Context) {
+		id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", c.Param("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		err = w.DeleteWebhook(c.Request.Context(), uint(id64))
+		if errors.Is(err, ErrWebhookNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to delete a webhook", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	manage.GET("/:id/deliveries", func(c *gin.Context) {
+		id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", c.Param("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		page, err := PageFromQuery(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		deliveries, next, err := w.ListDeliveries(c.Request.Context(), uint(id64), page)
+		if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to list webhook deliveries", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		SetNextLink(c, next)
+		c.JSON(http.StatusOK, deliveries)
+	})
+
+	manage.POST("/delivery/:id/redeliver", func(c *gin.Context) {
+		id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			LogFrom(c.Request.Context()).Warn("Error converting id to int64", "id", c.Param("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		delivery, err := w.Redeliver(c.Request.Context(), uint(id64))
+		if errors.Is(err, ErrDeliveryNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			LogFrom(c.Request.Context()).Error("Failed to redeliver", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusAccepted, delivery)
+	})
+}
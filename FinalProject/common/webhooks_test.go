@@ -0,0 +1,191 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestWebhooks has no worker running, the tests make the attempts
+func newTestWebhooks(t *testing.T, store Store, allowPrivate bool) *Webhooks {
+	t.Helper()
+
+	w := NewWebhooks(store, &Config{WebhookMaxAttempts: 3, WebhookRetention: time.Hour, WebhookAllowPrivate: allowPrivate})
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWebhookSignedAndRetried(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	w := newTestWebhooks(t, store, true)
+
+	var secret string
+	received := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received++
+		body, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "." + string(body)))
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("attempt %d: bad signature %q", received, r.Header.Get("X-Webhook-Signature"))
+		}
+		if r.Header.Get("X-Webhook-Event") != "vote.cast" || r.Header.Get("X-Webhook-Delivery") != "1" {
+			t.Errorf("attempt %d: headers %v", received, r.Header)
+		}
+
+		//The first attempt fails, the retry goes through
+		if received == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	hook, err := w.CreateWebhook(ctx, receiver.URL, []string{"vote.cast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = hook.Secret
+
+	if err := w.Emit(ctx, Event{Seq: 1, Type: "vote.cast", Time: time.Now(), Data: json.RawMessage(`{"voteID":1}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	delivery, err := w.GetDelivery(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.attempt(ctx, delivery)
+
+	delivery, err = w.GetDelivery(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != WebhookPending || delivery.Attempts != 1 || delivery.LastStatus != http.StatusServiceUnavailable {
+		t.Fatalf("after a failure the delivery is %s after %d attempts (%d), want pending after 1 (503)", delivery.Status, delivery.Attempts, delivery.LastStatus)
+	}
+	if !delivery.NextAttempt.After(time.Now()) {
+		t.Errorf("retry at %s, want it backed off", delivery.NextAttempt)
+	}
+
+	w.attempt(ctx, delivery)
+
+	delivery, err = w.GetDelivery(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != WebhookDelivered || delivery.Attempts != 2 {
+		t.Errorf("after the retry the delivery is %s after %d attempts, want delivered after 2", delivery.Status, delivery.Attempts)
+	}
+
+	pending, err := store.IndexRange(ctx, WebhookPendingIndex, 0, MaxPageLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("deliveries %v still pending", pending)
+	}
+}
+
+func TestWebhookOnlyPostsToPublicAddresses(t *testing.T) {
+	for _, hookUrl := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.1.2.3/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://[::ffff:192.168.1.1]/hook",
+		"http://100.64.0.1/hook",
+	} {
+		if err := validateWebhook(hookUrl, []string{"*"}, false); err == nil {
+			t.Errorf("%s was taken", hookUrl)
+		}
+		if err := validateWebhook(hookUrl, []string{"*"}, true); err != nil {
+			t.Errorf("%s was turned down with webhook-allow-private: %v", hookUrl, err)
+		}
+	}
+
+	if err := validateWebhook("https://example.com/hook", []string{"*"}, false); err != nil {
+		t.Errorf("public URL turned down: %v", err)
+	}
+
+	//A name is only resolved as it is dialed, that is where an internal
+	//address is stopped
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer receiver.Close()
+
+	w := newTestWebhooks(t, newMemoryStore(), false)
+	status, err := w.send(&Webhook{Url: receiver.URL}, &WebhookDelivery{Payload: json.RawMessage(`{}`)})
+	if err == nil || status != 0 || called {
+		t.Errorf("post to %s: status %d, err %v, want it refused", receiver.URL, status, err)
+	}
+}
+
+func TestWebhookTrimsFinishedDeliveries(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		w := newTestWebhooks(t, store, false)
+
+		hook, err := w.CreateWebhook(ctx, "https://example.com/hook", []string{"*"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for seq := uint64(1); seq <= 4; seq++ {
+			ev := Event{Seq: seq, Type: "vote.cast", Subject: "voter/1", Time: time.Now(), Data: json.RawMessage(`{}`)}
+			if err := w.Emit(ctx, ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		//1 delivered and 2 dead long ago, 3 still pending holds back 4
+		old := time.Now().Add(-2 * time.Hour)
+		for id, status := range map[uint64]string{1: WebhookDelivered, 2: WebhookDead, 3: WebhookPending, 4: WebhookDelivered} {
+			var b Batch
+			b.Set(webhookDeliveryKey(id), WebhookDelivery{DeliveryID: uint(id), WebhookID: hook.WebhookID, Subject: "voter/1", Status: status, CreatedAt: old})
+			if status != WebhookPending {
+				b.IndexRemove(WebhookPendingIndex, id)
+			}
+			if status == WebhookDead {
+				b.IndexAdd(WebhookDeadIndex, id)
+			}
+			if err := store.Commit(ctx, &b); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := w.trim(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		for index, want := range map[string]int{
+			webhookLogIndex(hook.WebhookID): 2,
+			webhookSubjectIndex("voter/1"):  2,
+			WebhookDeadIndex:                0,
+		} {
+			ids, err := store.IndexRange(ctx, index, 0, MaxPageLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != want || (want > 0 && ids[0] != 3) {
+				t.Errorf("%s: %s lists %v, want deliveries 3 and 4", name, index, ids)
+			}
+		}
+		if _, err := w.GetDelivery(ctx, 1); err == nil {
+			t.Errorf("%s: delivery 1 was kept", name)
+		}
+	}
+}
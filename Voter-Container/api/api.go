@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"voter-api/metrics"
 	"voter-api/voter"
 )
 
@@ -30,7 +31,10 @@ func (v *VoterApi) AddVoter(voterID uint, firstName, lastName string) {
 	err := v.voterDb.AddVoter(*voter.NewVoter(voterID, firstName, lastName))
 	if err != nil {
 		log.Println("Failed to add voter to the database: ", err)
+		return
 	}
+
+	metrics.VotersRegistered.Inc()
 }
 
 func (v *VoterApi) AddPoll(voterID, pollID uint) error {
@@ -6,6 +6,7 @@ import (
 	"log"
 	"github.com/gin-gonic/gin"
 	"voter-api/api"
+	"voter-api/metrics"
 )
 
 var (
@@ -40,6 +41,7 @@ func main() {
 	}
 
 	r := gin.Default()
+	r.Use(metrics.Middleware())
 	r.GET("/voters", api.GetVotersApi)
 	r.GET("/voters/:id", api.GetVoterApi)
 	r.POST("/voters/:id", api.PostVoterApi)
@@ -47,6 +49,7 @@ func main() {
 	r.GET("/voters/:id/polls/:pollid", api.GetPollApi)
 	r.POST("/voters/:id/polls/:pollid", api.PostPollApi)
 	r.GET("/voters/health", api.GetHealthApi)
+	r.GET(metrics.Path, metrics.Handler())
 
 	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
 	r.Run(serverPath)
@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"time"
+	"voter-api/metrics"
 )
 
 type voterPoll struct {
@@ -63,6 +64,7 @@ func NewDbWithInstance(location string) (*VoterDb, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr: location,
 	})
+	client.AddHook(metrics.RedisHook{})
 
 	ctx := context.Background()
 